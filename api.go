@@ -0,0 +1,582 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The HTTP API mirrors the WebSocket commands for integrations. Requests are
+// authenticated like the WebSocket and go through the same Hub methods, so
+// validation and access checks match; rejected requests get the same error
+// codes, with a matching HTTP status.
+
+// errorStatuses maps error codes to HTTP statuses.
+var errorStatuses = map[string]int{
+	errorBadRequest:      http.StatusBadRequest,
+	errorUnknownCommand:  http.StatusNotFound,
+	errorInvalidArgument: http.StatusBadRequest,
+	errorNotFound:        http.StatusNotFound,
+	errorForbidden:       http.StatusForbidden,
+	errorRateLimited:     http.StatusTooManyRequests,
+	errorUnavailable:     http.StatusServiceUnavailable,
+	errorInternal:        http.StatusInternalServerError,
+}
+
+// APIError is the body of a rejected API request.
+type APIError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// writeAPIError reports err like sendCommandError, with the HTTP status for
+// its code.
+func writeAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	code := errorCode(err)
+	message := err.Error()
+	if code == errorInternal {
+		log.Printf("Error handling %s %s: %v", r.Method, r.URL.Path, err)
+		message = "Something went wrong, please try again"
+	}
+	writeJSON(w, errorStatuses[code], APIError{Error: message, Code: code})
+}
+
+// authenticateAPI returns the request's user, or writes a 401 and returns
+// false.
+func authenticateAPI(hub *Hub, w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, err := hub.auth.authenticateRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, APIError{Error: "unauthorized", Code: "unauthorized"})
+		return "", false
+	}
+	return username, true
+}
+
+// throttleAPI draws from the user's bucket for a command family, the one
+// their WebSocket connections share, or writes a 429 and returns false.
+func throttleAPI(hub *Hub, w http.ResponseWriter, username, family string) bool {
+	if limit := hub.rateLimits.families[family]; limit.burst <= 0 {
+		return true
+	}
+	allowed, wait := hub.userBucket(username, family).take()
+	if !allowed {
+		writeRateLimited(w, wait)
+	}
+	return allowed
+}
+
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeJSON(w, http.StatusTooManyRequests, APIError{Error: "Too many requests, slow down", Code: errorRateLimited})
+}
+
+// decodeAPIBody unmarshals a JSON request body into v, or writes a 400 and
+// returns false.
+func decodeAPIBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, APIError{Error: "invalid JSON body", Code: errorBadRequest})
+		return false
+	}
+	return true
+}
+
+// GET /api/channels lists the channels the user can see, as active_channels
+// does.
+func handleListChannels(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	channels, err := hub.listChannels(username)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]ChannelInfo{"channels": channels})
+}
+
+// POST /api/channels creates a persistent channel. Ephemeral channels only
+// live while clients are in them, so they are created by joining.
+func handleCreateChannel(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	var req ChannelCreateRequest
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+	if req.ChannelType == "" {
+		req.ChannelType = Persistent
+	}
+	if err := validateNewChannel(&req); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if req.ChannelType != Persistent {
+		writeAPIError(w, r, newCommandError(errorInvalidArgument, "only persistent channels can be created over HTTP"))
+		return
+	}
+	if !throttleAPI(hub, w, username, rateChannelCreate) {
+		return
+	}
+
+	if _, err := hub.getChannelType(req.Name); err == nil {
+		writeJSON(w, http.StatusConflict, APIError{Error: "channel already exists", Code: "conflict"})
+		return
+	} else if !errors.Is(err, errChannelNotFound) {
+		writeAPIError(w, r, err)
+		return
+	}
+	if err := hub.createChannelInDB(req.Name, req.ChannelType, username, req.Private); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	log.Printf("Persistent channel '%s' created by %s over HTTP", req.Name, username)
+	hub.announceChannelCreated(req.Name, req.ChannelType)
+	writeJSON(w, http.StatusCreated, ChannelInfo{Name: req.Name, Type: req.ChannelType, Owner: username, Private: req.Private})
+}
+
+// DELETE /api/channels/{name} deletes a persistent channel and its messages.
+func handleDeleteChannel(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	if err := hub.deleteChannel(username, r.PathValue("name")); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/channels/{name}/messages returns a page of history, as
+// history_request does: before_id, after_id and limit work the same way.
+func handleChannelHistory(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	req := HistoryRequest{Channel: r.PathValue("name")}
+	params := r.URL.Query()
+	for name, dest := range map[string]*int{"before_id": &req.BeforeID, "after_id": &req.AfterID, "limit": &req.Limit} {
+		if value := params.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				writeAPIError(w, r, newCommandError(errorInvalidArgument, name+" must be a non-negative number"))
+				return
+			}
+			*dest = n
+		}
+	}
+
+	if !hub.canAccessChannel(username, req.Channel) {
+		writeAPIError(w, r, errChannelForbidden)
+		return
+	}
+	if _, err := hub.getChannelType(req.Channel); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	page, err := hub.getHistoryPage(req)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// POST /api/channels/{name}/messages posts a message as the user and
+// broadcasts it to the channel. A client_msg_id makes retries safe: a
+// resend returns the stored message with 200 instead of 201.
+func handlePostMessage(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Content     string `json:"content"`
+		ClientMsgID string `json:"client_msg_id"`
+	}
+	if !decodeAPIBody(w, r, &body) {
+		return
+	}
+	channelName := r.PathValue("name")
+	if !hub.canAccessChannel(username, channelName) {
+		writeAPIError(w, r, errChannelForbidden)
+		return
+	}
+	if !throttleAPI(hub, w, username, rateMessages) {
+		return
+	}
+	message := Message{
+		Username:    username,
+		DisplayName: hub.nickOf(username),
+		Content:     body.Content,
+		Channel:     channelName,
+		ClientMsgID: body.ClientMsgID,
+	}
+	if err := hub.checkPost(message); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	posted, duplicate, err := hub.postMessage(message)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	status := http.StatusCreated
+	if duplicate {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, posted)
+}
+
+// GET /api/channels/{name}/members lists the users present in a channel
+// across the cluster and counts its connections.
+func handleChannelMembers(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	channelName := r.PathValue("name")
+	if !hub.canAccessChannel(username, channelName) {
+		writeAPIError(w, r, errChannelForbidden)
+		return
+	}
+
+	members := hub.channelMembers(channelName)
+	writeJSON(w, http.StatusOK, ChannelMemberCount{
+		Channel:     channelName,
+		Count:       len(members),
+		Connections: hub.localMemberCount(channelName) + hub.remoteMemberCount(channelName),
+		Members:     members,
+	})
+}
+
+// GET /api/channels/{name}/roles lists the users with a role in a
+// persistent channel.
+func handleChannelRoles(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	channelName := r.PathValue("name")
+	roles, err := hub.channelRoles(username, channelName)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"channel": channelName, "roles": roles})
+}
+
+// PUT /api/channels/{name}/roles/{username} grants a role, like
+// grant_role: {"role": "moderator"}.
+func handleGrantRole(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Role string `json:"role"`
+	}
+	if !decodeAPIBody(w, r, &body) {
+		return
+	}
+	if err := hub.grantRole(username, r.PathValue("name"), r.PathValue("username"), body.Role); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /api/channels/{name}/roles/{username} revokes a role, like
+// revoke_role.
+func handleRevokeRole(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	if err := hub.revokeRole(username, r.PathValue("name"), r.PathValue("username")); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/channels/{name}/invites creates an invite link:
+// {"expires_in": 3600, "max_uses": 10}, both optional. The reply is the only
+// time its code is shown.
+func handleCreateInvite(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	var req InviteRequest
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+	req.Channel = r.PathValue("name")
+	invite, err := hub.createInvite(username, req)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, invite)
+}
+
+// POST /api/invites/{code} uses an invite link, making the user a member of
+// its channel.
+func handleJoinInvite(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	invite, err := hub.joinWithInvite(username, r.PathValue("code"))
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"channel": invite.Channel})
+}
+
+// POST /api/channels/{name}/moderation kicks, mutes, unmutes, bans or
+// unbans a user in the channel, like the commands of the same names:
+// {"action": "mute", "username": "bob", "duration": 600, "reason": "spam"}.
+// POST /api/moderation does the same server-wide; kicks need a channel.
+func handleModeration(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Action string `json:"action"`
+		ModerationRequest
+	}
+	if !decodeAPIBody(w, r, &body) {
+		return
+	}
+	req := body.ModerationRequest
+	req.Channel = r.PathValue("name")
+	req.Server = req.Channel == ""
+	if _, ok := sanctionKinds[body.Action]; !ok && body.Action != actionKick {
+		writeAPIError(w, r, newCommandError(errorInvalidArgument, "action must be kick, mute, unmute, ban or unban"))
+		return
+	}
+	if err := hub.moderate(username, body.Action, req); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PUT /api/channels/{name}/slow-mode sets the channel's slow mode, like
+// slow_mode: {"seconds": 30}; zero turns it off.
+func handleSetSlowMode(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Seconds int `json:"seconds"`
+	}
+	if !decodeAPIBody(w, r, &body) {
+		return
+	}
+	if err := hub.setSlowMode(username, r.PathValue("name"), body.Seconds); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/channels/{name}/audit returns the channel's moderation audit
+// log to its managers, newest first; GET /api/audit returns every entry to
+// server moderators. limit defaults to 50 and is capped at 200.
+func handleAuditLog(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeAPIError(w, r, newCommandError(errorInvalidArgument, "limit must be a non-negative number"))
+			return
+		}
+	}
+	entries, err := hub.auditLog(username, r.PathValue("name"), limit)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]AuditEntry{"entries": entries})
+}
+
+// GET /api/channels/{name}/webhooks lists a channel's incoming webhooks.
+func handleListWebhooks(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	hooks, err := hub.listIncomingWebhooks(username, r.PathValue("name"))
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]IncomingWebhook{"webhooks": hooks})
+}
+
+// POST /api/channels/{name}/webhooks creates an incoming webhook:
+// {"name": "ci-bot"}. The reply is the only time its token is shown.
+func handleCreateWebhook(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+	hook, err := hub.createIncomingWebhook(username, r.PathValue("name"), req.Name)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// DELETE /api/channels/{name}/webhooks/{id} revokes an incoming webhook.
+func handleDeleteWebhook(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, r, errWebhookNotFound)
+		return
+	}
+	if err := hub.deleteIncomingWebhook(username, r.PathValue("name"), id); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /hooks/{token} posts a WebhookPayload into the webhook's channel. The
+// token is the only credential, and each token has its own rate limit.
+func handleIncomingWebhook(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	hook, err := hub.incomingWebhook(r.PathValue("token"))
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if hub.rateLimits.webhook.burst > 0 {
+		if allowed, wait := hub.webhookBucket(hook.ID).take(); !allowed {
+			writeRateLimited(w, wait)
+			return
+		}
+	}
+	var payload WebhookPayload
+	if !decodeAPIBody(w, r, &payload) {
+		return
+	}
+	posted, err := hub.postWebhookMessage(hook, payload)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, posted)
+}
+
+// GET /api/webhooks lists the outgoing webhooks, without their secrets.
+func handleListOutgoingWebhooks(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	hooks, err := hub.listOutgoingWebhooks(username)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]OutgoingWebhook{"webhooks": hooks})
+}
+
+// POST /api/webhooks creates an outgoing webhook:
+// {"url": "https://...", "events": ["message.created"], "channel": "ops"}.
+// The reply is the only time its signing secret is shown.
+func handleCreateOutgoingWebhook(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		URL     string   `json:"url"`
+		Events  []string `json:"events"`
+		Channel string   `json:"channel"`
+	}
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+	hook, err := hub.createOutgoingWebhook(username, OutgoingWebhook{URL: req.URL, Events: req.Events, Channel: req.Channel})
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// DELETE /api/webhooks/{id} removes an outgoing webhook and its deliveries.
+func handleDeleteOutgoingWebhook(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, r, errWebhookNotFound)
+		return
+	}
+	if err := hub.deleteOutgoingWebhook(username, id); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/webhooks/{id}/deliveries returns the webhook's delivery log,
+// newest first; limit defaults to 50 and is capped at 100.
+func handleWebhookDeliveries(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateAPI(hub, w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, r, errWebhookNotFound)
+		return
+	}
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeAPIError(w, r, newCommandError(errorInvalidArgument, "limit must be a non-negative number"))
+			return
+		}
+	}
+	deliveries, err := hub.webhookDeliveries(username, id, limit)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]WebhookDelivery{"deliveries": deliveries})
+}
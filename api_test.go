@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// startAPIServer serves setupRoutes for the duration of the test and returns
+// a function making authenticated requests as a user; an empty username
+// sends no token.
+func startAPIServer(t *testing.T, hub *Hub) func(username, method, path string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	http.DefaultServeMux = http.NewServeMux()
+	setupRoutes(hub)
+	server := httptest.NewServer(http.DefaultServeMux)
+	t.Cleanup(server.Close)
+
+	return func(username, method, path string, body interface{}) (int, map[string]interface{}) {
+		t.Helper()
+		var reqBody bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&reqBody).Encode(body)
+		}
+		req, err := http.NewRequest(method, server.URL+path, &reqBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != "" {
+			req.Header = authHeader(t, hub, username)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var decoded map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		return resp.StatusCode, decoded
+	}
+}
+
+func TestAPIChannels(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.moderators = map[string]bool{"mod": true}
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	request := startAPIServer(t, hub)
+
+	watcher := dialTestClient(t, hub, wsURL, "watcher")
+
+	if status, _ := request("", "GET", "/api/channels", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", status)
+	}
+
+	status, body := request("alice", "POST", "/api/channels", map[string]string{"name": "releases"})
+	if status != http.StatusCreated || body["type"] != string(Persistent) || body["owner"] != "alice" {
+		t.Fatalf("Expected the channel to be created as persistent and owned by alice, got %d %v", status, body)
+	}
+	readUntil(t, watcher, func(msg map[string]interface{}) bool {
+		return msg["type"] == "channel_created" && msg["name"] == "releases"
+	})
+
+	createTests := []struct {
+		body   map[string]string
+		status int
+	}{
+		{map[string]string{"name": "releases"}, http.StatusConflict},
+		{map[string]string{"name": ""}, http.StatusBadRequest},
+		{map[string]string{"name": directChannelPrefix + "x"}, http.StatusBadRequest},
+		{map[string]string{"name": "scratch", "channel_type": "ephemeral"}, http.StatusBadRequest},
+	}
+	for _, tt := range createTests {
+		if status, body := request("alice", "POST", "/api/channels", tt.body); status != tt.status {
+			t.Errorf("Creating %v: expected %d, got %d %v", tt.body, tt.status, status, body)
+		}
+	}
+
+	status, body = request("alice", "GET", "/api/channels", nil)
+	listed := false
+	channels, _ := body["channels"].([]interface{})
+	for _, channel := range channels {
+		listed = listed || channel.(map[string]interface{})["name"] == "releases"
+	}
+	if status != http.StatusOK || !listed {
+		t.Fatalf("Expected releases to be listed, got %d %v", status, body)
+	}
+
+	if status, body := request("bob", "DELETE", "/api/channels/releases", nil); status != http.StatusForbidden || body["code"] != errorForbidden {
+		t.Errorf("Expected someone other than the owner or a moderator to be refused, got %d %v", status, body)
+	}
+	if status, _ := request("mod", "DELETE", "/api/channels/releases", nil); status != http.StatusNoContent {
+		t.Fatalf("Expected the moderator's delete to succeed, got %d", status)
+	}
+	readUntil(t, watcher, func(msg map[string]interface{}) bool {
+		return msg["type"] == "channel_deleted" && msg["channel"] == "releases"
+	})
+	if status, body := request("mod", "DELETE", "/api/channels/releases", nil); status != http.StatusNotFound || body["code"] != errorNotFound {
+		t.Errorf("Expected deleting a missing channel to be not_found, got %d %v", status, body)
+	}
+	if _, err := store.GetChannelType("releases"); err != errChannelNotFound {
+		t.Errorf("Expected the channel to be gone from the store, got %v", err)
+	}
+}
+
+func TestAPIMessages(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	request := startAPIServer(t, hub)
+
+	store.CreateChannel("ops", Persistent)
+	store.CreateDirectChannel("dm-private", []string{"bob", "carol"})
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "ops", "request_id": "j1"})
+	readUntil(t, bob, isAck("j1"))
+
+	status, posted := request("alice", "POST", "/api/channels/ops/messages", map[string]string{"content": "deploy done", "client_msg_id": "d1"})
+	if status != http.StatusCreated || posted["id"] == nil || posted["username"] != "alice" {
+		t.Fatalf("Expected the message to be stored, got %d %v", status, posted)
+	}
+	live := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	if live["id"] != posted["id"] || live["channel"] != "ops" {
+		t.Errorf("Expected the posted message live in ops, got %v", live)
+	}
+
+	status, resent := request("alice", "POST", "/api/channels/ops/messages", map[string]string{"content": "deploy done", "client_msg_id": "d1"})
+	if status != http.StatusOK || resent["id"] != posted["id"] {
+		t.Errorf("Expected a resend to return the stored message, got %d %v", status, resent)
+	}
+	request("alice", "POST", "/api/channels/ops/messages", map[string]string{"content": "second"})
+
+	postTests := []struct {
+		path   string
+		body   map[string]string
+		status int
+	}{
+		{"/api/channels/ops/messages", map[string]string{"content": "  "}, http.StatusBadRequest},
+		{"/api/channels/dm-private/messages", map[string]string{"content": "hi"}, http.StatusForbidden},
+		{"/api/channels/nowhere/messages", map[string]string{"content": "hi"}, http.StatusNotFound},
+	}
+	for _, tt := range postTests {
+		if status, body := request("alice", "POST", tt.path, tt.body); status != tt.status {
+			t.Errorf("POST %s %v: expected %d, got %d %v", tt.path, tt.body, tt.status, status, body)
+		}
+	}
+
+	status, page := request("alice", "GET", "/api/channels/ops/messages?limit=1", nil)
+	messages, _ := page["messages"].([]interface{})
+	if status != http.StatusOK || len(messages) != 1 || page["has_more"] != true {
+		t.Fatalf("Expected one message with more to come, got %d %v", status, page)
+	}
+	if newest := messages[0].(map[string]interface{}); newest["content"] != "second" {
+		t.Errorf("Expected the latest page, got %v", newest)
+	}
+	if status, _ := request("alice", "GET", "/api/channels/ops/messages?before_id=x", nil); status != http.StatusBadRequest {
+		t.Errorf("Expected a bad cursor to be rejected, got %d", status)
+	}
+	if status, _ := request("alice", "GET", "/api/channels/dm-private/messages", nil); status != http.StatusForbidden {
+		t.Errorf("Expected history of another user's direct channel to be forbidden, got %d", status)
+	}
+
+	status, members := request("alice", "GET", "/api/channels/ops/members", nil)
+	if status != http.StatusOK || members["count"] != float64(1) || members["connections"] != float64(1) {
+		t.Errorf("Expected bob alone in ops, got %d %v", status, members)
+	}
+}
@@ -1,81 +1,30 @@
 let ws = null;
-        let username = 'User';
+        let username = localStorage.getItem('username') || '';
+        let authToken = localStorage.getItem('authToken') || '';
         let currentChannel = 'general';
         let channels = new Set(['general']);
+        let channelLabels = new Map();
         let isPageVisible = true;
         let titleBlinkInterval = null;
         let originalTitle = 'EchoRoom - Real-time Conversations';
         let unreadCount = 0;
-
-        // Funny, informal sample usernames
-        const sampleUsernames = [
-            // Food & Drinks
-            'CoffeeAddict42', 'PizzaLover99', 'TacoTuesday', 'BurritoWizard', 'DonutDestroyer',
-            'JellybeanJedi', 'PancakePhantom', 'WaffleWarrior', 'CerealKiller', 'NachoAverage',
-            'SpaghettiMonster', 'PickleRick', 'BaconBeast', 'CookieMonster', 'IceCreamDream',
-            'MarshmallowMage', 'FoodieLife', 'ChefKiss', 'BakeOff', 'GrillMaster', 'SaladDays',
-            'VeggieVibes', 'MeatLover', 'SweetTooth', 'SpiceItUp', 'FlavorTown', 'CherryBomb',
-            'HotSauceHero', 'ChocolateChamp', 'VanillaVibes', 'StrawberrySmash', 'BlueberryBlast',
-            'RamenRider', 'SushiSamurai', 'PastaPirate', 'BreadBandit', 'CheeseChaser',
-
-            // Tech & Gaming
-            'ZoomZoomer', 'KeyboardWarrior', 'CtrlAltDelete', 'WiFiWhisperer', 'ByteMe',
-            '404NotFound', 'DebuggingDuck', 'JavaJunkie', 'HtmlHero', 'CssNinja',
-            'GamerGuru', 'ConsoleCommander', 'PCMasterRace', 'MobilePlayer', 'RetroGamer',
-            'PixelPirate', 'NPCWhisperer', 'LootGoblin', 'RespawnRanger', 'AchievementHunter',
-            'CodeCrusher', 'BugSquasher', 'GitCommander', 'DataDragon', 'CloudSurfer',
-            'BinaryBoss', 'AlgorithmAce', 'DatabaseDuke', 'ServerSage', 'NetworkNinja',
-            'CyberSleuth', 'DigitalDetective', 'VirtualVoyager', 'QuantumQueen', 'TechTitan',
-
-            // Internet Culture & Social Media
-            'DiscordMod', 'RedditLurker', 'MemeDealer', 'TikTokTalent', 'InstagramInfluencer',
-            'YoutubeYeller', 'TwitterTroll', 'SnapchatSage', 'LinkedInLegend', 'FacebookFan',
-            'MemeQueen', 'ViralViper', 'TrendTracker', 'HashtagHero', 'InfluencerImposter',
-            'ContentCreator', 'StreamingStarfish', 'PodcastPanda', 'BloggingBear', 'VlogVampire',
-
-            // Animals & Creatures
-            'LazyPanda', 'SleepyDragon', 'FluffyUnicorn', 'CrazyCat', 'HappyHippo',
-            'SneakySquirrel', 'BouncyBunny', 'WiseOwl', 'PlayfulPenguin', 'CheekyChimp',
-            'MajesticMoose', 'CuriousCrow', 'GentleGiraffe', 'BraveBear', 'CleverCoyote',
-            'SwiftSwallow', 'ProudPeacock', 'ShyShark', 'BoldBadger', 'KindKoala',
-            'ElephantEars', 'ZebraStripes', 'LionHeart', 'TigerTail', 'WolfPack',
-
-            // Personality & Vibes
-            'ChaosMaster', 'SockThief', 'ProcrastinatorPro', 'WifiStealer', 'CouchPotato',
-            'SnackAttack', 'DancingTaco', 'GiggleBox', 'ChillVibes', 'GoodVibesOnly',
-            'StayPositive', 'SmileMore', 'LaughOutLoud', 'HappyFeet', 'SunnyDays',
-            'RainbowChaser', 'StarGazer', 'DreamCatcher', 'AdventureSeeker', 'WanderlustWarrior',
-            'FreeSpiritFly', 'ZenMaster', 'PeacefulPanda', 'JoyfulJester', 'OptimisticOwl',
-            'EnergeticElf', 'CalmCactus', 'RelaxedRaven', 'SereneSeahorse', 'TranquilTurtle',
-
-            // Hobbies & Activities
-            'BookWorm', 'MovieBuff', 'MusicMaven', 'ArtAttack', 'DanceFloor',
-            'SingASong', 'PaintBrush', 'CraftyCrafter', 'DIYExpert', 'HandyHelper',
-            'GymRat', 'YogaMaster', 'RunnerHigh', 'SwimFast', 'BikeRider',
-            'HikerLife', 'CampingFan', 'NatureLover', 'BeachBum', 'MountainMan',
-            'PhotographyPhantom', 'GardeningGuru', 'CookingCaptain', 'TravelTiger', 'ReadingRaccoon',
-            'WritingWizard', 'DrawingDragon', 'SingingSloth', 'DancingDolphin', 'YogaYak',
-
-            // Random Fun
-            'NoodleNinja', 'BubblePopper', 'CloudWatcher', 'PuddleJumper', 'StarCollector',
-            'MoonDancer', 'SunChaser', 'RainMaker', 'WindWhisperer', 'ThunderClap',
-            'LightningBolt', 'SnowFlake', 'IceCube', 'FireCracker', 'SparkPlug',
-            'RocketFuel', 'TurboBoost', 'NitroNinja', 'SpeedDemon', 'FastTrack',
-            'QuickSilver', 'RapidFire', 'BlazingBolt', 'SwiftStrike', 'FlashDash',
-            'ZoomZap', 'WhirlWind', 'TornadoTwist', 'CycloneSpinner', 'HurricaneHunter',
-
-            // Silly & Absurd
-            'ToasterStrudel', 'WackyWombat', 'SillyGoose', 'CrazyCarrot', 'FunkyFerret',
-            'WobbleWalrus', 'JumpingJellybean', 'BouncingBanana', 'TwirlingTurnip', 'SpinningSpoon',
-            'FlippingFlapjack', 'RollingDonut', 'SlidingSloth', 'SkippingStone', 'HoppingHamster',
-            'GlidingGopher', 'SoaringSquid', 'FloatingFish', 'DriftingDuck', 'CruisingCrab',
-            'WaddlingWalrus', 'StrollingStarfish', 'Ambling Aardvark', 'MeanderingMole', 'RoamingRhino'
-        ];
-
-        function getRandomUsername() {
-            const randomIndex = Math.floor(Math.random() * sampleUsernames.length);
-            return sampleUsernames[randomIndex];
-        }
+        let oldestMessageId = null;
+        let openThreadId = null;
+        let channelMembers = {};
+        let typingUsers = new Set();
+        let channelTypes = new Map();
+        let markReadTimer = null;
+        let lastTypingSent = 0;
+        let hasMoreHistory = false;
+        let loadingHistory = false;
+        // Sent messages not yet acknowledged, by client_msg_id; resent when
+        // we are back in their channel so nothing is lost across reconnects
+        let pendingMessages = new Map(JSON.parse(localStorage.getItem('pendingMessages') || '[]'));
+        // How far we got in each channel, so a reconnect can resume there
+        let lastEventIds = {};
+        let lastMessageIds = {};
+        let resumedChannel = null;
+        let channelTopics = new Map();
 
         // Time formatting utility functions
         function getRelativeTime(timestamp) {
@@ -237,6 +186,11 @@ let ws = null;
             isPageVisible = !document.hidden;
             if (isPageVisible) {
                 stopTitleBlink();
+                scheduleMarkRead();
+            }
+            // Others see us as away while the tab is hidden
+            if (ws && ws.readyState === WebSocket.OPEN) {
+                ws.send(JSON.stringify({ type: 'set_status', status: isPageVisible ? 'online' : 'away' }));
             }
         });
 
@@ -266,10 +220,81 @@ let ws = null;
             }
         }
 
-        function initializeRandomUsername() {
-            const randomUsername = getRandomUsername();
-            username = randomUsername;
-            document.getElementById('username').value = randomUsername;
+        function tokenExpired(token) {
+            try {
+                const payload = JSON.parse(atob(token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/')));
+                return payload.exp * 1000 <= Date.now();
+            } catch (e) {
+                return true;
+            }
+        }
+
+        function showLogin(error = '') {
+            document.getElementById('authError').textContent = error;
+            document.getElementById('authOverlay').style.display = 'flex';
+            document.getElementById('authUsername').focus();
+        }
+
+        async function login() {
+            const user = document.getElementById('authUsername').value.trim();
+            const password = document.getElementById('authPassword').value;
+
+            const response = await fetch('/api/login', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ username: user, password: password })
+            });
+            const data = await response.json();
+            if (!response.ok) {
+                showLogin(data.error || 'Login failed');
+                return;
+            }
+
+            authToken = data.token;
+            username = data.username;
+            localStorage.setItem('authToken', authToken);
+            localStorage.setItem('username', username);
+            document.getElementById('authPassword').value = '';
+            document.getElementById('authOverlay').style.display = 'none';
+            document.getElementById('currentUser').textContent = username;
+            connect();
+        }
+
+        async function register() {
+            const user = document.getElementById('authUsername').value.trim();
+            const password = document.getElementById('authPassword').value;
+
+            const response = await fetch('/api/register', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ username: user, password: password })
+            });
+            if (!response.ok) {
+                const data = await response.json();
+                showLogin(data.error || 'Registration failed');
+                return;
+            }
+            await login();
+        }
+
+        function logout() {
+            authToken = '';
+            localStorage.removeItem('authToken');
+            if (ws) {
+                ws.onclose = null;
+                ws.close();
+                ws = null;
+            }
+            showLogin();
+        }
+
+        function startSession() {
+            if (!authToken || tokenExpired(authToken)) {
+                showLogin();
+                return;
+            }
+            document.getElementById('currentUser').textContent = username;
+            connect();
         }
 
         function connect() {
@@ -280,7 +305,14 @@ let ws = null;
             // Show loading spinner while connecting
             showLoadingSpinner(true);
 
-            ws = new WebSocket('ws://localhost:8080/ws');
+            let wsUrl = 'ws://localhost:8080/ws?token=' + encodeURIComponent(authToken);
+            if (lastEventIds[currentChannel] || lastMessageIds[currentChannel]) {
+                wsUrl += '&channel=' + encodeURIComponent(currentChannel) +
+                    '&last_event_id=' + encodeURIComponent(lastEventIds[currentChannel] || '') +
+                    '&last_message_id=' + (lastMessageIds[currentChannel] || 0);
+            }
+            resumedChannel = null;
+            ws = new WebSocket(wsUrl);
 
             ws.onopen = function () {
                 showLoadingSpinner(false);
@@ -300,12 +332,20 @@ let ws = null;
                     channel: currentChannel
                 };
                 ws.send(JSON.stringify(usernameMessage));
+
+                // Opening an invite link joins its channel
+                const inviteCode = new URLSearchParams(window.location.search).get('invite');
+                if (inviteCode) {
+                    ws.send(JSON.stringify({ type: 'join_invite', code: inviteCode }));
+                    history.replaceState(null, '', window.location.pathname);
+                }
             };
 
             ws.onmessage = function (event) {
                 try {
                     const message = JSON.parse(event.data);
                     console.log('Received WebSocket message:', message);
+                    trackPosition(message);
 
                     if (message.type === 'channel_switch') {
                         currentChannel = message.channel;
@@ -315,22 +355,220 @@ let ws = null;
                             updateChannelActiveState(currentChannel);
                         }, 10);
                         clearMessages();
+                        closeThread();
+                        typingUsers.clear();
+                        renderTypingIndicator();
+                        lastTypingSent = 0;
+                        scheduleMarkRead();
+                        resendPendingMessages(message.channel);
+                        oldestMessageId = null;
+                        hasMoreHistory = true;
+                        loadingHistory = false;
                         displayMessage(message);
                         return;
                     }
 
+                    if (message.type === 'message_edited' || message.type === 'message_deleted') {
+                        document.querySelectorAll(`[data-message-id="${message.id}"]`).forEach(messageDiv => {
+                            messageDiv.dataset.message = JSON.stringify(message);
+                            renderMessageBody(messageDiv, message);
+                        });
+                        return;
+                    }
+
+                    if (message.type === 'ack') {
+                        if (message.client_msg_id && pendingMessages.delete(message.client_msg_id)) {
+                            savePendingMessages();
+                        }
+                        return;
+                    }
+
+                    if (message.type === 'error') {
+                        // Rejected messages are not retried; transient failures are
+                        if (pendingMessages.has(message.request_id) && message.code !== 'rate_limited' && message.code !== 'internal') {
+                            pendingMessages.delete(message.request_id);
+                            savePendingMessages();
+                        }
+                        displayMessage({ type: 'system_message', username: 'System', content: message.message });
+                        return;
+                    }
+
+                    if (message.type === 'read_state') {
+                        setUnread(message.channel, message.unread);
+                        return;
+                    }
+
+                    if (message.type === 'typing') {
+                        if (message.channel === currentChannel) {
+                            if (message.typing) {
+                                typingUsers.add(message.username);
+                            } else {
+                                typingUsers.delete(message.username);
+                            }
+                            renderTypingIndicator();
+                        }
+                        return;
+                    }
+
+                    if (message.type === 'channel_topic') {
+                        channelTopics.set(message.channel, message.topic);
+                        if (message.channel === currentChannel) {
+                            updateCurrentChannelDisplay();
+                            // Topics sent on joining have no setter
+                            if (message.username) {
+                                displayMessage({
+                                    type: 'system_message',
+                                    username: 'System',
+                                    content: message.topic
+                                        ? `${message.username} set the topic: ${message.topic}`
+                                        : `${message.username} cleared the topic`
+                                });
+                            }
+                        }
+                        return;
+                    }
+
+                    if (message.type === 'channel_members') {
+                        if (message.channel === currentChannel) {
+                            channelMembers = {};
+                            message.members.forEach(member => { channelMembers[member.username] = member; });
+                            renderMembers();
+                        }
+                        return;
+                    }
+
+                    if (message.type === 'role_updated') {
+                        if (message.channel === currentChannel) {
+                            if (channelMembers[message.username]) {
+                                channelMembers[message.username].role = message.role;
+                                renderMembers();
+                            }
+                            displayMessage({
+                                type: 'system_message',
+                                username: 'System',
+                                content: message.role
+                                    ? `${message.by} made ${message.username} ${message.role}`
+                                    : `${message.by} revoked ${message.username}'s role`
+                            });
+                        }
+                        return;
+                    }
+
+                    if (message.type === 'moderation') {
+                        const removed = message.username === username && (message.action === 'kick' || message.action === 'ban');
+                        if (message.channel === currentChannel || !message.channel || removed) {
+                            displayMessage({
+                                type: 'system_message',
+                                username: 'System',
+                                content: describeModeration(message)
+                            });
+                        }
+                        // Taken out of the channel we are in: go back to
+                        // #general, joining it again if that was the one
+                        if (removed && message.channel === currentChannel) {
+                            ws.send(JSON.stringify({ type: 'join_channel', channel: 'general' }));
+                            updateChannelActiveState('general');
+                        }
+                        return;
+                    }
+
+                    if (message.type === 'invite_created') {
+                        const link = `${window.location.origin}${window.location.pathname}?invite=${encodeURIComponent(message.code)}`;
+                        const uses = message.max_uses ? `, ${message.max_uses} use${message.max_uses === 1 ? '' : 's'}` : '';
+                        displayMessage({
+                            type: 'command_reply',
+                            username: 'System',
+                            content: `Invite link to #${message.channel} (until ${new Date(message.expires_at).toLocaleString()}${uses}): ${link}`
+                        });
+                        return;
+                    }
+
+                    if (message.type === 'presence_update') {
+                        if (message.channel === currentChannel) {
+                            if (message.action === 'leave' && !channelLabels.has(currentChannel)) {
+                                delete channelMembers[message.username];
+                            } else {
+                                // Updates do not carry the member's role
+                                const role = channelMembers[message.username] && channelMembers[message.username].role;
+                                channelMembers[message.username] = { ...message, role };
+                            }
+                            renderMembers();
+                        }
+                        return;
+                    }
+
+                    if (message.type === 'reaction_updated') {
+                        document.querySelectorAll(`[data-message-id="${message.message_id}"]`).forEach(messageDiv => {
+                            messageDiv.dataset.reactions = JSON.stringify(message.reactions);
+                            if (!messageDiv.classList.contains('deleted')) {
+                                renderReactions(messageDiv, message.message_id);
+                            }
+                        });
+                        return;
+                    }
+
+                    if (message.type === 'reply') {
+                        handleReply(message);
+                        return;
+                    }
+
+                    if (message.type === 'thread') {
+                        if (message.parent.id !== openThreadId) {
+                            return;
+                        }
+                        const threadDiv = document.getElementById('threadMessages');
+                        threadDiv.innerHTML = '';
+                        displayMessage(message.parent, false, 'threadMessages');
+                        message.messages.forEach(reply => displayMessage(reply, false, 'threadMessages'));
+                        return;
+                    }
+
+                    if (message.type === 'search_results') {
+                        displaySearchResults(message.results);
+                        return;
+                    }
+
+                    if (message.type === 'history_page') {
+                        if (message.channel !== currentChannel) {
+                            return;
+                        }
+                        loadingHistory = false;
+                        hasMoreHistory = message.has_more;
+                        // Prepend newest first so the page ends up oldest first
+                        for (let i = message.messages.length - 1; i >= 0; i--) {
+                            trackOldestMessage(message.messages[i]);
+                            displayMessage(message.messages[i], true);
+                        }
+                        return;
+                    }
+
                     if (message.type === 'channel_created') {
                         const channelName = message.name;
                         const channelType = message.channel_type;
                         if (!channels.has(channelName)) {
                             channels.add(channelName);
-                            addChannelToList(channelName, channelType);
+                            addChannelToList(channelName, channelType, message.members, message.private);
+                        }
+                        return;
+                    }
+
+                    if (message.type === 'resumed') {
+                        resumedChannel = message.channel;
+                        if (message.gap) {
+                            displayMessage({
+                                type: 'system_message',
+                                username: 'System',
+                                content: 'Reconnected. Some updates from while you were away may be missing.'
+                            });
                         }
                         return;
                     }
 
                     if (message.type === 'active_channels') {
                         updateActiveChannelsList(message.channels);
+                        // Sent once per connection, which starts in #general
+                        // unless it resumed where we left off
+                        resendPendingMessages(resumedChannel || 'general');
                         return;
                     }
 
@@ -345,14 +583,18 @@ let ws = null;
                         return;
                     }
 
+                    trackOldestMessage(message);
                     displayMessage(message);
+                    if (message.type === 'message' && message.id) {
+                        scheduleMarkRead();
+                    }
                     
                     // Show notification for new messages when page is not visible
                     if (message.type === 'message' && message.username !== username && !isPageVisible) {
                         if ('Notification' in window && Notification.permission === 'granted') {
                             unreadCount++;
                             showNotification(
-                                `New message in #${currentChannel}`,
+                                `New message in ${channelLabel(currentChannel)}`,
                                 `${message.username}: ${message.content}`,
                             );
                             startTitleBlink();
@@ -367,7 +609,7 @@ let ws = null;
                 }
             };
 
-            ws.onclose = function () {
+            ws.onclose = function (event) {
                 showLoadingSpinner(false);
                 const statusContent = status.querySelector('.status-content');
                 const statusText = statusContent.querySelector('.status-text');
@@ -384,6 +626,20 @@ let ws = null;
                     }
                 }, 1000);
                 
+                // Users banned from the server cannot reconnect until the
+                // ban expires
+                if (event.code === 1008) {
+                    showLoadingSpinner(false);
+                    showLogin(`Disconnected: ${event.reason}`);
+                    return;
+                }
+
+                // An expired session cannot reconnect; ask the user to log in again
+                if (tokenExpired(authToken)) {
+                    showLoadingSpinner(false);
+                    showLogin('Your session has expired, please log in again');
+                    return;
+                }
                 setTimeout(connect, 3000);
             };
 
@@ -392,23 +648,122 @@ let ws = null;
             };
         }
 
+        function trackPosition(message) {
+            if (!message.channel) {
+                return;
+            }
+            if (message.event_id) {
+                lastEventIds[message.channel] = message.event_id;
+            }
+            if (message.type === 'message' && message.id) {
+                lastMessageIds[message.channel] = Math.max(lastMessageIds[message.channel] || 0, message.id);
+            }
+        }
+
+        function savePendingMessages() {
+            localStorage.setItem('pendingMessages', JSON.stringify(Array.from(pendingMessages)));
+        }
+
+        function newClientMsgId() {
+            if (window.crypto && crypto.randomUUID) {
+                return crypto.randomUUID();
+            }
+            return Date.now().toString(36) + '-' + Math.random().toString(36).slice(2);
+        }
+
+        function sendPendingMessage(clientMsgId, pending) {
+            ws.send(JSON.stringify({
+                type: 'message',
+                content: pending.content,
+                channel: pending.channel,
+                client_msg_id: clientMsgId,
+                request_id: clientMsgId
+            }));
+        }
+
+        // Resend unacknowledged messages once we are back in their channel;
+        // the server stores each client_msg_id only once
+        function resendPendingMessages(channel) {
+            pendingMessages.forEach((pending, clientMsgId) => {
+                if (pending.channel === channel) {
+                    sendPendingMessage(clientMsgId, pending);
+                }
+            });
+        }
+
         function sendMessage() {
             const messageInput = document.getElementById('messageInput');
             const message = messageInput.value.trim();
 
             if (message && ws && ws.readyState === WebSocket.OPEN) {
-                const messageObj = {
-                    username: username,
-                    content: message,
-                    type: 'message',
-                    channel: currentChannel
-                };
+                const clientMsgId = newClientMsgId();
+                const pending = { content: message, channel: currentChannel };
+                pendingMessages.set(clientMsgId, pending);
+                savePendingMessages();
 
-                ws.send(JSON.stringify(messageObj));
+                sendPendingMessage(clientMsgId, pending);
                 messageInput.value = '';
+                // The server ends our typing indicator when a message arrives
+                lastTypingSent = 0;
             }
         }
 
+        // Repeat typing_start while typing so the server does not expire it
+        function notifyTyping() {
+            if (!ws || ws.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            const input = document.getElementById('messageInput');
+            if (!input.value.trim()) {
+                if (lastTypingSent) {
+                    ws.send(JSON.stringify({ type: 'typing_stop' }));
+                    lastTypingSent = 0;
+                }
+                return;
+            }
+            if (Date.now() - lastTypingSent > 3000) {
+                ws.send(JSON.stringify({ type: 'typing_start' }));
+                lastTypingSent = Date.now();
+            }
+        }
+
+        function renderTypingIndicator() {
+            const indicator = document.getElementById('typingIndicator');
+            const names = Array.from(typingUsers);
+            if (names.length === 0) {
+                indicator.textContent = '';
+            } else if (names.length === 1) {
+                indicator.textContent = `${names[0]} is typing…`;
+            } else if (names.length <= 3) {
+                indicator.textContent = `${names.join(', ')} are typing…`;
+            } else {
+                indicator.textContent = 'Several people are typing…';
+            }
+        }
+
+        function describeModeration(notice) {
+            const where = notice.channel ? `#${notice.channel}` : 'the server';
+            const until = notice.until ? ` until ${new Date(notice.until).toLocaleString()}` : '';
+            const reason = notice.reason ? `: ${notice.reason}` : '';
+            switch (notice.action) {
+                case 'kick':
+                    return `${notice.by} kicked ${notice.username} from ${where}${reason}`;
+                case 'mute':
+                    return `${notice.by} muted ${notice.username} in ${where}${until}${reason}`;
+                case 'unmute':
+                    return `${notice.by} unmuted ${notice.username} in ${where}${reason}`;
+                case 'ban':
+                    return `${notice.by} banned ${notice.username} from ${where}${until}${reason}`;
+                case 'unban':
+                    return `${notice.by} unbanned ${notice.username} from ${where}${reason}`;
+                case 'slow_mode':
+                    return notice.seconds
+                        ? `${notice.by} set slow mode in ${where}: one message every ${notice.seconds} seconds`
+                        : `${notice.by} turned slow mode off in ${where}`;
+            }
+            return `${notice.by} moderated ${where}`;
+        }
+
         function switchChannel(channelName) {
             if (channelName === currentChannel) return;
 
@@ -426,6 +781,7 @@ let ws = null;
             console.log('createChannel function called');
             const input = document.getElementById('newChannelInput');
             const typeSelect = document.getElementById('channelTypeSelect');
+            const privateCheckbox = document.getElementById('channelPrivateCheckbox');
             const channelName = input.value.trim();
             const channelType = typeSelect.value;
 
@@ -438,12 +794,14 @@ let ws = null;
                 const createChannelMsg = {
                     type: 'create_channel',
                     name: channelName,
-                    channel_type: channelType // Use 'channel_type' instead of 'type'
+                    channel_type: channelType, // Use 'channel_type' instead of 'type'
+                    private: privateCheckbox.checked
                 };
 
                 console.log('Sending message:', createChannelMsg);
                 ws.send(JSON.stringify(createChannelMsg));
                 input.value = '';
+                privateCheckbox.checked = false;
                 console.log('Message sent, input cleared');
             } else {
                 console.log('Channel creation blocked:');
@@ -453,7 +811,28 @@ let ws = null;
             }
         }
 
-        function addChannelToList(channelName, channelType) {
+        function openDirectMessage() {
+            const input = document.getElementById('dmInput');
+            const usernames = input.value.split(',').map(name => name.trim()).filter(name => name);
+            if (usernames.length === 0 || !ws || ws.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            ws.send(JSON.stringify({ type: 'open_dm', usernames: usernames }));
+            input.value = '';
+        }
+
+        // Direct channels are shown as the other members' names
+        function channelLabel(channelName) {
+            return channelLabels.get(channelName) || '#' + channelName;
+        }
+
+        function addChannelToList(channelName, channelType, members = [], isPrivate = false) {
+            channelTypes.set(channelName, channelType);
+            if (channelType === 'direct') {
+                const others = (members || []).filter(member => member !== username);
+                channelLabels.set(channelName, '@' + others.join(', '));
+            }
+
             const channelsList = document.getElementById('channelsList');
             const channelItem = document.createElement('li');
             channelItem.className = 'channel-item';
@@ -462,17 +841,52 @@ let ws = null;
 
             const nameSpan = document.createElement('span');
             nameSpan.className = 'channel-name';
-            nameSpan.textContent = '#' + channelName;
+            nameSpan.textContent = channelLabel(channelName);
 
             const typeSpan = document.createElement('span');
             typeSpan.className = `channel-type ${channelType}`;
-            typeSpan.textContent = channelType === 'persistent' ? '💾' : '⚡';
+            typeSpan.textContent = channelType === 'direct' ? '✉️' : channelType === 'persistent' ? '💾' : '⚡';
+            if (isPrivate) {
+                typeSpan.textContent = '🔒';
+                typeSpan.title = 'Private channel';
+            }
+
+            const unreadSpan = document.createElement('span');
+            unreadSpan.className = 'unread-badge';
+            unreadSpan.style.display = 'none';
 
             channelItem.appendChild(nameSpan);
+            channelItem.appendChild(unreadSpan);
             channelItem.appendChild(typeSpan);
             channelsList.appendChild(channelItem);
         }
 
+        // Unread counts come from the server, so they survive reloads and
+        // follow the user across devices
+        function setUnread(channelName, count) {
+            const badge = document.querySelector(`.channel-item[data-channel="${CSS.escape(channelName)}"] .unread-badge`);
+            if (!badge) {
+                return;
+            }
+            badge.textContent = count > 99 ? '99+' : count;
+            badge.style.display = count > 0 ? 'inline-block' : 'none';
+        }
+
+        // Tell the server we have seen the current channel, once messages
+        // stop arriving for a moment
+        function scheduleMarkRead() {
+            const channelType = channelTypes.get(currentChannel);
+            if (!isPageVisible || (channelType !== 'persistent' && channelType !== 'direct')) {
+                return;
+            }
+            clearTimeout(markReadTimer);
+            markReadTimer = setTimeout(() => {
+                if (ws && ws.readyState === WebSocket.OPEN) {
+                    ws.send(JSON.stringify({ type: 'mark_read', channel: currentChannel }));
+                }
+            }, 500);
+        }
+
         function updateChannelActiveState(channelName) {
             const channelItems = document.querySelectorAll('.channel-item');
             channelItems.forEach(item => {
@@ -486,7 +900,11 @@ let ws = null;
 
         function updateCurrentChannelDisplay() {
             const currentChannelDiv = document.getElementById('currentChannel');
-            currentChannelDiv.textContent = `Current Channel: #${currentChannel}`;
+            currentChannelDiv.textContent = `Current Channel: ${channelLabel(currentChannel)}`;
+            const topic = channelTopics.get(currentChannel);
+            if (topic) {
+                currentChannelDiv.textContent += ` — ${topic}`;
+            }
         }
 
         function clearMessages() {
@@ -511,12 +929,15 @@ let ws = null;
                 } else {
                     // New format with type
                     channels.add(channelInfo.name);
-                    addChannelToList(channelInfo.name, channelInfo.type);
+                    channelTopics.set(channelInfo.name, channelInfo.topic || '');
+                    addChannelToList(channelInfo.name, channelInfo.type, channelInfo.members, channelInfo.private);
+                    setUnread(channelInfo.name, channelInfo.unread || 0);
                 }
             });
 
             // Set the active channel
             updateChannelActiveState(currentChannel);
+            updateCurrentChannelDisplay();
         }
 
         function removeChannelFromList(channelName) {
@@ -534,8 +955,281 @@ let ws = null;
             });
         }
 
-        function displayMessage(message) {
-            const messagesDiv = document.getElementById('messages');
+        function trackOldestMessage(message) {
+            if (message.id && (oldestMessageId === null || message.id < oldestMessageId)) {
+                oldestMessageId = message.id;
+            }
+        }
+
+        // Ask for the page of history before the oldest message shown
+        function loadOlderMessages() {
+            if (loadingHistory || !hasMoreHistory || oldestMessageId === null) {
+                return;
+            }
+            if (!ws || ws.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            loadingHistory = true;
+            ws.send(JSON.stringify({
+                type: 'history_request',
+                channel: currentChannel,
+                before_id: oldestMessageId
+            }));
+        }
+
+        function searchMessages() {
+            const input = document.getElementById('searchInput');
+            const query = input.value.trim();
+            if (!query || !ws || ws.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            ws.send(JSON.stringify({ type: 'search', query: query }));
+        }
+
+        function escapeHtml(text) {
+            const div = document.createElement('div');
+            div.textContent = text;
+            return div.innerHTML;
+        }
+
+        function displaySearchResults(results) {
+            const list = document.getElementById('searchResults');
+            list.innerHTML = '';
+
+            if (results.length === 0) {
+                list.innerHTML = '<li class="search-result">No matches</li>';
+                return;
+            }
+
+            results.forEach(result => {
+                const item = document.createElement('li');
+                item.className = 'search-result';
+                item.title = new Date(result.timestamp).toLocaleString();
+                // Escape the snippet, then restore the server's highlight markers
+                const snippet = escapeHtml(result.snippet)
+                    .replace(/&lt;mark&gt;/g, '<mark>')
+                    .replace(/&lt;\/mark&gt;/g, '</mark>');
+                item.innerHTML = `<span class="search-meta">#${escapeHtml(result.channel)} ${escapeHtml(result.username)}:</span> ${snippet}`;
+                item.addEventListener('click', () => switchChannel(result.channel));
+                list.appendChild(item);
+            });
+        }
+
+        function renderMessageBody(messageDiv, message) {
+            const contentSpan = messageDiv.querySelector('.content');
+            messageDiv.querySelectorAll('.edited, .attachments, .message-actions, .thread-link, .reactions').forEach(el => el.remove());
+
+            // Top-level messages in the channel link to their thread
+            if (!message.parent_id && messageDiv.parentNode && messageDiv.parentNode.id !== 'threadMessages') {
+                const count = parseInt(messageDiv.dataset.replyCount || '0', 10);
+                const link = document.createElement('span');
+                link.className = 'thread-link';
+                link.textContent = count > 0 ? `💬 ${count} ${count === 1 ? 'reply' : 'replies'}` : '💬 Reply';
+                link.onclick = () => openThread(message.id);
+                messageDiv.appendChild(link);
+            }
+
+            if (message.deleted_at) {
+                contentSpan.innerHTML = '<em>message deleted</em>';
+                messageDiv.classList.add('deleted');
+                return;
+            }
+
+            contentSpan.textContent = isEmote(message) ? message.content.slice(4) : message.content;
+            messageDiv.dataset.content = message.content;
+            if (message.edited_at) {
+                const edited = document.createElement('span');
+                edited.className = 'edited';
+                edited.title = new Date(message.edited_at).toLocaleString();
+                edited.textContent = '(edited)';
+                contentSpan.after(edited);
+            }
+            renderAttachments(messageDiv, message.attachments);
+
+            if (message.username === username) {
+                const actions = document.createElement('span');
+                actions.className = 'message-actions';
+                actions.innerHTML = `
+                    <button title="Edit" onclick="editMessage(${message.id})">✏️</button>
+                    <button title="Delete" onclick="deleteMessage(${message.id})">🗑️</button>
+                `;
+                messageDiv.appendChild(actions);
+            }
+
+            renderReactions(messageDiv, message.id);
+        }
+
+        // Webhook attachments are built with textContent, and the server only
+        // accepts http(s) links, so integrations cannot inject markup
+        function renderAttachments(messageDiv, attachments) {
+            if (!attachments || attachments.length === 0) return;
+            const list = document.createElement('div');
+            list.className = 'attachments';
+            attachments.forEach(attachment => {
+                const card = document.createElement('div');
+                card.className = 'attachment';
+                if (attachment.color) card.style.borderLeftColor = attachment.color;
+                if (attachment.title) {
+                    const title = document.createElement(attachment.title_link ? 'a' : 'strong');
+                    title.className = 'attachment-title';
+                    title.textContent = attachment.title;
+                    if (attachment.title_link) {
+                        title.href = attachment.title_link;
+                        title.target = '_blank';
+                        title.rel = 'noopener noreferrer';
+                    }
+                    card.appendChild(title);
+                }
+                if (attachment.text) {
+                    const text = document.createElement('div');
+                    text.textContent = attachment.text;
+                    card.appendChild(text);
+                }
+                if (attachment.image_url) {
+                    const image = document.createElement('img');
+                    image.src = attachment.image_url;
+                    image.alt = attachment.title || '';
+                    card.appendChild(image);
+                }
+                list.appendChild(card);
+            });
+            messageDiv.querySelector('.content').after(list);
+        }
+
+        // Reactions are kept on the element so edits, which carry no
+        // reactions, do not clear them
+        function renderReactions(messageDiv, messageId) {
+            messageDiv.querySelectorAll('.reactions').forEach(el => el.remove());
+            const reactions = JSON.parse(messageDiv.dataset.reactions || '[]');
+
+            const bar = document.createElement('div');
+            bar.className = 'reactions';
+            reactions.forEach(reaction => {
+                const mine = reaction.users.includes(username);
+                const button = document.createElement('button');
+                button.className = mine ? 'reaction mine' : 'reaction';
+                button.title = reaction.users.join(', ');
+                button.textContent = `${reaction.emoji} ${reaction.count}`;
+                button.onclick = () => sendReaction(messageId, reaction.emoji, !mine);
+                bar.appendChild(button);
+            });
+
+            const add = document.createElement('button');
+            add.className = 'reaction add-reaction';
+            add.title = 'Add reaction';
+            add.textContent = '☺+';
+            add.onclick = () => {
+                const emoji = prompt('React with', '👍');
+                if (emoji && emoji.trim()) {
+                    sendReaction(messageId, emoji.trim(), true);
+                }
+            };
+            bar.appendChild(add);
+            messageDiv.appendChild(bar);
+        }
+
+        function sendReaction(messageId, emoji, add) {
+            if (!ws || ws.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            ws.send(JSON.stringify({
+                type: add ? 'add_reaction' : 'remove_reaction',
+                message_id: messageId,
+                emoji: emoji
+            }));
+        }
+
+        function editMessage(id) {
+            const messageDiv = document.querySelector(`#messages [data-message-id="${id}"]`);
+            const content = prompt('Edit message', messageDiv ? messageDiv.dataset.content : '');
+            if (content && content.trim() && ws && ws.readyState === WebSocket.OPEN) {
+                ws.send(JSON.stringify({ type: 'edit_message', id: id, content: content }));
+            }
+        }
+
+        function deleteMessage(id) {
+            if (confirm('Delete this message?') && ws && ws.readyState === WebSocket.OPEN) {
+                ws.send(JSON.stringify({ type: 'delete_message', id: id }));
+            }
+        }
+
+        function renderMembers() {
+            const list = document.getElementById('membersList');
+            list.innerHTML = '';
+            Object.values(channelMembers)
+                .sort((a, b) => a.username.localeCompare(b.username))
+                .forEach(member => {
+                    const li = document.createElement('li');
+                    li.className = `member ${member.status}`;
+                    li.textContent = member.nick ? `${member.nick} (${member.username})` : member.username;
+                    if (member.bot) {
+                        li.textContent += ' 🤖';
+                    }
+                    if (member.role && member.role !== 'member') {
+                        const badge = document.createElement('span');
+                        badge.className = 'role-badge';
+                        badge.textContent = member.role;
+                        li.appendChild(badge);
+                    }
+                    if (member.status !== 'online' && member.last_seen) {
+                        li.title = `${member.status}, last seen ${getRelativeTime(member.last_seen)}`;
+                    } else {
+                        li.title = member.status;
+                    }
+                    list.appendChild(li);
+                });
+        }
+
+        function openThread(parentId) {
+            if (!ws || ws.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            openThreadId = parentId;
+            document.getElementById('threadMessages').innerHTML = '';
+            document.getElementById('threadPanel').style.display = 'flex';
+            ws.send(JSON.stringify({ type: 'thread_request', parent_id: parentId }));
+        }
+
+        function closeThread() {
+            openThreadId = null;
+            document.getElementById('threadPanel').style.display = 'none';
+        }
+
+        function sendReply() {
+            const input = document.getElementById('threadInput');
+            const content = input.value.trim();
+            if (!content || openThreadId === null || !ws || ws.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            ws.send(JSON.stringify({ type: 'reply', parent_id: openThreadId, content: content }));
+            input.value = '';
+        }
+
+        // Count a new reply on its parent and show it if the thread is open
+        function handleReply(reply) {
+            const parentDiv = document.querySelector(`#messages [data-message-id="${reply.parent_id}"]`);
+            if (parentDiv) {
+                parentDiv.dataset.replyCount = parseInt(parentDiv.dataset.replyCount || '0', 10) + 1;
+                renderMessageBody(parentDiv, JSON.parse(parentDiv.dataset.message));
+            }
+            if (openThreadId === reply.parent_id) {
+                displayMessage(reply, false, 'threadMessages');
+            }
+        }
+
+        // "/me waves" is shown as an action by its author
+        function isEmote(message) {
+            return message.type !== 'command_reply' && typeof message.content === 'string' && message.content.startsWith('/me ');
+        }
+
+        // Incoming webhooks pick their own display name, so mark their
+        // messages apart from users'
+        function isWebhook(message) {
+            return typeof message.username === 'string' && message.username.startsWith('webhook:');
+        }
+
+        function displayMessage(message, prepend = false, containerId = 'messages') {
+            const messagesDiv = document.getElementById(containerId);
             const messageDiv = document.createElement('div');
             messageDiv.className = 'message';
 
@@ -554,9 +1248,16 @@ let ws = null;
                         }
                     }, 500); // Wait for fade-out animation to complete
                 }, 3000);
-            } else if (message.username === 'System' || message.type === 'system_message') {
+            } else if (message.username === 'System' || message.type === 'system_message' || message.type === 'command_reply') {
                 messageDiv.classList.add('system');
             }
+            if (message.type === 'command_reply') {
+                messageDiv.classList.add('command-reply');
+            }
+            const emote = isEmote(message);
+            if (emote) {
+                messageDiv.classList.add('emote');
+            }
 
             // Format timestamp (but don't show for system messages like channel switches)
             let timestampHtml = '';
@@ -584,11 +1285,34 @@ let ws = null;
 
             messageDiv.innerHTML = `
                 ${timestampHtml}
-                <span class="username">${message.username}:</span>
-                <span class="content">${message.content}</span>
+                <span class="username" title="${escapeHtml(message.username)}">${emote ? '* ' : ''}${escapeHtml(message.display_name || message.username)}${isWebhook(message) ? '<span class="webhook-badge">webhook</span>' : ''}${emote ? '' : ':'}</span>
+                <span class="content">${escapeHtml(emote ? message.content.slice(4) : message.content)}</span>
             `;
 
+            // Stored messages can be edited and deleted by their author
+            const stored = message.id && (message.type === 'message' || message.type === 'reply');
+            if (stored) {
+                messageDiv.dataset.messageId = message.id;
+                messageDiv.dataset.replyCount = message.reply_count || 0;
+                messageDiv.dataset.reactions = JSON.stringify(message.reactions || []);
+                messageDiv.dataset.message = JSON.stringify(message);
+            }
+
+            if (prepend) {
+                // Keep the visible messages in place while older ones load above
+                const previousHeight = messagesDiv.scrollHeight;
+                messagesDiv.insertBefore(messageDiv, messagesDiv.firstChild);
+                if (stored) {
+                    renderMessageBody(messageDiv, message);
+                }
+                messagesDiv.scrollTop += messagesDiv.scrollHeight - previousHeight;
+                return;
+            }
+
             messagesDiv.appendChild(messageDiv);
+            if (stored) {
+                renderMessageBody(messageDiv, message);
+            }
             messagesDiv.scrollTop = messagesDiv.scrollHeight;
         }
 
@@ -599,14 +1323,42 @@ let ws = null;
             }
         });
 
+        document.getElementById('messageInput').addEventListener('input', notifyTyping);
+
+        document.getElementById('searchInput').addEventListener('keypress', function (e) {
+            if (e.key === 'Enter') {
+                searchMessages();
+            }
+        });
+
+        document.getElementById('threadInput').addEventListener('keypress', function (e) {
+            if (e.key === 'Enter') {
+                sendReply();
+            }
+        });
+
+        document.getElementById('dmInput').addEventListener('keypress', function (e) {
+            if (e.key === 'Enter') {
+                openDirectMessage();
+            }
+        });
+
         document.getElementById('newChannelInput').addEventListener('keypress', function (e) {
             if (e.key === 'Enter') {
                 createChannelWithSpinner();
             }
         });
 
-        document.getElementById('username').addEventListener('change', function (e) {
-            username = e.target.value || 'User';
+        document.getElementById('authForm').addEventListener('submit', function (e) {
+            e.preventDefault();
+            login();
+        });
+
+        // Load older history when scrolled to the top
+        document.getElementById('messages').addEventListener('scroll', function (e) {
+            if (e.target.scrollTop === 0) {
+                loadOlderMessages();
+            }
         });
 
         // Channel click handlers
@@ -683,9 +1435,8 @@ let ws = null;
             }, 1000);
         }
 
-        // Initialize theme, random username and connect when page loads
+        // Initialize theme and connect (or ask for login) when page loads
         initializeTheme();
-        initializeRandomUsername();
         updateNotificationStatus();
         requestNotificationPermission();
-        connect();
\ No newline at end of file
+        startSession();
\ No newline at end of file
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errUserExists         = errors.New("username already taken")
+	errUserNotFound       = errors.New("user not found")
+	errInvalidCredentials = errors.New("invalid username or password")
+	errInvalidToken       = errors.New("invalid or expired token")
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+const minPasswordLength = 8
+
+// passwordIterations is the PBKDF2-SHA256 work factor for new hashes. The
+// count is stored in each hash so it can be raised without breaking logins.
+var passwordIterations = 600000
+
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func validateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return errors.New("username must be 3-32 letters, digits, '.', '_' or '-'")
+	}
+	if strings.EqualFold(username, "System") {
+		return errors.New("username is reserved")
+	}
+	return nil
+}
+
+// hashPassword returns "pbkdf2-sha256$<iterations>$<salt>$<key>".
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func verifyPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// tokenClaims is the payload of the HS256 JWTs issued by login.
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type authenticator struct {
+	store    Store
+	secret   []byte
+	tokenTTL time.Duration
+}
+
+func newAuthenticator(store Store, secret []byte, tokenTTL time.Duration) *authenticator {
+	return &authenticator{store: store, secret: secret, tokenTTL: tokenTTL}
+}
+
+// loadAuthSecret reads AUTH_SECRET. Without it a random secret is generated,
+// which invalidates every session on restart.
+func loadAuthSecret() []byte {
+	if secret := getEnv("AUTH_SECRET", ""); secret != "" {
+		return []byte(secret)
+	}
+	log.Println("AUTH_SECRET not set, generating a random session secret")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal("Failed to generate session secret:", err)
+	}
+	return secret
+}
+
+func loadTokenTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnv("AUTH_TOKEN_TTL", "24h"))
+	if err != nil || ttl <= 0 {
+		log.Printf("Invalid AUTH_TOKEN_TTL, using 24h")
+		return 24 * time.Hour
+	}
+	return ttl
+}
+
+// loadModerators reads the comma-separated MODERATORS list of usernames
+// allowed to edit and delete other users' messages.
+func loadModerators() map[string]bool {
+	moderators := make(map[string]bool)
+	for _, username := range strings.Split(getEnv("MODERATORS", ""), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			moderators[username] = true
+		}
+	}
+	return moderators
+}
+
+func (a *authenticator) register(username, password string) (User, error) {
+	if err := validateUsername(username); err != nil {
+		return User{}, err
+	}
+	if len(password) < minPasswordLength {
+		return User{}, fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	user := User{Username: username, PasswordHash: hash, CreatedAt: time.Now().UTC()}
+	if err := a.store.CreateUser(user); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (a *authenticator) login(username, password string) (string, time.Time, error) {
+	user, err := a.store.GetUser(username)
+	if err != nil {
+		if errors.Is(err, errUserNotFound) {
+			return "", time.Time{}, errInvalidCredentials
+		}
+		return "", time.Time{}, err
+	}
+	if !verifyPassword(user.PasswordHash, password) {
+		return "", time.Time{}, errInvalidCredentials
+	}
+	return a.issueToken(user.Username)
+}
+
+func (a *authenticator) issueToken(username string) (string, time.Time, error) {
+	now := time.Now().UTC()
+	expiresAt := now.Add(a.tokenTTL)
+
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(tokenClaims{Subject: username, IssuedAt: now.Unix(), ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + a.sign(signingInput), expiresAt, nil
+}
+
+func (a *authenticator) sign(signingInput string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks the signature and expiry and returns the username.
+func (a *authenticator) verifyToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errInvalidToken
+	}
+
+	signingInput := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(a.sign(signingInput))) {
+		return "", errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerBytes, &header) != nil || header.Alg != "HS256" {
+		return "", errInvalidToken
+	}
+
+	var claims tokenClaims
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return "", errInvalidToken
+	}
+	if claims.Subject == "" || time.Now().Unix() >= claims.ExpiresAt {
+		return "", errInvalidToken
+	}
+	return claims.Subject, nil
+}
+
+// authenticateRequest verifies the token sent as a Bearer Authorization
+// header or, for browsers that cannot set headers on WebSocket upgrades, as
+// the "token" query parameter.
+func (a *authenticator) authenticateRequest(r *http.Request) (string, error) {
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if token == "" {
+		return "", errInvalidToken
+	}
+	return a.verifyToken(token)
+}
+
+type credentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func handleRegister(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req credentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	// Bots have no account, but their names are taken
+	if hub.isBot(req.Username) {
+		writeJSONError(w, http.StatusConflict, errUserExists.Error())
+		return
+	}
+	user, err := hub.auth.register(req.Username, req.Password)
+	if errors.Is(err, errUserExists) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Registration failed for '%s': %v", req.Username, err)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("Registered user '%s'", user.Username)
+	writeJSON(w, http.StatusCreated, map[string]string{"username": user.Username})
+}
+
+func handleLogin(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req credentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	token, expiresAt, err := hub.auth.login(req.Username, req.Password)
+	if errors.Is(err, errInvalidCredentials) {
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Login failed for '%s': %v", req.Username, err)
+		writeJSONError(w, http.StatusInternalServerError, "login failed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":      token,
+		"username":   req.Username,
+		"expires_at": expiresAt,
+	})
+}
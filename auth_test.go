@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fastPasswordHashing keeps PBKDF2 cheap for the duration of a test.
+func fastPasswordHashing(t *testing.T) {
+	original := passwordIterations
+	passwordIterations = 1000
+	t.Cleanup(func() { passwordIterations = original })
+}
+
+func TestPasswordHashing(t *testing.T) {
+	fastPasswordHashing(t)
+
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	if strings.Contains(hash, "correct horse") {
+		t.Error("Hash should not contain the password")
+	}
+	if !verifyPassword(hash, "correct horse") {
+		t.Error("Expected password to verify")
+	}
+	if verifyPassword(hash, "wrong horse") {
+		t.Error("Expected wrong password to be rejected")
+	}
+
+	other, _ := hashPassword("correct horse")
+	if hash == other {
+		t.Error("Hashes of the same password should use different salts")
+	}
+}
+
+func TestTokenVerification(t *testing.T) {
+	auth := newAuthenticator(newMemoryStore(), []byte("secret"), time.Hour)
+
+	token, _, err := auth.issueToken("alice")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	username, err := auth.verifyToken(token)
+	if err != nil || username != "alice" {
+		t.Errorf("Expected alice, got %q (%v)", username, err)
+	}
+
+	// Signed with a different secret
+	other := newAuthenticator(newMemoryStore(), []byte("other"), time.Hour)
+	if _, err := other.verifyToken(token); err == nil {
+		t.Error("Expected token signed with another secret to be rejected")
+	}
+
+	// Tampered payload
+	parts := strings.Split(token, ".")
+	forged, _, _ := other.issueToken("mallory")
+	if _, err := auth.verifyToken(parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]); err == nil {
+		t.Error("Expected tampered token to be rejected")
+	}
+
+	// Expired
+	expired := newAuthenticator(newMemoryStore(), []byte("secret"), -time.Minute)
+	expiredToken, _, _ := expired.issueToken("alice")
+	if _, err := auth.verifyToken(expiredToken); err == nil {
+		t.Error("Expected expired token to be rejected")
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	fastPasswordHashing(t)
+
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+
+	post := func(handler func(*Hub, http.ResponseWriter, *http.Request), body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		handler(hub, rr, req)
+		return rr
+	}
+
+	if rr := post(handleRegister, `{"username":"alice","password":"s3cret-pass"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 from register, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := post(handleRegister, `{"username":"alice","password":"another-pass"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for duplicate username, got %d", rr.Code)
+	}
+	if rr := post(handleRegister, `{"username":"bob","password":"short"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for short password, got %d", rr.Code)
+	}
+	if rr := post(handleRegister, `{"username":"System","password":"s3cret-pass"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for reserved username, got %d", rr.Code)
+	}
+
+	if rr := post(handleLogin, `{"username":"alice","password":"wrong-pass"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong password, got %d", rr.Code)
+	}
+	if rr := post(handleLogin, `{"username":"nobody","password":"s3cret-pass"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for unknown user, got %d", rr.Code)
+	}
+
+	rr := post(handleLogin, `{"username":"alice","password":"s3cret-pass"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from login, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode login response: %v", err)
+	}
+	if username, err := hub.auth.verifyToken(resp.Token); err != nil || username != "alice" {
+		t.Errorf("Expected login token for alice, got %q (%v)", username, err)
+	}
+}
+
+func TestWebSocketRequiresAuthentication(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("Expected unauthenticated upgrade to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for missing token, got %v", resp)
+	}
+
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL+"?token=garbage", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for invalid token, got %v", err)
+	}
+
+	token, _, _ := hub.auth.issueToken("alice")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+token, nil)
+	if err != nil {
+		t.Fatalf("Expected query-string token to be accepted: %v", err)
+	}
+	conn.Close()
+}
+
+func TestMessageUsernameCannotBeSpoofed(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, authHeader(t, hub, "alice"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// active_channels is sent once registration has completed
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("Did not receive active channels: %v", err)
+	}
+
+	spoofed, _ := json.Marshal(Message{Username: "bob", Content: "hi", Type: "message", Channel: "general"})
+	if err := conn.WriteMessage(websocket.TextMessage, spoofed); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Did not receive broadcast: %v", err)
+		}
+		var msg Message
+		if json.Unmarshal(data, &msg) == nil && msg.Type == "message" {
+			if msg.Username != "alice" {
+				t.Errorf("Expected message attributed to alice, got %q", msg.Username)
+			}
+			return
+		}
+	}
+	t.Error("Did not receive chat message")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+)
+
+var errBotNameTaken = errors.New("bot username is taken")
+
+// Bot is a server-side user that answers slash commands. Its commands
+// reply as the bot, and it is listed as an online member of Channels
+// without a connection.
+//
+//	hub.registerBot(Bot{
+//		Username: "dice",
+//		Channels: []string{"general"},
+//		Commands: []Command{{Name: "roll", Description: "Roll a die", Handler: func(cmd *CommandContext) error {
+//			return cmd.Reply(fmt.Sprintf("%s rolled %d", cmd.Username, rand.IntN(6)+1))
+//		}}},
+//	})
+type Bot struct {
+	Username string
+	Channels []string
+	Commands []Command
+}
+
+// registerBot adds a bot and its commands. The username must be valid and
+// not belong to a registered user; registered users cannot take it later.
+func (h *Hub) registerBot(bot Bot) error {
+	if err := validateUsername(bot.Username); err != nil {
+		return err
+	}
+	if _, err := h.store.GetUser(bot.Username); err == nil {
+		return errBotNameTaken
+	} else if !errors.Is(err, errUserNotFound) {
+		return err
+	}
+
+	h.commandsMu.Lock()
+	defer h.commandsMu.Unlock()
+	if _, exists := h.bots[bot.Username]; exists {
+		return errBotNameTaken
+	}
+	// Check every command first so a rejected bot registers none of them
+	for i, cmd := range bot.Commands {
+		if !commandNamePattern.MatchString(cmd.Name) || cmd.Handler == nil {
+			return errInvalidCommandName
+		}
+		if _, exists := h.commands[cmd.Name]; exists || slices.ContainsFunc(bot.Commands[:i], func(c Command) bool { return c.Name == cmd.Name }) {
+			return fmt.Errorf("/%s: %w", cmd.Name, errCommandExists)
+		}
+	}
+	for _, cmd := range bot.Commands {
+		cmd.bot = bot.Username
+		if err := h.registerCommandLocked(cmd); err != nil {
+			return err
+		}
+	}
+	h.bots[bot.Username] = &bot
+	log.Printf("Bot '%s' registered with %d commands", bot.Username, len(bot.Commands))
+	return nil
+}
+
+func (h *Hub) isBot(username string) bool {
+	h.commandsMu.RLock()
+	defer h.commandsMu.RUnlock()
+	_, ok := h.bots[username]
+	return ok
+}
+
+// botsIn returns the bots that are members of a channel, ordered by
+// username.
+func (h *Hub) botsIn(channelName string) []string {
+	h.commandsMu.RLock()
+	defer h.commandsMu.RUnlock()
+	var usernames []string
+	for username, bot := range h.bots {
+		if slices.Contains(bot.Channels, channelName) {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+	return usernames
+}
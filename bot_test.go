@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRegisterBot(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	store.CreateUser(User{Username: "alice", PasswordHash: "x", CreatedAt: time.Now().UTC()})
+	noop := func(cmd *CommandContext) error { return nil }
+
+	tests := []struct {
+		name string
+		bot  Bot
+		want error
+	}{
+		{"registered user's name", Bot{Username: "alice"}, errBotNameTaken},
+		{"built-in command", Bot{Username: "helper", Commands: []Command{{Name: "help", Handler: noop}}}, errCommandExists},
+		{"repeated command", Bot{Username: "helper", Commands: []Command{{Name: "ping", Handler: noop}, {Name: "ping", Handler: noop}}}, errCommandExists},
+		{"invalid command name", Bot{Username: "helper", Commands: []Command{{Name: "ping", Handler: noop}, {Name: "Ping!", Handler: noop}}}, errInvalidCommandName},
+	}
+	for _, tt := range tests {
+		if err := hub.registerBot(tt.bot); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+	if hub.isBot("helper") {
+		t.Error("Expected rejected bots not to be registered")
+	}
+	if _, ok := hub.lookupCommand("ping"); ok {
+		t.Error("Expected a rejected bot's commands not to be registered")
+	}
+
+	if err := hub.registerBot(Bot{Username: "helper", Commands: []Command{{Name: "ping", Handler: noop}}}); err != nil {
+		t.Fatalf("Failed to register bot: %v", err)
+	}
+	if err := hub.registerBot(Bot{Username: "helper"}); !errors.Is(err, errBotNameTaken) {
+		t.Errorf("Expected errBotNameTaken registering helper twice, got %v", err)
+	}
+	if p := hub.presenceOf("helper"); p.Status != statusOnline || !p.Bot {
+		t.Errorf("Expected the bot always online, got %+v", p)
+	}
+
+	// Users cannot register a bot's name, or take it as a nick
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"username":"helper","password":"s3cret-pass"}`))
+	rr := httptest.NewRecorder()
+	handleRegister(hub, rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 registering a bot's name, got %d", rr.Code)
+	}
+	if err := hub.setNick("bob", "helper"); !errors.Is(err, errNickTaken) {
+		t.Errorf("Expected errNickTaken for a bot's name, got %v", err)
+	}
+}
+
+func TestBotCommands(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	err := hub.registerBot(Bot{
+		Username: "dice",
+		Channels: []string{"general"},
+		Commands: []Command{
+			{Name: "roll", Usage: "<sides>", Description: "Roll a die", Handler: func(cmd *CommandContext) error {
+				if cmd.Args == "" {
+					return cmd.usageError("<sides>")
+				}
+				return cmd.Reply(cmd.Username + " rolled a d" + cmd.Args + ": 4")
+			}},
+			{Name: "odds", Description: "Show the odds", Handler: func(cmd *CommandContext) error {
+				cmd.ReplyPrivately("Always 1 in 6")
+				return nil
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to register bot: %v", err)
+	}
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+
+	// Bots are members without a connection
+	members := hub.channelMembers("general")
+	if len(members) != 3 || members[2].Username != "dice" || !members[2].Bot {
+		t.Errorf("Expected dice listed as a bot member of general, got %+v", members)
+	}
+	if members := hub.channelMembers("ops"); len(members) != 0 {
+		t.Errorf("Expected dice only in its own channels, got %+v", members)
+	}
+
+	// Channel replies come from the bot and reach everyone
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/roll 6", "request_id": "r1"})
+	readUntil(t, alice, isAck("r1"))
+	if msg := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" }); msg["username"] != "dice" || msg["content"] != "alice rolled a d6: 4" {
+		t.Errorf("Expected dice's reply in the channel, got %v", msg)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/roll", "request_id": "r2"})
+	if frame := readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "error" }); frame["code"] != errorInvalidArgument || frame["message"] != "usage: /roll <sides>" {
+		t.Errorf("Expected a usage error, got %v", frame)
+	}
+
+	// Private replies only reach the connection that ran the command
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "/odds"})
+	if reply := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "command_reply" }); reply["username"] != "dice" || reply["content"] != "Always 1 in 6" {
+		t.Errorf("Expected dice's private reply, got %v", reply)
+	}
+	expectNone(t, alice, 50*time.Millisecond, func(msg map[string]interface{}) bool { return msg["type"] == "command_reply" })
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// clusterNotifyChannel is the PostgreSQL NOTIFY channel shared by all nodes.
+const clusterNotifyChannel = "echoroom_cluster"
+
+// maxNotifyPayload is PostgreSQL's NOTIFY payload limit (8000 bytes) minus
+// some headroom.
+const maxNotifyPayload = 7900
+
+// Events larger than maxNotifyPayload are stored in cluster_events and
+// notified as notifyRefPrefix followed by the row's ID. Listeners read them
+// at once, so rows are deleted after a minute.
+const notifyRefPrefix = "ref:"
+
+// postgresBroker fans events out with LISTEN/NOTIFY on the application
+// database, so no extra infrastructure is needed for a cluster.
+type postgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+}
+
+func newPostgresBroker(connStr string) (*postgresBroker, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect cluster broker: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping cluster broker database: %v", err)
+	}
+
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Cluster listener error: %v", err)
+		}
+	})
+	if err := listener.Listen(clusterNotifyChannel); err != nil {
+		listener.Close()
+		db.Close()
+		return nil, fmt.Errorf("failed to LISTEN on %s: %v", clusterNotifyChannel, err)
+	}
+
+	return &postgresBroker{db: db, listener: listener}, nil
+}
+
+func (b *postgresBroker) Publish(event ClusterEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	notification := string(payload)
+	if len(payload) > maxNotifyPayload {
+		var id int64
+		err := b.db.QueryRow("INSERT INTO cluster_events (payload) VALUES ($1) RETURNING id", notification).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("failed to store %s event of %d bytes: %v", event.Kind, len(payload), err)
+		}
+		notification = notifyRefPrefix + strconv.FormatInt(id, 10)
+		if _, err := b.db.Exec("DELETE FROM cluster_events WHERE created_at < CURRENT_TIMESTAMP - INTERVAL '1 minute'"); err != nil {
+			log.Printf("Error deleting old cluster events: %v", err)
+		}
+	}
+	_, err = b.db.Exec("SELECT pg_notify($1, $2)", clusterNotifyChannel, notification)
+	return err
+}
+
+// decodeNotification returns the event in a notification's payload,
+// loading it from cluster_events if it was too large to notify.
+func (b *postgresBroker) decodeNotification(payload string) (ClusterEvent, error) {
+	if ref, ok := strings.CutPrefix(payload, notifyRefPrefix); ok {
+		if err := b.db.QueryRow("SELECT payload FROM cluster_events WHERE id = $1", ref).Scan(&payload); err != nil {
+			return ClusterEvent{}, fmt.Errorf("failed to load cluster event %s: %v", ref, err)
+		}
+	}
+	var event ClusterEvent
+	err := json.Unmarshal([]byte(payload), &event)
+	return event, err
+}
+
+func (b *postgresBroker) Subscribe(handler func(ClusterEvent)) error {
+	go func() {
+		for notification := range b.listener.Notify {
+			if notification == nil {
+				// The connection was re-established; events may have been
+				// missed, which the next presence heartbeat repairs.
+				log.Println("Cluster listener reconnected")
+				continue
+			}
+			event, err := b.decodeNotification(notification.Extra)
+			if err != nil {
+				log.Printf("Error decoding cluster event: %v", err)
+				continue
+			}
+			handler(event)
+		}
+	}()
+	return nil
+}
+
+func (b *postgresBroker) Close() error {
+	b.listener.Close()
+	return b.db.Close()
+}
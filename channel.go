@@ -5,11 +5,42 @@ func newChannel(name string, channelType ChannelType) *Channel {
 		name:        name,
 		channelType: channelType,
 		clients:     make(map[*Client]bool),
+		focused:     make(map[*Client]bool),
 		broadcast:   make(chan []byte),
 		shutdown:    make(chan bool),
+		epoch:       newEpoch(),
 	}
 }
 
+// usernames returns the users focused on the channel, each listed once.
+// Clients that only subscribe to it do not count as present.
+func (c *Channel) usernames() []string {
+	c.clientsMu.RLock()
+	defer c.clientsMu.RUnlock()
+	seen := make(map[string]bool, len(c.focused))
+	var usernames []string
+	for client := range c.focused {
+		if client.username != "" && !seen[client.username] {
+			seen[client.username] = true
+			usernames = append(usernames, client.username)
+		}
+	}
+	return usernames
+}
+
+// hasUser reports whether any of username's connections is focused on the
+// channel.
+func (c *Channel) hasUser(username string) bool {
+	c.clientsMu.RLock()
+	defer c.clientsMu.RUnlock()
+	for client := range c.focused {
+		if client.username == username {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Channel) run(hubShutdown chan bool) {
 	for {
 		select {
@@ -19,12 +50,14 @@ func (c *Channel) run(hubShutdown chan bool) {
 			return
 		case message := <-c.broadcast:
 			c.clientsMu.Lock()
+			message = c.record(message)
 			for client := range c.clients {
 				select {
 				case client.send <- message:
 				default:
-					close(client.send)
 					delete(c.clients, client)
+					delete(c.focused, client)
+					client.disconnect()
 				}
 			}
 			c.clientsMu.Unlock()
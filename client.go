@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -11,10 +12,19 @@ import (
 
 func (c *Client) readPump() {
 	defer func() {
+		c.stopTyping()
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
 
+	// A reconnecting client gets its subscriptions back where it left off
+	for _, pos := range c.resumeSubscriptions {
+		if err := c.subscribeFrom(pos.Channel, pos); err != nil {
+			log.Printf("Could not resume %s's subscription to '%s': %v", c.username, pos.Channel, err)
+		}
+	}
+	c.resumeSubscriptions = nil
+
 	for {
 		_, messageBytes, err := c.conn.ReadMessage()
 		if err != nil {
@@ -25,128 +35,343 @@ func (c *Client) readPump() {
 		}
 
 		// First, check the message type to determine how to unmarshal
-		var msgType struct {
-			Type string `json:"type"`
-		}
-		if err := json.Unmarshal(messageBytes, &msgType); err != nil {
-			log.Printf("Error unmarshaling message type: %v", err)
+		var cmd commandEnvelope
+		malformed := json.Unmarshal(messageBytes, &cmd)
+
+		// Malformed frames are throttled like unknown commands
+		if drop, disconnect := c.throttle(cmd); disconnect {
+			c.closeForAbuse()
+			break
+		} else if drop {
 			continue
 		}
 
-		if msgType.Type == "user_connected" {
-			var message Message
-			if err := json.Unmarshal(messageBytes, &message); err != nil {
-				log.Printf("Error unmarshaling user_connected message: %v", err)
-				continue
+		if malformed != nil {
+			log.Printf("Error unmarshaling message type: %v", malformed)
+			c.sendCommandError(commandEnvelope{}, errMalformedCommand)
+			if c.violate() {
+				c.closeForAbuse()
+				break
 			}
+			continue
+		}
 
-			// Set username and send join message immediately
-			if message.Username != "" && c.username != message.Username {
-				c.username = message.Username
-				c.hasJoined = true
+		// Every command is answered with an ack or an error frame
+		ack := Ack{Type: "ack", RequestID: cmd.RequestID, Command: cmd.Type}
+		if err := c.handleCommand(cmd.Type, messageBytes, &ack); err != nil {
+			c.sendCommandError(cmd, err)
+			// Unknown frame types count towards disconnecting; mistyped
+			// slash commands arrive as messages and do not
+			if cmd.Type != "message" && errorCode(err) == errorUnknownCommand && c.violate() {
+				c.closeForAbuse()
+				break
+			}
+		} else {
+			c.sendFrame(ack)
+		}
+	}
+}
 
-				channelName := c.channel
-				if channelName == "" {
-					channelName = "general"
-				}
+// handleCommand runs one client command. A nil error means the command
+// succeeded; commands may add details to its ack.
+func (c *Client) handleCommand(commandType string, messageBytes []byte, ack *Ack) error {
+	if commandType == "user_connected" {
+		// The username comes from the authenticated session; the one in
+		// the message is ignored. Announce the user once per connection.
+		if c.username != "" && !c.hasJoined {
+			c.hasJoined = true
+
+			channelName := c.channel
+			if channelName == "" {
+				channelName = "general"
+			}
 
-				// Send join message for ephemeral channels if there are other clients
-				if channel, ok := c.hub.channels[channelName]; ok && channel.channelType == Ephemeral {
-					if len(channel.clients) > 1 {
-						joinMsg := Message{
-							Username:  "System",
-							Content:   fmt.Sprintf("%s joined the channel", c.username),
-							Type:      "system_message",
-							Channel:   channelName,
-							Timestamp: time.Now().UTC(),
-						}
-						if joinMsgBytes, err := json.Marshal(joinMsg); err == nil {
-							log.Printf("Sending immediate join message for %s to channel '%s'", c.username, channelName)
-							channel.broadcast <- joinMsgBytes
-						}
+			// Send join message for ephemeral channels if there are other clients
+			if channel, ok := c.hub.channels[channelName]; ok && channel.channelType == Ephemeral {
+				if len(channel.clients)+c.hub.remoteMemberCount(channelName) > 1 {
+					joinMsg := Message{
+						Username:  "System",
+						Content:   fmt.Sprintf("%s joined the channel", c.username),
+						Type:      "system_message",
+						Channel:   channelName,
+						Timestamp: time.Now().UTC(),
+					}
+					if joinMsgBytes, err := json.Marshal(joinMsg); err == nil {
+						log.Printf("Sending immediate join message for %s to channel '%s'", c.username, channelName)
+						c.hub.broadcastToChannel(channel, joinMsgBytes)
 					}
 				}
 			}
-			continue
 		}
+		return nil
+	}
 
-		if msgType.Type == "join_channel" {
-			var message Message
-			if err := json.Unmarshal(messageBytes, &message); err != nil {
-				log.Printf("Error unmarshaling join_channel message: %v", err)
-				continue
-			}
-			c.switchChannel(message.Channel)
-			continue
+	if commandType == "join_channel" {
+		var message Message
+		if err := decodeCommand(commandType, messageBytes, &message); err != nil {
+			return err
 		}
+		return c.switchChannel(message.Channel)
+	}
 
-		if msgType.Type == "create_channel" {
-			var createReq ChannelCreateRequest
-			if err := json.Unmarshal(messageBytes, &createReq); err != nil {
-				log.Printf("Error unmarshaling channel create request: %v", err)
-				continue
-			}
+	if commandType == "subscribe" || commandType == "unsubscribe" {
+		var subReq SubscriptionRequest
+		if err := decodeCommand(commandType, messageBytes, &subReq); err != nil {
+			return err
+		}
+		if commandType == "unsubscribe" {
+			return c.unsubscribe(subReq.Channel)
+		}
+		return c.subscribe(subReq.Channel)
+	}
 
-			log.Printf("Received create_channel request: name='%s', channel_type='%s'", createReq.Name, createReq.ChannelType)
+	if commandType == "open_dm" {
+		var dmReq DirectMessageRequest
+		if err := decodeCommand(commandType, messageBytes, &dmReq); err != nil {
+			return err
+		}
+		return c.openDirectMessage(dmReq)
+	}
 
-			// Create channel in database (only for persistent channels)
-			if err := c.hub.createChannelInDB(createReq.Name, createReq.ChannelType); err != nil {
-				log.Printf("Error creating channel in database: %v", err)
-				continue
-			}
-			if createReq.ChannelType == Persistent {
-				log.Printf("Persistent channel created in database: name='%s'", createReq.Name)
-			} else {
-				log.Printf("Ephemeral channel created: name='%s' (not stored in database)", createReq.Name)
+	if commandType == "edit_message" {
+		var editReq EditMessageRequest
+		if err := decodeCommand(commandType, messageBytes, &editReq); err != nil {
+			return err
+		}
+		if err := c.checkMessageChannel(editReq.ID); err != nil {
+			return err
+		}
+		return c.hub.editMessage(c.username, editReq.ID, editReq.Content)
+	}
+
+	if commandType == "delete_message" {
+		var deleteReq DeleteMessageRequest
+		if err := decodeCommand(commandType, messageBytes, &deleteReq); err != nil {
+			return err
+		}
+		return c.hub.deleteMessage(c.username, deleteReq.ID)
+	}
+
+	if commandType == "mark_read" {
+		var readReq MarkReadRequest
+		if err := decodeCommand(commandType, messageBytes, &readReq); err != nil {
+			return err
+		}
+		if readReq.Channel == "" {
+			readReq.Channel = c.channel
+		}
+		_, err := c.hub.markRead(c.username, readReq.Channel, readReq.MessageID)
+		return err
+	}
+
+	if commandType == "typing_start" {
+		c.startTyping()
+		return nil
+	}
+
+	if commandType == "typing_stop" {
+		c.stopTyping()
+		return nil
+	}
+
+	if commandType == "set_status" {
+		var statusReq StatusRequest
+		if err := decodeCommand(commandType, messageBytes, &statusReq); err != nil {
+			return err
+		}
+		return c.hub.setStatus(c.username, statusReq.Status)
+	}
+
+	if commandType == "add_reaction" || commandType == "remove_reaction" {
+		var reactionReq ReactionRequest
+		if err := decodeCommand(commandType, messageBytes, &reactionReq); err != nil {
+			return err
+		}
+		add := commandType == "add_reaction"
+		if add {
+			if err := c.checkMessageChannel(reactionReq.MessageID); err != nil {
+				return err
 			}
+		}
+		return c.hub.react(c.username, reactionReq.MessageID, reactionReq.Emoji, add)
+	}
 
-			// Switch to the new channel
-			c.switchChannelWithType(createReq.Name, createReq.ChannelType)
-			log.Printf("Switched client to new channel: %s", createReq.Name)
-			continue
+	if commandType == "reply" {
+		var reply Message
+		if err := decodeCommand(commandType, messageBytes, &reply); err != nil {
+			return err
 		}
+		if err := c.checkMessageChannel(reply.ParentID); err != nil {
+			return err
+		}
+		_, err := c.hub.postReply(c.username, reply.ParentID, reply.Content)
+		return err
+	}
 
-		// Handle regular messages
-		var message Message
-		if err := json.Unmarshal(messageBytes, &message); err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
-			continue
+	if commandType == "thread_request" {
+		var threadReq ThreadRequest
+		if err := decodeCommand(commandType, messageBytes, &threadReq); err != nil {
+			return err
 		}
+		return c.sendThread(threadReq)
+	}
 
-		channelName := c.channel
-		if channelName == "" {
-			channelName = "general"
+	if commandType == "history_request" {
+		var historyReq HistoryRequest
+		if err := decodeCommand(commandType, messageBytes, &historyReq); err != nil {
+			return err
 		}
+		return c.sendHistoryPage(historyReq)
+	}
 
-		// Update client username from message (username should already be set from user_connected)
-		if message.Username != "" && c.username != message.Username {
-			c.username = message.Username
+	if commandType == "search" {
+		var query SearchQuery
+		if err := decodeCommand(commandType, messageBytes, &query); err != nil {
+			return err
 		}
+		return c.sendSearchResults(query)
+	}
 
-		// Only process regular messages for channel broadcasting
-		if message.Type == "message" {
-			// Set timestamp for all messages
-			message.Timestamp = time.Now().UTC()
+	if commandType == "grant_role" || commandType == "revoke_role" {
+		var roleReq RoleRequest
+		if err := decodeCommand(commandType, messageBytes, &roleReq); err != nil {
+			return err
+		}
+		if roleReq.Channel == "" {
+			roleReq.Channel = c.focusedChannel()
+		}
+		if commandType == "revoke_role" {
+			return c.hub.revokeRole(c.username, roleReq.Channel, roleReq.Username)
+		}
+		return c.hub.grantRole(c.username, roleReq.Channel, roleReq.Username, roleReq.Role)
+	}
 
-			// Only save to database if channel is persistent
-			if channel, ok := c.hub.channels[channelName]; ok && channel.channelType == Persistent {
-				if err := c.hub.saveMessage(message); err != nil {
-					log.Printf("Error saving message: %v", err)
-				}
-			}
+	if commandType == "invite" {
+		var inviteReq InviteRequest
+		if err := decodeCommand(commandType, messageBytes, &inviteReq); err != nil {
+			return err
+		}
+		return c.handleInvite(inviteReq)
+	}
 
-			// Broadcast to channel with updated timestamp
-			if channel, ok := c.hub.channels[channelName]; ok {
-				// Re-marshal the message with the timestamp included
-				if updatedBytes, err := json.Marshal(message); err == nil {
-					channel.broadcast <- updatedBytes
-				} else {
-					// Fallback to original message if marshaling fails
-					channel.broadcast <- messageBytes
-				}
-			}
+	if commandType == "join_invite" {
+		var joinReq JoinInviteRequest
+		if err := decodeCommand(commandType, messageBytes, &joinReq); err != nil {
+			return err
+		}
+		invite, err := c.hub.joinWithInvite(c.username, joinReq.Code)
+		if err != nil {
+			return err
+		}
+		return c.switchChannel(invite.Channel)
+	}
+
+	if _, ok := sanctionKinds[commandType]; ok || commandType == actionKick {
+		var modReq ModerationRequest
+		if err := decodeCommand(commandType, messageBytes, &modReq); err != nil {
+			return err
 		}
+		return c.handleModeration(commandType, modReq)
 	}
+
+	if commandType == actionSlowMode {
+		var slowReq SlowModeRequest
+		if err := decodeCommand(commandType, messageBytes, &slowReq); err != nil {
+			return err
+		}
+		if slowReq.Channel == "" {
+			slowReq.Channel = c.focusedChannel()
+		}
+		return c.hub.setSlowMode(c.username, slowReq.Channel, slowReq.Seconds)
+	}
+
+	if commandType == "create_channel" {
+		var createReq ChannelCreateRequest
+		if err := decodeCommand(commandType, messageBytes, &createReq); err != nil {
+			return err
+		}
+
+		log.Printf("Received create_channel request: name='%s', channel_type='%s', private=%v", createReq.Name, createReq.ChannelType, createReq.Private)
+
+		if err := validateNewChannel(&createReq); err != nil {
+			return err
+		}
+
+		// Create channel in database (only for persistent channels)
+		if err := c.hub.createChannelInDB(createReq.Name, createReq.ChannelType, c.username, createReq.Private); err != nil {
+			log.Printf("Error creating channel in database: %v", err)
+			return err
+		}
+		if createReq.ChannelType == Persistent {
+			log.Printf("Persistent channel created in database: name='%s'", createReq.Name)
+		} else {
+			log.Printf("Ephemeral channel created: name='%s' (not stored in database)", createReq.Name)
+		}
+		// Creating an existing channel joins it, which a private one may refuse
+		if !c.hub.canAccessChannel(c.username, createReq.Name) {
+			return errChannelForbidden
+		}
+
+		// Switch to the new channel
+		c.switchChannelWithType(createReq.Name, createReq.ChannelType)
+		log.Printf("Switched client to new channel: %s", createReq.Name)
+		return nil
+	}
+
+	if commandType != "message" {
+		return newCommandError(errorUnknownCommand, fmt.Sprintf("unknown command %q", commandType))
+	}
+
+	// Handle regular messages
+	var message Message
+	if err := decodeCommand(commandType, messageBytes, &message); err != nil {
+		return err
+	}
+	// Messages go to the focused channel unless they name a subscribed one
+	channelName := c.focusedChannel()
+	if message.Channel != "" {
+		if !c.isSubscribed(message.Channel) {
+			return errNotSubscribed
+		}
+		channelName = message.Channel
+	}
+
+	// Messages are always attributed to the authenticated user, shown
+	// under their nick if they set one; only webhooks set attachments
+	message.Username = c.username
+	message.Channel = channelName
+	message.DisplayName, message.Attachments = c.hub.nickOf(c.username), nil
+
+	// Sending ends the sender's typing indicator
+	c.stopTyping()
+
+	// "/" runs a slash command; "//" posts the message with one slash
+	if strings.HasPrefix(message.Content, "//") {
+		message.Content = message.Content[1:]
+	} else if strings.HasPrefix(message.Content, "/") {
+		return c.runSlashCommand(message, ack)
+	}
+	return c.post(message, ack)
+}
+
+// post posts a message the client sent and fills in its ack.
+func (c *Client) post(message Message, ack *Ack) error {
+	if c.wasRemoved(message.Channel) {
+		return errRemovedFromChannel
+	}
+	if err := c.hub.checkPost(message); err != nil {
+		return err
+	}
+	posted, duplicate, err := c.hub.postMessage(message)
+	if err != nil {
+		return err
+	}
+	// The ID lets clients edit, delete and page from the message
+	ack.ID = posted.ID
+	ack.Timestamp = &posted.Timestamp
+	ack.ClientMsgID = message.ClientMsgID
+	ack.Duplicate = duplicate
+	return nil
 }
 
 func (c *Client) switchChannelWithType(newChannelName string, channelType ChannelType) {
@@ -159,6 +384,8 @@ func (c *Client) switchChannelWithType(newChannelName string, channelType Channe
 		return
 	}
 
+	c.stopTyping()
+
 	oldChannel := c.channel
 	if oldChannel == "" {
 		oldChannel = "general"
@@ -168,40 +395,22 @@ func (c *Client) switchChannelWithType(newChannelName string, channelType Channe
 	channel, ok := c.hub.channels[oldChannel]
 	c.hub.channelsMu.RUnlock()
 
-	if ok {
+	if ok && c.subscriptions[oldChannel] {
+		// Still subscribed: the client keeps receiving the channel
+		c.unfocus(channel)
+	} else if ok {
 		channel.clientsMu.Lock()
 		delete(channel.clients, c)
+		delete(channel.focused, c)
 		clientCount := len(channel.clients)
 		channel.clientsMu.Unlock()
+		c.hub.publishPresence(oldChannel, clientCount)
+		if !channel.hasUser(c.username) {
+			c.hub.announcePresence(oldChannel, c.username, presenceLeave)
+		}
 
 		if clientCount == 0 && oldChannel != "general" {
-			// Only delete ephemeral channels when empty
-			if channel.channelType == Ephemeral {
-				c.hub.channelsMu.Lock()
-				delete(c.hub.channels, oldChannel)
-				c.hub.channelsMu.Unlock()
-
-				// Broadcast channel deletion to all clients
-				channelDeletedMsg := Message{
-					Username: "System",
-					Content:  oldChannel,
-					Type:     "channel_deleted",
-					Channel:  oldChannel,
-				}
-
-				if msgBytes, err := json.Marshal(channelDeletedMsg); err == nil {
-					select {
-					case c.hub.broadcast <- msgBytes:
-					default:
-						// Hub broadcast channel is full, skip
-					}
-				}
-			} else {
-				// For persistent channels, just remove from memory
-				c.hub.channelsMu.Lock()
-				delete(c.hub.channels, oldChannel)
-				c.hub.channelsMu.Unlock()
-			}
+			c.hub.closeChannel(channel, nil)
 		}
 	}
 
@@ -217,13 +426,20 @@ func (c *Client) switchChannelWithType(newChannelName string, channelType Channe
 	newChannel := c.hub.channels[newChannelName]
 	c.hub.channelsMu.Unlock()
 
+	present := newChannel.hasUser(c.username)
 	newChannel.clientsMu.Lock()
 	newChannel.clients[c] = true
+	newChannel.focused[c] = true
 	clientCount := len(newChannel.clients)
 	newChannel.clientsMu.Unlock()
+	remoteCount := c.hub.remoteMemberCount(newChannelName)
+	c.hub.publishPresence(newChannelName, clientCount)
+	if !present {
+		c.hub.announcePresence(newChannelName, c.username, presenceJoin)
+	}
 
 	// Send join message for ephemeral channels if there are other clients and we have a username
-	if newChannel.channelType == Ephemeral && clientCount > 1 && c.username != "" {
+	if newChannel.channelType == Ephemeral && clientCount+remoteCount > 1 && c.username != "" {
 		joinMsg := Message{
 			Username:  "System",
 			Content:   fmt.Sprintf("%s joined the channel", c.username),
@@ -233,28 +449,14 @@ func (c *Client) switchChannelWithType(newChannelName string, channelType Channe
 		}
 		if joinMsgBytes, err := json.Marshal(joinMsg); err == nil {
 			log.Printf("Sending join message for %s switching to channel '%s'", c.username, newChannelName)
-			newChannel.broadcast <- joinMsgBytes
+			c.hub.broadcastToChannel(newChannel, joinMsgBytes)
 		}
 	}
 
-	if channelCreated {
-		channelCreatedMsg := struct {
-			Type        string      `json:"type"`
-			Name        string      `json:"name"`
-			ChannelType ChannelType `json:"channel_type"`
-		}{
-			Type:        "channel_created",
-			Name:        newChannelName,
-			ChannelType: channelType,
-		}
-
-		if msgBytes, err := json.Marshal(channelCreatedMsg); err == nil {
-			select {
-			case c.hub.broadcast <- msgBytes:
-			default:
-				// Hub broadcast channel is full, skip
-			}
-		}
+	// A channel with members on other nodes already exists cluster-wide, and
+	// direct channels are only announced to their members
+	if channelCreated && remoteCount == 0 && newChannel.channelType != Direct {
+		c.hub.announceChannelCreated(newChannelName, channelType)
 	}
 
 	channelSwitchMsg := Message{
@@ -267,9 +469,11 @@ func (c *Client) switchChannelWithType(newChannelName string, channelType Channe
 	if msgBytes, err := json.Marshal(channelSwitchMsg); err == nil {
 		c.send <- msgBytes
 	}
+	c.sendChannelMembers(newChannelName)
+	c.sendChannelTopic(newChannelName)
 
-	// Send message history for persistent channels AFTER channel switch message
-	if newChannel.channelType == Persistent {
+	// Send message history for stored channels AFTER channel switch message
+	if newChannel.channelType.isStored() {
 		history, err := c.hub.getChannelHistory(newChannelName, 50)
 		if err == nil {
 			log.Printf("Loading %d messages from history for channel '%s'", len(history), newChannelName)
@@ -278,7 +482,7 @@ func (c *Client) switchChannelWithType(newChannelName string, channelType Channe
 					select {
 					case c.send <- msgBytes:
 					default:
-						close(c.send)
+						log.Printf("Dropping history for %s: send buffer full", c.username)
 						return
 					}
 				}
@@ -291,14 +495,26 @@ func (c *Client) switchChannelWithType(newChannelName string, channelType Channe
 	log.Printf("Client switched from '%s' to '%s'", oldChannel, newChannelName)
 }
 
-func (c *Client) switchChannel(newChannelName string) {
+func (c *Client) switchChannel(newChannelName string) error {
 	if newChannelName == "" {
 		newChannelName = "general"
 	}
 
-	if c.channel == newChannelName {
-		return
+	// A client kicked from its focused channel may join it again
+	rejoining := c.wasRemoved(newChannelName)
+	if c.channel == newChannelName && !rejoining {
+		return nil
+	}
+
+	if err := c.hub.sanctionError(c.username, newChannelName, permJoin); err != nil {
+		return err
 	}
+	if !c.hub.canAccessChannel(c.username, newChannelName) {
+		log.Printf("Client %s may not join channel '%s'", c.username, newChannelName)
+		return errChannelForbidden
+	}
+
+	c.stopTyping()
 
 	oldChannel := c.channel
 	if oldChannel == "" {
@@ -308,11 +524,19 @@ func (c *Client) switchChannel(newChannelName string) {
 	c.hub.channelsMu.RLock()
 	channel, ok := c.hub.channels[oldChannel]
 	c.hub.channelsMu.RUnlock()
+	if c.wasRemoved(oldChannel) {
+		// A moderator already took the client out of it
+		ok = false
+	}
 
-	if ok {
+	if ok && c.subscriptions[oldChannel] {
+		// Still subscribed: the client keeps receiving the channel
+		c.unfocus(channel)
+	} else if ok {
 		channel.clientsMu.Lock()
 		// Send leave message for ephemeral channels if there are other clients
-		if channel.channelType == Ephemeral && len(channel.clients) > 1 && c.username != "" {
+		var leaveMsgBytes []byte
+		if channel.channelType == Ephemeral && len(channel.clients)+c.hub.remoteMemberCount(oldChannel) > 1 && c.username != "" {
 			leaveMsg := Message{
 				Username:  "System",
 				Content:   fmt.Sprintf("%s left the channel", c.username),
@@ -320,44 +544,25 @@ func (c *Client) switchChannel(newChannelName string) {
 				Channel:   oldChannel,
 				Timestamp: time.Now().UTC(),
 			}
-			if leaveMsgBytes, err := json.Marshal(leaveMsg); err == nil {
-				log.Printf("Sending leave message for %s switching from channel '%s'", c.username, oldChannel)
-				channel.broadcast <- leaveMsgBytes
-			}
+			leaveMsgBytes, _ = json.Marshal(leaveMsg)
 		}
 
 		delete(channel.clients, c)
+		delete(channel.focused, c)
 		clientCount := len(channel.clients)
 		channel.clientsMu.Unlock()
+		// Broadcast without holding the lock the channel needs to deliver
+		if leaveMsgBytes != nil {
+			log.Printf("Sending leave message for %s switching from channel '%s'", c.username, oldChannel)
+			c.hub.broadcastToChannel(channel, leaveMsgBytes)
+		}
+		c.hub.publishPresence(oldChannel, clientCount)
+		if !channel.hasUser(c.username) {
+			c.hub.announcePresence(oldChannel, c.username, presenceLeave)
+		}
 
 		if clientCount == 0 && oldChannel != "general" {
-			// Only delete ephemeral channels when empty
-			if channel.channelType == Ephemeral {
-				c.hub.channelsMu.Lock()
-				delete(c.hub.channels, oldChannel)
-				c.hub.channelsMu.Unlock()
-
-				// Broadcast channel deletion to all clients
-				channelDeletedMsg := Message{
-					Username: "System",
-					Content:  oldChannel,
-					Type:     "channel_deleted",
-					Channel:  oldChannel,
-				}
-
-				if msgBytes, err := json.Marshal(channelDeletedMsg); err == nil {
-					select {
-					case c.hub.broadcast <- msgBytes:
-					default:
-						// Hub broadcast channel is full, skip
-					}
-				}
-			} else {
-				// For persistent channels, just remove from memory
-				c.hub.channelsMu.Lock()
-				delete(c.hub.channels, oldChannel)
-				c.hub.channelsMu.Unlock()
-			}
+			c.hub.closeChannel(channel, nil)
 		}
 	}
 
@@ -379,13 +584,21 @@ func (c *Client) switchChannel(newChannelName string) {
 	newChannel := c.hub.channels[newChannelName]
 	c.hub.channelsMu.Unlock()
 
+	present := newChannel.hasUser(c.username)
 	newChannel.clientsMu.Lock()
 	newChannel.clients[c] = true
+	newChannel.focused[c] = true
 	clientCount := len(newChannel.clients)
 	newChannel.clientsMu.Unlock()
+	c.rejoined(newChannelName)
+	remoteCount := c.hub.remoteMemberCount(newChannelName)
+	c.hub.publishPresence(newChannelName, clientCount)
+	if !present {
+		c.hub.announcePresence(newChannelName, c.username, presenceJoin)
+	}
 
 	// Send join message for ephemeral channels if there are other clients and we have a username
-	if newChannel.channelType == Ephemeral && clientCount > 1 && c.username != "" {
+	if newChannel.channelType == Ephemeral && clientCount+remoteCount > 1 && c.username != "" {
 		joinMsg := Message{
 			Username:  "System",
 			Content:   fmt.Sprintf("%s joined the channel", c.username),
@@ -395,31 +608,14 @@ func (c *Client) switchChannel(newChannelName string) {
 		}
 		if joinMsgBytes, err := json.Marshal(joinMsg); err == nil {
 			log.Printf("Sending join message for %s switching to channel '%s'", c.username, newChannelName)
-			newChannel.broadcast <- joinMsgBytes
+			c.hub.broadcastToChannel(newChannel, joinMsgBytes)
 		}
 	}
 
-	if channelCreated {
-		// Get the channel type to send in the message
-		channelType := newChannel.channelType
-
-		channelCreatedMsg := struct {
-			Type        string      `json:"type"`
-			Name        string      `json:"name"`
-			ChannelType ChannelType `json:"channel_type"`
-		}{
-			Type:        "channel_created",
-			Name:        newChannelName,
-			ChannelType: channelType,
-		}
-
-		if msgBytes, err := json.Marshal(channelCreatedMsg); err == nil {
-			select {
-			case c.hub.broadcast <- msgBytes:
-			default:
-				// Hub broadcast channel is full, skip
-			}
-		}
+	// A channel with members on other nodes already exists cluster-wide, and
+	// direct channels are only announced to their members
+	if channelCreated && remoteCount == 0 && newChannel.channelType != Direct {
+		c.hub.announceChannelCreated(newChannelName, newChannel.channelType)
 	}
 
 	channelSwitchMsg := Message{
@@ -432,9 +628,11 @@ func (c *Client) switchChannel(newChannelName string) {
 	if msgBytes, err := json.Marshal(channelSwitchMsg); err == nil {
 		c.send <- msgBytes
 	}
+	c.sendChannelMembers(newChannelName)
+	c.sendChannelTopic(newChannelName)
 
-	// Send message history for persistent channels AFTER channel switch message
-	if newChannel.channelType == Persistent {
+	// Send message history for stored channels AFTER channel switch message
+	if newChannel.channelType.isStored() {
 		history, err := c.hub.getChannelHistory(newChannelName, 50)
 		if err == nil {
 			log.Printf("Loading %d messages from history for channel '%s'", len(history), newChannelName)
@@ -443,8 +641,8 @@ func (c *Client) switchChannel(newChannelName string) {
 					select {
 					case c.send <- msgBytes:
 					default:
-						close(c.send)
-						return
+						log.Printf("Dropping history for %s: send buffer full", c.username)
+						return nil
 					}
 				}
 			}
@@ -454,6 +652,69 @@ func (c *Client) switchChannel(newChannelName string) {
 	}
 
 	log.Printf("Client switched from '%s' to '%s'", oldChannel, newChannelName)
+	return nil
+}
+
+// sendHistoryPage answers a history_request, defaulting to the client's
+// current channel.
+func (c *Client) sendHistoryPage(req HistoryRequest) error {
+	if req.Channel == "" {
+		req.Channel = c.channel
+	}
+	if req.Channel == "" {
+		req.Channel = "general"
+	}
+
+	if !c.hub.canAccessChannel(c.username, req.Channel) {
+		log.Printf("Client %s may not read history of channel '%s'", c.username, req.Channel)
+		return errChannelForbidden
+	}
+
+	page, err := c.hub.getHistoryPage(req)
+	if err != nil {
+		log.Printf("Error loading history page for channel '%s': %v", req.Channel, err)
+		return err
+	}
+
+	if msgBytes, err := json.Marshal(page); err == nil {
+		select {
+		case c.send <- msgBytes:
+		default:
+			log.Printf("Dropping history page for %s: send buffer full", c.username)
+		}
+	}
+	return nil
+}
+
+func (c *Client) sendSearchResults(query SearchQuery) error {
+	results, err := c.hub.searchMessages(c.username, query)
+	if err != nil {
+		log.Printf("Error searching messages for %s: %v", c.username, err)
+		return err
+	}
+
+	if msgBytes, err := json.Marshal(results); err == nil {
+		select {
+		case c.send <- msgBytes:
+		default:
+			log.Printf("Dropping search results for %s: send buffer full", c.username)
+		}
+	}
+	return nil
+}
+
+// disconnect drops a client that cannot keep up with its messages. Its read
+// pump then ends and the hub removes it from all of its channels.
+func (c *Client) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// closeSend ends the write pump. Only the hub calls it, once the client has
+// left every channel, so nothing sends on the closed channel.
+func (c *Client) closeSend() {
+	c.closeOnce.Do(func() { close(c.send) })
 }
 
 func (c *Client) writePump() {
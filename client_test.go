@@ -7,14 +7,10 @@ import (
 )
 
 func TestClientSwitchChannel(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping client tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 	go hub.run()
 	defer hub.stop() // Ensure cleanup
 
@@ -54,14 +50,10 @@ func TestClientSwitchChannel(t *testing.T) {
 }
 
 func TestClientSwitchChannelWithType(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping client tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 	go hub.run()
 	defer hub.stop() // Ensure cleanup
 
@@ -95,14 +87,10 @@ func TestClientSwitchChannelWithType(t *testing.T) {
 }
 
 func TestClientSwitchToSameChannel(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping client tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 
 	client := &Client{
 		hub:     hub,
@@ -130,14 +118,10 @@ func TestClientSwitchToSameChannel(t *testing.T) {
 }
 
 func TestClientChannelCleanupOnSwitch(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping client tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 
 	client := &Client{
 		hub:     hub,
@@ -160,17 +144,13 @@ func TestClientChannelCleanupOnSwitch(t *testing.T) {
 }
 
 func TestClientPersistentChannelMemoryCleanup(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping client tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 
 	// Create persistent channel in database
-	err := hub.createChannelInDB("persistent-test", Persistent)
+	err := hub.createChannelInDB("persistent-test", Persistent, "", false)
 	if err != nil {
 		t.Fatalf("Failed to create persistent channel: %v", err)
 	}
@@ -195,9 +175,7 @@ func TestClientPersistentChannelMemoryCleanup(t *testing.T) {
 	}
 
 	// Verify it still exists in database
-	var channelType string
-	err = db.QueryRow("SELECT type FROM channels WHERE name = $1", "persistent-test").Scan(&channelType)
-	if err != nil {
+	if _, err := store.GetChannelType("persistent-test"); err != nil {
 		t.Error("Persistent channel should still exist in database")
 	}
 }
@@ -228,14 +206,10 @@ func TestClientWritePump(t *testing.T) {
 }
 
 func TestChannelSwitchMessage(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping client tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 
 	client := &Client{
 		hub:     hub,
@@ -278,14 +252,10 @@ func TestChannelSwitchMessage(t *testing.T) {
 }
 
 func TestChannelCreatedMessage(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping client tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 	hub.channels = make(map[string]*Channel) // Ensure clean state
 
 	client := &Client{
@@ -323,14 +293,10 @@ func TestChannelCreatedMessage(t *testing.T) {
 }
 
 func TestEmptyChannelNameDefaults(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping client tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 
 	client := &Client{
 		hub:     hub,
@@ -353,3 +319,64 @@ func TestEmptyChannelNameDefaults(t *testing.T) {
 		t.Errorf("Empty channel name should default to 'general', got '%s'", client.channel)
 	}
 }
+
+func TestHistoryRequest(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+
+	hub := newHub(store)
+	if err := hub.createChannelInDB("archive", Persistent, "", false); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+	for i := 0; i < maxHistoryPageSize+5; i++ {
+		if _, err := hub.saveMessage(Message{Username: "user", Content: "msg", Type: "message", Channel: "archive", Timestamp: time.Now().UTC()}); err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+	}
+
+	client := &Client{
+		hub:     hub,
+		send:    make(chan []byte, 256),
+		channel: "archive",
+	}
+
+	readPage := func() HistoryPage {
+		t.Helper()
+		select {
+		case msg := <-client.send:
+			var page HistoryPage
+			if err := json.Unmarshal(msg, &page); err != nil {
+				t.Fatalf("Failed to unmarshal history page: %v", err)
+			}
+			return page
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Client should receive a history page")
+		}
+		return HistoryPage{}
+	}
+
+	// The page size is capped and the channel defaults to the current one
+	client.sendHistoryPage(HistoryRequest{Type: "history_request", Limit: 1000})
+	page := readPage()
+	if page.Type != "history_page" || page.Channel != "archive" {
+		t.Errorf("Unexpected page header: %+v", page)
+	}
+	if len(page.Messages) != maxHistoryPageSize || !page.HasMore {
+		t.Fatalf("Expected %d messages with more, got %d (has_more=%v)", maxHistoryPageSize, len(page.Messages), page.HasMore)
+	}
+
+	client.sendHistoryPage(HistoryRequest{Type: "history_request", BeforeID: page.Messages[0].ID})
+	older := readPage()
+	if len(older.Messages) != 5 || older.HasMore {
+		t.Errorf("Expected final 5 messages without more, got %d (has_more=%v)", len(older.Messages), older.HasMore)
+	}
+	if older.Messages[4].ID >= page.Messages[0].ID {
+		t.Errorf("Expected older page to precede the cursor")
+	}
+
+	// Channels without history return an empty list rather than null
+	client.sendHistoryPage(HistoryRequest{Type: "history_request", Channel: "nowhere"})
+	if empty := readPage(); empty.Messages == nil || len(empty.Messages) != 0 || empty.HasMore {
+		t.Errorf("Expected empty page, got %+v", empty)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Broker fans events out between EchoRoom nodes sharing the same backend.
+// Publish delivers to every subscriber, including the publishing node;
+// hubs ignore their own events by Origin.
+type Broker interface {
+	Publish(event ClusterEvent) error
+	Subscribe(handler func(ClusterEvent)) error
+	Close() error
+}
+
+const (
+	eventChannelMessage = "channel_message"   // Payload goes to members of Channel
+	eventHubBroadcast   = "hub_broadcast"     // Payload goes to every connected client
+	eventUserMessage    = "user_message"      // Payload goes to the clients of Users
+	eventPresence       = "presence"          // Count and Users are the origin's members of Channel
+	eventPresenceSync   = "presence_snapshot" // Members and ChannelUsers are the origin's full member maps
+	eventSyncRequest    = "sync_request"      // Asks every node for a presence snapshot
+	eventUserStatus     = "user_status"       // Presence is a user's status on the origin
+	eventChannelRelay   = "channel_relay"     // Payload goes to members of Channel except Except's clients
+	eventKick           = "kick"              // Users' clients get Payload, if any, and leave Channel, or disconnect if it is empty
+	eventWebhooksChange = "webhooks_changed"  // Outgoing webhooks were created or deleted
+)
+
+type ClusterEvent struct {
+	Origin  string          `json:"origin"`
+	Kind    string          `json:"kind"`
+	Channel string          `json:"channel,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Count   int             `json:"count,omitempty"`
+	Members map[string]int  `json:"members,omitempty"`
+	Users   []string        `json:"users,omitempty"`
+
+	ChannelUsers map[string][]string `json:"channel_users,omitempty"`
+	Presence     *Presence           `json:"presence,omitempty"`
+	Except       string              `json:"except,omitempty"`
+}
+
+// clusterHeartbeat is how often each node republishes its presence snapshot.
+// Nodes silent for three heartbeats are forgotten.
+var clusterHeartbeat = 10 * time.Second
+
+// initBroker builds the Broker selected by CLUSTER_BROKER. An empty value
+// runs a single standalone node.
+func initBroker() (Broker, error) {
+	switch driver := getEnv("CLUSTER_BROKER", ""); driver {
+	case "":
+		return nil, nil
+	case "postgres":
+		return newPostgresBroker(connectionString(getDefaultDBConfig()))
+	default:
+		return nil, fmt.Errorf("unknown CLUSTER_BROKER %q", driver)
+	}
+}
+
+func defaultNodeID() string {
+	if id := getEnv("NODE_ID", ""); id != "" {
+		return id
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "node"
+	}
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()%100000)
+}
+
+// useBroker joins the hub to a cluster. It must be called before run.
+func (h *Hub) useBroker(broker Broker) error {
+	h.broker = broker
+	h.remoteMembers = make(map[string]map[string]int)
+	h.remoteUsers = make(map[string]map[string][]string)
+	h.remoteSeen = make(map[string]time.Time)
+	h.clusterDone = make(chan struct{})
+
+	if err := broker.Subscribe(h.handleClusterEvent); err != nil {
+		return err
+	}
+
+	// Learn who is already connected elsewhere and announce ourselves
+	h.publish(ClusterEvent{Kind: eventSyncRequest})
+	go h.clusterHeartbeat()
+	log.Printf("Node '%s' joined the cluster", h.nodeID)
+	return nil
+}
+
+var errNotDelivered = errors.New("message could not be delivered to other nodes")
+
+// publish sends event to the other nodes. Failures are logged and reported
+// as errNotDelivered, for callers whose senders should know.
+func (h *Hub) publish(event ClusterEvent) error {
+	if h.broker == nil {
+		return nil
+	}
+	event.Origin = h.nodeID
+	if err := h.broker.Publish(event); err != nil {
+		log.Printf("Error publishing %s event: %v", event.Kind, err)
+		return errNotDelivered
+	}
+	return nil
+}
+
+// broadcastToChannel delivers msg to the channel's local members and to its
+// members on other nodes. The error reports that other nodes were missed.
+func (h *Hub) broadcastToChannel(channel *Channel, msg []byte) error {
+	channel.broadcast <- msg
+	return h.publish(ClusterEvent{Kind: eventChannelMessage, Channel: channel.name, Payload: msg})
+}
+
+// broadcastToChannelName is broadcastToChannel for a channel that may have
+// no members on this node.
+func (h *Hub) broadcastToChannelName(channelName string, msg []byte) error {
+	h.channelsMu.RLock()
+	channel, ok := h.channels[channelName]
+	h.channelsMu.RUnlock()
+	if ok {
+		channel.broadcast <- msg
+	}
+	return h.publish(ClusterEvent{Kind: eventChannelMessage, Channel: channelName, Payload: msg})
+}
+
+// broadcastToAll queues msg for every client on every node.
+func (h *Hub) broadcastToAll(msg []byte) {
+	select {
+	case h.broadcast <- msg:
+	default:
+		// Hub broadcast channel is full, skip
+	}
+	h.publish(ClusterEvent{Kind: eventHubBroadcast, Payload: msg})
+}
+
+// deliverToAll sends msg to every local client except one, skipping clients
+// whose send buffer is full.
+func (h *Hub) deliverToAll(msg []byte, except *Client) {
+	sent := map[*Client]bool{except: true}
+	h.channelsMu.RLock()
+	defer h.channelsMu.RUnlock()
+	for _, ch := range h.channels {
+		ch.clientsMu.RLock()
+		for c := range ch.clients {
+			if !sent[c] {
+				sent[c] = true
+				select {
+				case c.send <- msg:
+				default:
+					// Client's send channel is full, skip
+				}
+			}
+		}
+		ch.clientsMu.RUnlock()
+	}
+}
+
+// relayToChannel sends msg to a channel's members on every node except the
+// connections of one user. It bypasses the channel's broadcast queue and
+// skips clients whose send buffer is full, so it suits frequent,
+// disposable events.
+func (h *Hub) relayToChannel(channelName string, msg []byte, except string) {
+	h.deliverToChannel(channelName, msg, except)
+	h.publish(ClusterEvent{Kind: eventChannelRelay, Channel: channelName, Payload: msg, Except: except})
+}
+
+// deliverToChannel sends msg to a channel's local members except the
+// connections of one user, skipping clients whose send buffer is full.
+func (h *Hub) deliverToChannel(channelName string, msg []byte, except string) {
+	h.channelsMu.RLock()
+	channel, ok := h.channels[channelName]
+	h.channelsMu.RUnlock()
+	if !ok {
+		return
+	}
+
+	channel.clientsMu.RLock()
+	defer channel.clientsMu.RUnlock()
+	for c := range channel.clients {
+		if c.username == except {
+			continue
+		}
+		select {
+		case c.send <- msg:
+		default:
+			// Client's send channel is full, skip
+		}
+	}
+}
+
+// publishPresence announces this node's member count and users for a
+// channel.
+func (h *Hub) publishPresence(channelName string, count int) {
+	if h.broker == nil {
+		return
+	}
+	h.channelsMu.RLock()
+	channel, ok := h.channels[channelName]
+	h.channelsMu.RUnlock()
+	var users []string
+	if ok {
+		users = channel.usernames()
+	}
+	h.publish(ClusterEvent{Kind: eventPresence, Channel: channelName, Count: count, Users: users})
+}
+
+// publishSnapshot announces this node's full member maps.
+func (h *Hub) publishSnapshot() {
+	h.publish(ClusterEvent{Kind: eventPresenceSync, Members: h.localPresence(), ChannelUsers: h.localUsers()})
+}
+
+// localMemberCount returns how many clients this node has in a channel.
+func (h *Hub) localMemberCount(channelName string) int {
+	h.channelsMu.RLock()
+	channel, ok := h.channels[channelName]
+	h.channelsMu.RUnlock()
+	if !ok {
+		return 0
+	}
+	channel.clientsMu.RLock()
+	defer channel.clientsMu.RUnlock()
+	return len(channel.clients)
+}
+
+// remoteMemberCount returns how many clients other nodes have in a channel.
+func (h *Hub) remoteMemberCount(channelName string) int {
+	if h.broker == nil {
+		return 0
+	}
+	h.remoteMu.RLock()
+	defer h.remoteMu.RUnlock()
+	total := 0
+	for _, count := range h.remoteMembers[channelName] {
+		total += count
+	}
+	return total
+}
+
+// remoteUsernames returns the users other nodes have in a channel.
+func (h *Hub) remoteUsernames(channelName string) []string {
+	if h.broker == nil {
+		return nil
+	}
+	h.remoteMu.RLock()
+	defer h.remoteMu.RUnlock()
+	var usernames []string
+	for _, users := range h.remoteUsers[channelName] {
+		usernames = append(usernames, users...)
+	}
+	return usernames
+}
+
+// remoteChannels returns channels that have members on other nodes. Direct
+// channels are left out; members learn about those from the store.
+func (h *Hub) remoteChannels() []string {
+	if h.broker == nil {
+		return nil
+	}
+	h.remoteMu.RLock()
+	defer h.remoteMu.RUnlock()
+	names := make([]string, 0, len(h.remoteMembers))
+	for name := range h.remoteMembers {
+		if isDirectChannelName(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func (h *Hub) localPresence() map[string]int {
+	h.channelsMu.RLock()
+	defer h.channelsMu.RUnlock()
+	members := make(map[string]int, len(h.channels))
+	for name, channel := range h.channels {
+		channel.clientsMu.RLock()
+		if count := len(channel.clients); count > 0 {
+			members[name] = count
+		}
+		channel.clientsMu.RUnlock()
+	}
+	return members
+}
+
+// localUsers maps each channel with members on this node to their
+// usernames, each listed once.
+func (h *Hub) localUsers() map[string][]string {
+	h.channelsMu.RLock()
+	defer h.channelsMu.RUnlock()
+	users := make(map[string][]string, len(h.channels))
+	for name, channel := range h.channels {
+		if usernames := channel.usernames(); len(usernames) > 0 {
+			users[name] = usernames
+		}
+	}
+	return users
+}
+
+func (h *Hub) setRemotePresence(node, channelName string, count int, users []string) {
+	nodes, ok := h.remoteMembers[channelName]
+	if count <= 0 {
+		if ok {
+			delete(nodes, node)
+			if len(nodes) == 0 {
+				delete(h.remoteMembers, channelName)
+			}
+		}
+		if nodeUsers, ok := h.remoteUsers[channelName]; ok {
+			delete(nodeUsers, node)
+			if len(nodeUsers) == 0 {
+				delete(h.remoteUsers, channelName)
+			}
+		}
+		return
+	}
+	if !ok {
+		nodes = make(map[string]int)
+		h.remoteMembers[channelName] = nodes
+	}
+	nodes[node] = count
+	if _, ok := h.remoteUsers[channelName]; !ok {
+		h.remoteUsers[channelName] = make(map[string][]string)
+	}
+	h.remoteUsers[channelName][node] = users
+}
+
+// forgetNode drops all presence recorded for a node. Callers hold remoteMu.
+func (h *Hub) forgetNode(node string) {
+	for channelName := range h.remoteMembers {
+		h.setRemotePresence(node, channelName, 0, nil)
+	}
+	delete(h.remoteSeen, node)
+}
+
+func (h *Hub) handleClusterEvent(event ClusterEvent) {
+	if event.Origin == h.nodeID {
+		return
+	}
+
+	h.remoteMu.Lock()
+	h.remoteSeen[event.Origin] = time.Now()
+	h.remoteMu.Unlock()
+
+	switch event.Kind {
+	case eventChannelMessage:
+		h.channelsMu.RLock()
+		channel, ok := h.channels[event.Channel]
+		h.channelsMu.RUnlock()
+		if ok {
+			select {
+			case channel.broadcast <- event.Payload:
+			case <-h.clusterDone:
+			}
+		}
+	case eventHubBroadcast:
+		h.deliverToAll(event.Payload, nil)
+	case eventUserMessage:
+		h.deliverToUsers(event.Payload, event.Users)
+	case eventChannelRelay:
+		h.deliverToChannel(event.Channel, event.Payload, event.Except)
+	case eventKick:
+		for _, username := range event.Users {
+			h.ejectLocal(event.Channel, username, event.Payload)
+		}
+	case eventPresence:
+		h.remoteMu.Lock()
+		h.setRemotePresence(event.Origin, event.Channel, event.Count, event.Users)
+		h.remoteMu.Unlock()
+	case eventPresenceSync:
+		h.remoteMu.Lock()
+		h.forgetNode(event.Origin)
+		for channelName, count := range event.Members {
+			h.setRemotePresence(event.Origin, channelName, count, event.ChannelUsers[channelName])
+		}
+		if len(event.Members) > 0 {
+			h.remoteSeen[event.Origin] = time.Now()
+		}
+		h.remoteMu.Unlock()
+	case eventSyncRequest:
+		h.publishSnapshot()
+	case eventUserStatus:
+		if event.Presence != nil {
+			h.setRemoteStatus(*event.Presence)
+		}
+	case eventWebhooksChange:
+		h.invalidateOutgoingWebhooks()
+	}
+}
+
+// clusterHeartbeat republishes local presence and expires silent nodes.
+func (h *Hub) clusterHeartbeat() {
+	ticker := time.NewTicker(clusterHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.clusterDone:
+			return
+		case <-ticker.C:
+			h.publishSnapshot()
+
+			h.remoteMu.Lock()
+			for node, seen := range h.remoteSeen {
+				if time.Since(seen) > 3*clusterHeartbeat {
+					log.Printf("Node '%s' timed out, forgetting its members", node)
+					h.forgetNode(node)
+				}
+			}
+			h.remoteMu.Unlock()
+		}
+	}
+}
+
+// leaveCluster tells other nodes this node's members are gone.
+func (h *Hub) leaveCluster() {
+	if h.broker == nil {
+		return
+	}
+	h.clusterOnce.Do(func() {
+		close(h.clusterDone)
+		h.publish(ClusterEvent{Kind: eventPresenceSync, Members: map[string]int{}})
+	})
+}
+
+// localBroker is an in-process Broker shared by several hubs, used for tests
+// and for running multiple hubs in one process.
+type localBroker struct {
+	mu          sync.Mutex
+	subscribers []*localSubscriber
+	closed      bool
+}
+
+// localSubscriber delivers events in order on its own goroutine so a slow
+// hub never blocks publishers.
+type localSubscriber struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []ClusterEvent
+	closed  bool
+	handler func(ClusterEvent)
+}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{}
+}
+
+func (b *localBroker) Publish(event ClusterEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return fmt.Errorf("broker closed")
+	}
+	for _, sub := range b.subscribers {
+		sub.mu.Lock()
+		sub.queue = append(sub.queue, event)
+		sub.mu.Unlock()
+		sub.cond.Signal()
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(handler func(ClusterEvent)) error {
+	sub := &localSubscriber{handler: handler}
+	sub.cond = sync.NewCond(&sub.mu)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return fmt.Errorf("broker closed")
+	}
+	b.subscribers = append(b.subscribers, sub)
+	go sub.run()
+	return nil
+}
+
+func (s *localSubscriber) run() {
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		event := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		s.handler(event)
+	}
+}
+
+func (b *localBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, sub := range b.subscribers {
+		sub.mu.Lock()
+		sub.closed = true
+		sub.mu.Unlock()
+		sub.cond.Signal()
+	}
+	return nil
+}
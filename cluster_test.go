@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startClusterNode runs a hub joined to broker behind a test server and
+// returns the hub and its WebSocket URL.
+func startClusterNode(t *testing.T, store Store, broker Broker, secret []byte) (*Hub, string) {
+	t.Helper()
+
+	hub := newHub(store)
+	hub.auth = newAuthenticator(store, secret, time.Hour)
+	if err := hub.useBroker(broker); err != nil {
+		t.Fatalf("Failed to join cluster: %v", err)
+	}
+	go hub.run()
+	t.Cleanup(hub.stop)
+
+	return hub, startTestServer(t, hub)
+}
+
+func TestClusterChannelMessageFanOut(t *testing.T) {
+	store := newMemoryStore()
+	broker := newLocalBroker()
+	defer broker.Close()
+	secret := []byte("cluster-secret")
+
+	hubA, urlA := startClusterNode(t, store, broker, secret)
+	hubB, urlB := startClusterNode(t, store, broker, secret)
+
+	alice := dialTestClient(t, hubA, urlA, "alice")
+	bob := dialTestClient(t, hubB, urlB, "bob")
+
+	waitFor(t, "presence to propagate", func() bool {
+		return hubA.remoteMemberCount("general") == 1 && hubB.remoteMemberCount("general") == 1
+	})
+
+	sendJSON(t, alice, Message{Type: "message", Content: "hello from node A"})
+
+	msg := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	if msg["content"] != "hello from node A" || msg["username"] != "alice" {
+		t.Errorf("Unexpected message on node B: %v", msg)
+	}
+}
+
+func TestClusterChannelLifecycle(t *testing.T) {
+	store := newMemoryStore()
+	broker := newLocalBroker()
+	defer broker.Close()
+	secret := []byte("cluster-secret")
+
+	hubA, urlA := startClusterNode(t, store, broker, secret)
+	hubB, urlB := startClusterNode(t, store, broker, secret)
+
+	alice := dialTestClient(t, hubA, urlA, "alice")
+	bob := dialTestClient(t, hubB, urlB, "bob")
+
+	// Creating an ephemeral channel on node A is announced on node B
+	sendJSON(t, alice, map[string]string{"type": "create_channel", "name": "ops", "channel_type": "ephemeral"})
+	readUntil(t, bob, func(msg map[string]interface{}) bool {
+		return msg["type"] == "channel_created" && msg["name"] == "ops"
+	})
+	waitFor(t, "ops presence on node B", func() bool { return hubB.remoteMemberCount("ops") == 1 })
+
+	// Joining it on node B does not announce it again
+	sendJSON(t, bob, Message{Type: "join_channel", Channel: "ops"})
+	readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" })
+	waitFor(t, "ops presence on node A", func() bool { return hubA.remoteMemberCount("ops") == 1 })
+
+	// Alice leaving keeps the channel alive because Bob is still in it
+	sendJSON(t, alice, Message{Type: "join_channel", Channel: "general"})
+	expectNone(t, bob, 200*time.Millisecond, func(msg map[string]interface{}) bool {
+		return msg["type"] == "channel_deleted"
+	})
+
+	// When Bob leaves too, the channel is deleted everywhere
+	sendJSON(t, bob, Message{Type: "join_channel", Channel: "general"})
+	readUntil(t, alice, func(msg map[string]interface{}) bool {
+		return msg["type"] == "channel_deleted" && msg["content"] == "ops"
+	})
+}
+
+func TestClusterActiveChannelsIncludeRemoteChannels(t *testing.T) {
+	store := newMemoryStore()
+	broker := newLocalBroker()
+	defer broker.Close()
+	secret := []byte("cluster-secret")
+
+	hubA, urlA := startClusterNode(t, store, broker, secret)
+	hubB, urlB := startClusterNode(t, store, broker, secret)
+
+	alice := dialTestClient(t, hubA, urlA, "alice")
+	sendJSON(t, alice, map[string]string{"type": "create_channel", "name": "remote-only", "channel_type": "ephemeral"})
+	waitFor(t, "remote presence", func() bool { return hubB.remoteMemberCount("remote-only") == 1 })
+
+	conn, _, err := websocket.DefaultDialer.Dial(urlB, authHeader(t, hubB, "bob"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	msg := readUntil(t, conn, func(msg map[string]interface{}) bool { return msg["type"] == "active_channels" })
+	found := false
+	for _, ch := range msg["channels"].([]interface{}) {
+		if ch.(map[string]interface{})["name"] == "remote-only" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected remote-only channel in active channels, got %v", msg["channels"])
+	}
+}
+
+func TestClusterPresenceExpires(t *testing.T) {
+	broker := newLocalBroker()
+	defer broker.Close()
+
+	hub := newHub(newMemoryStore())
+	if err := hub.useBroker(broker); err != nil {
+		t.Fatalf("Failed to join cluster: %v", err)
+	}
+	defer hub.stop()
+
+	hub.handleClusterEvent(ClusterEvent{Origin: "other", Kind: eventPresenceSync, Members: map[string]int{"a": 2, "b": 1}})
+	if hub.remoteMemberCount("a") != 2 || hub.remoteMemberCount("b") != 1 {
+		t.Fatalf("Expected snapshot to be recorded")
+	}
+
+	// A newer snapshot replaces the old one
+	hub.handleClusterEvent(ClusterEvent{Origin: "other", Kind: eventPresenceSync, Members: map[string]int{"a": 1}})
+	if hub.remoteMemberCount("a") != 1 || hub.remoteMemberCount("b") != 0 {
+		t.Errorf("Expected snapshot to replace previous presence")
+	}
+
+	hub.handleClusterEvent(ClusterEvent{Origin: "other", Kind: eventPresence, Channel: "a", Count: 0})
+	if hub.remoteMemberCount("a") != 0 {
+		t.Errorf("Expected presence update to clear channel")
+	}
+
+	// Stopping a node clears its members elsewhere
+	other := newHub(newMemoryStore())
+	if err := other.useBroker(broker); err != nil {
+		t.Fatalf("Failed to join cluster: %v", err)
+	}
+	other.publishPresence("c", 3)
+	waitFor(t, "presence from other node", func() bool { return hub.remoteMemberCount("c") == 3 })
+	other.stop()
+	waitFor(t, "node departure", func() bool { return hub.remoteMemberCount("c") == 0 })
+}
+
+// failingBroker accepts subscribers but fails every publish, like a
+// broker whose database is unreachable.
+type failingBroker struct{}
+
+func (failingBroker) Publish(event ClusterEvent) error {
+	return errors.New("broker unavailable")
+}
+func (failingBroker) Subscribe(handler func(ClusterEvent)) error { return nil }
+func (failingBroker) Close() error                               { return nil }
+
+func TestClusterPublishFailure(t *testing.T) {
+	store := newMemoryStore()
+	hub := newHub(store)
+	if err := hub.useBroker(failingBroker{}); err != nil {
+		t.Fatalf("Failed to join cluster: %v", err)
+	}
+	defer hub.stop()
+	if err := store.CreateChannel("team", Persistent); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+
+	// Stored messages, replies and edits succeed; other nodes' users find
+	// them in history
+	posted, _, err := hub.postMessage(Message{Username: "alice", Content: "hello", Channel: "team"})
+	if err != nil {
+		t.Fatalf("Expected the stored message to be posted, got %v", err)
+	}
+	if _, err := store.GetMessage(posted.ID); err != nil {
+		t.Errorf("Expected the message to be stored, got %v", err)
+	}
+	if _, err := hub.postReply("alice", posted.ID, "reply"); err != nil {
+		t.Errorf("Expected the stored reply to be posted, got %v", err)
+	}
+	if err := hub.editMessage("alice", posted.ID, "edited"); err != nil {
+		t.Errorf("Expected the edit to succeed, got %v", err)
+	}
+
+	// An ephemeral message exists only in the broadcast, so its sender learns
+	// other nodes missed it
+	channel := newChannel("lobby", Ephemeral)
+	shutdown := make(chan bool)
+	defer func() { shutdown <- true }()
+	go channel.run(shutdown)
+	hub.channelsMu.Lock()
+	hub.channels["lobby"] = channel
+	hub.channelsMu.Unlock()
+	if _, _, err := hub.postMessage(Message{Username: "alice", Content: "hello", Channel: "lobby"}); !errors.Is(err, errNotDelivered) || errorCode(err) != errorUnavailable {
+		t.Errorf("Expected errNotDelivered, got %v", err)
+	}
+}
+
+func TestPostgresBrokerLargeEvents(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	broker, err := newPostgresBroker(testConnectionString())
+	if err != nil {
+		t.Skipf("Skipping broker test: %v", err)
+	}
+	defer broker.Close()
+
+	received := make(chan ClusterEvent, 1)
+	if err := broker.Subscribe(func(event ClusterEvent) { received <- event }); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	// Events over the NOTIFY limit go through cluster_events
+	payload, _ := json.Marshal(Message{Content: strings.Repeat("x", 2*maxNotifyPayload)})
+	if err := broker.Publish(ClusterEvent{Origin: "a", Kind: eventChannelMessage, Channel: "team", Payload: payload}); err != nil {
+		t.Fatalf("Failed to publish a large event: %v", err)
+	}
+	select {
+	case event := <-received:
+		if event.Channel != "team" || string(event.Payload) != string(payload) {
+			t.Errorf("Unexpected event: %s %s", event.Kind, event.Channel)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the large event")
+	}
+}
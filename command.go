@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Messages starting with "/" run slash commands on the server instead of
+// being posted. A message starting with "//" is posted with one slash.
+
+// Limits on what commands set.
+const (
+	maxTopicLength = 250
+	maxNickLength  = 32
+)
+
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var (
+	errInvalidCommandName = errors.New("command names are 1-32 lowercase letters, digits, '_' or '-'")
+	errCommandExists      = errors.New("command already registered")
+	errTopicTooLong       = fmt.Errorf("topic must be at most %d characters", maxTopicLength)
+	errInvalidNick        = fmt.Errorf("nick must be at most %d characters, without control characters", maxNickLength)
+	errNickTaken          = errors.New("nick is another user's name")
+)
+
+// CommandHandler runs a slash command. An error rejects the command like
+// any other, with an error frame.
+type CommandHandler func(cmd *CommandContext) error
+
+// Command is a slash command. Name is used without the slash; Usage
+// describes its arguments for /help.
+type Command struct {
+	Name        string
+	Usage       string
+	Description string
+	Handler     CommandHandler
+
+	bot string // the bot that registered the command, if any
+}
+
+// CommandContext is one run of a slash command: who ran it, in which
+// channel, and with what arguments. Its methods reply as the command's bot,
+// or as System for built-in commands.
+type CommandContext struct {
+	Name     string
+	Args     string // the rest of the line, trimmed
+	Username string
+	Channel  string
+
+	hub         *Hub
+	client      *Client
+	ack         *Ack
+	clientMsgID string
+	bot         string
+}
+
+// parseSlashCommand splits a message into a command name and arguments. It
+// reports false for messages that are not commands.
+func parseSlashCommand(content string) (name, args string, ok bool) {
+	if !strings.HasPrefix(content, "/") || strings.HasPrefix(content, "//") {
+		return "", "", false
+	}
+	name, args, _ = strings.Cut(content[1:], " ")
+	return strings.ToLower(name), strings.TrimSpace(args), true
+}
+
+// registerCommand adds a slash command. Names are unique across built-in
+// and bot commands.
+func (h *Hub) registerCommand(cmd Command) error {
+	h.commandsMu.Lock()
+	defer h.commandsMu.Unlock()
+	return h.registerCommandLocked(cmd)
+}
+
+func (h *Hub) registerCommandLocked(cmd Command) error {
+	if !commandNamePattern.MatchString(cmd.Name) || cmd.Handler == nil {
+		return errInvalidCommandName
+	}
+	if _, exists := h.commands[cmd.Name]; exists {
+		return fmt.Errorf("/%s: %w", cmd.Name, errCommandExists)
+	}
+	h.commands[cmd.Name] = cmd
+	return nil
+}
+
+func (h *Hub) lookupCommand(name string) (Command, bool) {
+	h.commandsMu.RLock()
+	defer h.commandsMu.RUnlock()
+	cmd, ok := h.commands[name]
+	return cmd, ok
+}
+
+// listCommands returns every slash command ordered by name.
+func (h *Hub) listCommands() []Command {
+	h.commandsMu.RLock()
+	defer h.commandsMu.RUnlock()
+	commands := make([]Command, 0, len(h.commands))
+	for _, cmd := range h.commands {
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// runSlashCommand runs the command in a message the client sent to a
+// channel.
+func (c *Client) runSlashCommand(message Message, ack *Ack) error {
+	name, args, _ := parseSlashCommand(message.Content)
+	cmd, ok := c.hub.lookupCommand(name)
+	if !ok {
+		return newCommandError(errorUnknownCommand, fmt.Sprintf("unknown command /%s, try /help", name))
+	}
+	// A client taken out of the channel may only join it again
+	if name != "join" && c.wasRemoved(message.Channel) {
+		return errRemovedFromChannel
+	}
+	log.Printf("Client %s ran /%s in channel '%s'", c.username, name, message.Channel)
+	// The ack settles the client's pending message like a posted one
+	ack.ClientMsgID = message.ClientMsgID
+	return cmd.Handler(&CommandContext{
+		Name:        name,
+		Args:        args,
+		Username:    c.username,
+		Channel:     message.Channel,
+		hub:         c.hub,
+		client:      c,
+		ack:         ack,
+		clientMsgID: message.ClientMsgID,
+		bot:         cmd.bot,
+	})
+}
+
+func (cmd *CommandContext) from() string {
+	if cmd.bot != "" {
+		return cmd.bot
+	}
+	return "System"
+}
+
+// ReplyPrivately shows text only to the connection that ran the command.
+func (cmd *CommandContext) ReplyPrivately(text string) {
+	cmd.client.sendFrame(Message{
+		Username:  cmd.from(),
+		Content:   text,
+		Type:      "command_reply",
+		Channel:   cmd.Channel,
+		Timestamp: time.Now().UTC(),
+	})
+}
+
+// Reply posts text to the channel, where everyone sees it. Replies are
+// refused where the user who ran the command may not post, or the bot is
+// muted.
+func (cmd *CommandContext) Reply(text string) error {
+	if cmd.client.wasRemoved(cmd.Channel) {
+		return errRemovedFromChannel
+	}
+	if err := cmd.hub.checkCanPost(cmd.Username, cmd.Channel); err != nil {
+		return err
+	}
+	if err := cmd.hub.sanctionError(cmd.from(), cmd.Channel, permPost); err != nil {
+		return err
+	}
+	_, _, err := cmd.hub.postMessage(Message{Username: cmd.from(), Content: text, Channel: cmd.Channel})
+	return err
+}
+
+// postAsUser posts content to the channel as the user who ran the command,
+// acknowledged like the message that carried the command.
+func (cmd *CommandContext) postAsUser(content string) error {
+	return cmd.client.post(Message{
+		Username:    cmd.Username,
+		DisplayName: cmd.hub.nickOf(cmd.Username),
+		Content:     content,
+		Channel:     cmd.Channel,
+		ClientMsgID: cmd.clientMsgID,
+	}, cmd.ack)
+}
+
+// usageError rejects a command run with the wrong arguments.
+func (cmd *CommandContext) usageError(usage string) error {
+	return newCommandError(errorInvalidArgument, fmt.Sprintf("usage: /%s %s", cmd.Name, usage))
+}
+
+func (h *Hub) registerBuiltinCommands() {
+	for _, cmd := range []Command{
+		{Name: "ban", Usage: "<user> <duration> [reason]", Description: "Ban a user from the channel for a while, like 24h", Handler: runModeration},
+		{Name: "grant", Usage: "<user> <role>", Description: "Give a user a role: moderator, member, read-only, or owner to hand the channel over", Handler: runGrant},
+		{Name: "help", Description: "List the available commands", Handler: runHelp},
+		{Name: "invite", Usage: "[user]", Description: "Invite a user into the channel, or get an invite link", Handler: runInvite},
+		{Name: "join", Usage: "<channel>", Description: "Switch to a channel", Handler: runJoin},
+		{Name: "kick", Usage: "<user> [reason]", Description: "Remove a user from the channel", Handler: runModeration},
+		{Name: "me", Usage: "<action>", Description: "Post an action, like \"/me waves\"", Handler: runMe},
+		{Name: "mute", Usage: "<user> <duration> [reason]", Description: "Stop a user posting in the channel for a while, like 10m", Handler: runModeration},
+		{Name: "nick", Usage: "[name]", Description: "Set the name shown on your messages, or clear it", Handler: runNick},
+		{Name: "revoke", Usage: "<user>", Description: "Take a user's role away", Handler: runRevoke},
+		{Name: "slowmode", Usage: "<duration | off>", Description: "Make users wait between messages in the channel, like 30s", Handler: runSlowMode},
+		{Name: "topic", Usage: "[topic | -]", Description: "Show or set the channel's topic; - clears it", Handler: runTopic},
+		{Name: "unban", Usage: "<user>", Description: "Lift a user's ban from the channel", Handler: runModeration},
+		{Name: "unmute", Usage: "<user>", Description: "Lift a user's mute in the channel", Handler: runModeration},
+		{Name: "who", Description: "List who is in the channel", Handler: runWho},
+	} {
+		if err := h.registerCommand(cmd); err != nil {
+			log.Fatalf("Failed to register /%s: %v", cmd.Name, err)
+		}
+	}
+}
+
+func runGrant(cmd *CommandContext) error {
+	fields := strings.Fields(cmd.Args)
+	if len(fields) != 2 {
+		return cmd.usageError("<user> <role>")
+	}
+	return cmd.hub.grantRole(cmd.Username, cmd.Channel, fields[0], fields[1])
+}
+
+func runRevoke(cmd *CommandContext) error {
+	fields := strings.Fields(cmd.Args)
+	if len(fields) != 1 {
+		return cmd.usageError("<user>")
+	}
+	return cmd.hub.revokeRole(cmd.Username, cmd.Channel, fields[0])
+}
+
+// runInvite invites a user like the invite command, or sends the user an
+// invite_created frame with a link valid for defaultInviteTTL.
+func runInvite(cmd *CommandContext) error {
+	fields := strings.Fields(cmd.Args)
+	if len(fields) > 1 {
+		return cmd.usageError("[user]")
+	}
+	req := InviteRequest{Channel: cmd.Channel}
+	if len(fields) == 1 {
+		req.Username = fields[0]
+	}
+	return cmd.client.handleInvite(req)
+}
+
+// runModeration runs /kick, /mute, /unmute, /ban and /unban in the
+// channel, like the commands of the same names. Durations are written like
+// 10m or 24h.
+func runModeration(cmd *CommandContext) error {
+	fields := strings.Fields(cmd.Args)
+	req := ModerationRequest{Channel: cmd.Channel}
+	switch cmd.Name {
+	case actionMute, actionBan:
+		if len(fields) < 2 {
+			return cmd.usageError("<user> <duration> [reason]")
+		}
+		duration, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return cmd.usageError("<user> <duration> [reason]")
+		}
+		req.Duration = int(duration.Seconds())
+		req.Reason = strings.Join(fields[2:], " ")
+	case actionKick:
+		if len(fields) < 1 {
+			return cmd.usageError("<user> [reason]")
+		}
+		req.Reason = strings.Join(fields[1:], " ")
+	default:
+		if len(fields) != 1 {
+			return cmd.usageError("<user>")
+		}
+	}
+	req.Username = fields[0]
+	return cmd.hub.moderate(cmd.Username, cmd.Name, req)
+}
+
+// runSlowMode sets the channel's slow mode, written like 30s, or turns it
+// off.
+func runSlowMode(cmd *CommandContext) error {
+	if cmd.Args == "off" {
+		return cmd.hub.setSlowMode(cmd.Username, cmd.Channel, 0)
+	}
+	interval, err := time.ParseDuration(cmd.Args)
+	if err != nil {
+		return cmd.usageError("<duration | off>")
+	}
+	return cmd.hub.setSlowMode(cmd.Username, cmd.Channel, int(interval.Seconds()))
+}
+
+func runHelp(cmd *CommandContext) error {
+	var lines []string
+	for _, c := range cmd.hub.listCommands() {
+		line := "/" + c.Name
+		if c.Usage != "" {
+			line += " " + c.Usage
+		}
+		lines = append(lines, line+" - "+c.Description)
+	}
+	cmd.ReplyPrivately("Commands:\n" + strings.Join(lines, "\n"))
+	return nil
+}
+
+func runJoin(cmd *CommandContext) error {
+	channelName := strings.TrimPrefix(cmd.Args, "#")
+	if channelName == "" || strings.ContainsAny(channelName, " \t") {
+		return cmd.usageError("<channel>")
+	}
+	return cmd.client.switchChannel(channelName)
+}
+
+// runMe posts the action as typed, "/me waves"; clients show it as an
+// action by its author.
+func runMe(cmd *CommandContext) error {
+	if cmd.Args == "" {
+		return cmd.usageError("<action>")
+	}
+	return cmd.postAsUser("/me " + cmd.Args)
+}
+
+func runNick(cmd *CommandContext) error {
+	if err := cmd.hub.setNick(cmd.Username, cmd.Args); err != nil {
+		return err
+	}
+	if cmd.Args == "" {
+		cmd.ReplyPrivately("Your nick is cleared")
+	} else {
+		cmd.ReplyPrivately("Your nick is now " + cmd.Args)
+	}
+	return nil
+}
+
+func runTopic(cmd *CommandContext) error {
+	if cmd.Args == "" {
+		topic, err := cmd.hub.channelTopic(cmd.Channel)
+		if err != nil {
+			return err
+		}
+		if topic == "" {
+			cmd.ReplyPrivately("#" + cmd.Channel + " has no topic")
+		} else {
+			cmd.ReplyPrivately("Topic for #" + cmd.Channel + ": " + topic)
+		}
+		return nil
+	}
+	topic := cmd.Args
+	if topic == "-" {
+		topic = ""
+	}
+	return cmd.hub.setChannelTopic(cmd.Username, cmd.Channel, topic)
+}
+
+func runWho(cmd *CommandContext) error {
+	members := cmd.hub.channelMembers(cmd.Channel)
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		name := member.Username
+		switch {
+		case member.Bot:
+			name += " (bot)"
+		case member.Status != statusOnline:
+			name += " (" + member.Status + ")"
+		}
+		if member.Role != "" && member.Role != roleMember {
+			name += " [" + member.Role + "]"
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		cmd.ReplyPrivately("Nobody is in #" + cmd.Channel)
+		return nil
+	}
+	cmd.ReplyPrivately(fmt.Sprintf("In #%s (%d): %s", cmd.Channel, len(names), strings.Join(names, ", ")))
+	return nil
+}
+
+// channelTopic returns the topic of a stored channel or an active
+// ephemeral one.
+func (h *Hub) channelTopic(channelName string) (string, error) {
+	topic, err := h.store.GetChannelTopic(channelName)
+	if !errors.Is(err, errChannelNotFound) {
+		return topic, err
+	}
+	h.channelsMu.RLock()
+	channel, ok := h.channels[channelName]
+	h.channelsMu.RUnlock()
+	if !ok {
+		return "", errChannelNotFound
+	}
+	channel.clientsMu.RLock()
+	defer channel.clientsMu.RUnlock()
+	return channel.topic, nil
+}
+
+// setChannelTopic changes a channel's topic and tells its members. Ephemeral
+// channels keep their topic while they are active.
+func (h *Hub) setChannelTopic(username, channelName, topic string) error {
+	if len([]rune(topic)) > maxTopicLength {
+		return errTopicTooLong
+	}
+	// Anyone who may post may set the topic of an ephemeral channel
+	if err := h.checkCanPost(username, channelName); err != nil {
+		return err
+	}
+	if channelType, err := h.getChannelType(channelName); err == nil && channelType == Persistent && !h.canManageChannel(username, channelName) {
+		return errNotChannelAdmin
+	}
+	err := h.store.SetChannelTopic(channelName, topic)
+	if errors.Is(err, errChannelNotFound) {
+		h.channelsMu.RLock()
+		channel, ok := h.channels[channelName]
+		h.channelsMu.RUnlock()
+		if ok {
+			channel.clientsMu.Lock()
+			channel.topic = topic
+			channel.clientsMu.Unlock()
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Topic of channel '%s' set by %s", channelName, username)
+
+	update := ChannelTopic{Type: "channel_topic", Channel: channelName, Topic: topic, Username: username}
+	if msgBytes, err := json.Marshal(update); err == nil {
+		h.broadcastToChannelName(channelName, msgBytes)
+	}
+	return nil
+}
+
+// sendChannelTopic tells a client a channel's topic, if it has one.
+func (c *Client) sendChannelTopic(channelName string) {
+	topic, err := c.hub.channelTopic(channelName)
+	if err != nil || topic == "" {
+		return
+	}
+	c.sendFrame(ChannelTopic{Type: "channel_topic", Channel: channelName, Topic: topic})
+}
+
+// setNick changes the name shown on a user's messages; an empty nick
+// clears it. Nicks cannot be another user's or a bot's name.
+func (h *Hub) setNick(username, nick string) error {
+	if len([]rune(nick)) > maxNickLength || strings.IndexFunc(nick, unicode.IsControl) >= 0 {
+		return errInvalidNick
+	}
+	if nick != "" && !strings.EqualFold(nick, username) {
+		if err := h.checkNameFree(nick); err != nil {
+			return err
+		}
+	}
+	h.updatePresence(username, func(up *userPresence) {
+		up.nick = nick
+	})
+	h.announceStatus(username)
+	return nil
+}
+
+// checkNameFree returns errNickTaken if name is the server's, a bot's or a
+// registered user's, so nobody can pose as them.
+func (h *Hub) checkNameFree(name string) error {
+	if strings.EqualFold(name, "System") || h.isBot(name) {
+		return errNickTaken
+	}
+	if _, err := h.store.GetUser(name); err == nil {
+		return errNickTaken
+	} else if !errors.Is(err, errUserNotFound) {
+		return err
+	}
+	return nil
+}
+
+// nickOf returns the name shown on a user's messages, if they set one.
+func (h *Hub) nickOf(username string) string {
+	return h.presenceOf(username).Nick
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSlashCommand(t *testing.T) {
+	tests := []struct {
+		content    string
+		name, args string
+		ok         bool
+	}{
+		{"/me waves", "me", "waves", true},
+		{"/TOPIC  Release on Friday ", "topic", "Release on Friday", true},
+		{"/who", "who", "", true},
+		{"//not a command", "", "", false},
+		{"hello /me", "", "", false},
+	}
+	for _, tt := range tests {
+		name, args, ok := parseSlashCommand(tt.content)
+		if name != tt.name || args != tt.args || ok != tt.ok {
+			t.Errorf("parseSlashCommand(%q) = %q, %q, %v; want %q, %q, %v", tt.content, name, args, ok, tt.name, tt.args, tt.ok)
+		}
+	}
+}
+
+func TestSlashCommands(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	store.CreateUser(User{Username: "carol", PasswordHash: "x", CreatedAt: time.Now().UTC()})
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	isReply := func(msg map[string]interface{}) bool { return msg["type"] == "command_reply" }
+	isError := func(msg map[string]interface{}) bool { return msg["type"] == "error" }
+
+	// Commands are answered, not broadcast
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/help", "request_id": "h1"})
+	if reply := readUntil(t, alice, isReply); !strings.Contains(reply["content"].(string), "/topic [topic | -]") {
+		t.Errorf("Expected /help to list the commands, got %v", reply)
+	}
+	readUntil(t, alice, isAck("h1"))
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/dance", "request_id": "d1"})
+	if frame := readUntil(t, alice, isError); frame["code"] != errorUnknownCommand || frame["request_id"] != "d1" {
+		t.Errorf("Expected unknown_command for /dance, got %v", frame)
+	}
+
+	// A double slash posts the message with one slash; it is the first
+	// thing bob sees
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "//etc/hosts"})
+	if msg := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" || isReply(msg) }); msg["content"] != "/etc/hosts" {
+		t.Errorf("Expected only the escaped message posted, got %v", msg)
+	}
+
+	// /me posts the action as the user and acks it like a message
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/me waves", "request_id": "m1", "client_msg_id": "me-1"})
+	if msg := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" }); msg["content"] != "/me waves" || msg["username"] != "alice" {
+		t.Errorf("Expected alice's action, got %v", msg)
+	}
+	if ack := readUntil(t, alice, isAck("m1")); ack["client_msg_id"] != "me-1" {
+		t.Errorf("Expected the action acked with its client_msg_id, got %v", ack)
+	}
+
+	// /topic sets and shows the channel's topic
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/topic Release on Friday"})
+	if update := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "channel_topic" }); update["topic"] != "Release on Friday" || update["username"] != "alice" {
+		t.Errorf("Expected the new topic announced, got %v", update)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "/topic"})
+	if reply := readUntil(t, bob, isReply); reply["content"] != "Topic for #general: Release on Friday" {
+		t.Errorf("Expected the topic shown, got %v", reply)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/topic " + strings.Repeat("x", maxTopicLength+1)})
+	if frame := readUntil(t, alice, isError); frame["code"] != errorInvalidArgument {
+		t.Errorf("Expected a long topic rejected, got %v", frame)
+	}
+	dialTestClient(t, hub, wsURL, "carol")
+	if channels, _ := hub.listChannels("alice"); len(channels) != 1 || channels[0].Topic != "Release on Friday" {
+		t.Errorf("Expected the ephemeral channel's topic listed, got %+v", channels)
+	}
+
+	// /who lists the channel's members
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "/who"})
+	if reply := readUntil(t, bob, isReply); reply["content"] != "In #general (3): alice, bob, carol" {
+		t.Errorf("Expected everyone in general listed, got %v", reply)
+	}
+
+	// /nick changes the name shown on messages, but not to another user's
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/nick carol", "request_id": "n1"})
+	if frame := readUntil(t, alice, isError); frame["code"] != errorInvalidArgument || frame["request_id"] != "n1" {
+		t.Errorf("Expected carol's name refused, got %v", frame)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/nick Ali"})
+	if update := readUntil(t, bob, func(msg map[string]interface{}) bool {
+		return msg["type"] == "presence_update" && msg["username"] == "alice"
+	}); update["nick"] != "Ali" {
+		t.Errorf("Expected alice's nick announced, got %v", update)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "hi"})
+	if msg := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" }); msg["display_name"] != "Ali" || msg["username"] != "alice" {
+		t.Errorf("Expected the message shown under alice's nick, got %v", msg)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/nick"})
+	waitFor(t, "alice's nick to clear", func() bool { return hub.nickOf("alice") == "" })
+
+	// /join switches channels, and joining a channel tells its topic
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "/join #ops", "request_id": "j1"})
+	if frame := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" }); frame["channel"] != "ops" {
+		t.Errorf("Expected bob switched to ops, got %v", frame)
+	}
+	readUntil(t, bob, isAck("j1"))
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "/topic Incidents only"})
+	readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "channel_topic" })
+	sendJSON(t, alice, map[string]interface{}{"type": "join_channel", "channel": "ops"})
+	if topic := readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "channel_topic" }); topic["channel"] != "ops" || topic["topic"] != "Incidents only" {
+		t.Errorf("Expected the topic sent on joining, got %v", topic)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -27,48 +28,60 @@ func getDefaultDBConfig() *DatabaseConfig {
 	}
 }
 
-func initDatabase() (*sql.DB, error) {
-	config := getDefaultDBConfig()
-
-	// Build PostgreSQL connection string
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+// connectionString builds a lib/pq connection string from config.
+func connectionString(config *DatabaseConfig) string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		config.Host, config.Port, config.User, config.Password, config.DBName, config.SSLMode)
+}
 
-	db, err := sql.Open("postgres", connStr)
+// openDatabase connects to PostgreSQL without touching the schema.
+func openDatabase() (*sql.DB, error) {
+	db, err := sql.Open("postgres", connectionString(getDefaultDBConfig()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %v", err)
 	}
 
 	// Test the connection
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping database: %v", err)
 	}
 
-	// Create channels table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS channels (
-			name VARCHAR(100) PRIMARY KEY,
-			type VARCHAR(20) NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+	return db, nil
+}
+
+func initDatabase() (*sql.DB, error) {
+	config := getDefaultDBConfig()
+
+	db, err := openDatabase()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create channels table: %v", err)
-	}
-
-	// Create messages table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS messages (
-			id SERIAL PRIMARY KEY,
-			channel_name VARCHAR(100) NOT NULL,
-			username VARCHAR(100) NOT NULL,
-			content TEXT NOT NULL,
-			timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (channel_name) REFERENCES channels (name)
-		)
-	`)
+		return nil, err
+	}
+
+	migrations, err := loadMigrations(migrationFiles)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create messages table: %v", err)
+		db.Close()
+		return nil, fmt.Errorf("failed to load migrations: %v", err)
+	}
+
+	if getEnv("DB_AUTO_MIGRATE", "true") == "true" {
+		// migrateUp reads the schema version under the migration lock, so
+		// replicas starting together wait for each other
+		if _, err := migrateUp(db, migrations); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate database: %v", err)
+		}
+	} else {
+		// Refuse to run against a schema written by a newer binary
+		version, err := checkSchemaVersion(db, migrations)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		if version < len(migrations) {
+			db.Close()
+			return nil, fmt.Errorf("database schema is at version %d but %d is required; run `migrate up`", version, len(migrations))
+		}
 	}
 
 	// Note: general channel is ephemeral and not stored in database
@@ -79,62 +92,98 @@ func initDatabase() (*sql.DB, error) {
 	return db, nil
 }
 
-func (h *Hub) saveMessage(msg Message) error {
-	if msg.Type != "message" {
-		return nil // Only save regular messages
+// saveMessage stores a regular message or reply and returns its ID.
+func (h *Hub) saveMessage(msg Message) (int, error) {
+	if msg.Type != "message" && msg.Type != "reply" {
+		return 0, nil // Only save regular messages
 	}
 
-	// This function should only be called for persistent channels
-	_, err := h.db.Exec(`
-		INSERT INTO messages (channel_name, username, content, timestamp) 
-		VALUES ($1, $2, $3, $4)
-	`, msg.Channel, msg.Username, msg.Content, msg.Timestamp)
-
-	return err
+	// This function should only be called for stored channels
+	id, err := h.store.SaveMessage(msg)
+	if err != nil {
+		return 0, err
+	}
+	msg.ID = id
+	h.emitWebhookEvent(eventMessageCreated, msg.Channel, msg)
+	return id, nil
 }
 
-func (h *Hub) getChannelHistory(channelName string, limit int) ([]Message, error) {
-	rows, err := h.db.Query(`
-		SELECT id, username, content, timestamp 
-		FROM messages 
-		WHERE channel_name = $1 
-		ORDER BY timestamp DESC 
-		LIMIT $2
-	`, channelName, limit)
+// saveClientMessage stores msg like saveMessage and returns it with its ID.
+// If the author already sent a message with the same ClientMsgID, nothing is
+// stored and the original message is returned with duplicate set.
+func (h *Hub) saveClientMessage(msg Message) (saved Message, duplicate bool, err error) {
+	if len(msg.ClientMsgID) > maxClientMsgIDLength {
+		return Message{}, false, errInvalidClientMsgID
+	}
+	msg.ID, err = h.saveMessage(msg)
+	if errors.Is(err, errDuplicateMessage) {
+		original, err := h.store.GetMessageByClientID(msg.Username, msg.ClientMsgID)
+		return original, true, err
+	}
 	if err != nil {
-		return nil, err
+		return Message{}, false, err
 	}
-	defer rows.Close()
+	return msg, false, nil
+}
 
-	var messages []Message
-	for rows.Next() {
-		var msg Message
-		err := rows.Scan(&msg.ID, &msg.Username, &msg.Content, &msg.Timestamp)
-		if err != nil {
-			return nil, err
-		}
-		msg.Channel = channelName
-		msg.Type = "message"
-		messages = append([]Message{msg}, messages...) // Reverse order
+func (h *Hub) getChannelHistory(channelName string, limit int) ([]Message, error) {
+	return h.store.GetChannelHistory(channelName, limit)
+}
+
+// Client message IDs are opaque strings of at most maxClientMsgIDLength
+// bytes, such as UUIDs.
+const maxClientMsgIDLength = 64
+
+var errInvalidClientMsgID = fmt.Errorf("client_msg_id must be at most %d bytes", maxClientMsgIDLength)
+
+// History pages default to defaultHistoryPageSize messages and are capped at
+// maxHistoryPageSize whatever the client asks for.
+const (
+	defaultHistoryPageSize = 50
+	maxHistoryPageSize     = 100
+)
+
+func (h *Hub) getHistoryPage(req HistoryRequest) (HistoryPage, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultHistoryPageSize
+	}
+	if limit > maxHistoryPageSize {
+		limit = maxHistoryPageSize
 	}
 
-	return messages, nil
+	messages, hasMore, err := h.store.GetHistoryPage(req.Channel, req.BeforeID, req.AfterID, limit)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+	if messages == nil {
+		messages = []Message{}
+	}
+	return HistoryPage{
+		Type:     "history_page",
+		Channel:  req.Channel,
+		Messages: messages,
+		HasMore:  hasMore,
+	}, nil
 }
 
 func (h *Hub) getChannelType(channelName string) (ChannelType, error) {
-	var channelType string
-	err := h.db.QueryRow("SELECT type FROM channels WHERE name = $1", channelName).Scan(&channelType)
-	if err != nil {
-		return Ephemeral, err
-	}
-	return ChannelType(channelType), nil
+	return h.store.GetChannelType(channelName)
 }
 
-func (h *Hub) createChannelInDB(name string, channelType ChannelType) error {
+// createChannelInDB stores a persistent channel. A new channel is owned by
+// owner, if given, and only shown to its members if private. Creating an
+// existing channel changes neither.
+func (h *Hub) createChannelInDB(name string, channelType ChannelType, owner string, private bool) error {
 	// Only store persistent channels in database
-	if channelType == Persistent {
-		_, err := h.db.Exec("INSERT INTO channels (name, type) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING", name, string(channelType))
+	if channelType != Persistent {
+		return nil
+	}
+	// One store call, so of concurrent creators only one becomes the owner
+	created, err := h.store.CreateOwnedChannel(name, channelType, owner, private)
+	if err != nil || !created {
 		return err
 	}
+	h.emitWebhookEvent(eventChannelCreated, name, ChannelInfo{Name: name, Type: channelType, Owner: owner, Private: private})
 	return nil
 }
@@ -11,7 +11,9 @@ import (
 	_ "github.com/lib/pq"
 )
 
-func setupTestDB(t *testing.T) *sql.DB {
+// testConnectionString returns the PostgreSQL test database configured
+// through TEST_DATABASE_URL or the TEST_DB_* variables.
+func testConnectionString() string {
 	// Load .env file for test configuration
 	_ = godotenv.Load() // Silent fail - not required for tests
 
@@ -49,52 +51,65 @@ func setupTestDB(t *testing.T) *sql.DB {
 		testConnStr = fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s&connect_timeout=3",
 			user, password, host, port, dbname, sslmode)
 	}
+	return testConnStr
+}
 
-	db, err := sql.Open("postgres", testConnStr)
+// openTestDB connects to the PostgreSQL test database.
+func openTestDB() (*sql.DB, error) {
+	db, err := sql.Open("postgres", testConnectionString())
 	if err != nil {
-		t.Skipf("Skipping database tests - PostgreSQL not available: %v", err)
-		return nil
+		return nil, err
 	}
 
 	// Test connection
 	if err := db.Ping(); err != nil {
-		t.Skipf("Skipping database tests - PostgreSQL not reachable: %v", err)
-		return nil
+		db.Close()
+		return nil, err
 	}
 
-	// Clean up tables if they exist
-	db.Exec("DROP TABLE IF EXISTS messages")
-	db.Exec("DROP TABLE IF EXISTS channels")
+	return db, nil
+}
+
+// resetTestDB drops and recreates the schema so each test starts empty.
+func resetTestDB(t *testing.T, db *sql.DB) {
+	// Clean up everything, including schema_migrations
+	if _, err := db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public"); err != nil {
+		t.Fatalf("Failed to reset test schema: %v", err)
+	}
 
-	// Create tables
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS channels (
-			name VARCHAR(100) PRIMARY KEY,
-			type VARCHAR(20) NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+	migrations, err := loadMigrations(migrationFiles)
 	if err != nil {
-		t.Fatalf("Failed to create channels table: %v", err)
-	}
-
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS messages (
-			id SERIAL PRIMARY KEY,
-			channel_name VARCHAR(100) NOT NULL,
-			username VARCHAR(100) NOT NULL,
-			content TEXT NOT NULL,
-			timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (channel_name) REFERENCES channels (name)
-		)
-	`)
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+	if _, err := migrateUp(db, migrations); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+}
+
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := openTestDB()
 	if err != nil {
-		t.Fatalf("Failed to create messages table: %v", err)
+		t.Skipf("Skipping database tests - PostgreSQL not available: %v", err)
+		return nil
 	}
 
+	resetTestDB(t, db)
 	return db
 }
 
+// setupTestStore returns a clean PostgreSQL-backed store when the test
+// database is reachable and an in-memory store otherwise, so hub and client
+// tests never need to skip.
+func setupTestStore(t *testing.T) Store {
+	db, err := openTestDB()
+	if err != nil {
+		return newMemoryStore()
+	}
+
+	resetTestDB(t, db)
+	return newPostgresStore(db)
+}
+
 func TestInitDatabase(t *testing.T) {
 	db, err := initDatabase()
 	if err != nil {
@@ -123,10 +138,10 @@ func TestSaveMessage(t *testing.T) {
 	}
 	defer db.Close()
 
-	hub := newHub(db)
+	hub := newHub(newPostgresStore(db))
 
 	// Create a persistent channel first
-	err := hub.createChannelInDB("test-persistent", Persistent)
+	err := hub.createChannelInDB("test-persistent", Persistent, "", false)
 	if err != nil {
 		t.Fatalf("Failed to create persistent channel: %v", err)
 	}
@@ -140,7 +155,7 @@ func TestSaveMessage(t *testing.T) {
 		Timestamp: time.Now().UTC(),
 	}
 
-	err = hub.saveMessage(msg)
+	_, err = hub.saveMessage(msg)
 	if err != nil {
 		t.Errorf("Failed to save message: %v", err)
 	}
@@ -157,7 +172,7 @@ func TestSaveMessage(t *testing.T) {
 
 	// Test that ephemeral channel messages are not saved
 	msg.Channel = "ephemeral-channel"
-	err = hub.saveMessage(msg)
+	_, err = hub.saveMessage(msg)
 	if err == nil {
 		t.Errorf("Expected error when saving to non-existent channel")
 	}
@@ -170,10 +185,10 @@ func TestGetChannelHistory(t *testing.T) {
 	}
 	defer db.Close()
 
-	hub := newHub(db)
+	hub := newHub(newPostgresStore(db))
 
 	// Create a persistent channel
-	err := hub.createChannelInDB("history-test", Persistent)
+	err := hub.createChannelInDB("history-test", Persistent, "", false)
 	if err != nil {
 		t.Fatalf("Failed to create persistent channel: %v", err)
 	}
@@ -186,7 +201,7 @@ func TestGetChannelHistory(t *testing.T) {
 	}
 
 	for _, msg := range messages {
-		err = hub.saveMessage(msg)
+		_, err = hub.saveMessage(msg)
 		if err != nil {
 			t.Fatalf("Failed to save message: %v", err)
 		}
@@ -216,10 +231,10 @@ func TestGetChannelType(t *testing.T) {
 	}
 	defer db.Close()
 
-	hub := newHub(db)
+	hub := newHub(newPostgresStore(db))
 
 	// Create channels of different types
-	err := hub.createChannelInDB("persistent-test", Persistent)
+	err := hub.createChannelInDB("persistent-test", Persistent, "", false)
 	if err != nil {
 		t.Fatalf("Failed to create persistent channel: %v", err)
 	}
@@ -247,10 +262,10 @@ func TestCreateChannelInDB(t *testing.T) {
 	}
 	defer db.Close()
 
-	hub := newHub(db)
+	hub := newHub(newPostgresStore(db))
 
 	// Test creating persistent channel
-	err := hub.createChannelInDB("new-persistent", Persistent)
+	err := hub.createChannelInDB("new-persistent", Persistent, "", false)
 	if err != nil {
 		t.Errorf("Failed to create persistent channel: %v", err)
 	}
@@ -266,7 +281,7 @@ func TestCreateChannelInDB(t *testing.T) {
 	}
 
 	// Test creating ephemeral channel (should not be stored)
-	err = hub.createChannelInDB("new-ephemeral", Ephemeral)
+	err = hub.createChannelInDB("new-ephemeral", Ephemeral, "", false)
 	if err != nil {
 		t.Errorf("Unexpected error creating ephemeral channel: %v", err)
 	}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Direct channels are named after a hash of their sorted members, so opening
+// a conversation with the same people always returns the same channel. The
+// prefix is reserved: other channels cannot use it.
+const (
+	directChannelPrefix = "dm-"
+	maxDirectMembers    = 8
+)
+
+var (
+	errDirectTooFew     = errors.New("a direct conversation needs at least one other user")
+	errDirectTooMany    = fmt.Errorf("a direct conversation has at most %d members", maxDirectMembers)
+	errChannelForbidden = errors.New("you are not a member of this channel")
+)
+
+func directChannelName(members []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(members, "\n")))
+	return directChannelPrefix + hex.EncodeToString(sum[:16])
+}
+
+func isDirectChannelName(name string) bool {
+	return strings.HasPrefix(name, directChannelPrefix)
+}
+
+// openDirectChannel stores the conversation between opener and usernames if
+// it does not exist yet and returns it. Every participant must be a
+// registered user.
+func (h *Hub) openDirectChannel(opener string, usernames []string) (ChannelInfo, error) {
+	seen := map[string]bool{opener: true}
+	members := []string{opener}
+	for _, username := range usernames {
+		username = strings.TrimSpace(username)
+		if username == "" || seen[username] {
+			continue
+		}
+		if _, err := h.store.GetUser(username); err != nil {
+			return ChannelInfo{}, fmt.Errorf("user '%s': %w", username, err)
+		}
+		seen[username] = true
+		members = append(members, username)
+	}
+	if len(members) < 2 {
+		return ChannelInfo{}, errDirectTooFew
+	}
+	if len(members) > maxDirectMembers {
+		return ChannelInfo{}, errDirectTooMany
+	}
+	sort.Strings(members)
+
+	name := directChannelName(members)
+	if err := h.store.CreateDirectChannel(name, members); err != nil {
+		return ChannelInfo{}, err
+	}
+	return ChannelInfo{Name: name, Type: Direct, Members: members}, nil
+}
+
+// canAccessChannel reports whether username may join or read a channel.
+// Direct channels are limited to their members.
+func (h *Hub) canAccessChannel(username, channelName string) bool {
+	return h.can(username, channelName, permJoin)
+}
+
+// sendToUsers delivers msg to every connection of the named users on any node.
+func (h *Hub) sendToUsers(usernames []string, msg []byte) {
+	h.deliverToUsers(msg, usernames)
+	h.publish(ClusterEvent{Kind: eventUserMessage, Users: usernames, Payload: msg})
+}
+
+// deliverToUsers sends msg to the local clients of the named users, skipping
+// clients whose send buffer is full.
+func (h *Hub) deliverToUsers(msg []byte, usernames []string) {
+	wanted := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		wanted[username] = true
+	}
+
+	sent := make(map[*Client]bool)
+	h.channelsMu.RLock()
+	defer h.channelsMu.RUnlock()
+	for _, ch := range h.channels {
+		ch.clientsMu.RLock()
+		for c := range ch.clients {
+			if wanted[c.username] && !sent[c] {
+				sent[c] = true
+				select {
+				case c.send <- msg:
+				default:
+					// Client's send channel is full, skip
+				}
+			}
+		}
+		ch.clientsMu.RUnlock()
+	}
+}
+
+// openDirectMessage handles open_dm: it announces the conversation to its
+// members and moves the sender into it.
+func (c *Client) openDirectMessage(req DirectMessageRequest) error {
+	info, err := c.hub.openDirectChannel(c.username, req.Usernames)
+	if err != nil {
+		log.Printf("Error opening direct conversation for %s: %v", c.username, err)
+		return err
+	}
+
+	channelCreatedMsg := struct {
+		Type        string      `json:"type"`
+		Name        string      `json:"name"`
+		ChannelType ChannelType `json:"channel_type"`
+		Members     []string    `json:"members"`
+	}{
+		Type:        "channel_created",
+		Name:        info.Name,
+		ChannelType: Direct,
+		Members:     info.Members,
+	}
+	if msgBytes, err := json.Marshal(channelCreatedMsg); err == nil {
+		c.hub.sendToUsers(info.Members, msgBytes)
+	}
+
+	c.switchChannelWithType(info.Name, Direct)
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOpenDirectChannel(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if err := store.CreateUser(User{Username: username, PasswordHash: "x", CreatedAt: time.Now()}); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	info, err := hub.openDirectChannel("alice", []string{"bob"})
+	if err != nil {
+		t.Fatalf("Failed to open direct channel: %v", err)
+	}
+	if info.Type != Direct || !isDirectChannelName(info.Name) || len(info.Members) != 2 {
+		t.Errorf("Unexpected direct channel: %+v", info)
+	}
+
+	// The same participants always get the same channel
+	again, err := hub.openDirectChannel("bob", []string{"alice", "alice", " "})
+	if err != nil || again.Name != info.Name {
+		t.Errorf("Expected reopening to return %s, got %+v (%v)", info.Name, again, err)
+	}
+	group, _ := hub.openDirectChannel("alice", []string{"bob", "carol"})
+	if group.Name == info.Name {
+		t.Error("Expected a group conversation to get its own channel")
+	}
+
+	if _, err := hub.openDirectChannel("alice", []string{"nobody"}); !errors.Is(err, errUserNotFound) {
+		t.Errorf("Expected errUserNotFound for unknown user, got %v", err)
+	}
+	if _, err := hub.openDirectChannel("alice", []string{"alice"}); !errors.Is(err, errDirectTooFew) {
+		t.Errorf("Expected errDirectTooFew, got %v", err)
+	}
+
+	many := []string{"bob", "carol"}
+	for i := 0; i < maxDirectMembers; i++ {
+		username := "user" + string(rune('a'+i))
+		store.CreateUser(User{Username: username, PasswordHash: "x", CreatedAt: time.Now()})
+		many = append(many, username)
+	}
+	if _, err := hub.openDirectChannel("alice", many); !errors.Is(err, errDirectTooMany) {
+		t.Errorf("Expected errDirectTooMany, got %v", err)
+	}
+
+	if !hub.canAccessChannel("bob", info.Name) || hub.canAccessChannel("carol", info.Name) {
+		t.Error("Expected only members to access the direct channel")
+	}
+	if hub.canAccessChannel("alice", directChannelPrefix+"unknown") {
+		t.Error("Expected unknown direct channels to be inaccessible")
+	}
+}
+
+func TestDirectMessagesOverWebSocket(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		store.CreateUser(User{Username: username, PasswordHash: "x", CreatedAt: time.Now()})
+	}
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	carol := dialTestClient(t, hub, wsURL, "carol")
+
+	isDirectCreated := func(msg map[string]interface{}) bool {
+		return msg["type"] == "channel_created" && msg["channel_type"] == string(Direct)
+	}
+
+	sendJSON(t, alice, DirectMessageRequest{Type: "open_dm", Usernames: []string{"bob"}})
+	created := readUntil(t, alice, isDirectCreated)
+	dmName := created["name"].(string)
+	if members := created["members"].([]interface{}); len(members) != 2 {
+		t.Errorf("Expected two members, got %v", members)
+	}
+	readUntil(t, alice, func(msg map[string]interface{}) bool {
+		return msg["type"] == "channel_switch" && msg["channel"] == dmName
+	})
+	readUntil(t, bob, isDirectCreated)
+	expectNone(t, carol, 100*time.Millisecond, isDirectCreated)
+
+	sendJSON(t, alice, Message{Type: "message", Content: "just between us"})
+	readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+
+	// Bob joins later and sees the persisted history
+	sendJSON(t, bob, Message{Type: "join_channel", Channel: dmName})
+	msg := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	if msg["content"] != "just between us" || msg["channel"] != dmName {
+		t.Errorf("Expected direct message history, got %v", msg)
+	}
+
+	// Carol can neither join nor read it
+	sendJSON(t, carol, Message{Type: "join_channel", Channel: dmName})
+	sendJSON(t, carol, HistoryRequest{Type: "history_request", Channel: dmName})
+	expectNone(t, carol, 200*time.Millisecond, func(msg map[string]interface{}) bool {
+		return msg["channel"] == dmName
+	})
+
+	// Only members see it in their channel list
+	hasDM := func(conn map[string]interface{}) bool {
+		for _, ch := range conn["channels"].([]interface{}) {
+			if ch.(map[string]interface{})["name"] == dmName {
+				return true
+			}
+		}
+		return false
+	}
+	activeChannels := func(username string) map[string]interface{} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, authHeader(t, hub, username))
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		return readUntil(t, conn, func(msg map[string]interface{}) bool { return msg["type"] == "active_channels" })
+	}
+
+	if !hasDM(activeChannels("bob")) {
+		t.Error("Expected direct channel in bob's active channels")
+	}
+	if hasDM(activeChannels("carol")) {
+		t.Error("Expected direct channel to be hidden from carol")
+	}
+}
@@ -1,75 +1,137 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 )
 
-func newHub(db *sql.DB) *Hub {
-	return &Hub{
+func newHub(store Store) *Hub {
+	h := &Hub{
 		channels:   make(map[string]*Channel),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		broadcast:  make(chan []byte),
-		db:         db,
-		shutdown:   make(chan bool),
+		store:      store,
+		auth:       newAuthenticator(store, loadAuthSecret(), loadTokenTTL()),
+		moderators: loadModerators(),
+		presence:   make(map[string]*userPresence),
+
+		rateLimits:  loadRateLimits(),
+		userBuckets: make(map[string]*tokenBucket),
+		lastPosts:   make(map[slowModeKey]time.Time),
+		shutdown:    make(chan bool),
+		nodeID:      defaultNodeID(),
+
+		webhookRetry:  loadWebhookRetryPolicy(),
+		webhookClient: &http.Client{Timeout: webhookTimeout},
+		webhookWake:   make(chan struct{}, 1),
+		webhookDone:   make(chan struct{}),
+
+		commands: make(map[string]Command),
+		bots:     make(map[string]*Bot),
 	}
+	h.registerBuiltinCommands()
+	return h
 }
 
 func (h *Hub) sendActiveChannels(client *Client) {
-	// Get all channels from database (persistent channels)
-	rows, err := h.db.Query("SELECT name, type FROM channels ORDER BY name")
+	channelInfos, err := h.listChannels(client.username)
 	if err != nil {
 		log.Printf("Error querying channels: %v", err)
 		return
 	}
-	defer rows.Close()
 
-	type ChannelInfo struct {
-		Name string      `json:"name"`
-		Type ChannelType `json:"type"`
+	activeChannelsMsg := struct {
+		Type     string        `json:"type"`
+		Channels []ChannelInfo `json:"channels"`
+	}{
+		Type:     "active_channels",
+		Channels: channelInfos,
 	}
 
-	var channelInfos []ChannelInfo
+	if msgBytes, err := json.Marshal(activeChannelsMsg); err == nil {
+		select {
+		case client.send <- msgBytes:
+		default:
+			client.disconnect()
+		}
+	}
+}
+
+// listChannels returns the channels username can see: public stored
+// channels and the private ones they are a member of, their own direct
+// conversations and the ephemeral channels active anywhere in the cluster,
+// with username's read position in each.
+func (h *Hub) listChannels(username string) ([]ChannelInfo, error) {
+	// Get all channels from the store (persistent channels)
+	storedChannels, err := h.store.ListChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	channelInfos := []ChannelInfo{}
 	channelMap := make(map[string]ChannelType)
 
-	// Add persistent channels from database
-	for rows.Next() {
-		var name, channelType string
-		if err := rows.Scan(&name, &channelType); err != nil {
+	// Add persistent channels from the store; other users' private ones
+	// stay hidden
+	for _, info := range storedChannels {
+		channelMap[info.Name] = info.Type
+		if info.Private && !h.isChannelMember(username, info.Name) {
 			continue
 		}
-		channelInfos = append(channelInfos, ChannelInfo{Name: name, Type: ChannelType(channelType)})
-		channelMap[name] = ChannelType(channelType)
+		channelInfos = append(channelInfos, info)
+	}
+
+	// Add the client's direct conversations; other users' stay hidden
+	directChannels, err := h.store.ListDirectChannels(username)
+	if err != nil {
+		log.Printf("Error querying direct channels for %s: %v", username, err)
+	}
+	for _, info := range directChannels {
+		channelInfos = append(channelInfos, info)
+		channelMap[info.Name] = info.Type
 	}
 
 	// Add currently active ephemeral channels not in database
+	var ephemeral []*Channel
 	h.channelsMu.RLock()
 	for name, channel := range h.channels {
 		if _, exists := channelMap[name]; !exists && channel.channelType == Ephemeral {
-			channelInfos = append(channelInfos, ChannelInfo{Name: name, Type: Ephemeral})
+			ephemeral = append(ephemeral, channel)
+			channelMap[name] = Ephemeral
 		}
 	}
 	h.channelsMu.RUnlock()
+	for _, channel := range ephemeral {
+		channel.clientsMu.RLock()
+		channelInfos = append(channelInfos, ChannelInfo{Name: channel.name, Type: Ephemeral, Topic: channel.topic, SlowMode: int(channel.slowMode.Seconds())})
+		channel.clientsMu.RUnlock()
+	}
 
-	activeChannelsMsg := struct {
-		Type     string        `json:"type"`
-		Channels []ChannelInfo `json:"channels"`
-	}{
-		Type:     "active_channels",
-		Channels: channelInfos,
+	// Add ephemeral channels that only exist on other nodes
+	for _, name := range h.remoteChannels() {
+		if _, exists := channelMap[name]; !exists {
+			channelInfos = append(channelInfos, ChannelInfo{Name: name, Type: Ephemeral})
+		}
 	}
 
-	if msgBytes, err := json.Marshal(activeChannelsMsg); err == nil {
-		select {
-		case client.send <- msgBytes:
-		default:
-			close(client.send)
+	// Add the client's read position in each stored channel
+	readStates, err := h.store.GetReadStates(username)
+	if err != nil {
+		log.Printf("Error querying read states for %s: %v", username, err)
+	}
+	for i := range channelInfos {
+		if state, ok := readStates[channelInfos[i].Name]; ok {
+			channelInfos[i].LastReadID = state.LastReadID
+			channelInfos[i].Unread = state.Unread
 		}
 	}
+	return channelInfos, nil
 }
 
 func (h *Hub) run() {
@@ -99,14 +161,31 @@ func (h *Hub) run() {
 			channel := h.channels[channelName]
 			h.channelsMu.Unlock()
 
-			channel.clientsMu.Lock()
-			channel.clients[client] = true
-			clientCount := len(channel.clients)
-			channel.clientsMu.Unlock()
+			h.userConnected(client.username)
+			present := channel.hasUser(client.username)
+			var clientCount int
+			var resumed Resumed
+			if client.resume != nil {
+				resumed, clientCount = h.resumeChannel(client, channel, client.resume, true)
+				client.resume = nil
+			} else {
+				channel.clientsMu.Lock()
+				channel.clients[client] = true
+				channel.focused[client] = true
+				clientCount = len(channel.clients)
+				channel.clientsMu.Unlock()
+			}
 			log.Printf("Client connected to channel '%s'. Total clients in channel: %d", channelName, clientCount)
+			h.publishPresence(channelName, clientCount)
+			if !present {
+				h.announcePresence(channelName, client.username, presenceJoin)
+			}
 
-			// Send message history for persistent channels
-			if channel.channelType == Persistent {
+			// Send message history for stored channels, unless a
+			// reconnecting client was sent what it missed
+			if resumed.Type != "" {
+				client.sendFrame(resumed)
+			} else if channel.channelType.isStored() {
 				history, err := h.getChannelHistory(channelName, 50) // Last 50 messages
 				if err == nil {
 					for _, msg := range history {
@@ -114,14 +193,16 @@ func (h *Hub) run() {
 							select {
 							case client.send <- msgBytes:
 							default:
-								close(client.send)
-								return
+								client.disconnect()
 							}
 						}
 					}
 				}
 			}
 
+			client.sendChannelMembers(channelName)
+			client.sendChannelTopic(channelName)
+
 			// Send active channels list to the newly connected client
 			h.sendActiveChannels(client)
 
@@ -135,11 +216,19 @@ func (h *Hub) run() {
 			channel, ok := h.channels[channelName]
 			h.channelsMu.RUnlock()
 
-			if ok {
+			if !ok {
+				h.userDisconnected(client.username)
+			} else {
 				channel.clientsMu.Lock()
-				if _, ok := channel.clients[client]; ok {
+				if _, ok := channel.clients[client]; !ok {
+					// Already dropped for falling behind
+					delete(channel.focused, client)
+					channel.clientsMu.Unlock()
+					h.userDisconnected(client.username)
+				} else {
 					// Send leave message for ephemeral channels only if there will be other clients remaining
-					if channel.channelType == Ephemeral && len(channel.clients) > 1 && client.username != "" {
+					var leaveMsgBytes []byte
+					if channel.channelType == Ephemeral && len(channel.clients)+h.remoteMemberCount(channelName) > 1 && client.username != "" {
 						leaveMsg := Message{
 							Username:  "System",
 							Content:   fmt.Sprintf("%s left the channel", client.username),
@@ -147,73 +236,55 @@ func (h *Hub) run() {
 							Channel:   channelName,
 							Timestamp: time.Now().UTC(),
 						}
-						if leaveMsgBytes, err := json.Marshal(leaveMsg); err == nil {
-							log.Printf("Sending leave message for %s to channel '%s'", client.username, channelName)
-							channel.broadcast <- leaveMsgBytes
-						}
+						leaveMsgBytes, _ = json.Marshal(leaveMsg)
 					}
 
 					delete(channel.clients, client)
+					delete(channel.focused, client)
 					clientCount := len(channel.clients)
 					channel.clientsMu.Unlock()
+					// Broadcast without holding the lock the channel needs to deliver
+					if leaveMsgBytes != nil {
+						log.Printf("Sending leave message for %s to channel '%s'", client.username, channelName)
+						h.broadcastToChannel(channel, leaveMsgBytes)
+					}
 					log.Printf("Client disconnected from channel '%s'. Total clients in channel: %d", channelName, clientCount)
+					h.publishPresence(channelName, clientCount)
+					h.userDisconnected(client.username)
+					if !channel.hasUser(client.username) {
+						h.announcePresence(channelName, client.username, presenceLeave)
+					}
 
 					if clientCount == 0 && channelName != "general" {
-						// Only remove ephemeral channels when empty
-						if channel.channelType == Ephemeral {
-							h.channelsMu.Lock()
-							delete(h.channels, channelName)
-							h.channelsMu.Unlock()
-							log.Printf("Ephemeral channel '%s' removed (no clients)", channelName)
-
-							// Broadcast channel deletion to all clients BEFORE closing the send channel
-							channelDeletedMsg := Message{
-								Username: "System",
-								Content:  channelName,
-								Type:     "channel_deleted",
-								Channel:  channelName,
-							}
-
-							if msgBytes, err := json.Marshal(channelDeletedMsg); err == nil {
-								// Send to all remaining clients in all channels
-								h.channelsMu.RLock()
-								for _, ch := range h.channels {
-									ch.clientsMu.RLock()
-									for c := range ch.clients {
-										if c != client { // Don't send to the disconnecting client
-											select {
-											case c.send <- msgBytes:
-											default:
-												// Client's send channel is full, skip
-											}
-										}
-									}
-									ch.clientsMu.RUnlock()
-								}
-								h.channelsMu.RUnlock()
-							}
-						} else {
-							// For persistent channels, keep the channel but remove it from memory
-							h.channelsMu.Lock()
-							delete(h.channels, channelName)
-							h.channelsMu.Unlock()
-							log.Printf("Persistent channel '%s' removed from memory (no clients, but preserved in database)", channelName)
-						}
+						h.closeChannel(channel, client)
 					}
+				}
+			}
 
-					close(client.send)
+			// Leave the channels the client subscribed to, then end its write pump
+			for name := range client.subscriptions {
+				if name != channelName {
+					h.leaveSubscription(client, name)
 				}
 			}
+			client.closeSend()
 		case message := <-h.broadcast:
+			// Clients in several channels get the message once
+			sent := make(map[*Client]bool)
 			h.channelsMu.RLock()
 			for _, channel := range h.channels {
 				channel.clientsMu.Lock()
 				for client := range channel.clients {
+					if sent[client] {
+						continue
+					}
+					sent[client] = true
 					select {
 					case client.send <- message:
 					default:
-						close(client.send)
 						delete(channel.clients, client)
+						delete(channel.focused, client)
+						client.disconnect()
 					}
 				}
 				channel.clientsMu.Unlock()
@@ -224,6 +295,9 @@ func (h *Hub) run() {
 }
 
 func (h *Hub) stop() {
+	h.leaveCluster()
+	h.stopWebhookDelivery()
+
 	// Stop all channels first
 	h.channelsMu.RLock()
 	for _, channel := range h.channels {
@@ -240,3 +314,167 @@ func (h *Hub) stop() {
 	default:
 	}
 }
+
+var errNotChannelAdmin = errors.New("you cannot manage this channel")
+
+// validateNewChannel checks a channel creation request from a client,
+// defaulting its type to ephemeral.
+func validateNewChannel(req *ChannelCreateRequest) error {
+	// Direct channels are only opened with open_dm
+	if req.ChannelType == "" {
+		req.ChannelType = Ephemeral
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		return newCommandError(errorInvalidArgument, "channel name is required")
+	}
+	if req.ChannelType != Ephemeral && req.ChannelType != Persistent {
+		log.Printf("Rejected channel '%s': invalid channel type '%s'", req.Name, req.ChannelType)
+		return newCommandError(errorInvalidArgument, "channel_type must be ephemeral or persistent")
+	}
+	if isDirectChannelName(req.Name) {
+		log.Printf("Rejected channel '%s': the %s prefix is reserved", req.Name, directChannelPrefix)
+		return newCommandError(errorInvalidArgument, fmt.Sprintf("the %s prefix is reserved for direct messages", directChannelPrefix))
+	}
+	if req.Private && req.ChannelType != Persistent {
+		return newCommandError(errorInvalidArgument, "private channels must be persistent")
+	}
+	return nil
+}
+
+// announceChannelCreated tells every client about a new channel, or only
+// its members if it is private. Persistent channels are loaded this way too,
+// so only ephemeral ones are reported to webhooks here; createChannelInDB
+// reports persistent ones.
+func (h *Hub) announceChannelCreated(name string, channelType ChannelType) {
+	if channelType == Ephemeral {
+		h.emitWebhookEvent(eventChannelCreated, name, ChannelInfo{Name: name, Type: channelType})
+	}
+
+	private := channelType == Persistent && h.isPrivateChannel(name)
+	if !private {
+		h.broadcastToAll(channelCreatedFrame(name, channelType, false))
+		return
+	}
+	members, err := h.store.GetChannelMembers(name)
+	if err != nil {
+		log.Printf("Error loading members of private channel '%s': %v", name, err)
+		return
+	}
+	h.sendToUsers(members, channelCreatedFrame(name, channelType, true))
+}
+
+// channelCreatedFrame builds the channel_created frame for a channel.
+func channelCreatedFrame(name string, channelType ChannelType, private bool) []byte {
+	channelCreatedMsg := struct {
+		Type        string      `json:"type"`
+		Name        string      `json:"name"`
+		ChannelType ChannelType `json:"channel_type"`
+		Private     bool        `json:"private,omitempty"`
+	}{
+		Type:        "channel_created",
+		Name:        name,
+		ChannelType: channelType,
+		Private:     private,
+	}
+	msgBytes, _ := json.Marshal(channelCreatedMsg)
+	return msgBytes
+}
+
+// deleteChannel removes a persistent channel and its messages and tells
+// every client it is gone, or only its members and the deleter if it was
+// private.
+func (h *Hub) deleteChannel(username, name string) error {
+	if !h.canDeleteChannel(username, name) {
+		return errNotChannelAdmin
+	}
+	channelType, err := h.getChannelType(name)
+	if err != nil {
+		return err
+	}
+	if channelType != Persistent {
+		return newCommandError(errorInvalidArgument, "only persistent channels can be deleted")
+	}
+	var audience []string
+	if h.isPrivateChannel(name) {
+		if audience, err = h.store.GetChannelMembers(name); err != nil {
+			return err
+		}
+		audience = append(audience, username)
+	}
+	if err := h.store.DeleteChannel(name); err != nil {
+		return err
+	}
+	log.Printf("Channel '%s' deleted by %s", name, username)
+	h.emitWebhookEvent(eventChannelDeleted, name, ChannelInfo{Name: name, Type: channelType})
+
+	// Clients still in the channel switch away when told it is gone
+	channelDeletedMsg := Message{
+		Username: "System",
+		Content:  name,
+		Type:     "channel_deleted",
+		Channel:  name,
+	}
+	msgBytes, err := json.Marshal(channelDeletedMsg)
+	if err != nil {
+		return nil
+	}
+	if audience != nil {
+		h.sendToUsers(audience, msgBytes)
+	} else {
+		h.broadcastToAll(msgBytes)
+	}
+	return nil
+}
+
+// postMessage stores a message in a stored channel and broadcasts it to the
+// channel's members. The message must name its author and channel. If the
+// author already sent a message with the same ClientMsgID, the original is
+// returned with duplicate set and nothing is broadcast. errNotDelivered
+// means other nodes could not be told about a message in an ephemeral
+// channel, which exists nowhere else.
+func (h *Hub) postMessage(message Message) (posted Message, duplicate bool, err error) {
+	if strings.TrimSpace(message.Content) == "" {
+		return Message{}, false, errEmptyMessage
+	}
+
+	h.channelsMu.RLock()
+	channel, active := h.channels[message.Channel]
+	h.channelsMu.RUnlock()
+	var channelType ChannelType
+	if active {
+		channelType = channel.channelType
+	} else if channelType, err = h.getChannelType(message.Channel); err != nil {
+		return Message{}, false, err
+	}
+
+	message.Type = "message"
+	message.Timestamp = time.Now().UTC()
+
+	// Only save to database if channel is stored
+	if channelType.isStored() {
+		saved, duplicate, err := h.saveClientMessage(message)
+		if err != nil {
+			log.Printf("Error saving message: %v", err)
+			return Message{}, false, err
+		}
+		if duplicate {
+			// A resend of a stored message was already broadcast
+			return saved, true, nil
+		}
+		message.ID = saved.ID
+	}
+
+	// The raw client bytes are never relayed, so the username cannot be spoofed
+	msgBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return Message{}, false, err
+	}
+	err = h.broadcastToChannelName(message.Channel, msgBytes)
+	if channelType.isStored() {
+		// Stored messages reach other nodes' users through history, so a
+		// failed publish, already logged, is not the sender's problem
+		return message, false, nil
+	}
+	return message, false, err
+}
@@ -7,29 +7,10 @@ import (
 )
 
 func TestNewHub(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		// Create a mock hub without database for basic functionality tests
-		hub := &Hub{
-			channels:   make(map[string]*Channel),
-			register:   make(chan *Client),
-			unregister: make(chan *Client),
-			broadcast:  make(chan []byte),
-			db:         nil,
-			shutdown:   make(chan bool),
-		}
+	store := setupTestStore(t)
+	defer store.Close()
 
-		if hub.channels == nil {
-			t.Error("Hub channels map should be initialized")
-		}
-		if hub.register == nil {
-			t.Error("Hub register channel should be initialized")
-		}
-		return
-	}
-	defer db.Close()
-
-	hub := newHub(db)
+	hub := newHub(store)
 
 	if hub.channels == nil {
 		t.Error("Hub channels map should be initialized")
@@ -43,20 +24,16 @@ func TestNewHub(t *testing.T) {
 	if hub.broadcast == nil {
 		t.Error("Hub broadcast channel should be initialized")
 	}
-	if hub.db != db {
-		t.Error("Hub database should be set to provided database")
+	if hub.store != store {
+		t.Error("Hub store should be set to provided store")
 	}
 }
 
 func TestHubClientRegistration(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping hub tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 
 	// Create a mock client
 	client := &Client{
@@ -114,14 +91,10 @@ func TestHubClientRegistration(t *testing.T) {
 }
 
 func TestHubBroadcast(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping hub tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 
 	// Create mock clients
 	client1 := &Client{
@@ -198,17 +171,13 @@ testBroadcast:
 }
 
 func TestSendActiveChannels(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping hub tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 
 	// Create a persistent channel in database
-	err := hub.createChannelInDB("test-persistent", Persistent)
+	err := hub.createChannelInDB("test-persistent", Persistent, "", false)
 	if err != nil {
 		t.Fatalf("Failed to create persistent channel: %v", err)
 	}
@@ -267,14 +236,10 @@ func TestSendActiveChannels(t *testing.T) {
 }
 
 func TestHubChannelCleanup(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping hub tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 	go hub.run()
 	defer hub.stop() // Ensure cleanup
 
@@ -314,19 +279,15 @@ func TestHubChannelCleanup(t *testing.T) {
 }
 
 func TestHubPersistentChannelMemoryCleanup(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping hub tests without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 	go hub.run()
 	defer hub.stop() // Ensure cleanup
 
 	// Create a persistent channel in database
-	err := hub.createChannelInDB("test-persistent", Persistent)
+	err := hub.createChannelInDB("test-persistent", Persistent, "", false)
 	if err != nil {
 		t.Fatalf("Failed to create persistent channel: %v", err)
 	}
@@ -366,9 +327,7 @@ func TestHubPersistentChannelMemoryCleanup(t *testing.T) {
 	}
 
 	// Verify it still exists in database
-	var channelType string
-	err = db.QueryRow("SELECT type FROM channels WHERE name = $1", "test-persistent").Scan(&channelType)
-	if err != nil {
+	if _, err := store.GetChannelType("test-persistent"); err != nil {
 		t.Error("Persistent channel should still exist in database after memory cleanup")
 	}
 }
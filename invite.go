@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Invite links last defaultInviteTTL unless asked for less, and at most
+// maxInviteTTL.
+const (
+	defaultInviteTTL = 24 * time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+)
+
+var (
+	errAlreadyMember        = errors.New("user is already a member of this channel")
+	errInvitesNeedPersisted = errors.New("only persistent channels have invites")
+	errInvalidInvite        = fmt.Errorf("expires_in must be at most %d seconds and max_uses must not be negative", int(maxInviteTTL.Seconds()))
+)
+
+// inviteUser adds username to a persistent channel as a member, which lets
+// them see and join it if it is private. Owners and moderators may invite.
+func (h *Hub) inviteUser(actor, channelName, username string) error {
+	if h.isChannelMember(username, channelName) {
+		return errAlreadyMember
+	}
+	return h.grantRole(actor, channelName, username, roleMember)
+}
+
+// createInvite makes an invite link to a persistent channel, valid for
+// req.ExpiresIn seconds (zero for defaultInviteTTL) and req.MaxUses joins
+// (zero for no limit). The returned invite carries its code, which is not
+// stored and cannot be shown again.
+func (h *Hub) createInvite(actor string, req InviteRequest) (ChannelInvite, error) {
+	channelName := req.Channel
+	channelType, err := h.getChannelType(channelName)
+	if err != nil && !errors.Is(err, errChannelNotFound) {
+		return ChannelInvite{}, err
+	}
+	if err != nil || channelType != Persistent {
+		return ChannelInvite{}, errInvitesNeedPersisted
+	}
+	if !h.can(actor, channelName, permInvite) {
+		return ChannelInvite{}, errNotChannelAdmin
+	}
+	if req.ExpiresIn < 0 || req.ExpiresIn > int(maxInviteTTL.Seconds()) || req.MaxUses < 0 {
+		return ChannelInvite{}, errInvalidInvite
+	}
+	expiresIn := time.Duration(req.ExpiresIn) * time.Second
+	if expiresIn == 0 {
+		expiresIn = defaultInviteTTL
+	}
+
+	// Codes are kept as hashes, like webhook tokens
+	code, hash, err := newWebhookToken()
+	if err != nil {
+		return ChannelInvite{}, err
+	}
+	now := time.Now().UTC()
+	invite := ChannelInvite{
+		Channel:   channelName,
+		CreatedBy: actor,
+		CreatedAt: now,
+		ExpiresAt: now.Add(expiresIn),
+		MaxUses:   req.MaxUses,
+		CodeHash:  hash,
+	}
+	if invite.ID, err = h.store.CreateChannelInvite(invite); err != nil {
+		return ChannelInvite{}, err
+	}
+	log.Printf("Invite to channel '%s' created by %s, expiring %s", channelName, actor, invite.ExpiresAt.Format(time.RFC3339))
+	invite.Code = code
+	return invite, nil
+}
+
+// joinWithInvite uses an invite link, making username a member of its
+// channel unless they are banned from it. Users who already have a role
+// there keep it, and do not use the invite up.
+func (h *Hub) joinWithInvite(username, code string) (ChannelInvite, error) {
+	codeHash, now := hashWebhookToken(code), time.Now().UTC()
+	invite, err := h.store.GetChannelInvite(codeHash, now)
+	if err != nil {
+		return ChannelInvite{}, err
+	}
+	// Invites do not get around bans
+	if err := h.sanctionError(username, invite.Channel, permJoin); err != nil {
+		return ChannelInvite{}, err
+	}
+	if h.isChannelMember(username, invite.Channel) {
+		return invite, nil
+	}
+	used, err := h.store.UseChannelInvite(codeHash, username, now)
+	if errors.Is(err, errAlreadyMember) {
+		// Joined meanwhile, from another connection
+		return invite, nil
+	}
+	if err != nil {
+		return ChannelInvite{}, err
+	}
+	invite = used
+	log.Printf("%s joined channel '%s' with an invite from %s", username, invite.Channel, invite.CreatedBy)
+	h.announceRole(invite.Channel, username, roleMember, invite.CreatedBy)
+	if h.isPrivateChannel(invite.Channel) {
+		h.sendToUsers([]string{username}, channelCreatedFrame(invite.Channel, Persistent, true))
+	}
+	return invite, nil
+}
+
+// handleInvite answers an invite command: it invites the named user, or
+// sends the client a new invite link.
+func (c *Client) handleInvite(req InviteRequest) error {
+	if req.Channel == "" {
+		req.Channel = c.focusedChannel()
+	}
+	if req.Username != "" {
+		return c.hub.inviteUser(c.username, req.Channel, req.Username)
+	}
+	invite, err := c.hub.createInvite(c.username, req)
+	if err != nil {
+		return err
+	}
+	c.sendFrame(InviteCreated{Type: "invite_created", ChannelInvite: invite})
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPrivateChannels(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	request := startAPIServer(t, hub)
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	carol := dialTestClient(t, hub, wsURL, "carol")
+	isCreated := func(msg map[string]interface{}) bool { return msg["type"] == "channel_created" }
+	isError := func(msg map[string]interface{}) bool { return msg["type"] == "error" }
+
+	sendJSON(t, alice, map[string]interface{}{"type": "create_channel", "name": "scratch", "channel_type": "ephemeral", "private": true, "request_id": "c0"})
+	if frame := readUntil(t, alice, isError); frame["code"] != errorInvalidArgument || frame["request_id"] != "c0" {
+		t.Errorf("Expected a private ephemeral channel refused, got %v", frame)
+	}
+
+	// Only members hear of a private channel: the next channel bob hears
+	// of is the public one
+	sendJSON(t, alice, map[string]interface{}{"type": "create_channel", "name": "secret", "channel_type": "persistent", "private": true, "request_id": "c1"})
+	if created := readUntil(t, alice, isCreated); created["name"] != "secret" || created["private"] != true {
+		t.Errorf("Expected alice told of the private channel, got %v", created)
+	}
+	readUntil(t, alice, isAck("c1"))
+	sendJSON(t, carol, map[string]interface{}{"type": "create_channel", "name": "lobby", "channel_type": "persistent", "request_id": "c2"})
+	if created := readUntil(t, bob, isCreated); created["name"] != "lobby" {
+		t.Errorf("Expected bob not told of the private channel, got %v", created)
+	}
+	readUntil(t, carol, isAck("c2"))
+	if channels, _ := hub.listChannels("bob"); len(channels) != 2 || channels[0].Name != "lobby" || channels[1].Name != "general" {
+		t.Errorf("Expected bob not to see the private channel, got %+v", channels)
+	}
+	if channels, _ := hub.listChannels("alice"); len(channels) != 3 || channels[1].Name != "secret" || !channels[1].Private {
+		t.Errorf("Expected alice to see the private channel, got %+v", channels)
+	}
+
+	// Non-members cannot join, even by creating it again, or read it
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "secret", "request_id": "j1"})
+	if frame := readUntil(t, bob, isError); frame["code"] != errorForbidden || frame["request_id"] != "j1" {
+		t.Errorf("Expected bob refused, got %v", frame)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "create_channel", "name": "secret", "channel_type": "persistent", "request_id": "j2"})
+	if frame := readUntil(t, bob, isError); frame["code"] != errorForbidden || frame["request_id"] != "j2" {
+		t.Errorf("Expected bob refused creating the channel again, got %v", frame)
+	}
+	if status, _ := request("bob", "GET", "/api/channels/secret/messages", nil); status != http.StatusForbidden {
+		t.Errorf("Expected bob refused the history, got %d", status)
+	}
+
+	// Inviting bob announces the channel to them and lets them in
+	sendJSON(t, alice, map[string]interface{}{"type": "invite", "username": "bob", "request_id": "i1"})
+	readUntil(t, alice, isAck("i1"))
+	if created := readUntil(t, bob, isCreated); created["name"] != "secret" {
+		t.Errorf("Expected bob told of the channel they were invited to, got %v", created)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "secret", "request_id": "j3"})
+	readUntil(t, bob, isAck("j3"))
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/invite bob", "request_id": "i2"})
+	if frame := readUntil(t, alice, isError); frame["code"] != errorInvalidArgument || frame["request_id"] != "i2" {
+		t.Errorf("Expected inviting a member again refused, got %v", frame)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "meet at noon", "request_id": "m1"})
+	readUntil(t, bob, isAck("m1"))
+	if results, _ := hub.searchMessages("carol", SearchQuery{Query: "noon"}); len(results.Results) != 0 {
+		t.Errorf("Expected carol's search to skip the private channel, got %+v", results)
+	}
+	if results, _ := hub.searchMessages("alice", SearchQuery{Query: "noon"}); len(results.Results) != 1 {
+		t.Errorf("Expected alice's search to find the message, got %+v", results)
+	}
+
+	// Revoking bob's membership takes every connection of theirs out, so
+	// they hear nothing more
+	bobElsewhere := dialTestClient(t, hub, wsURL, "bob")
+	sendJSON(t, bobElsewhere, map[string]interface{}{"type": "join_channel", "channel": "secret", "request_id": "j4"})
+	readUntil(t, bobElsewhere, isAck("j4"))
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/revoke bob", "request_id": "r1"})
+	readUntil(t, alice, isAck("r1"))
+	for _, conn := range []*websocket.Conn{bob, bobElsewhere} {
+		if deleted := readUntil(t, conn, func(msg map[string]interface{}) bool { return msg["type"] == "channel_deleted" }); deleted["channel"] != "secret" {
+			t.Errorf("Expected bob told the channel is gone, got %v", deleted)
+		}
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "general", "request_id": "j5"})
+	readUntil(t, bob, isAck("j5"))
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "bob left", "request_id": "m2"})
+	readUntil(t, alice, isAck("m2"))
+	expectNone(t, bobElsewhere, 300*time.Millisecond, func(msg map[string]interface{}) bool { return msg["content"] == "bob left" })
+	if channels, _ := hub.listChannels("bob"); len(channels) != 2 {
+		t.Errorf("Expected bob no longer to see the private channel, got %+v", channels)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "invite", "username": "bob", "request_id": "i3"})
+	readUntil(t, alice, isAck("i3"))
+
+	// Deleting it only tells its members: the next deletion carol hears
+	// of is the public channel's
+	if status, body := request("alice", "DELETE", "/api/channels/secret", nil); status != http.StatusNoContent {
+		t.Fatalf("Failed to delete the channel: %d %v", status, body)
+	}
+	if deleted := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "channel_deleted" }); deleted["channel"] != "secret" {
+		t.Errorf("Expected bob told the channel was deleted, got %v", deleted)
+	}
+	request("carol", "DELETE", "/api/channels/lobby", nil)
+	if deleted := readUntil(t, carol, func(msg map[string]interface{}) bool { return msg["type"] == "channel_deleted" }); deleted["channel"] != "lobby" {
+		t.Errorf("Expected carol not told of the private channel's deletion, got %v", deleted)
+	}
+}
+
+func TestInviteLinks(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	request := startAPIServer(t, hub)
+	if err := hub.createChannelInDB("secret", Persistent, "alice", true); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	isError := func(msg map[string]interface{}) bool { return msg["type"] == "error" }
+
+	sendJSON(t, alice, map[string]interface{}{"type": "invite", "channel": "secret", "expires_in": int(maxInviteTTL.Seconds()) + 1, "request_id": "i0"})
+	if frame := readUntil(t, alice, isError); frame["code"] != errorInvalidArgument {
+		t.Errorf("Expected an invite outliving maxInviteTTL refused, got %v", frame)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "invite", "channel": "secret", "max_uses": 1, "request_id": "i1"})
+	invite := readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "invite_created" })
+	code, _ := invite["code"].(string)
+	expiresAt, _ := time.Parse(time.RFC3339, invite["expires_at"].(string))
+	if code == "" || invite["channel"] != "secret" || time.Until(expiresAt) < defaultInviteTTL-time.Minute {
+		t.Fatalf("Expected an invite link valid for a day, got %v", invite)
+	}
+
+	// The link lets bob in once
+	sendJSON(t, bob, map[string]interface{}{"type": "join_invite", "code": code, "request_id": "j1"})
+	if frame := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" }); frame["channel"] != "secret" {
+		t.Errorf("Expected bob switched into the channel, got %v", frame)
+	}
+	readUntil(t, bob, isAck("j1"))
+	if role, _ := store.GetChannelRole("secret", "bob"); role != roleMember {
+		t.Errorf("Expected bob a member, got %q", role)
+	}
+	if status, _ := request("carol", "POST", "/api/invites/"+code, nil); status != http.StatusNotFound {
+		t.Errorf("Expected a used up invite refused, got %d", status)
+	}
+
+	// Members cannot make links; owners and moderators can over HTTP too
+	if status, _ := request("bob", "POST", "/api/channels/secret/invites", map[string]int{}); status != http.StatusForbidden {
+		t.Errorf("Expected a member refused an invite link, got %d", status)
+	}
+	status, body := request("alice", "POST", "/api/channels/secret/invites", map[string]int{"expires_in": 60})
+	if status != http.StatusCreated || body["code"] == nil {
+		t.Fatalf("Expected an invite link, got %d %v", status, body)
+	}
+	if status, body := request("carol", "POST", "/api/invites/"+body["code"].(string), nil); status != http.StatusOK || body["channel"] != "secret" {
+		t.Errorf("Expected carol to join with the link, got %d %v", status, body)
+	}
+	if !hub.canAccessChannel("carol", "secret") {
+		t.Error("Expected carol to have access after using the link")
+	}
+	if status, _ := request("alice", "POST", "/api/channels/general/invites", map[string]int{}); status != http.StatusBadRequest {
+		t.Errorf("Expected ephemeral channels to have no invites, got %d", status)
+	}
+
+	// Banned users and members do not use up a single-use link
+	now := time.Now().UTC()
+	store.SetSanction(Sanction{Kind: sanctionBan, Channel: "secret", Username: "dave", CreatedBy: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	status, body = request("alice", "POST", "/api/channels/secret/invites", map[string]int{"max_uses": 1})
+	if status != http.StatusCreated {
+		t.Fatalf("Expected an invite link, got %d %v", status, body)
+	}
+	once := body["code"].(string)
+	if status, _ := request("dave", "POST", "/api/invites/"+once, nil); status != http.StatusForbidden {
+		t.Errorf("Expected a banned user refused, got %d", status)
+	}
+	if status, _ := request("bob", "POST", "/api/invites/"+once, nil); status != http.StatusOK {
+		t.Errorf("Expected a member's use accepted, got %d", status)
+	}
+	if status, _ := request("erin", "POST", "/api/invites/"+once, nil); status != http.StatusOK {
+		t.Errorf("Expected the link still unused for erin, got %d", status)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/joho/godotenv"
 )
@@ -13,15 +14,37 @@ func main() {
 		log.Println("No .env file found, using system environment variables")
 	}
 
-	// Initialize database
-	db, err := initDatabase()
+	// `echoroom migrate up|down|status` manages the PostgreSQL schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		return
+	}
+
+	// Initialize storage (PostgreSQL unless STORE_DRIVER says otherwise)
+	store, err := initStore()
 	if err != nil {
-		log.Fatal("Failed to initialize database:", err)
+		log.Fatal("Failed to initialize store:", err)
+	}
+	defer store.Close()
+
+	hub := newHub(store)
+
+	// Join other nodes when a cluster broker is configured
+	broker, err := initBroker()
+	if err != nil {
+		log.Fatal("Failed to initialize cluster broker:", err)
+	}
+	if broker != nil {
+		defer broker.Close()
+		if err := hub.useBroker(broker); err != nil {
+			log.Fatal("Failed to join cluster:", err)
+		}
 	}
-	defer db.Close()
 
-	hub := newHub(db)
 	go hub.run()
+	hub.startWebhookDelivery()
 
 	setupRoutes(hub)
 
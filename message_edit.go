@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	errNotMessageAuthor = errors.New("only the author or a moderator can change this message")
+	errEmptyMessage     = errors.New("message content is required")
+)
+
+// isModerator reports whether username may edit and delete other users'
+// messages.
+func (h *Hub) isModerator(username string) bool {
+	return h.moderators[username]
+}
+
+// authorizeMessageChange loads a message and checks that username may change
+// it: they must be able to see its channel, and be its author, a server
+// moderator or, if channelManagers is set, an owner or moderator of the
+// channel.
+func (h *Hub) authorizeMessageChange(username string, id int, channelManagers bool) (Message, error) {
+	msg, err := h.store.GetMessage(id)
+	if err != nil {
+		return Message{}, err
+	}
+	if msg.DeletedAt != nil || !h.canAccessChannel(username, msg.Channel) {
+		return Message{}, errMessageNotFound
+	}
+	if msg.Username != username && !h.isModerator(username) && !(channelManagers && h.can(username, msg.Channel, permManage)) {
+		return Message{}, errNotMessageAuthor
+	}
+	return msg, nil
+}
+
+// editMessage replaces a message's content and broadcasts message_edited to
+// its channel.
+func (h *Hub) editMessage(username string, id int, content string) error {
+	if strings.TrimSpace(content) == "" {
+		return errEmptyMessage
+	}
+	msg, err := h.authorizeMessageChange(username, id, false)
+	if err != nil {
+		return err
+	}
+	// Editing adds content, which muted and read-only users may not
+	if err := h.checkCanPost(username, msg.Channel); err != nil {
+		return err
+	}
+
+	msg, err = h.store.EditMessage(id, content, username, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	msg.Type = "message_edited"
+	if msgBytes, err := json.Marshal(msg); err == nil {
+		h.broadcastToChannelName(msg.Channel, msgBytes)
+	}
+	return nil
+}
+
+// deleteMessage marks a message deleted and broadcasts message_deleted to
+// its channel. Channel owners and moderators may delete any message there.
+func (h *Hub) deleteMessage(username string, id int) error {
+	if _, err := h.authorizeMessageChange(username, id, true); err != nil {
+		return err
+	}
+
+	msg, err := h.store.DeleteMessage(id, username, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	msg.Type = "message_deleted"
+	if msgBytes, err := json.Marshal(msg); err == nil {
+		h.broadcastToChannelName(msg.Channel, msgBytes)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMessageChangeAuthorization(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.moderators = map[string]bool{"mod": true}
+
+	if err := store.CreateChannel("team", Persistent); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+	id, err := hub.saveMessage(Message{Username: "alice", Content: "original", Type: "message", Channel: "team", Timestamp: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("Failed to save message: %v", err)
+	}
+
+	if err := hub.editMessage("bob", id, "hijacked"); !errors.Is(err, errNotMessageAuthor) {
+		t.Errorf("Expected errNotMessageAuthor for another user, got %v", err)
+	}
+	if err := hub.editMessage("alice", id, "   "); !errors.Is(err, errEmptyMessage) {
+		t.Errorf("Expected errEmptyMessage, got %v", err)
+	}
+	if err := hub.editMessage("alice", id+1000, "missing"); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("Expected errMessageNotFound, got %v", err)
+	}
+	if err := hub.editMessage("alice", id, "revised"); err != nil {
+		t.Errorf("Expected author to edit, got %v", err)
+	}
+	if err := hub.deleteMessage("bob", id); !errors.Is(err, errNotMessageAuthor) {
+		t.Errorf("Expected errNotMessageAuthor deleting another user's message, got %v", err)
+	}
+	if err := hub.deleteMessage("mod", id); err != nil {
+		t.Errorf("Expected moderator to delete, got %v", err)
+	}
+	if err := hub.deleteMessage("alice", id); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("Expected errMessageNotFound for a deleted message, got %v", err)
+	}
+
+	// Channel owners and moderators may delete, but not edit, others' messages
+	store.SetChannelRole("team", "carol", roleModerator)
+	store.SetChannelRole("team", "dave", roleMember)
+	id, _ = hub.saveMessage(Message{Username: "alice", Content: "off topic", Type: "message", Channel: "team", Timestamp: time.Now().UTC()})
+	if err := hub.editMessage("carol", id, "on topic"); !errors.Is(err, errNotMessageAuthor) {
+		t.Errorf("Expected a channel moderator refused an edit, got %v", err)
+	}
+	if err := hub.deleteMessage("dave", id); !errors.Is(err, errNotMessageAuthor) {
+		t.Errorf("Expected a member refused, got %v", err)
+	}
+	if err := hub.deleteMessage("carol", id); err != nil {
+		t.Errorf("Expected the channel moderator to delete, got %v", err)
+	}
+}
+
+func TestMessageEditBroadcast(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	if err := store.CreateChannel("team", Persistent); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	sendJSON(t, alice, Message{Type: "join_channel", Channel: "team"})
+	readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" })
+	sendJSON(t, bob, Message{Type: "join_channel", Channel: "team"})
+	readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" })
+
+	sendJSON(t, alice, Message{Type: "message", Content: "teh plan"})
+	sent := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	id, ok := sent["id"].(float64)
+	if !ok || id == 0 {
+		t.Fatalf("Expected broadcast message to carry its ID, got %v", sent)
+	}
+
+	sendJSON(t, alice, EditMessageRequest{Type: "edit_message", ID: int(id), Content: "the plan"})
+	edited := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message_edited" })
+	if edited["content"] != "the plan" || edited["id"] != id || edited["edited_at"] == nil {
+		t.Errorf("Unexpected message_edited frame: %v", edited)
+	}
+
+	// Bob cannot delete Alice's message
+	sendJSON(t, bob, DeleteMessageRequest{Type: "delete_message", ID: int(id)})
+	expectNone(t, alice, 200*time.Millisecond, func(msg map[string]interface{}) bool {
+		return msg["type"] == "message_deleted"
+	})
+
+	sendJSON(t, alice, DeleteMessageRequest{Type: "delete_message", ID: int(id)})
+	deleted := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message_deleted" })
+	if deleted["id"] != id || deleted["deleted_at"] == nil || deleted["content"] != "" {
+		t.Errorf("Unexpected message_deleted frame: %v", deleted)
+	}
+}
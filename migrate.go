@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is one versioned schema change. Files are named
+// NNNN_description.up.sql / NNNN_description.down.sql.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+type migrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		versionStr, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name: %s", fileName)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %s", fileName)
+		}
+
+		contents, err := fs.ReadFile(fsys, "migrations/"+fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		} else if m.name != name {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.name, name)
+		}
+		if direction == "up" {
+			m.up = string(contents)
+		} else {
+			m.down = string(contents)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration versions must be sequential: expected %d, found %d", i+1, m.version)
+		}
+	}
+	return migrations, nil
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+func currentSchemaVersion(db *sql.DB) (int, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// checkSchemaVersion refuses to run against a schema newer than the
+// migrations compiled into this binary.
+func checkSchemaVersion(db *sql.DB, migrations []migration) (int, error) {
+	version, err := currentSchemaVersion(db)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	latest := len(migrations)
+	if version > latest {
+		return version, fmt.Errorf("database schema version %d is newer than this binary supports (%d); upgrade EchoRoom", version, latest)
+	}
+	return version, nil
+}
+
+// migrationLockID keys the PostgreSQL advisory lock held while migrating.
+const migrationLockID = 0x6563686f726f6f6d // "echoroom"
+
+// withMigrationLock runs fn holding the migration lock, so that replicas
+// starting together do not apply the same migrations at once. The lock is
+// held by a connection of its own and released when fn returns.
+func withMigrationLock(db *sql.DB, fn func() error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to take migration lock: %v", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+			log.Printf("Error releasing migration lock: %v", err)
+		}
+	}()
+	return fn()
+}
+
+// migrateUp applies all pending migrations, each in its own transaction,
+// under the migration lock. Migrations another replica applied while this
+// one waited for the lock are skipped.
+func migrateUp(db *sql.DB, migrations []migration) (applied int, err error) {
+	err = withMigrationLock(db, func() error {
+		applied, err = applyPending(db, migrations)
+		return err
+	})
+	return applied, err
+}
+
+func applyPending(db *sql.DB, migrations []migration) (int, error) {
+	version, err := checkSchemaVersion(db, migrations)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range migrations[version:] {
+		tx, err := db.Begin()
+		if err != nil {
+			return applied, err
+		}
+		if _, err := tx.Exec(m.up); err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("migration %d_%s failed: %v", m.version, m.name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name); err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, err
+		}
+		log.Printf("Applied migration %d_%s", m.version, m.name)
+		applied++
+	}
+	return applied, nil
+}
+
+// migrateDown reverts the most recent steps migrations under the migration
+// lock.
+func migrateDown(db *sql.DB, migrations []migration, steps int) (reverted int, err error) {
+	err = withMigrationLock(db, func() error {
+		reverted, err = revertLatest(db, migrations, steps)
+		return err
+	})
+	return reverted, err
+}
+
+func revertLatest(db *sql.DB, migrations []migration, steps int) (int, error) {
+	version, err := checkSchemaVersion(db, migrations)
+	if err != nil {
+		return 0, err
+	}
+
+	reverted := 0
+	for ; reverted < steps && version > 0; version-- {
+		m := migrations[version-1]
+		tx, err := db.Begin()
+		if err != nil {
+			return reverted, err
+		}
+		if _, err := tx.Exec(m.down); err != nil {
+			tx.Rollback()
+			return reverted, fmt.Errorf("reverting migration %d_%s failed: %v", m.version, m.name, err)
+		}
+		if _, err := tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.version); err != nil {
+			tx.Rollback()
+			return reverted, err
+		}
+		if err := tx.Commit(); err != nil {
+			return reverted, err
+		}
+		log.Printf("Reverted migration %d_%s", m.version, m.name)
+		reverted++
+	}
+	return reverted, nil
+}
+
+func getMigrationStatus(db *sql.DB, migrations []migration) ([]migrationStatus, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]migrationStatus)
+	for rows.Next() {
+		var status migrationStatus
+		var appliedAt time.Time
+		if err := rows.Scan(&status.Version, &status.Name, &appliedAt); err != nil {
+			return nil, err
+		}
+		status.AppliedAt = &appliedAt
+		applied[status.Version] = status
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var statuses []migrationStatus
+	for _, m := range migrations {
+		status, ok := applied[m.version]
+		if !ok {
+			status = migrationStatus{Version: m.version, Name: m.name}
+		}
+		delete(applied, m.version)
+		statuses = append(statuses, status)
+	}
+	// Versions recorded in the database but unknown to this binary
+	for _, status := range applied {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// runMigrateCommand implements `echoroom migrate up|down [steps]|status`.
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrateUp(db, migrations)
+		if err != nil {
+			return err
+		}
+		log.Printf("Applied %d migration(s)", applied)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+		}
+		reverted, err := migrateDown(db, migrations, steps)
+		if err != nil {
+			return err
+		}
+		log.Printf("Reverted %d migration(s)", reverted)
+	case "status":
+		statuses, err := getMigrationStatus(db, migrations)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			if status.Version > len(migrations) {
+				state += " (unknown to this binary)"
+			}
+			fmt.Fprintf(os.Stdout, "%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q (expected up, down or status)", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatalf("Failed to load embedded migrations: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("Expected at least one embedded migration")
+	}
+
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Expected migration %d at position %d, got %d", i+1, i, m.version)
+		}
+		if strings.TrimSpace(m.up) == "" || strings.TrimSpace(m.down) == "" {
+			t.Errorf("Migration %d_%s should have up and down SQL", m.version, m.name)
+		}
+	}
+}
+
+func TestLoadMigrationsValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"migrations/0001_init.up.sql": {Data: []byte("SELECT 1")},
+			},
+		},
+		{
+			name: "gap in versions",
+			files: fstest.MapFS{
+				"migrations/0001_init.up.sql":    {Data: []byte("SELECT 1")},
+				"migrations/0001_init.down.sql":  {Data: []byte("SELECT 1")},
+				"migrations/0003_later.up.sql":   {Data: []byte("SELECT 1")},
+				"migrations/0003_later.down.sql": {Data: []byte("SELECT 1")},
+			},
+		},
+		{
+			name: "bad version",
+			files: fstest.MapFS{
+				"migrations/abc_init.up.sql":   {Data: []byte("SELECT 1")},
+				"migrations/abc_init.down.sql": {Data: []byte("SELECT 1")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadMigrations(tt.files); err == nil {
+				t.Error("Expected loadMigrations to fail")
+			}
+		})
+	}
+}
+
+func TestMigrateUpDownStatus(t *testing.T) {
+	db := setupTestDB(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+
+	// setupTestDB already migrated to the latest version
+	version, err := currentSchemaVersion(db)
+	if err != nil {
+		t.Fatalf("Failed to read schema version: %v", err)
+	}
+	if version != len(migrations) {
+		t.Errorf("Expected schema version %d, got %d", len(migrations), version)
+	}
+
+	applied, err := migrateUp(db, migrations)
+	if err != nil || applied != 0 {
+		t.Errorf("Expected no pending migrations, applied %d: %v", applied, err)
+	}
+
+	reverted, err := migrateDown(db, migrations, len(migrations))
+	if err != nil {
+		t.Fatalf("Failed to migrate down: %v", err)
+	}
+	if reverted != len(migrations) {
+		t.Errorf("Expected %d reverted migrations, got %d", len(migrations), reverted)
+	}
+
+	statuses, err := getMigrationStatus(db, migrations)
+	if err != nil {
+		t.Fatalf("Failed to get migration status: %v", err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			t.Errorf("Migration %d should be pending after migrating down", status.Version)
+		}
+	}
+
+	if _, err := migrateUp(db, migrations); err != nil {
+		t.Fatalf("Failed to migrate up: %v", err)
+	}
+	var tableName string
+	err = db.QueryRow("SELECT table_name FROM information_schema.tables WHERE table_name = 'messages'").Scan(&tableName)
+	if err != nil {
+		t.Errorf("Messages table not found after migrating up: %v", err)
+	}
+}
+
+func TestCheckSchemaVersionRejectsNewerSchema(t *testing.T) {
+	db := setupTestDB(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+
+	future := len(migrations) + 1
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, 'from_the_future')", future); err != nil {
+		t.Fatalf("Failed to record future migration: %v", err)
+	}
+
+	if _, err := checkSchemaVersion(db, migrations); err == nil {
+		t.Error("Expected newer schema version to be rejected")
+	}
+	if _, err := migrateUp(db, migrations); err == nil {
+		t.Error("Expected migrateUp to refuse a newer schema")
+	}
+}
+
+func TestConcurrentMigrateUpAppliesOnce(t *testing.T) {
+	db := setupTestDB(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+	if _, err := migrateDown(db, migrations, len(migrations)); err != nil {
+		t.Fatalf("Failed to migrate down: %v", err)
+	}
+
+	// Replicas starting together each try to migrate the fresh database
+	const replicas = 4
+	results := make(chan int, replicas)
+	errs := make(chan error, replicas)
+	for i := 0; i < replicas; i++ {
+		go func() {
+			replica, err := openTestDB()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer replica.Close()
+			applied, err := migrateUp(replica, migrations)
+			if err != nil {
+				errs <- err
+				return
+			}
+			results <- applied
+		}()
+	}
+	total := 0
+	for i := 0; i < replicas; i++ {
+		select {
+		case applied := <-results:
+			total += applied
+		case err := <-errs:
+			t.Errorf("Replica failed to migrate: %v", err)
+		}
+	}
+	if total != len(migrations) {
+		t.Errorf("Expected each of %d migrations applied once, applied %d", len(migrations), total)
+	}
+}
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS channels (
+    name VARCHAR(100) PRIMARY KEY,
+    type VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS messages (
+    id SERIAL PRIMARY KEY,
+    channel_name VARCHAR(100) NOT NULL,
+    username VARCHAR(100) NOT NULL,
+    content TEXT NOT NULL,
+    timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (channel_name) REFERENCES channels (name)
+);
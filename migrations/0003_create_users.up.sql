@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS users (
+    username VARCHAR(100) PRIMARY KEY,
+    password_hash VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS idx_messages_channel_id ON messages (channel_name, id);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS channel_members (
+    channel_name VARCHAR(100) NOT NULL REFERENCES channels (name) ON DELETE CASCADE,
+    username VARCHAR(100) NOT NULL,
+    joined_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (channel_name, username)
+);
+CREATE INDEX IF NOT EXISTS idx_channel_members_username ON channel_members (username);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS message_edits;
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS deleted_at,
+    DROP COLUMN IF EXISTS edited_at;
@@ -0,0 +1,12 @@
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS message_edits (
+    id SERIAL PRIMARY KEY,
+    message_id INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    previous_content TEXT NOT NULL,
+    edited_by VARCHAR(100) NOT NULL,
+    edited_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_message_edits_message_id ON message_edits (message_id);
@@ -0,0 +1,3 @@
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES messages (id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS idx_messages_parent_id ON messages (parent_id, id);
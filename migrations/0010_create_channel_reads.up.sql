@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS channel_reads (
+    username VARCHAR(100) NOT NULL,
+    channel_name VARCHAR(100) NOT NULL REFERENCES channels (name) ON DELETE CASCADE,
+    last_read_id INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (username, channel_name)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_username_client_msg_id_key;
+ALTER TABLE messages DROP COLUMN IF EXISTS client_msg_id;
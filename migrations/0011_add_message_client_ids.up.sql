@@ -0,0 +1,3 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_msg_id VARCHAR(64);
+ALTER TABLE messages
+    ADD CONSTRAINT messages_username_client_msg_id_key UNIQUE (username, client_msg_id);
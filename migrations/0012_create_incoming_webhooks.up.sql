@@ -0,0 +1,13 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS display_name VARCHAR(100);
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachments JSONB;
+
+CREATE TABLE IF NOT EXISTS incoming_webhooks (
+    id SERIAL PRIMARY KEY,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    channel_name VARCHAR(100) NOT NULL,
+    name VARCHAR(32) NOT NULL,
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_incoming_webhooks_channel_name ON incoming_webhooks (channel_name);
@@ -0,0 +1 @@
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS topic VARCHAR(250) NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+DELETE FROM channel_members WHERE channel_name IN (SELECT name FROM channels WHERE type <> 'direct');
+ALTER TABLE channel_members DROP COLUMN IF EXISTS role;
+ALTER TABLE channels DROP COLUMN IF EXISTS owner;
@@ -0,0 +1,3 @@
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS owner VARCHAR(100);
+ALTER TABLE channel_members ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'member'
+    CHECK (role IN ('owner', 'moderator', 'member', 'read-only'));
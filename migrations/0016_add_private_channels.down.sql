@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS channel_invites;
+ALTER TABLE channels DROP COLUMN IF EXISTS private;
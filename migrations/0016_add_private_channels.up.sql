@@ -0,0 +1,12 @@
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS private BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS channel_invites (
+    id SERIAL PRIMARY KEY,
+    code_hash CHAR(64) NOT NULL UNIQUE,
+    channel_name VARCHAR(100) NOT NULL REFERENCES channels (name) ON DELETE CASCADE,
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    max_uses INTEGER NOT NULL DEFAULT 0,
+    uses INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS sanctions;
+ALTER TABLE channels DROP COLUMN IF EXISTS slow_mode;
@@ -0,0 +1,30 @@
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS slow_mode INTEGER NOT NULL DEFAULT 0;
+
+-- Sanctions may name ephemeral channels, which are not stored, so
+-- channel_name has no foreign key; server-wide sanctions leave it empty.
+CREATE TABLE IF NOT EXISTS sanctions (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(10) NOT NULL CHECK (kind IN ('mute', 'ban')),
+    channel_name VARCHAR(100) NOT NULL DEFAULT '',
+    username VARCHAR(100) NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    UNIQUE (kind, channel_name, username)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sanctions_username ON sanctions (username, expires_at);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id SERIAL PRIMARY KEY,
+    action VARCHAR(20) NOT NULL,
+    channel_name VARCHAR(100) NOT NULL DEFAULT '',
+    actor VARCHAR(100) NOT NULL,
+    target VARCHAR(100) NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    details TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_channel ON audit_log (channel_name, id);
@@ -0,0 +1,9 @@
+-- Cluster events too large for a NOTIFY payload. The publishing node
+-- notifies the row's ID instead, and rows older than a minute are deleted.
+CREATE TABLE IF NOT EXISTS cluster_events (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_cluster_events_created_at ON cluster_events (created_at);
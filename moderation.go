@@ -0,0 +1,581 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Moderators deal with disruptive users by kicking them out of a channel,
+// muting them so they cannot post, or banning them so they cannot join,
+// for a while. Mutes and bans apply to one channel or, from server
+// moderators, everywhere. Slow mode makes users wait between messages.
+// Every action is recorded in the audit log.
+
+// Kinds of sanction.
+const (
+	sanctionMute = "mute"
+	sanctionBan  = "ban"
+)
+
+// Moderation actions, as named in commands, notices and the audit log.
+const (
+	actionKick     = "kick"
+	actionMute     = "mute"
+	actionUnmute   = "unmute"
+	actionBan      = "ban"
+	actionUnban    = "unban"
+	actionSlowMode = "slow_mode"
+)
+
+// sanctionKinds maps the actions that add or lift a sanction to its kind.
+var sanctionKinds = map[string]string{
+	actionMute:   sanctionMute,
+	actionUnmute: sanctionMute,
+	actionBan:    sanctionBan,
+	actionUnban:  sanctionBan,
+}
+
+// Limits on moderation requests.
+const (
+	maxSanctionDuration = 365 * 24 * time.Hour
+	maxSlowMode         = time.Hour
+	maxReasonLength     = 250
+	defaultAuditLimit   = 50
+	maxAuditLimit       = 200
+)
+
+// serverBanReason is the close reason sent to connections of a user banned
+// server-wide.
+const serverBanReason = "banned from the server"
+
+var (
+	errInvalidSanction      = fmt.Errorf("duration must be between 1 and %d seconds", int(maxSanctionDuration.Seconds()))
+	errInvalidSlowMode      = fmt.Errorf("slow mode must be between 0 and %d seconds", int(maxSlowMode.Seconds()))
+	errReasonTooLong        = fmt.Errorf("reason must be at most %d characters", maxReasonLength)
+	errModerateSelf         = errors.New("you cannot moderate yourself")
+	errServerModeratorsOnly = errors.New("only server moderators can moderate users server-wide")
+	errNotInChannel         = errors.New("user is not in this channel")
+	errRemovedFromChannel   = errors.New("you were removed from this channel; join it again")
+)
+
+// slowModeKey identifies a user's messages in a channel.
+type slowModeKey struct {
+	Channel  string
+	Username string
+}
+
+// moderate runs a moderation action on req.Username, in req.Channel or
+// everywhere if req.Server is set. Actors must manage the channel
+// (permManage), or be server moderators for server-wide actions, and must
+// outrank the user.
+func (h *Hub) moderate(actor, action string, req ModerationRequest) error {
+	if len([]rune(req.Reason)) > maxReasonLength {
+		return errReasonTooLong
+	}
+	channelName := req.Channel
+	if req.Server {
+		if action == actionKick {
+			return newCommandError(errorInvalidArgument, "kicks apply to one channel")
+		}
+		channelName = ""
+	} else if channelName == "" {
+		return newCommandError(errorInvalidArgument, "channel is required")
+	}
+	if err := h.checkModeration(actor, channelName, req.Username); err != nil {
+		return err
+	}
+
+	switch action {
+	case actionKick:
+		return h.kick(actor, channelName, req.Username, req.Reason)
+	case actionMute, actionBan:
+		if req.Duration <= 0 || req.Duration > int(maxSanctionDuration.Seconds()) {
+			return errInvalidSanction
+		}
+		return h.addSanction(actor, action, channelName, req.Username, time.Duration(req.Duration)*time.Second, req.Reason)
+	case actionUnmute, actionUnban:
+		return h.liftSanction(actor, action, channelName, req.Username, req.Reason)
+	}
+	return newCommandError(errorInvalidArgument, fmt.Sprintf("unknown moderation action %q", action))
+}
+
+// checkModeration checks that actor may moderate username in a channel, or
+// server-wide when channelName is empty.
+func (h *Hub) checkModeration(actor, channelName, username string) error {
+	if err := validateUsername(username); err != nil {
+		return newCommandError(errorInvalidArgument, err.Error())
+	}
+	if username == actor {
+		return errModerateSelf
+	}
+	if channelName == "" {
+		if !h.isModerator(actor) {
+			return errServerModeratorsOnly
+		}
+	} else if !h.can(actor, channelName, permManage) {
+		return errNotChannelAdmin
+	}
+	actorRank, err := h.moderationRank(channelName, actor)
+	if err != nil {
+		return err
+	}
+	targetRank, err := h.moderationRank(channelName, username)
+	if err != nil {
+		return err
+	}
+	if actorRank <= targetRank {
+		return errNotChannelAdmin
+	}
+	return nil
+}
+
+// moderationRank ranks username in a channel, or server-wide, by role.
+func (h *Hub) moderationRank(channelName, username string) (int, error) {
+	if h.isModerator(username) {
+		return rankServerModerator, nil
+	}
+	if channelName == "" {
+		return roleRanks[""], nil
+	}
+	role, err := h.channelRole(channelName, username)
+	return roleRanks[role], err
+}
+
+// kick takes username's connections out of a channel on every node. They
+// may join again unless they are banned.
+func (h *Hub) kick(actor, channelName, username, reason string) error {
+	if !h.isInChannel(channelName, username) {
+		return errNotInChannel
+	}
+	notice := ModerationNotice{Action: actionKick, Channel: channelName, Username: username, By: actor, Reason: reason}
+	h.eject(notice)
+	h.announceModeration(notice)
+	log.Printf("%s kicked %s from channel '%s'", actor, username, channelName)
+	h.recordAudit(AuditEntry{Action: actionKick, Channel: channelName, Actor: actor, Target: username, Reason: reason})
+	return nil
+}
+
+// addSanction mutes or bans username for duration, replacing any earlier
+// mute or ban. Banned users are taken out of the channel, or disconnected
+// everywhere for a server-wide ban.
+func (h *Hub) addSanction(actor, action, channelName, username string, duration time.Duration, reason string) error {
+	now := time.Now().UTC()
+	sanction := Sanction{
+		Kind:      sanctionKinds[action],
+		Channel:   channelName,
+		Username:  username,
+		Reason:    reason,
+		CreatedBy: actor,
+		CreatedAt: now,
+		ExpiresAt: now.Add(duration),
+	}
+	if _, err := h.store.SetSanction(sanction); err != nil {
+		return err
+	}
+	log.Printf("%s gave %s a %s in %s until %s", actor, username, sanction.Kind, describeScope(channelName), sanction.ExpiresAt.Format(time.RFC3339))
+
+	notice := ModerationNotice{Action: action, Channel: channelName, Username: username, By: actor, Reason: reason, Until: &sanction.ExpiresAt}
+	if sanction.Kind == sanctionBan {
+		h.eject(notice)
+	}
+	h.announceModeration(notice)
+	h.recordAudit(AuditEntry{Action: action, Channel: channelName, Actor: actor, Target: username, Reason: reason, Details: duration.String()})
+	return nil
+}
+
+// liftSanction ends username's mute or ban before it expires.
+func (h *Hub) liftSanction(actor, action, channelName, username, reason string) error {
+	if err := h.store.RemoveSanction(sanctionKinds[action], channelName, username, time.Now().UTC()); err != nil {
+		return err
+	}
+	log.Printf("%s lifted %s's %s in %s", actor, username, sanctionKinds[action], describeScope(channelName))
+	h.announceModeration(ModerationNotice{Action: action, Channel: channelName, Username: username, By: actor, Reason: reason})
+	h.recordAudit(AuditEntry{Action: action, Channel: channelName, Actor: actor, Target: username, Reason: reason})
+	return nil
+}
+
+// describeScope names a channel, or the whole server, for logs and errors.
+func describeScope(channelName string) string {
+	if channelName == "" {
+		return "the server"
+	}
+	return "#" + channelName
+}
+
+// sanctionError explains why a mute or ban stops username doing what perm
+// allows in a channel, or returns nil if nothing does. Bans stop
+// everything; mutes stop posting. Server moderators are never stopped.
+func (h *Hub) sanctionError(username, channelName string, perm permission) error {
+	if h.isModerator(username) {
+		return nil
+	}
+	sanctions, err := h.store.ListSanctions(username, time.Now().UTC())
+	if err != nil {
+		log.Printf("Error loading sanctions on %s: %v", username, err)
+		return err
+	}
+	for _, s := range sanctions {
+		if s.Channel != "" && s.Channel != channelName {
+			continue
+		}
+		if s.Kind == sanctionBan {
+			return newCommandError(errorForbidden, fmt.Sprintf("you are banned from %s until %s", describeScope(s.Channel), s.ExpiresAt.UTC().Format(time.RFC3339)))
+		}
+		if perm == permPost {
+			return newCommandError(errorForbidden, fmt.Sprintf("you are muted in %s until %s", describeScope(s.Channel), s.ExpiresAt.UTC().Format(time.RFC3339)))
+		}
+	}
+	return nil
+}
+
+// serverBanError returns why username may not connect, if they are banned
+// server-wide. Connections are let through if sanctions cannot be loaded;
+// can still refuses them everything.
+func (h *Hub) serverBanError(username string) error {
+	if h.isModerator(username) {
+		return nil
+	}
+	sanctions, err := h.store.ListSanctions(username, time.Now().UTC())
+	if err != nil {
+		log.Printf("Error loading sanctions on %s: %v", username, err)
+		return nil
+	}
+	for _, s := range sanctions {
+		if s.Kind == sanctionBan && s.Channel == "" {
+			return newCommandError(errorForbidden, fmt.Sprintf("you are banned from the server until %s", s.ExpiresAt.UTC().Format(time.RFC3339)))
+		}
+	}
+	return nil
+}
+
+// isInChannel reports whether any of username's connections, on any node,
+// receive a channel.
+func (h *Hub) isInChannel(channelName, username string) bool {
+	h.channelsMu.RLock()
+	channel, ok := h.channels[channelName]
+	h.channelsMu.RUnlock()
+	if ok {
+		channel.clientsMu.RLock()
+		for c := range channel.clients {
+			if c.username == username {
+				channel.clientsMu.RUnlock()
+				return true
+			}
+		}
+		channel.clientsMu.RUnlock()
+	}
+	return slices.Contains(h.remoteUsernames(channelName), username)
+}
+
+// eject takes the user a kick or ban notice names out of its channel on
+// every node, sending their clients there the notice first, or disconnects
+// them everywhere for a server-wide ban.
+func (h *Hub) eject(notice ModerationNotice) {
+	notice.Type = "moderation"
+	msgBytes, err := json.Marshal(notice)
+	if err != nil {
+		log.Printf("Error marshaling moderation notice: %v", err)
+		return
+	}
+	h.ejectLocal(notice.Channel, notice.Username, msgBytes)
+	h.publish(ClusterEvent{Kind: eventKick, Channel: notice.Channel, Users: []string{notice.Username}, Payload: msgBytes})
+}
+
+// ejectLocal does eject's work for this node's clients.
+func (h *Hub) ejectLocal(channelName, username string, notice []byte) {
+	if channelName == "" {
+		h.disconnectUser(username, serverBanReason)
+		return
+	}
+	h.removeFromChannel(channelName, username, notice)
+}
+
+// removeFromChannel sends notice, if any, to username's local clients in a
+// channel and takes them out of its clients, as if they had left. Their focused
+// channel stays as it was; posting there is refused until they join it
+// again, which the notice tells them to do.
+func (h *Hub) removeFromChannel(channelName, username string, notice []byte) {
+	h.channelsMu.RLock()
+	channel, ok := h.channels[channelName]
+	h.channelsMu.RUnlock()
+	if !ok {
+		return
+	}
+
+	removed := 0
+	channel.clientsMu.Lock()
+	for c := range channel.clients {
+		if c.username != username {
+			continue
+		}
+		// Sent under the lock, before the hub can close the client's send
+		// channel on unregistering it
+		if notice != nil {
+			select {
+			case c.send <- notice:
+			default:
+			}
+		}
+		delete(channel.clients, c)
+		delete(channel.focused, c)
+		c.markRemoved(channelName)
+		removed++
+	}
+	clientCount := len(channel.clients)
+	channel.clientsMu.Unlock()
+	if removed == 0 {
+		return
+	}
+
+	log.Printf("Removed %d connection(s) of %s from channel '%s'", removed, username, channelName)
+	h.publishPresence(channelName, clientCount)
+	h.announcePresence(channelName, username, presenceLeave)
+	if clientCount == 0 && channelName != "general" {
+		h.closeChannel(channel, nil)
+	}
+}
+
+// disconnectUser closes username's local connections with reason.
+func (h *Hub) disconnectUser(username, reason string) {
+	var clients []*Client
+	seen := make(map[*Client]bool)
+	h.channelsMu.RLock()
+	for _, ch := range h.channels {
+		ch.clientsMu.RLock()
+		for c := range ch.clients {
+			if c.username == username && !seen[c] {
+				seen[c] = true
+				clients = append(clients, c)
+			}
+		}
+		ch.clientsMu.RUnlock()
+	}
+	h.channelsMu.RUnlock()
+
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	for _, c := range clients {
+		if c.conn == nil {
+			continue
+		}
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		c.disconnect()
+	}
+	if len(clients) > 0 {
+		log.Printf("Disconnected %d connection(s) of %s: %s", len(clients), username, reason)
+	}
+}
+
+// markRemoved records that a moderator took the client out of a channel.
+func (c *Client) markRemoved(channelName string) {
+	c.removedMu.Lock()
+	defer c.removedMu.Unlock()
+	if c.removed == nil {
+		c.removed = make(map[string]bool)
+	}
+	c.removed[channelName] = true
+}
+
+// wasRemoved reports whether a moderator took the client out of a channel
+// it has not joined again since.
+func (c *Client) wasRemoved(channelName string) bool {
+	c.removedMu.Lock()
+	defer c.removedMu.Unlock()
+	return c.removed[channelName]
+}
+
+// checkMessageChannel refuses a command on a message in a channel a
+// moderator took the client out of. Messages that cannot be loaded are
+// left for the command to report.
+func (c *Client) checkMessageChannel(messageID int) error {
+	c.removedMu.Lock()
+	removed := len(c.removed) > 0
+	c.removedMu.Unlock()
+	if !removed {
+		return nil
+	}
+	msg, err := c.hub.store.GetMessage(messageID)
+	if err == nil && c.wasRemoved(msg.Channel) {
+		return errRemovedFromChannel
+	}
+	return nil
+}
+
+// rejoined forgets that the client was taken out of a channel.
+func (c *Client) rejoined(channelName string) {
+	c.removedMu.Lock()
+	defer c.removedMu.Unlock()
+	delete(c.removed, channelName)
+}
+
+// announceModeration tells a channel's members about a moderation action,
+// or only the user concerned when it is server-wide.
+func (h *Hub) announceModeration(notice ModerationNotice) {
+	notice.Type = "moderation"
+	msgBytes, err := json.Marshal(notice)
+	if err != nil {
+		log.Printf("Error marshaling moderation notice: %v", err)
+		return
+	}
+	if notice.Channel == "" {
+		h.sendToUsers([]string{notice.Username}, msgBytes)
+	} else {
+		h.broadcastToChannelName(notice.Channel, msgBytes)
+	}
+}
+
+// recordAudit adds an entry to the audit log. The action has already taken
+// effect, so failures are only logged.
+func (h *Hub) recordAudit(entry AuditEntry) {
+	entry.CreatedAt = time.Now().UTC()
+	if _, err := h.store.AddAuditEntry(entry); err != nil {
+		log.Printf("Error recording %s by %s in the audit log: %v", entry.Action, entry.Actor, err)
+	}
+}
+
+// auditLog returns up to limit of the newest audit entries for a channel,
+// which its managers may read, or for everything when channelName is
+// empty, which only server moderators may read.
+func (h *Hub) auditLog(username, channelName string, limit int) ([]AuditEntry, error) {
+	if channelName == "" {
+		if !h.isModerator(username) {
+			return nil, errServerModeratorsOnly
+		}
+	} else if !h.can(username, channelName, permManage) {
+		return nil, errNotChannelAdmin
+	}
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	return h.store.ListAuditLog(channelName, min(limit, maxAuditLimit))
+}
+
+// setSlowMode makes users wait seconds between messages in a channel; zero
+// turns slow mode off. Ephemeral channels keep their interval while they
+// are active.
+func (h *Hub) setSlowMode(actor, channelName string, seconds int) error {
+	if seconds < 0 || seconds > int(maxSlowMode.Seconds()) {
+		return errInvalidSlowMode
+	}
+	if !h.can(actor, channelName, permManage) {
+		return errNotChannelAdmin
+	}
+	interval := time.Duration(seconds) * time.Second
+	err := h.store.SetChannelSlowMode(channelName, seconds)
+	if errors.Is(err, errChannelNotFound) {
+		h.channelsMu.RLock()
+		channel, ok := h.channels[channelName]
+		h.channelsMu.RUnlock()
+		if ok {
+			channel.clientsMu.Lock()
+			channel.slowMode = interval
+			channel.clientsMu.Unlock()
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Slow mode of channel '%s' set to %s by %s", channelName, interval, actor)
+
+	h.announceModeration(ModerationNotice{Action: actionSlowMode, Channel: channelName, By: actor, Seconds: seconds})
+	h.recordAudit(AuditEntry{Action: actionSlowMode, Channel: channelName, Actor: actor, Details: interval.String()})
+	return nil
+}
+
+// slowModeInterval returns how long users wait between messages in a
+// stored channel or an active ephemeral one.
+func (h *Hub) slowModeInterval(channelName string) time.Duration {
+	seconds, err := h.store.GetChannelSlowMode(channelName)
+	if err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if !errors.Is(err, errChannelNotFound) {
+		log.Printf("Error loading slow mode of channel '%s': %v", channelName, err)
+		return 0
+	}
+	h.channelsMu.RLock()
+	channel, ok := h.channels[channelName]
+	h.channelsMu.RUnlock()
+	if !ok {
+		return 0
+	}
+	channel.clientsMu.RLock()
+	defer channel.clientsMu.RUnlock()
+	return channel.slowMode
+}
+
+// checkPost checks that a user may post message now: they must not be
+// muted or banned, their role must allow posting, and in slow mode they
+// must have waited out the interval since their last message, which
+// passing the check restarts. Resends of a stored message pass, so that
+// they can be acknowledged.
+func (h *Hub) checkPost(message Message) error {
+	if err := h.checkCanPost(message.Username, message.Channel); err != nil {
+		return err
+	}
+	err := h.takeSlowModeTurn(message.Username, message.Channel)
+	if err != nil && message.ClientMsgID != "" {
+		if _, lookupErr := h.store.GetMessageByClientID(message.Username, message.ClientMsgID); lookupErr == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkCanPost checks that username may add content to a channel, by
+// posting, editing, reacting or setting its topic: they must not be muted
+// or banned there, and their role must allow posting.
+func (h *Hub) checkCanPost(username, channelName string) error {
+	if err := h.sanctionError(username, channelName, permPost); err != nil {
+		return err
+	}
+	if !h.can(username, channelName, permPost) {
+		return errCannotPost
+	}
+	return nil
+}
+
+// takeSlowModeTurn lets username post in a channel in slow mode if they
+// waited out its interval, and starts it again. Channel managers are
+// exempt.
+func (h *Hub) takeSlowModeTurn(username, channelName string) error {
+	interval := h.slowModeInterval(channelName)
+	if interval == 0 || h.can(username, channelName, permManage) {
+		return nil
+	}
+
+	h.slowModeMu.Lock()
+	defer h.slowModeMu.Unlock()
+	now := time.Now()
+	key := slowModeKey{Channel: channelName, Username: username}
+	if wait := h.lastPosts[key].Add(interval).Sub(now); wait > 0 {
+		return newCommandError(errorRateLimited, fmt.Sprintf("#%s is in slow mode: wait %d seconds before posting again", channelName, int(math.Ceil(wait.Seconds()))))
+	}
+	h.lastPosts[key] = now
+
+	// Forget turns no interval can still be running for
+	if len(h.lastPosts) > 1024 {
+		for k, last := range h.lastPosts {
+			if now.Sub(last) > maxSlowMode {
+				delete(h.lastPosts, k)
+			}
+		}
+	}
+	return nil
+}
+
+// handleModeration answers the kick, mute, unmute, ban and unban commands.
+// Channel actions default to the focused channel.
+func (c *Client) handleModeration(action string, req ModerationRequest) error {
+	if req.Channel == "" && !req.Server {
+		req.Channel = c.focusedChannel()
+	}
+	return c.hub.moderate(c.username, action, req)
+}
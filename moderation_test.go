@@ -0,0 +1,383 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestKick(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.moderators = map[string]bool{"mod": true}
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	request := startAPIServer(t, hub)
+	if err := hub.createChannelInDB("team", Persistent, "alice", false); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+
+	isSwitch := func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" }
+	isNotice := func(msg map[string]interface{}) bool { return msg["type"] == "moderation" }
+	isError := func(msg map[string]interface{}) bool { return msg["type"] == "error" }
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"alice", "bob", "carol", "mod"} {
+		conns[name] = dialTestClient(t, hub, wsURL, name)
+		sendJSON(t, conns[name], map[string]interface{}{"type": "join_channel", "channel": "team"})
+		readUntil(t, conns[name], isSwitch)
+	}
+	alice, bob, carol := conns["alice"], conns["bob"], conns["carol"]
+
+	// Members cannot kick, and nobody can kick someone of their own rank
+	// or above
+	steps := []struct {
+		actor, username, want string
+	}{
+		{"carol", "bob", errorForbidden},
+		{"alice", "alice", errorInvalidArgument},
+		{"alice", "mod", errorForbidden},
+		{"alice", "dave", errorNotFound},
+	}
+	for i, step := range steps {
+		requestID := "k" + string(rune('0'+i))
+		sendJSON(t, conns[step.actor], map[string]interface{}{"type": "kick", "username": step.username, "request_id": requestID})
+		if frame := readUntil(t, conns[step.actor], isAck(requestID)); frame["code"] != step.want {
+			t.Errorf("%s kicking %s: expected %s, got %v", step.actor, step.username, step.want, frame)
+		}
+	}
+
+	// bob is told why and taken out of the channel
+	sendJSON(t, alice, map[string]interface{}{"type": "kick", "username": "bob", "reason": "flooding", "request_id": "k9"})
+	if notice := readUntil(t, bob, isNotice); notice["action"] != actionKick || notice["by"] != "alice" || notice["reason"] != "flooding" {
+		t.Errorf("Expected bob told of the kick, got %v", notice)
+	}
+	if ack := readUntil(t, alice, isAck("k9")); ack["type"] != "ack" {
+		t.Fatalf("Expected the kick acknowledged, got %v", ack)
+	}
+	if notice := readUntil(t, carol, isNotice); notice["action"] != actionKick || notice["username"] != "bob" {
+		t.Errorf("Expected the channel told of the kick, got %v", notice)
+	}
+	if hub.isInChannel("team", "bob") {
+		t.Error("Expected bob out of the channel")
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "still here", "request_id": "p1"})
+	if frame := readUntil(t, bob, isError); frame["code"] != errorForbidden || frame["request_id"] != "p1" {
+		t.Errorf("Expected bob refused posting, got %v", frame)
+	}
+
+	// A kick is not a ban: bob may join again and post
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "team"})
+	readUntil(t, bob, isSwitch)
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "sorry", "request_id": "p2"})
+	if ack := readUntil(t, bob, isAck("p2")); ack["type"] != "ack" {
+		t.Errorf("Expected bob to post after joining again, got %v", ack)
+	}
+
+	// The kick is in the audit log, which only the channel's managers read
+	status, body := request("alice", "GET", "/api/channels/team/audit", nil)
+	entries, _ := body["entries"].([]interface{})
+	if status != http.StatusOK || len(entries) != 1 {
+		t.Fatalf("Expected one audit entry, got %d %v", status, body)
+	}
+	if entry := entries[0].(map[string]interface{}); entry["action"] != actionKick || entry["actor"] != "alice" || entry["target"] != "bob" || entry["reason"] != "flooding" {
+		t.Errorf("Expected the kick recorded, got %v", entry)
+	}
+	if status, _ := request("bob", "GET", "/api/channels/team/audit", nil); status != http.StatusForbidden {
+		t.Errorf("Expected bob refused the audit log, got %d", status)
+	}
+	if status, _ := request("alice", "GET", "/api/audit", nil); status != http.StatusForbidden {
+		t.Errorf("Expected alice refused the server's audit log, got %d", status)
+	}
+	if status, body := request("mod", "GET", "/api/audit?limit=5", nil); status != http.StatusOK || len(body["entries"].([]interface{})) != 1 {
+		t.Errorf("Expected the server's audit log, got %d %v", status, body)
+	}
+}
+
+func TestMuteAndBan(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.moderators = map[string]bool{"mod": true}
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	request := startAPIServer(t, hub)
+	if err := hub.createChannelInDB("team", Persistent, "alice", false); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+
+	isSwitch := func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" }
+	isNotice := func(msg map[string]interface{}) bool { return msg["type"] == "moderation" }
+	isError := func(msg map[string]interface{}) bool { return msg["type"] == "error" }
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		sendJSON(t, conn, map[string]interface{}{"type": "join_channel", "channel": "team"})
+		readUntil(t, conn, isSwitch)
+	}
+
+	// A mute stops bob posting in the channel, over the API too, but not
+	// elsewhere
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/mute bob 10m calm down"})
+	notice := readUntil(t, bob, isNotice)
+	if notice["action"] != actionMute || notice["reason"] != "calm down" || notice["until"] == nil {
+		t.Errorf("Expected bob told of the mute, got %v", notice)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "hello?", "request_id": "p1"})
+	if frame := readUntil(t, bob, isError); frame["code"] != errorForbidden || !strings.Contains(frame["message"].(string), "muted in #team") {
+		t.Errorf("Expected bob refused posting while muted, got %v", frame)
+	}
+	if status, _ := request("bob", "POST", "/api/channels/team/messages", map[string]string{"content": "hello?"}); status != http.StatusForbidden {
+		t.Errorf("Expected bob refused posting over the API, got %d", status)
+	}
+	if !hub.can("bob", "team", permJoin) || !hub.can("bob", "general", permPost) {
+		t.Error("Expected a mute only to stop bob posting in the channel")
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "mute", "username": "bob", "duration": 0, "request_id": "m1"})
+	if frame := readUntil(t, alice, isAck("m1")); frame["code"] != errorInvalidArgument {
+		t.Errorf("Expected a mute without a duration refused, got %v", frame)
+	}
+
+	sendJSON(t, alice, map[string]interface{}{"type": "unmute", "username": "bob", "request_id": "m2"})
+	readUntil(t, alice, isAck("m2"))
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "thanks", "request_id": "p2"})
+	if ack := readUntil(t, bob, isAck("p2")); ack["type"] != "ack" {
+		t.Errorf("Expected bob to post once unmuted, got %v", ack)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "unmute", "username": "bob", "request_id": "m3"})
+	if frame := readUntil(t, alice, isAck("m3")); frame["code"] != errorNotFound {
+		t.Errorf("Expected lifting a missing mute to fail, got %v", frame)
+	}
+
+	// A ban takes bob out of the channel and keeps them out, invited or not
+	status, _ := request("alice", "POST", "/api/channels/team/moderation", map[string]interface{}{"action": "ban", "username": "bob", "duration": 3600})
+	if status != http.StatusNoContent {
+		t.Fatalf("Expected the ban to succeed, got %d", status)
+	}
+	if notice := readUntil(t, bob, isNotice); notice["action"] != actionBan {
+		t.Errorf("Expected bob told of the ban, got %v", notice)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "team", "request_id": "j1"})
+	if frame := readUntil(t, bob, isError); frame["code"] != errorForbidden || frame["request_id"] != "j1" {
+		t.Errorf("Expected bob refused joining while banned, got %v", frame)
+	}
+	if status, _ := request("bob", "GET", "/api/channels/team/messages", nil); status != http.StatusForbidden {
+		t.Errorf("Expected bob refused the history while banned, got %d", status)
+	}
+	status, invite := request("alice", "POST", "/api/channels/team/invites", map[string]interface{}{})
+	if status != http.StatusCreated {
+		t.Fatalf("Failed to create an invite link: %d %v", status, invite)
+	}
+	if status, _ := request("bob", "POST", "/api/invites/"+invite["code"].(string), nil); status != http.StatusForbidden {
+		t.Errorf("Expected an invite not to get round the ban, got %d", status)
+	}
+
+	if status, _ := request("alice", "POST", "/api/channels/team/moderation", map[string]interface{}{"action": "unban", "username": "bob"}); status != http.StatusNoContent {
+		t.Fatalf("Expected the unban to succeed, got %d", status)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "team"})
+	readUntil(t, bob, isSwitch)
+
+	// Only server moderators ban server-wide; banned users are
+	// disconnected and cannot connect again
+	if status, _ := request("alice", "POST", "/api/moderation", map[string]interface{}{"action": "ban", "username": "bob", "duration": 60}); status != http.StatusForbidden {
+		t.Errorf("Expected alice refused a server-wide ban, got %d", status)
+	}
+	mod := dialTestClient(t, hub, wsURL, "mod")
+	sendJSON(t, mod, map[string]interface{}{"type": "ban", "username": "bob", "duration": 60, "server": true, "reason": "spam", "request_id": "b1"})
+	if ack := readUntil(t, mod, isAck("b1")); ack["type"] != "ack" {
+		t.Fatalf("Expected the server-wide ban acknowledged, got %v", ack)
+	}
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := bob.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("Expected bob's connection closed for a policy violation, got %v", err)
+			}
+			break
+		}
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, authHeader(t, hub, "bob")); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected bob refused connecting while banned, got %v", err)
+	}
+	if hub.can("bob", "general", permJoin) {
+		t.Error("Expected a server-wide ban to stop bob everywhere")
+	}
+}
+
+func TestSlowMode(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.moderators = map[string]bool{"mod": true}
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	if err := hub.createChannelInDB("team", Persistent, "alice", false); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+
+	isSwitch := func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" }
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		sendJSON(t, conn, map[string]interface{}{"type": "join_channel", "channel": "team"})
+		readUntil(t, conn, isSwitch)
+	}
+
+	sendJSON(t, bob, map[string]interface{}{"type": "slow_mode", "seconds": 30, "request_id": "s1"})
+	if frame := readUntil(t, bob, isAck("s1")); frame["code"] != errorForbidden {
+		t.Errorf("Expected bob refused setting slow mode, got %v", frame)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "slow_mode", "seconds": 7200, "request_id": "s2"})
+	if frame := readUntil(t, alice, isAck("s2")); frame["code"] != errorInvalidArgument {
+		t.Errorf("Expected too long an interval refused, got %v", frame)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/slowmode 1m"})
+	if notice := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "moderation" }); notice["action"] != actionSlowMode || notice["seconds"] != float64(60) {
+		t.Errorf("Expected the channel told of slow mode, got %v", notice)
+	}
+	if channels, _ := hub.listChannels("bob"); channels[0].Name != "team" || channels[0].SlowMode != 60 {
+		t.Errorf("Expected the channel listed in slow mode, got %+v", channels)
+	}
+
+	// bob waits between messages; a resend of his last one is still acked
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "one", "client_msg_id": "c1", "request_id": "p1"})
+	if ack := readUntil(t, bob, isAck("p1")); ack["type"] != "ack" {
+		t.Fatalf("Expected bob's first message acked, got %v", ack)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "two", "client_msg_id": "c2", "request_id": "p2"})
+	if frame := readUntil(t, bob, isAck("p2")); frame["code"] != errorRateLimited || !strings.Contains(frame["message"].(string), "slow mode") {
+		t.Errorf("Expected bob's second message refused, got %v", frame)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "one", "client_msg_id": "c1", "request_id": "p3"})
+	if ack := readUntil(t, bob, isAck("p3")); ack["type"] != "ack" {
+		t.Errorf("Expected the resend acked, got %v", ack)
+	}
+
+	// The channel's managers are exempt
+	for i := 0; i < 2; i++ {
+		requestID := "a" + string(rune('0'+i))
+		sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "announcement", "request_id": requestID})
+		if ack := readUntil(t, alice, isAck(requestID)); ack["type"] != "ack" {
+			t.Errorf("Expected alice exempt from slow mode, got %v", ack)
+		}
+	}
+
+	// Ephemeral channels keep their interval while active
+	if err := hub.setSlowMode("mod", "general", 5); err != nil {
+		t.Fatalf("Failed to set slow mode: %v", err)
+	}
+	if hub.slowModeInterval("general") != 5*time.Second {
+		t.Errorf("Expected general in slow mode, got %s", hub.slowModeInterval("general"))
+	}
+	if err := hub.setSlowMode("alice", "general", 5); errorCode(err) != errorForbidden {
+		t.Errorf("Expected only server moderators to manage an ephemeral channel, got %v", err)
+	}
+	entries, err := hub.auditLog("alice", "team", 0)
+	if err != nil || len(entries) != 1 || entries[0].Action != actionSlowMode || entries[0].Details != "1m0s" {
+		t.Errorf("Expected the slow mode change audited, got %+v, %v", entries, err)
+	}
+}
+
+func TestSanctionsCoverEveryWayToAddContent(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.moderators = map[string]bool{"mod": true}
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	if err := hub.createChannelInDB("team", Persistent, "alice", false); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+	err := hub.registerBot(Bot{Username: "echo", Commands: []Command{{Name: "echo", Description: "Repeat", Handler: func(cmd *CommandContext) error {
+		return cmd.Reply(cmd.Args)
+	}}}})
+	if err != nil {
+		t.Fatalf("Failed to register bot: %v", err)
+	}
+
+	isSwitch := func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" }
+	isMessage := func(msg map[string]interface{}) bool { return msg["type"] == "message" }
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"alice", "bob", "dave"} {
+		conns[name] = dialTestClient(t, hub, wsURL, name)
+		sendJSON(t, conns[name], map[string]interface{}{"type": "join_channel", "channel": "team"})
+		readUntil(t, conns[name], isSwitch)
+	}
+	alice, bob, dave := conns["alice"], conns["bob"], conns["dave"]
+
+	posted, _, err := hub.postMessage(Message{Username: "bob", Content: "before", Channel: "team"})
+	if err != nil {
+		t.Fatalf("Failed to post: %v", err)
+	}
+	if _, err := hub.store.AddReaction(posted.ID, "bob", "👍"); err != nil {
+		t.Fatalf("Failed to react: %v", err)
+	}
+	if err := hub.moderate("alice", actionMute, ModerationRequest{Channel: "team", Username: "bob", Duration: 600}); err != nil {
+		t.Fatalf("Failed to mute bob: %v", err)
+	}
+
+	// A muted user cannot edit their messages
+	sendJSON(t, bob, map[string]interface{}{"type": "edit_message", "id": posted.ID, "content": "after", "request_id": "e1"})
+	if frame := readUntil(t, bob, isAck("e1")); frame["code"] != errorForbidden || !strings.Contains(frame["message"].(string), "muted") {
+		t.Errorf("Expected bob refused editing while muted, got %v", frame)
+	}
+
+	// Nor react, though they may take a reaction back
+	sendJSON(t, bob, map[string]interface{}{"type": "add_reaction", "message_id": posted.ID, "emoji": "🎉", "request_id": "r1"})
+	if frame := readUntil(t, bob, isAck("r1")); frame["code"] != errorForbidden {
+		t.Errorf("Expected bob refused reacting while muted, got %v", frame)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "remove_reaction", "message_id": posted.ID, "emoji": "👍", "request_id": "r2"})
+	if frame := readUntil(t, bob, isAck("r2")); frame["type"] != "ack" {
+		t.Errorf("Expected bob to remove his reaction, got %v", frame)
+	}
+
+	// Read-only members cannot react either
+	if err := hub.grantRole("alice", "team", "carol", roleReadOnly); err != nil {
+		t.Fatalf("Failed to grant read-only: %v", err)
+	}
+	if err := hub.react("carol", posted.ID, "🎉", true); err != errCannotPost {
+		t.Errorf("Expected a read-only member refused reacting, got %v", err)
+	}
+
+	// Bots do not post for a muted user
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "/echo spam", "request_id": "c1"})
+	if frame := readUntil(t, bob, isAck("c1")); frame["code"] != errorForbidden {
+		t.Errorf("Expected bob's bot command refused while muted, got %v", frame)
+	}
+	expectNone(t, alice, 50*time.Millisecond, func(msg map[string]interface{}) bool { return isMessage(msg) && msg["username"] == "echo" })
+
+	// A kicked user cannot run commands in the channel until they join it
+	// again
+	if err := hub.moderate("alice", actionKick, ModerationRequest{Channel: "team", Username: "dave"}); err != nil {
+		t.Fatalf("Failed to kick dave: %v", err)
+	}
+	readUntil(t, dave, func(msg map[string]interface{}) bool { return msg["type"] == "moderation" })
+	sendJSON(t, dave, map[string]interface{}{"type": "message", "content": "/echo back", "request_id": "c2"})
+	if frame := readUntil(t, dave, isAck("c2")); frame["code"] != errorForbidden {
+		t.Errorf("Expected dave's command refused after the kick, got %v", frame)
+	}
+	sendJSON(t, dave, map[string]interface{}{"type": "message", "content": "/join team", "request_id": "c3"})
+	if frame := readUntil(t, dave, isAck("c3")); frame["type"] != "ack" {
+		t.Errorf("Expected dave to join again, got %v", frame)
+	}
+
+	// A muted user cannot set an ephemeral channel's topic
+	if err := hub.moderate("mod", actionMute, ModerationRequest{Channel: "general", Username: "bob", Duration: 600}); err != nil {
+		t.Fatalf("Failed to mute bob in general: %v", err)
+	}
+	if err := hub.setChannelTopic("bob", "general", "spam"); errorCode(err) != errorForbidden {
+		t.Errorf("Expected bob refused setting the topic while muted, got %v", err)
+	}
+	if err := hub.setChannelTopic("alice", "general", "welcome"); err != nil {
+		t.Errorf("Expected alice to set the topic, got %v", err)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Events sent to outgoing webhooks.
+const (
+	eventMessageCreated = "message.created"
+	eventChannelCreated = "channel.created"
+	eventChannelDeleted = "channel.deleted"
+	eventMemberJoined   = "member.joined"
+	eventMemberLeft     = "member.left"
+)
+
+var webhookEvents = []string{eventMessageCreated, eventChannelCreated, eventChannelDeleted, eventMemberJoined, eventMemberLeft}
+
+// Delivery statuses.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// webhookPollInterval is how often the dispatcher looks for due deliveries,
+// besides whenever one is queued.
+var webhookPollInterval = 5 * time.Second
+
+// A claimed delivery is retried by any node once webhookDeliveryLease passes
+// without an outcome, so the lease must outlast webhookTimeout.
+const (
+	webhookDeliveryLease = time.Minute
+	webhookDeliveryBatch = 20
+	webhookTimeout       = 10 * time.Second
+	maxDeliveryErrorLen  = 500
+)
+
+// webhookCacheTTL bounds how long the cached outgoing webhooks are used, in
+// case a change on another node was missed.
+var webhookCacheTTL = time.Minute
+
+// Delivery logs are listed defaultDeliveryPageSize at a time unless the
+// request asks for up to maxDeliveryPageSize.
+const (
+	defaultDeliveryPageSize = 50
+	maxDeliveryPageSize     = 100
+)
+
+var (
+	errModeratorsOnly      = errors.New("only moderators can manage outgoing webhooks")
+	errInvalidWebhookURL   = errors.New("webhook url must be an absolute http or https URL")
+	errUnknownWebhookEvent = fmt.Errorf("events must be among %v", webhookEvents)
+)
+
+// webhookRetryPolicy spaces out failed deliveries: the delay doubles from
+// baseDelay after each attempt, up to maxDelay, and a delivery fails for
+// good after maxAttempts.
+type webhookRetryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+func loadWebhookRetryPolicy() webhookRetryPolicy {
+	policy := webhookRetryPolicy{maxAttempts: 8, baseDelay: 10 * time.Second, maxDelay: time.Hour}
+	if value := getEnv("WEBHOOK_MAX_ATTEMPTS", ""); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts <= 0 {
+			log.Printf("Invalid WEBHOOK_MAX_ATTEMPTS, using %d", policy.maxAttempts)
+		} else {
+			policy.maxAttempts = attempts
+		}
+	}
+	return policy
+}
+
+// backoff returns how long to wait after a delivery's attempts-th failure.
+func (p webhookRetryPolicy) backoff(attempts int) time.Duration {
+	delay := p.baseDelay
+	for i := 1; i < attempts && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.maxDelay)
+}
+
+// wants reports whether the webhook receives an event from a channel.
+func (hook OutgoingWebhook) wants(event, channelName string) bool {
+	return slices.Contains(hook.Events, event) && (hook.Channel == "" || hook.Channel == channelName)
+}
+
+// signWebhookPayload returns the X-EchoRoom-Signature header for a payload:
+// the hex HMAC-SHA256 of the body keyed with the webhook's secret.
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// createOutgoingWebhook adds a webhook receiving events, or every event if
+// none are listed. The returned webhook carries its signing secret, which
+// is not shown again.
+func (h *Hub) createOutgoingWebhook(username string, hook OutgoingWebhook) (OutgoingWebhook, error) {
+	if !h.isModerator(username) {
+		return OutgoingWebhook{}, errModeratorsOnly
+	}
+	if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return OutgoingWebhook{}, errInvalidWebhookURL
+	}
+	if len(hook.Events) == 0 {
+		hook.Events = webhookEvents
+	}
+	for _, event := range hook.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return OutgoingWebhook{}, errUnknownWebhookEvent
+		}
+	}
+	if isDirectChannelName(hook.Channel) {
+		return OutgoingWebhook{}, newCommandError(errorInvalidArgument, "direct channels cannot have webhooks")
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return OutgoingWebhook{}, err
+	}
+	hook.Events = slices.Compact(slices.Sorted(slices.Values(hook.Events)))
+	hook.Secret = secret
+	hook.CreatedBy = username
+	hook.CreatedAt = time.Now().UTC()
+	if hook.ID, err = h.store.CreateOutgoingWebhook(hook); err != nil {
+		return OutgoingWebhook{}, err
+	}
+	h.outgoingWebhooksChanged()
+	log.Printf("Outgoing webhook %d to %s created by %s", hook.ID, hook.URL, username)
+	return hook, nil
+}
+
+// listOutgoingWebhooks returns every outgoing webhook, without its secret.
+func (h *Hub) listOutgoingWebhooks(username string) ([]OutgoingWebhook, error) {
+	if !h.isModerator(username) {
+		return nil, errModeratorsOnly
+	}
+	hooks, err := h.store.ListOutgoingWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	return hooks, nil
+}
+
+// deleteOutgoingWebhook removes a webhook and drops its queued deliveries.
+func (h *Hub) deleteOutgoingWebhook(username string, id int) error {
+	if !h.isModerator(username) {
+		return errModeratorsOnly
+	}
+	if err := h.store.DeleteOutgoingWebhook(id); err != nil {
+		return err
+	}
+	h.outgoingWebhooksChanged()
+	log.Printf("Outgoing webhook %d deleted by %s", id, username)
+	return nil
+}
+
+// webhookDeliveries returns a webhook's delivery log, newest first.
+func (h *Hub) webhookDeliveries(username string, id, limit int) ([]WebhookDelivery, error) {
+	if !h.isModerator(username) {
+		return nil, errModeratorsOnly
+	}
+	if limit <= 0 {
+		limit = defaultDeliveryPageSize
+	}
+	if limit > maxDeliveryPageSize {
+		limit = maxDeliveryPageSize
+	}
+	hooks, err := h.store.ListOutgoingWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(hooks, func(hook OutgoingWebhook) bool { return hook.ID == id }) {
+		return nil, errWebhookNotFound
+	}
+	return h.store.ListWebhookDeliveries(id, limit)
+}
+
+// outgoingWebhooks returns every outgoing webhook, from the cache unless it
+// was dropped or has expired.
+func (h *Hub) outgoingWebhooks() ([]OutgoingWebhook, error) {
+	h.webhooksMu.Lock()
+	if h.webhooksCache != nil && time.Since(h.webhooksLoadedAt) < webhookCacheTTL {
+		defer h.webhooksMu.Unlock()
+		return h.webhooksCache, nil
+	}
+	gen := h.webhooksGen
+	h.webhooksMu.Unlock()
+
+	hooks, err := h.store.ListOutgoingWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	if hooks == nil {
+		hooks = []OutgoingWebhook{}
+	}
+	h.webhooksMu.Lock()
+	defer h.webhooksMu.Unlock()
+	// A change while loading may be missing from hooks; load again next time
+	if gen == h.webhooksGen {
+		h.webhooksCache, h.webhooksLoadedAt = hooks, time.Now()
+	}
+	return hooks, nil
+}
+
+// invalidateOutgoingWebhooks drops the cached outgoing webhooks.
+func (h *Hub) invalidateOutgoingWebhooks() {
+	h.webhooksMu.Lock()
+	defer h.webhooksMu.Unlock()
+	h.webhooksGen++
+	h.webhooksCache = nil
+}
+
+// outgoingWebhooksChanged drops the cached outgoing webhooks here and on
+// every other node.
+func (h *Hub) outgoingWebhooksChanged() {
+	h.invalidateOutgoingWebhooks()
+	h.publish(ClusterEvent{Kind: eventWebhooksChange})
+}
+
+// emitWebhookEvent queues an event for every outgoing webhook that wants
+// it. Events in direct channels are private and never sent.
+func (h *Hub) emitWebhookEvent(event, channelName string, data interface{}) {
+	if isDirectChannelName(channelName) {
+		return
+	}
+	hooks, err := h.outgoingWebhooks()
+	if err != nil {
+		log.Printf("Error loading outgoing webhooks for %s: %v", event, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	var payload []byte
+	queued := false
+	for _, hook := range hooks {
+		if !hook.wants(event, channelName) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = json.Marshal(WebhookEvent{Event: event, Timestamp: now, Channel: channelName, Data: data}); err != nil {
+				log.Printf("Error marshaling %s event: %v", event, err)
+				return
+			}
+		}
+		delivery := WebhookDelivery{
+			WebhookID:     hook.ID,
+			Event:         event,
+			Payload:       payload,
+			Status:        deliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+		if _, err := h.store.EnqueueWebhookDelivery(delivery); err != nil {
+			log.Printf("Error queuing %s for webhook %d: %v", event, hook.ID, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case h.webhookWake <- struct{}{}:
+		default:
+			// The dispatcher is already due to look
+		}
+	}
+}
+
+// startWebhookDelivery sends queued deliveries until the hub stops. Every
+// node may run it; claims keep them from sending the same delivery twice.
+func (h *Hub) startWebhookDelivery() {
+	ticker := time.NewTicker(webhookPollInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			h.deliverDueWebhooks()
+			select {
+			case <-h.webhookDone:
+				return
+			case <-h.webhookWake:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (h *Hub) stopWebhookDelivery() {
+	h.webhookOnce.Do(func() {
+		close(h.webhookDone)
+	})
+}
+
+// deliverDueWebhooks attempts every due delivery, a batch at a time.
+func (h *Hub) deliverDueWebhooks() {
+	for {
+		deliveries, err := h.store.ClaimWebhookDeliveries(time.Now().UTC(), webhookDeliveryLease, webhookDeliveryBatch)
+		if err != nil {
+			log.Printf("Error claiming webhook deliveries: %v", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+		hooks, err := h.store.ListOutgoingWebhooks()
+		if err != nil {
+			log.Printf("Error loading outgoing webhooks: %v", err)
+			return
+		}
+		byID := make(map[int]OutgoingWebhook, len(hooks))
+		for _, hook := range hooks {
+			byID[hook.ID] = hook
+		}
+
+		var wg sync.WaitGroup
+		for _, delivery := range deliveries {
+			hook, ok := byID[delivery.WebhookID]
+			if !ok {
+				// Deleted since it was claimed, along with the delivery
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h.attemptDelivery(hook, delivery)
+			}()
+		}
+		wg.Wait()
+
+		if len(deliveries) < webhookDeliveryBatch {
+			return
+		}
+	}
+}
+
+// attemptDelivery posts a delivery and records the outcome, scheduling a
+// retry after a failure until the attempts run out.
+func (h *Hub) attemptDelivery(hook OutgoingWebhook, delivery WebhookDelivery) {
+	status, err := h.sendWebhook(hook, delivery)
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.ResponseStatus = status
+	delivery.Error = ""
+	switch {
+	case err == nil:
+		delivery.Status = deliveryDelivered
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= h.webhookRetry.maxAttempts:
+		delivery.Status = deliveryFailed
+		delivery.Error = truncate(err.Error(), maxDeliveryErrorLen)
+		log.Printf("Giving up on %s delivery %d to webhook %d after %d attempts: %v", delivery.Event, delivery.ID, hook.ID, delivery.Attempts, err)
+	default:
+		delivery.Error = truncate(err.Error(), maxDeliveryErrorLen)
+		delivery.NextAttemptAt = now.Add(h.webhookRetry.backoff(delivery.Attempts))
+	}
+	if err := h.store.UpdateWebhookDelivery(delivery); err != nil && !errors.Is(err, errWebhookNotFound) {
+		log.Printf("Error recording webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+// sendWebhook posts a delivery's payload, signed with the webhook's secret,
+// and returns the response status. Anything but a 2xx is an error.
+func (h *Hub) sendWebhook(hook OutgoingWebhook, delivery WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "EchoRoom-Webhook")
+	req.Header.Set("X-EchoRoom-Event", delivery.Event)
+	req.Header.Set("X-EchoRoom-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-EchoRoom-Signature", signWebhookPayload(hook.Secret, delivery.Payload))
+
+	resp, err := h.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// truncate shortens s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the requests an outgoing webhook receives and
+// answers them with the statuses in replies, then 200.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	requests []receivedWebhook
+	replies  []int
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+	event  WebhookEvent
+}
+
+func startWebhookReceiver(t *testing.T, replies ...int) (*webhookReceiver, string) {
+	t.Helper()
+	receiver := &webhookReceiver{replies: replies}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event WebhookEvent
+		json.Unmarshal(body, &event)
+		receiver.mu.Lock()
+		receiver.requests = append(receiver.requests, receivedWebhook{header: r.Header, body: body, event: event})
+		status := http.StatusOK
+		if len(receiver.replies) > 0 {
+			status, receiver.replies = receiver.replies[0], receiver.replies[1:]
+		}
+		receiver.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return receiver, server.URL
+}
+
+// waitForEvent returns the first request for an event in a channel,
+// waiting for it to arrive.
+func (r *webhookReceiver) waitForEvent(t *testing.T, event, channel string) receivedWebhook {
+	t.Helper()
+	var found receivedWebhook
+	waitFor(t, "a "+event+" webhook for "+channel, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, req := range r.requests {
+			if req.event.Event == event && req.event.Channel == channel {
+				found = req
+				return true
+			}
+		}
+		return false
+	})
+	return found
+}
+
+func (r *webhookReceiver) events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []string
+	for _, req := range r.requests {
+		events = append(events, req.event.Event)
+	}
+	return events
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	policy := webhookRetryPolicy{maxAttempts: 8, baseDelay: 10 * time.Second, maxDelay: time.Minute}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, time.Minute},
+		{20, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := policy.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"abcdef", 3, "abc"},
+		{"héllo", 2, "h"},
+		{"日本語", 4, "日"},
+		{"日本語", 2, ""},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestOutgoingWebhookCache(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.remoteSeen = make(map[string]time.Time)
+	deliveries := func(hookID int) int {
+		list, _ := store.ListWebhookDeliveries(hookID, 10)
+		return len(list)
+	}
+
+	// Events use the loaded list rather than querying the store each time
+	hub.emitWebhookEvent(eventChannelCreated, "ops", ChannelInfo{Name: "ops"})
+	id, _ := store.CreateOutgoingWebhook(OutgoingWebhook{URL: "https://example.com/hook", Events: []string{eventChannelCreated}, Secret: "s", CreatedBy: "mod", CreatedAt: time.Now().UTC()})
+	hub.emitWebhookEvent(eventChannelCreated, "ops", ChannelInfo{Name: "ops"})
+	if n := deliveries(id); n != 0 {
+		t.Fatalf("Expected the cached list used, got %d deliveries", n)
+	}
+
+	// Another node's change drops the cache
+	hub.handleClusterEvent(ClusterEvent{Origin: "node-b", Kind: eventWebhooksChange})
+	hub.emitWebhookEvent(eventChannelCreated, "ops", ChannelInfo{Name: "ops"})
+	if n := deliveries(id); n != 1 {
+		t.Errorf("Expected the new webhook to get the event, got %d deliveries", n)
+	}
+
+	// And so do changes made here
+	hub.moderators = map[string]bool{"mod": true}
+	hook, err := hub.createOutgoingWebhook("mod", OutgoingWebhook{URL: "https://example.com/other", Events: []string{eventChannelCreated}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.emitWebhookEvent(eventChannelCreated, "ops", ChannelInfo{Name: "ops"})
+	if n := deliveries(hook.ID); n != 1 {
+		t.Errorf("Expected the webhook created here to get the event, got %d deliveries", n)
+	}
+	hub.deleteOutgoingWebhook("mod", id)
+	hub.emitWebhookEvent(eventChannelCreated, "ops", ChannelInfo{Name: "ops"})
+	if n := deliveries(hook.ID); n != 2 {
+		t.Errorf("Expected events to keep reaching the remaining webhook, got %d deliveries", n)
+	}
+}
+
+func TestOutgoingWebhooks(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.moderators = map[string]bool{"mod": true}
+	go hub.run()
+	hub.startWebhookDelivery()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	request := startAPIServer(t, hub)
+	receiver, receiverURL := startWebhookReceiver(t)
+	opsReceiver, opsURL := startWebhookReceiver(t)
+
+	createTests := []struct {
+		username string
+		body     map[string]interface{}
+		status   int
+	}{
+		{"alice", map[string]interface{}{"url": receiverURL}, http.StatusForbidden},
+		{"mod", map[string]interface{}{"url": "ftp://example.com"}, http.StatusBadRequest},
+		{"mod", map[string]interface{}{"url": receiverURL, "events": []string{"message.sent"}}, http.StatusBadRequest},
+		{"mod", map[string]interface{}{"url": receiverURL, "channel": directChannelPrefix + "x"}, http.StatusBadRequest},
+	}
+	for _, tt := range createTests {
+		if status, body := request(tt.username, "POST", "/api/webhooks", tt.body); status != tt.status {
+			t.Errorf("Creating %v as %s: expected %d, got %d %v", tt.body, tt.username, tt.status, status, body)
+		}
+	}
+
+	status, hook := request("mod", "POST", "/api/webhooks", map[string]interface{}{"url": receiverURL})
+	secret, _ := hook["secret"].(string)
+	if status != http.StatusCreated || secret == "" || len(hook["events"].([]interface{})) != len(webhookEvents) {
+		t.Fatalf("Expected a webhook for every event with its secret, got %d %v", status, hook)
+	}
+	request("mod", "POST", "/api/webhooks", map[string]interface{}{"url": opsURL, "events": []string{eventMessageCreated}, "channel": "ops"})
+	status, list := request("mod", "GET", "/api/webhooks", nil)
+	hooks, _ := list["webhooks"].([]interface{})
+	if status != http.StatusOK || len(hooks) != 2 || hooks[0].(map[string]interface{})["secret"] != nil {
+		t.Errorf("Expected both webhooks listed without secrets, got %d %v", status, list)
+	}
+
+	// Channel creation, messages and membership are all reported
+	request("alice", "POST", "/api/channels", map[string]string{"name": "ops"})
+	created := receiver.waitForEvent(t, eventChannelCreated, "ops")
+	if data, _ := created.event.Data.(map[string]interface{}); data["type"] != string(Persistent) {
+		t.Errorf("Expected ops reported as a persistent channel, got %+v", created.event)
+	}
+
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "ops", "request_id": "j1"})
+	readUntil(t, bob, isAck("j1"))
+	joined := receiver.waitForEvent(t, eventMemberJoined, "ops")
+	if data, _ := joined.event.Data.(map[string]interface{}); data["username"] != "bob" {
+		t.Errorf("Expected bob's join reported, got %+v", joined.event)
+	}
+
+	request("alice", "POST", "/api/channels/ops/messages", map[string]string{"content": "deploy done"})
+	message := receiver.waitForEvent(t, eventMessageCreated, "ops")
+	if data, _ := message.event.Data.(map[string]interface{}); data["content"] != "deploy done" || data["id"] == nil {
+		t.Errorf("Expected the stored message reported, got %+v", message.event)
+	}
+	if got := message.header.Get("X-EchoRoom-Signature"); got != signWebhookPayload(secret, message.body) {
+		t.Errorf("Expected the payload signed with the webhook's secret, got %q", got)
+	}
+	if message.header.Get("X-EchoRoom-Event") != eventMessageCreated || message.header.Get("X-EchoRoom-Delivery") == "" {
+		t.Errorf("Expected event and delivery headers, got %v", message.header)
+	}
+
+	// The channel filter only lets ops' messages through
+	opsReceiver.waitForEvent(t, eventMessageCreated, "ops")
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "elsewhere", "request_id": "j2"})
+	readUntil(t, bob, isAck("j2"))
+	receiver.waitForEvent(t, eventMemberLeft, "ops")
+	if created := receiver.waitForEvent(t, eventChannelCreated, "elsewhere"); created.event.Data.(map[string]interface{})["type"] != string(Ephemeral) {
+		t.Errorf("Expected elsewhere reported as an ephemeral channel, got %+v", created.event)
+	}
+
+	// Direct messages are private
+	store.CreateDirectChannel("dm-alice-bob", []string{"alice", "bob"})
+	request("alice", "POST", "/api/channels/dm-alice-bob/messages", map[string]string{"content": "psst"})
+
+	if status, _ := request("mod", "DELETE", "/api/channels/ops", nil); status != http.StatusNoContent {
+		t.Fatalf("Expected ops to be deleted, got %d", status)
+	}
+	receiver.waitForEvent(t, eventChannelDeleted, "ops")
+	if events := opsReceiver.events(); len(events) != 1 {
+		t.Errorf("Expected the ops webhook to only receive ops' message, got %v", events)
+	}
+	receiver.mu.Lock()
+	for _, req := range receiver.requests {
+		if req.event.Channel == "dm-alice-bob" {
+			t.Errorf("Expected direct channel events to stay private, got %+v", req.event)
+		}
+	}
+	receiver.mu.Unlock()
+
+	// The delivery log shows what was sent
+	id := int(hook["id"].(float64))
+	status, page := request("mod", "GET", "/api/webhooks/"+strconv.Itoa(id)+"/deliveries?limit=2", nil)
+	deliveries, _ := page["deliveries"].([]interface{})
+	if status != http.StatusOK || len(deliveries) != 2 {
+		t.Fatalf("Expected two logged deliveries, got %d %v", status, page)
+	}
+	if latest := deliveries[0].(map[string]interface{}); latest["event"] != eventChannelDeleted {
+		t.Errorf("Expected the latest delivery first, got %v", latest)
+	}
+	if status, _ := request("alice", "GET", "/api/webhooks/"+strconv.Itoa(id)+"/deliveries", nil); status != http.StatusForbidden {
+		t.Errorf("Expected the log to be moderator-only, got %d", status)
+	}
+
+	if status, _ := request("mod", "DELETE", "/api/webhooks/"+strconv.Itoa(id), nil); status != http.StatusNoContent {
+		t.Fatalf("Expected the webhook to be deleted, got %d", status)
+	}
+	if status, _ := request("mod", "GET", "/api/webhooks/"+strconv.Itoa(id)+"/deliveries", nil); status != http.StatusNotFound {
+		t.Errorf("Expected a deleted webhook's log to be gone, got %d", status)
+	}
+}
+
+func TestWebhookDeliveryRetries(t *testing.T) {
+	defer func(interval time.Duration) { webhookPollInterval = interval }(webhookPollInterval)
+	webhookPollInterval = 10 * time.Millisecond
+
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.moderators = map[string]bool{"mod": true}
+	hub.webhookRetry = webhookRetryPolicy{maxAttempts: 3, baseDelay: 20 * time.Millisecond, maxDelay: 50 * time.Millisecond}
+	go hub.run()
+	hub.startWebhookDelivery()
+	defer hub.stop()
+
+	flaky, flakyURL := startWebhookReceiver(t, http.StatusInternalServerError, http.StatusBadGateway)
+	_, downURL := startWebhookReceiver(t, 500, 500, 500)
+	recovering, err := hub.createOutgoingWebhook("mod", OutgoingWebhook{URL: flakyURL, Events: []string{eventChannelCreated}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	down, err := hub.createOutgoingWebhook("mod", OutgoingWebhook{URL: downURL, Events: []string{eventChannelCreated}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.createChannelInDB("releases", Persistent, "", false)
+	flaky.waitForEvent(t, eventChannelCreated, "releases")
+
+	lastDelivery := func(hookID int) WebhookDelivery {
+		deliveries, err := hub.webhookDeliveries("mod", hookID, 1)
+		if err != nil || len(deliveries) != 1 {
+			t.Fatalf("Expected one delivery for webhook %d, got %+v (%v)", hookID, deliveries, err)
+		}
+		return deliveries[0]
+	}
+	waitFor(t, "the flaky webhook to be delivered", func() bool { return lastDelivery(recovering.ID).Status == deliveryDelivered })
+	if got := lastDelivery(recovering.ID); got.Attempts != 3 || got.ResponseStatus != http.StatusOK || got.DeliveredAt == nil || got.Error != "" {
+		t.Errorf("Expected delivery on the third attempt, got %+v", got)
+	}
+	if len(flaky.events()) != 3 {
+		t.Errorf("Expected three attempts at the flaky webhook, got %v", flaky.events())
+	}
+
+	waitFor(t, "the down webhook to fail", func() bool { return lastDelivery(down.ID).Status == deliveryFailed })
+	if got := lastDelivery(down.ID); got.Attempts != 3 || got.ResponseStatus != http.StatusInternalServerError || got.Error == "" {
+		t.Errorf("Expected the failure and its cause logged, got %+v", got)
+	}
+
+	// Recreating an existing channel is not a new event
+	hub.createChannelInDB("releases", Persistent, "", false)
+	time.Sleep(50 * time.Millisecond)
+	if len(flaky.events()) != 3 {
+		t.Errorf("Expected no event for an existing channel, got %v", flaky.events())
+	}
+}
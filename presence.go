@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	statusOnline  = "online"
+	statusAway    = "away"
+	statusOffline = "offline"
+)
+
+// Actions carried by presence_update.
+const (
+	presenceJoin   = "join"
+	presenceLeave  = "leave"
+	presenceStatus = "status"
+)
+
+var errInvalidStatus = errors.New("status must be online or away")
+
+// userPresence is what the hub knows about one user. connections counts the
+// user's clients on this node; remoteStatus is the status last reported by
+// another node and applies while the user has no local clients.
+type userPresence struct {
+	connections  int
+	status       string
+	remoteStatus string
+	nick         string
+	lastSeen     time.Time
+}
+
+// presenceOf returns a user's current presence. Users the hub has never
+// seen are offline without a last-seen time; bots are always online.
+func (h *Hub) presenceOf(username string) Presence {
+	if h.isBot(username) {
+		return Presence{Username: username, Status: statusOnline, Bot: true}
+	}
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+	return h.presenceLocked(username)
+}
+
+func (h *Hub) presenceLocked(username string) Presence {
+	p := Presence{Username: username, Status: statusOffline}
+	up, ok := h.presence[username]
+	if !ok {
+		return p
+	}
+	lastSeen := up.lastSeen
+	p.LastSeen = &lastSeen
+	p.Nick = up.nick
+	switch {
+	case up.connections > 0:
+		p.Status = up.status
+	case up.remoteStatus != "":
+		p.Status = up.remoteStatus
+	}
+	return p
+}
+
+// updatePresence applies change to a user's record and shares the result
+// with other nodes.
+func (h *Hub) updatePresence(username string, change func(up *userPresence)) Presence {
+	h.presenceMu.Lock()
+	up, ok := h.presence[username]
+	if !ok {
+		up = &userPresence{status: statusOnline}
+		h.presence[username] = up
+	}
+	change(up)
+	up.lastSeen = time.Now().UTC()
+	p := h.presenceLocked(username)
+	h.presenceMu.Unlock()
+
+	h.publish(ClusterEvent{Kind: eventUserStatus, Presence: &p})
+	return p
+}
+
+// userConnected records a new client of username. A user's first client
+// brings them online.
+func (h *Hub) userConnected(username string) {
+	if username == "" {
+		return
+	}
+	h.updatePresence(username, func(up *userPresence) {
+		if up.connections == 0 {
+			up.status = statusOnline
+		}
+		up.connections++
+	})
+}
+
+// userDisconnected records that one of username's clients closed.
+func (h *Hub) userDisconnected(username string) {
+	if username == "" {
+		return
+	}
+	h.updatePresence(username, func(up *userPresence) {
+		if up.connections > 0 {
+			up.connections--
+		}
+	})
+}
+
+// setRemoteStatus records a user's presence as reported by another node.
+func (h *Hub) setRemoteStatus(p Presence) {
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+	up, ok := h.presence[p.Username]
+	if !ok {
+		up = &userPresence{status: statusOnline}
+		h.presence[p.Username] = up
+	}
+	up.remoteStatus = ""
+	up.nick = p.Nick
+	if p.Status != statusOffline {
+		up.remoteStatus = p.Status
+	}
+	if p.LastSeen != nil && p.LastSeen.After(up.lastSeen) {
+		up.lastSeen = *p.LastSeen
+	}
+}
+
+// setStatus changes a connected user's status and announces it to every
+// channel they are in.
+func (h *Hub) setStatus(username, status string) error {
+	if status != statusOnline && status != statusAway {
+		return errInvalidStatus
+	}
+	h.updatePresence(username, func(up *userPresence) {
+		up.status = status
+	})
+	h.announceStatus(username)
+	return nil
+}
+
+// announceStatus tells every channel a user is in about a change to their
+// presence.
+func (h *Hub) announceStatus(username string) {
+	h.channelsMu.RLock()
+	var channels []*Channel
+	for _, channel := range h.channels {
+		channels = append(channels, channel)
+	}
+	h.channelsMu.RUnlock()
+	for _, channel := range channels {
+		if channel.hasUser(username) {
+			h.announcePresence(channel.name, username, presenceStatus)
+		}
+	}
+}
+
+// announcePresence broadcasts a presence_update for username to a channel.
+func (h *Hub) announcePresence(channelName, username, action string) {
+	if username == "" {
+		return
+	}
+	update := PresenceUpdate{
+		Type:     "presence_update",
+		Channel:  channelName,
+		Action:   action,
+		Presence: h.presenceOf(username),
+	}
+	if msgBytes, err := json.Marshal(update); err == nil {
+		h.broadcastToChannelName(channelName, msgBytes)
+	}
+
+	switch action {
+	case presenceJoin:
+		h.emitWebhookEvent(eventMemberJoined, channelName, update.Presence)
+	case presenceLeave:
+		h.emitWebhookEvent(eventMemberLeft, channelName, update.Presence)
+	}
+}
+
+// channelMembers lists the users in a channel on any node, ordered by
+// username, with their roles in persistent channels. Direct channels also
+// list their members who are not connected.
+func (h *Hub) channelMembers(channelName string) []Presence {
+	seen := make(map[string]bool)
+	var usernames []string
+	add := func(names []string) {
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				usernames = append(usernames, name)
+			}
+		}
+	}
+
+	h.channelsMu.RLock()
+	channel, ok := h.channels[channelName]
+	h.channelsMu.RUnlock()
+	if ok {
+		add(channel.usernames())
+	}
+	add(h.remoteUsernames(channelName))
+	add(h.botsIn(channelName))
+	if isDirectChannelName(channelName) {
+		if members, err := h.store.GetChannelMembers(channelName); err == nil {
+			add(members)
+		}
+	}
+	sort.Strings(usernames)
+
+	roles := make(map[string]string)
+	if channelType, err := h.getChannelType(channelName); err == nil && channelType == Persistent {
+		list, _ := h.store.ListChannelRoles(channelName)
+		for _, r := range list {
+			roles[r.Username] = r.Role
+		}
+	}
+
+	members := make([]Presence, 0, len(usernames))
+	for _, username := range usernames {
+		p := h.presenceOf(username)
+		p.Role = roles[username]
+		members = append(members, p)
+	}
+	return members
+}
+
+// sendChannelMembers sends the client a channel_members snapshot of a
+// channel.
+func (c *Client) sendChannelMembers(channelName string) {
+	snapshot := ChannelMembers{
+		Type:    "channel_members",
+		Channel: channelName,
+		Members: c.hub.channelMembers(channelName),
+	}
+	c.hub.channelsMu.RLock()
+	channel, ok := c.hub.channels[channelName]
+	c.hub.channelsMu.RUnlock()
+	if ok {
+		snapshot.EventID = channel.currentEventID()
+	}
+	msgBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Printf("Error marshaling channel members: %v", err)
+		return
+	}
+	select {
+	case c.send <- msgBytes:
+	default:
+		// Client's send channel is full, skip
+	}
+}
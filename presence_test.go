@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPresenceTracking(t *testing.T) {
+	hub := newHub(newMemoryStore())
+
+	if p := hub.presenceOf("alice"); p.Status != statusOffline || p.LastSeen != nil {
+		t.Errorf("Expected unknown user to be offline without last seen, got %+v", p)
+	}
+
+	hub.userConnected("alice")
+	hub.userConnected("alice")
+	if err := hub.setStatus("alice", statusAway); err != nil {
+		t.Fatalf("Failed to set status: %v", err)
+	}
+	if err := hub.setStatus("alice", "busy"); !errors.Is(err, errInvalidStatus) {
+		t.Errorf("Expected errInvalidStatus, got %v", err)
+	}
+
+	// Closing one of two connections keeps the user's status
+	hub.userDisconnected("alice")
+	if p := hub.presenceOf("alice"); p.Status != statusAway {
+		t.Errorf("Expected alice away with one connection left, got %+v", p)
+	}
+
+	hub.userDisconnected("alice")
+	p := hub.presenceOf("alice")
+	if p.Status != statusOffline || p.LastSeen == nil {
+		t.Fatalf("Expected alice offline with last seen, got %+v", p)
+	}
+	lastSeen := *p.LastSeen
+
+	// Reconnecting brings the user back online
+	hub.userConnected("alice")
+	if p := hub.presenceOf("alice"); p.Status != statusOnline || p.LastSeen.Before(lastSeen) {
+		t.Errorf("Expected alice online again, got %+v", p)
+	}
+
+	// Statuses reported by other nodes apply to users with no local clients
+	now := time.Now().UTC()
+	hub.setRemoteStatus(Presence{Username: "bob", Status: statusAway, LastSeen: &now})
+	if p := hub.presenceOf("bob"); p.Status != statusAway || !p.LastSeen.Equal(now) {
+		t.Errorf("Expected remote status for bob, got %+v", p)
+	}
+	hub.setRemoteStatus(Presence{Username: "bob", Status: statusOffline, LastSeen: &now})
+	if p := hub.presenceOf("bob"); p.Status != statusOffline {
+		t.Errorf("Expected bob offline, got %+v", p)
+	}
+}
+
+func TestPresenceUpdates(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	if err := store.CreateChannel("team", Persistent); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+
+	sendJSON(t, alice, Message{Type: "join_channel", Channel: "team"})
+	members := readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "channel_members" })
+	if list := members["members"].([]interface{}); members["channel"] != "team" || len(list) != 1 {
+		t.Errorf("Expected alice alone in team, got %v", members)
+	}
+
+	// Joins are announced in persistent channels too
+	sendJSON(t, bob, Message{Type: "join_channel", Channel: "team"})
+	update := readUntil(t, alice, func(msg map[string]interface{}) bool {
+		return msg["type"] == "presence_update" && msg["username"] == "bob"
+	})
+	if update["action"] != presenceJoin || update["status"] != statusOnline || update["channel"] != "team" {
+		t.Errorf("Unexpected join update: %v", update)
+	}
+	members = readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "channel_members" })
+	list := members["members"].([]interface{})
+	if len(list) != 2 || list[0].(map[string]interface{})["username"] != "alice" || list[1].(map[string]interface{})["username"] != "bob" {
+		t.Errorf("Expected alice and bob in snapshot, got %v", members)
+	}
+
+	sendJSON(t, bob, StatusRequest{Type: "set_status", Status: statusAway})
+	update = readUntil(t, alice, func(msg map[string]interface{}) bool {
+		return msg["type"] == "presence_update" && msg["username"] == "bob"
+	})
+	if update["action"] != presenceStatus || update["status"] != statusAway {
+		t.Errorf("Unexpected status update: %v", update)
+	}
+
+	bob.Close()
+	update = readUntil(t, alice, func(msg map[string]interface{}) bool {
+		return msg["type"] == "presence_update" && msg["username"] == "bob"
+	})
+	if update["action"] != presenceLeave || update["status"] != statusOffline || update["last_seen"] == nil {
+		t.Errorf("Unexpected leave update: %v", update)
+	}
+}
+
+func TestClusterChannelMembers(t *testing.T) {
+	store := newMemoryStore()
+	broker := newLocalBroker()
+	defer broker.Close()
+	secret := []byte("cluster-secret")
+
+	hubA, urlA := startClusterNode(t, store, broker, secret)
+	hubB, urlB := startClusterNode(t, store, broker, secret)
+
+	dialTestClient(t, hubA, urlA, "alice")
+	bob := dialTestClient(t, hubB, urlB, "bob")
+	waitFor(t, "bob's presence on node A", func() bool {
+		return len(hubA.remoteUsernames("general")) == 1
+	})
+
+	sendJSON(t, bob, StatusRequest{Type: "set_status", Status: statusAway})
+	waitFor(t, "bob's status on node A", func() bool { return hubA.presenceOf("bob").Status == statusAway })
+
+	members := hubA.channelMembers("general")
+	if len(members) != 2 || members[0].Username != "alice" || members[1].Username != "bob" || members[1].Status != statusAway {
+		t.Errorf("Expected local and remote members, got %+v", members)
+	}
+}
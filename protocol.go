@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// Error codes sent in error frames.
+const (
+	errorBadRequest      = "bad_request"
+	errorUnknownCommand  = "unknown_command"
+	errorInvalidArgument = "invalid_argument"
+	errorNotFound        = "not_found"
+	errorForbidden       = "forbidden"
+	errorRateLimited     = "rate_limited"
+	errorUnavailable     = "unavailable"
+	errorInternal        = "internal"
+)
+
+// commandError is a rejection with its own error code, for failures that
+// have no sentinel error.
+type commandError struct {
+	code    string
+	message string
+}
+
+func (e *commandError) Error() string {
+	return e.message
+}
+
+func newCommandError(code, message string) error {
+	return &commandError{code: code, message: message}
+}
+
+var errMalformedCommand = newCommandError(errorBadRequest, "command is not valid JSON")
+
+// errorCodes maps the errors command handlers return to error frame codes.
+// Anything else is reported as an internal error without its details.
+var errorCodes = map[error]string{
+	errMessageNotFound:  errorNotFound,
+	errChannelNotFound:  errorNotFound,
+	errUserNotFound:     errorNotFound,
+	errWebhookNotFound:  errorNotFound,
+	errNotMessageAuthor: errorForbidden,
+	errChannelForbidden: errorForbidden,
+	errNotChannelAdmin:  errorForbidden,
+	errEmptyMessage:     errorInvalidArgument,
+	errNotDelivered:     errorUnavailable,
+	errReplyToDeleted:   errorInvalidArgument,
+	errInvalidEmoji:     errorInvalidArgument,
+	errReactToDeleted:   errorInvalidArgument,
+	errInvalidStatus:    errorInvalidArgument,
+	errNotStoredChannel: errorInvalidArgument,
+	errDirectTooFew:     errorInvalidArgument,
+	errDirectTooMany:    errorInvalidArgument,
+	errEmptySearch:      errorInvalidArgument,
+
+	errInvalidClientMsgID:   errorInvalidArgument,
+	errNotSubscribed:        errorInvalidArgument,
+	errTooManySubscriptions: errorInvalidArgument,
+	errInvalidWebhookName:   errorInvalidArgument,
+	errInvalidAttachment:    errorInvalidArgument,
+	errTooManyAttachments:   errorInvalidArgument,
+	errModeratorsOnly:       errorForbidden,
+	errInvalidWebhookURL:    errorInvalidArgument,
+	errUnknownWebhookEvent:  errorInvalidArgument,
+	errInvalidCommandName:   errorInvalidArgument,
+	errCommandExists:        errorInvalidArgument,
+	errBotNameTaken:         errorInvalidArgument,
+	errTopicTooLong:         errorInvalidArgument,
+	errInvalidNick:          errorInvalidArgument,
+	errNickTaken:            errorInvalidArgument,
+	errWebhookNameTaken:     errorInvalidArgument,
+	errCannotPost:           errorForbidden,
+	errInvalidRole:          errorInvalidArgument,
+	errRolesNeedPersisted:   errorInvalidArgument,
+	errOwnerRole:            errorForbidden,
+	errInviteNotFound:       errorNotFound,
+	errAlreadyMember:        errorInvalidArgument,
+	errInvitesNeedPersisted: errorInvalidArgument,
+	errInvalidInvite:        errorInvalidArgument,
+	errSanctionNotFound:     errorNotFound,
+	errInvalidSanction:      errorInvalidArgument,
+	errInvalidSlowMode:      errorInvalidArgument,
+	errReasonTooLong:        errorInvalidArgument,
+	errModerateSelf:         errorInvalidArgument,
+	errServerModeratorsOnly: errorForbidden,
+	errNotInChannel:         errorNotFound,
+	errRemovedFromChannel:   errorForbidden,
+}
+
+// errorCode returns the error frame code for err.
+func errorCode(err error) string {
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.code
+	}
+	for sentinel, code := range errorCodes {
+		if errors.Is(err, sentinel) {
+			return code
+		}
+	}
+	return errorInternal
+}
+
+// decodeCommand unmarshals a command of the given type into v.
+func decodeCommand(commandType string, data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		log.Printf("Error unmarshaling %s command: %v", commandType, err)
+		return errMalformedCommand
+	}
+	return nil
+}
+
+// sendFrame queues v for the client, dropping it if the send buffer is full.
+func (c *Client) sendFrame(v interface{}) {
+	msgBytes, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error marshaling frame for %s: %v", c.username, err)
+		return
+	}
+	select {
+	case c.send <- msgBytes:
+	default:
+		// Client's send channel is full, skip
+	}
+}
+
+// sendError tells the client a command was rejected. retryAfter is how long
+// to wait before retrying, if that helps.
+func (c *Client) sendError(cmd commandEnvelope, code, message string, retryAfter time.Duration) {
+	c.sendFrame(ErrorFrame{
+		Type:         "error",
+		RequestID:    cmd.RequestID,
+		Command:      cmd.Type,
+		Code:         code,
+		Message:      message,
+		RetryAfterMS: retryAfter.Milliseconds(),
+	})
+}
+
+// sendCommandError reports a failed command. Internal errors are logged and
+// reported without their details.
+func (c *Client) sendCommandError(cmd commandEnvelope, err error) {
+	code := errorCode(err)
+	message := err.Error()
+	if code == errorInternal {
+		log.Printf("Error handling %s command for %s: %v", cmd.Type, c.username, err)
+		message = "Something went wrong, please try again"
+	}
+	c.sendError(cmd, code, message, 0)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{errMalformedCommand, errorBadRequest},
+		{newCommandError(errorUnknownCommand, "nope"), errorUnknownCommand},
+		{errMessageNotFound, errorNotFound},
+		{fmt.Errorf("user 'zed': %w", errUserNotFound), errorNotFound},
+		{errNotMessageAuthor, errorForbidden},
+		{errChannelForbidden, errorForbidden},
+		{errInvalidEmoji, errorInvalidArgument},
+		{errors.New("connection refused"), errorInternal},
+	}
+	for _, tt := range tests {
+		if code := errorCode(tt.err); code != tt.code {
+			t.Errorf("errorCode(%v) = %s, want %s", tt.err, code, tt.code)
+		}
+	}
+}
+
+func TestCommandAcksAndErrors(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	store.CreateDirectChannel("dm-private", []string{"bob", "carol"})
+	conn := dialTestClient(t, hub, wsURL, "alice")
+
+	isReply := func(requestID string) func(map[string]interface{}) bool {
+		return func(msg map[string]interface{}) bool {
+			return (msg["type"] == "ack" || msg["type"] == "error") && msg["request_id"] == requestID
+		}
+	}
+
+	sendJSON(t, conn, map[string]interface{}{"type": "message", "content": "hello", "request_id": "m1"})
+	ack := readUntil(t, conn, isReply("m1"))
+	if ack["type"] != "ack" || ack["command"] != "message" {
+		t.Errorf("Expected an ack for the message, got %v", ack)
+	}
+
+	errorTests := []struct {
+		command map[string]interface{}
+		code    string
+	}{
+		{map[string]interface{}{"type": "message", "content": "  "}, errorInvalidArgument},
+		{map[string]interface{}{"type": "teleport"}, errorUnknownCommand},
+		{map[string]interface{}{"type": "join_channel", "channel": "dm-private"}, errorForbidden},
+		{map[string]interface{}{"type": "create_channel", "name": "x", "channel_type": "direct"}, errorInvalidArgument},
+		{map[string]interface{}{"type": "edit_message", "id": 999999, "content": "x"}, errorNotFound},
+		{map[string]interface{}{"type": "set_status", "status": "asleep"}, errorInvalidArgument},
+		{map[string]interface{}{"type": "history_request", "limit": "ten"}, errorBadRequest},
+	}
+	for i, tt := range errorTests {
+		requestID := fmt.Sprintf("e%d", i)
+		tt.command["request_id"] = requestID
+		sendJSON(t, conn, tt.command)
+		frame := readUntil(t, conn, isReply(requestID))
+		if frame["type"] != "error" || frame["code"] != tt.code || frame["command"] != tt.command["type"] || frame["message"] == "" {
+			t.Errorf("%v: expected a %s error, got %v", tt.command["type"], tt.code, frame)
+		}
+	}
+
+	// Invalid JSON cannot carry a request_id but is still answered
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("{not json")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	frame := readUntil(t, conn, func(msg map[string]interface{}) bool { return msg["type"] == "error" })
+	if frame["code"] != errorBadRequest || frame["request_id"] != nil {
+		t.Errorf("Expected an uncorrelated bad_request error, got %v", frame)
+	}
+}
+
+func TestRateLimitErrorEchoesRequestID(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.rateLimits.families[rateMessages] = rateLimit{burst: 1, per: time.Minute}
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	conn := dialTestClient(t, hub, wsURL, "alice")
+	sendJSON(t, conn, map[string]interface{}{"type": "message", "content": "one", "request_id": "r1"})
+	sendJSON(t, conn, map[string]interface{}{"type": "message", "content": "two", "request_id": "r2"})
+	frame := readUntil(t, conn, func(msg map[string]interface{}) bool { return msg["request_id"] == "r2" })
+	if frame["type"] != "error" || frame["code"] != errorRateLimited {
+		t.Errorf("Expected a rate_limited error for r2, got %v", frame)
+	}
+}
+
+func TestMessageAckDeduplicatesResends(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	store.CreateChannel("news", Persistent)
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		sendJSON(t, conn, map[string]interface{}{"type": "join_channel", "channel": "news"})
+		readUntil(t, conn, func(msg map[string]interface{}) bool { return msg["type"] == "ack" })
+	}
+
+	isAck := func(msg map[string]interface{}) bool { return msg["type"] == "ack" && msg["command"] == "message" }
+	send := map[string]interface{}{"type": "message", "content": "exactly once", "client_msg_id": "c-42"}
+	sendJSON(t, alice, send)
+	ack := readUntil(t, alice, isAck)
+	if ack["id"] == nil || ack["timestamp"] == nil || ack["client_msg_id"] != "c-42" || ack["duplicate"] != nil {
+		t.Fatalf("Expected an ack with the stored ID and timestamp, got %v", ack)
+	}
+	broadcast := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	if broadcast["id"] != ack["id"] || broadcast["client_msg_id"] != "c-42" {
+		t.Errorf("Expected the broadcast to match the ack, got %v", broadcast)
+	}
+
+	// A resend after a reconnect is acknowledged with the original message
+	retry := dialTestClient(t, hub, wsURL, "alice")
+	sendJSON(t, retry, map[string]interface{}{"type": "join_channel", "channel": "news"})
+	sendJSON(t, retry, send)
+	dup := readUntil(t, retry, isAck)
+	if dup["id"] != ack["id"] || dup["timestamp"] != ack["timestamp"] || dup["duplicate"] != true {
+		t.Errorf("Expected a duplicate ack for message %v, got %v", ack["id"], dup)
+	}
+	expectNone(t, bob, 200*time.Millisecond, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+
+	if history, _ := store.GetChannelHistory("news", 10); len(history) != 1 {
+		t.Errorf("Expected the message to be stored once, got %d", len(history))
+	}
+
+	sendJSON(t, retry, map[string]interface{}{"type": "message", "content": "x", "client_msg_id": strings.Repeat("x", maxClientMsgIDLength+1)})
+	frame := readUntil(t, retry, func(msg map[string]interface{}) bool { return msg["type"] == "error" })
+	if frame["code"] != errorInvalidArgument {
+		t.Errorf("Expected invalid_argument for an overlong client_msg_id, got %v", frame)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// rateLimit allows burst commands at once, refilled evenly over per. A zero
+// burst disables the limit.
+type rateLimit struct {
+	burst int
+	per   time.Duration
+}
+
+func (l rateLimit) String() string {
+	if l.burst <= 0 {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", l.burst, l.per)
+}
+
+// parseRateLimit reads "N/duration", such as "10/5s", or "off".
+func parseRateLimit(value string) (rateLimit, error) {
+	if value == "off" || value == "0" {
+		return rateLimit{}, nil
+	}
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("expected N/duration, got %q", value)
+	}
+	burst, err := strconv.Atoi(count)
+	if err != nil || burst < 0 {
+		return rateLimit{}, fmt.Errorf("invalid count in %q", value)
+	}
+	per, err := time.ParseDuration(period)
+	if err != nil || per <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid duration in %q", value)
+	}
+	return rateLimit{burst: burst, per: per}, nil
+}
+
+// Command families with their own buckets.
+const (
+	rateMessages      = "messages"
+	rateChannelCreate = "channel_create"
+	rateChannelSwitch = "channel_switch"
+	rateOther         = "other"
+)
+
+// rateFamily maps a WebSocket command to the bucket it draws from. Commands
+// without a family of their own, unknown ones included, share rateOther.
+func rateFamily(commandType string) string {
+	switch commandType {
+	case "message", "reply", "edit_message", "delete_message", "add_reaction", "remove_reaction":
+		return rateMessages
+	case "create_channel", "open_dm":
+		return rateChannelCreate
+	case "join_channel", "subscribe":
+		return rateChannelSwitch
+	}
+	return rateOther
+}
+
+// userRateFactor is how many connections' worth of commands one user may
+// send in total, so a few open tabs work but many do not multiply a flood.
+const userRateFactor = 3
+
+// rateLimits configures flood protection. violations is the budget of
+// throttled commands a connection may send before it is disconnected, and
+// webhook limits each incoming webhook token.
+type rateLimits struct {
+	families   map[string]rateLimit
+	violations rateLimit
+	webhook    rateLimit
+}
+
+func defaultRateLimits() rateLimits {
+	return rateLimits{
+		families: map[string]rateLimit{
+			rateMessages:      {burst: 10, per: 5 * time.Second},
+			rateChannelCreate: {burst: 3, per: time.Minute},
+			rateChannelSwitch: {burst: 10, per: 10 * time.Second},
+			rateOther:         {burst: 30, per: 10 * time.Second},
+		},
+		violations: rateLimit{burst: 20, per: time.Minute},
+		webhook:    rateLimit{burst: 30, per: time.Minute},
+	}
+}
+
+// loadRateLimits reads RATE_LIMIT_MESSAGES, RATE_LIMIT_CHANNEL_CREATE,
+// RATE_LIMIT_CHANNEL_SWITCH, RATE_LIMIT_OTHER, RATE_LIMIT_VIOLATIONS and
+// RATE_LIMIT_WEBHOOK, keeping the default for unset or invalid values.
+func loadRateLimits() rateLimits {
+	limits := defaultRateLimits()
+	load := func(env string, current rateLimit) rateLimit {
+		value := getEnv(env, "")
+		if value == "" {
+			return current
+		}
+		limit, err := parseRateLimit(value)
+		if err != nil {
+			log.Printf("Invalid %s (%v), using %s", env, err, current)
+			return current
+		}
+		return limit
+	}
+	limits.families[rateMessages] = load("RATE_LIMIT_MESSAGES", limits.families[rateMessages])
+	limits.families[rateChannelCreate] = load("RATE_LIMIT_CHANNEL_CREATE", limits.families[rateChannelCreate])
+	limits.families[rateChannelSwitch] = load("RATE_LIMIT_CHANNEL_SWITCH", limits.families[rateChannelSwitch])
+	limits.families[rateOther] = load("RATE_LIMIT_OTHER", limits.families[rateOther])
+	limits.violations = load("RATE_LIMIT_VIOLATIONS", limits.violations)
+	limits.webhook = load("RATE_LIMIT_WEBHOOK", limits.webhook)
+	return limits
+}
+
+// tokenBucket is safe for concurrent use; per-user buckets are shared by
+// the user's connections.
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit rateLimit) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.burst), last: time.Now()}
+}
+
+// take spends a token if one is available. Otherwise it returns how long
+// until the next token.
+func (b *tokenBucket) take() (bool, time.Duration) {
+	if b.limit.burst <= 0 {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	refill := now.Sub(b.last).Seconds() / b.limit.per.Seconds() * float64(b.limit.burst)
+	b.tokens = math.Min(float64(b.limit.burst), b.tokens+refill)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / float64(b.limit.burst) * b.limit.per.Seconds()
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// idle reports whether the bucket is full again, so dropping it loses
+// nothing.
+func (b *tokenBucket) idle() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elapsed := time.Since(b.last).Seconds() / b.limit.per.Seconds() * float64(b.limit.burst)
+	return b.tokens+elapsed >= float64(b.limit.burst)
+}
+
+// connectionBuckets holds a connection's buckets. Only the connection's
+// read goroutine uses it.
+type connectionBuckets struct {
+	families   map[string]*tokenBucket
+	violations *tokenBucket
+}
+
+// userBucket returns username's shared bucket for a command family.
+func (h *Hub) userBucket(username, family string) *tokenBucket {
+	limit := h.rateLimits.families[family]
+	limit.burst *= userRateFactor
+	return h.sharedBucket(username+"\x00"+family, limit)
+}
+
+// webhookBucket returns the bucket shared by all requests to an incoming
+// webhook.
+func (h *Hub) webhookBucket(hookID int) *tokenBucket {
+	return h.sharedBucket(fmt.Sprintf("webhook\x00%d", hookID), h.rateLimits.webhook)
+}
+
+// sharedBucket returns the bucket for key, making it with limit if needed.
+// Idle buckets of other keys are dropped as new ones are made.
+func (h *Hub) sharedBucket(key string, limit rateLimit) *tokenBucket {
+	h.rateMu.Lock()
+	defer h.rateMu.Unlock()
+	if bucket, ok := h.userBuckets[key]; ok {
+		return bucket
+	}
+	for k, bucket := range h.userBuckets {
+		if bucket.idle() {
+			delete(h.userBuckets, k)
+		}
+	}
+	bucket := newTokenBucket(limit)
+	h.userBuckets[key] = bucket
+	return bucket
+}
+
+// throttle checks a command against the connection's and the user's
+// buckets. A dropped command gets an error frame; disconnect reports that
+// the client has used up its violation budget.
+func (c *Client) throttle(cmd commandEnvelope) (drop, disconnect bool) {
+	family := rateFamily(cmd.Type)
+	limit, ok := c.hub.rateLimits.families[family]
+	if !ok || limit.burst <= 0 {
+		return false, false
+	}
+
+	buckets := c.connectionBuckets()
+	bucket, ok := buckets.families[family]
+	if !ok {
+		bucket = newTokenBucket(limit)
+		buckets.families[family] = bucket
+	}
+
+	allowed, wait := bucket.take()
+	if allowed && c.username != "" {
+		allowed, wait = c.hub.userBucket(c.username, family).take()
+	}
+	if allowed {
+		return false, false
+	}
+
+	if c.violate() {
+		return true, true
+	}
+	c.sendError(cmd, errorRateLimited, fmt.Sprintf("Too many %s commands, slow down", strings.ReplaceAll(family, "_", " ")), wait)
+	return true, false
+}
+
+// violate counts a throttled, malformed or unknown command against the
+// connection's violation budget and reports whether the budget is used up.
+func (c *Client) violate() (disconnect bool) {
+	ok, _ := c.connectionBuckets().violations.take()
+	return !ok
+}
+
+func (c *Client) connectionBuckets() *connectionBuckets {
+	if c.buckets == nil {
+		c.buckets = &connectionBuckets{
+			families:   make(map[string]*tokenBucket),
+			violations: newTokenBucket(c.hub.rateLimits.violations),
+		}
+	}
+	return c.buckets
+}
+
+// closeForAbuse disconnects a client that keeps flooding after being
+// throttled.
+func (c *Client) closeForAbuse() {
+	log.Printf("Disconnecting %s for sustained flooding", c.username)
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded")
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value string
+		want  rateLimit
+		ok    bool
+	}{
+		{"10/5s", rateLimit{burst: 10, per: 5 * time.Second}, true},
+		{"3/1m", rateLimit{burst: 3, per: time.Minute}, true},
+		{"off", rateLimit{}, true},
+		{"0", rateLimit{}, true},
+		{"10", rateLimit{}, false},
+		{"x/5s", rateLimit{}, false},
+		{"10/soon", rateLimit{}, false},
+		{"10/-1s", rateLimit{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRateLimit(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseRateLimit(%q) = %v, %v; want %v, ok=%v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(rateLimit{burst: 2, per: 100 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		if ok, _ := bucket.take(); !ok {
+			t.Fatalf("Expected token %d of the burst", i+1)
+		}
+	}
+	ok, wait := bucket.take()
+	if ok || wait <= 0 || wait > 50*time.Millisecond {
+		t.Fatalf("Expected an empty bucket with a short wait, got %v, %v", ok, wait)
+	}
+	time.Sleep(wait + 10*time.Millisecond)
+	if ok, _ := bucket.take(); !ok {
+		t.Errorf("Expected a token after waiting %v", wait)
+	}
+
+	unlimited := newTokenBucket(rateLimit{})
+	for i := 0; i < 100; i++ {
+		if ok, _ := unlimited.take(); !ok {
+			t.Fatal("Expected a disabled limit to allow everything")
+		}
+	}
+}
+
+func TestUserBucketIsShared(t *testing.T) {
+	hub := newHub(newMemoryStore())
+	hub.rateLimits.families[rateMessages] = rateLimit{burst: 2, per: time.Minute}
+
+	// Every connection of a user draws from the same, larger bucket
+	for i := 0; i < 2*userRateFactor; i++ {
+		if ok, _ := hub.userBucket("alice", rateMessages).take(); !ok {
+			t.Fatalf("Expected token %d for alice", i+1)
+		}
+	}
+	if ok, _ := hub.userBucket("alice", rateMessages).take(); ok {
+		t.Error("Expected alice's bucket to be empty")
+	}
+	if ok, _ := hub.userBucket("bob", rateMessages).take(); !ok {
+		t.Error("Expected bob to have his own bucket")
+	}
+}
+
+func TestRateLimitDisconnectsFlooder(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.rateLimits.families[rateMessages] = rateLimit{burst: 2, per: time.Minute}
+	hub.rateLimits.violations = rateLimit{burst: 3, per: time.Minute}
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	flooder := dialTestClient(t, hub, wsURL, "flooder")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+
+	for i := 0; i < 3; i++ {
+		sendJSON(t, flooder, Message{Type: "message", Content: "spam"})
+	}
+	errFrame := readUntil(t, flooder, func(msg map[string]interface{}) bool { return msg["type"] == "error" })
+	if errFrame["code"] != errorRateLimited || errFrame["message"] == "" || errFrame["retry_after_ms"] == nil {
+		t.Errorf("Unexpected error frame: %v", errFrame)
+	}
+	// Only the messages within the limit reach the channel
+	readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	expectNone(t, bob, 100*time.Millisecond, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+
+	// Three more throttled messages use up the violation budget
+	for i := 0; i < 3; i++ {
+		sendJSON(t, flooder, Message{Type: "message", Content: "spam"})
+	}
+	flooder.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := flooder.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("Expected a policy violation close, got %v", err)
+		}
+		break
+	}
+}
+
+func TestRateLimitCoversOtherCommands(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.rateLimits.families[rateOther] = rateLimit{burst: 5, per: time.Minute}
+	hub.rateLimits.violations = rateLimit{burst: 2, per: time.Minute}
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	if family := rateFamily("search"); family != rateOther {
+		t.Errorf("Expected search in the default family, got %q", family)
+	}
+
+	// Commands without a family of their own share the default bucket
+	searcher := dialTestClient(t, hub, wsURL, "searcher")
+	for i := 0; i < 6; i++ {
+		sendJSON(t, searcher, map[string]interface{}{"type": "search", "query": "x"})
+	}
+	if frame := readUntil(t, searcher, func(msg map[string]interface{}) bool { return msg["type"] == "error" }); frame["code"] != errorRateLimited {
+		t.Errorf("Expected the sixth search throttled, got %v", frame)
+	}
+
+	// Malformed and unknown frames use up the violation budget before the
+	// bucket runs dry
+	for i, frame := range []string{`{"type": "teleport"}`, `not json`} {
+		prober := dialTestClient(t, hub, wsURL, fmt.Sprintf("prober%d", i))
+		for i := 0; i < 3; i++ {
+			prober.WriteMessage(websocket.TextMessage, []byte(frame))
+		}
+		prober.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, _, err := prober.ReadMessage()
+			if err == nil {
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("Expected %s to get a policy violation close, got %v", frame, err)
+			}
+			break
+		}
+	}
+}
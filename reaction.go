@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// maxEmojiLength bounds a reaction in bytes; it fits ZWJ emoji sequences
+// and short :name: codes.
+const maxEmojiLength = 32
+
+var (
+	errInvalidEmoji   = fmt.Errorf("a reaction must be an emoji or code of at most %d bytes without spaces", maxEmojiLength)
+	errReactToDeleted = errors.New("cannot react to a deleted message")
+)
+
+// validEmoji reports whether emoji is usable as a reaction. Any short,
+// non-blank token is accepted so clients can send either emoji or codes.
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLength {
+		return false
+	}
+	return strings.IndexFunc(emoji, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) == -1
+}
+
+// react adds or removes username's reaction to a message and broadcasts the
+// message's reactions to its channel as reaction_updated.
+func (h *Hub) react(username string, messageID int, emoji string, add bool) error {
+	if !validEmoji(emoji) {
+		return errInvalidEmoji
+	}
+	msg, err := h.store.GetMessage(messageID)
+	if err != nil {
+		return err
+	}
+	if !h.canAccessChannel(username, msg.Channel) {
+		return errMessageNotFound
+	}
+	if msg.DeletedAt != nil {
+		return errReactToDeleted
+	}
+	// Muted and read-only users may still take their reactions back
+	if add {
+		if err := h.checkCanPost(username, msg.Channel); err != nil {
+			return err
+		}
+	}
+
+	var reactions []Reaction
+	if add {
+		reactions, err = h.store.AddReaction(messageID, username, emoji)
+	} else {
+		reactions, err = h.store.RemoveReaction(messageID, username, emoji)
+	}
+	if err != nil {
+		return err
+	}
+
+	update := ReactionUpdate{
+		Type:      "reaction_updated",
+		MessageID: messageID,
+		Channel:   msg.Channel,
+		Reactions: reactions,
+	}
+	if msgBytes, err := json.Marshal(update); err == nil {
+		h.broadcastToChannelName(msg.Channel, msgBytes)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReactionValidation(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+
+	if err := store.CreateChannel("team", Persistent); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+	id, err := hub.saveMessage(Message{Username: "alice", Content: "hello", Type: "message", Channel: "team", Timestamp: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("Failed to save message: %v", err)
+	}
+
+	for _, emoji := range []string{"", "two words", "\n", "🎉🎉🎉🎉🎉🎉🎉🎉🎉"} {
+		if err := hub.react("bob", id, emoji, true); !errors.Is(err, errInvalidEmoji) {
+			t.Errorf("Expected errInvalidEmoji for %q, got %v", emoji, err)
+		}
+	}
+	if err := hub.react("bob", id, ":+1:", true); err != nil {
+		t.Errorf("Expected a reaction code to be accepted, got %v", err)
+	}
+	if err := hub.react("bob", id+1000, "👍", true); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("Expected errMessageNotFound, got %v", err)
+	}
+	if err := hub.deleteMessage("alice", id); err != nil {
+		t.Fatalf("Failed to delete message: %v", err)
+	}
+	if err := hub.react("bob", id, "👍", true); !errors.Is(err, errReactToDeleted) {
+		t.Errorf("Expected errReactToDeleted, got %v", err)
+	}
+}
+
+func TestReactionBroadcast(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	if err := store.CreateChannel("team", Persistent); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	sendJSON(t, alice, Message{Type: "join_channel", Channel: "team"})
+	readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" })
+	sendJSON(t, bob, Message{Type: "join_channel", Channel: "team"})
+	readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" })
+
+	sendJSON(t, alice, Message{Type: "message", Content: "release is out"})
+	sent := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	id := int(sent["id"].(float64))
+
+	sendJSON(t, bob, ReactionRequest{Type: "add_reaction", MessageID: id, Emoji: "🎉"})
+	update := readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "reaction_updated" })
+	reactions, _ := update["reactions"].([]interface{})
+	if int(update["message_id"].(float64)) != id || len(reactions) != 1 {
+		t.Fatalf("Unexpected reaction_updated frame: %v", update)
+	}
+	if r := reactions[0].(map[string]interface{}); r["emoji"] != "🎉" || r["count"] != float64(1) {
+		t.Errorf("Unexpected reaction: %v", r)
+	}
+
+	sendJSON(t, bob, ReactionRequest{Type: "remove_reaction", MessageID: id, Emoji: "🎉"})
+	update = readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "reaction_updated" })
+	if reactions, _ := update["reactions"].([]interface{}); len(reactions) != 0 {
+		t.Errorf("Expected no reactions after removal, got %v", update)
+	}
+
+	// History loads carry the aggregated counts
+	sendJSON(t, bob, ReactionRequest{Type: "add_reaction", MessageID: id, Emoji: "👍"})
+	readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "reaction_updated" })
+	history, err := store.GetChannelHistory("team", 10)
+	if err != nil || len(history) != 1 || len(history[0].Reactions) != 1 || history[0].Reactions[0].Emoji != "👍" {
+		t.Errorf("Expected reactions in history, got %+v (%v)", history, err)
+	}
+}
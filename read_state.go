@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var errNotStoredChannel = errors.New("read state is only kept for persistent and direct channels")
+
+// markRead moves username's read position in a stored channel up to
+// messageID, or to the newest message when messageID is zero, and sends the
+// new read state to all of the user's connections.
+func (h *Hub) markRead(username, channelName string, messageID int) (ReadState, error) {
+	channelType, err := h.store.GetChannelType(channelName)
+	if err != nil {
+		return ReadState{}, err
+	}
+	if !h.canAccessChannel(username, channelName) {
+		return ReadState{}, errChannelNotFound
+	}
+	if !channelType.isStored() {
+		return ReadState{}, errNotStoredChannel
+	}
+
+	if messageID == 0 {
+		newest, _, err := h.store.GetHistoryPage(channelName, 0, 0, 1)
+		if err != nil {
+			return ReadState{}, err
+		}
+		if len(newest) > 0 {
+			messageID = newest[0].ID
+		}
+	} else if msg, err := h.store.GetMessage(messageID); err != nil {
+		return ReadState{}, err
+	} else if msg.Channel != channelName {
+		return ReadState{}, errMessageNotFound
+	}
+
+	if messageID != 0 {
+		if err := h.store.MarkRead(username, channelName, messageID); err != nil {
+			return ReadState{}, err
+		}
+	}
+	state, err := h.store.GetReadState(username, channelName)
+	if err != nil {
+		return ReadState{}, err
+	}
+
+	update := ReadStateUpdate{Type: "read_state", Channel: channelName, ReadState: state}
+	if msgBytes, err := json.Marshal(update); err == nil {
+		h.sendToUsers([]string{username}, msgBytes)
+	}
+	return state, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialActiveChannels connects as username and returns the connection with
+// the channels from its active_channels message, by name.
+func dialActiveChannels(t *testing.T, hub *Hub, wsURL, username string) (*websocket.Conn, map[string]map[string]interface{}) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, authHeader(t, hub, username))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	msg := readUntil(t, conn, func(msg map[string]interface{}) bool { return msg["type"] == "active_channels" })
+	channels := make(map[string]map[string]interface{})
+	for _, ch := range msg["channels"].([]interface{}) {
+		info := ch.(map[string]interface{})
+		channels[info["name"].(string)] = info
+	}
+	return conn, channels
+}
+
+func TestMarkReadValidation(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+
+	store.CreateChannel("news", Persistent)
+	store.CreateChannel("other", Persistent)
+	store.CreateChannel("lobby", Ephemeral)
+	store.CreateDirectChannel("dm-private", []string{"bob", "carol"})
+	otherID, _ := hub.saveMessage(Message{Username: "bob", Content: "elsewhere", Type: "message", Channel: "other", Timestamp: time.Now().UTC()})
+
+	if _, err := hub.markRead("alice", "lobby", 0); !errors.Is(err, errNotStoredChannel) {
+		t.Errorf("Expected errNotStoredChannel, got %v", err)
+	}
+	if _, err := hub.markRead("alice", "news", otherID); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("Expected errMessageNotFound for a message in another channel, got %v", err)
+	}
+	if _, err := hub.markRead("alice", "dm-private", 0); !errors.Is(err, errChannelNotFound) {
+		t.Errorf("Expected errChannelNotFound for another user's direct channel, got %v", err)
+	}
+	// Marking an empty channel read is harmless
+	if state, err := hub.markRead("alice", "news", 0); err != nil || state.LastReadID != 0 {
+		t.Errorf("Expected empty read state, got %+v (%v)", state, err)
+	}
+}
+
+// brokenStore fails to look up channels, like a store whose database is
+// unreachable.
+type brokenStore struct{ Store }
+
+var errStoreDown = errors.New("store unavailable")
+
+func (brokenStore) GetChannelType(name string) (ChannelType, error) {
+	return Ephemeral, errStoreDown
+}
+
+func TestMarkReadStoreFailure(t *testing.T) {
+	hub := newHub(brokenStore{newMemoryStore()})
+	if _, err := hub.markRead("alice", "news", 0); !errors.Is(err, errStoreDown) {
+		t.Errorf("Expected the store's error, got %v", err)
+	}
+}
+
+func TestReadStateAcrossConnections(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	store.CreateChannel("news", Persistent)
+	var lastID int
+	for _, content := range []string{"first", "second"} {
+		id, err := hub.saveMessage(Message{Username: "bob", Content: content, Type: "message", Channel: "news", Timestamp: time.Now().UTC()})
+		if err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+		lastID = id
+	}
+
+	laptop, channels := dialActiveChannels(t, hub, wsURL, "alice")
+	if channels["news"]["unread"] != float64(2) {
+		t.Fatalf("Expected 2 unread in active_channels, got %v", channels["news"])
+	}
+	phone, _ := dialActiveChannels(t, hub, wsURL, "alice")
+
+	sendJSON(t, laptop, MarkReadRequest{Type: "mark_read", Channel: "news"})
+	for _, conn := range []*websocket.Conn{laptop, phone} {
+		update := readUntil(t, conn, func(msg map[string]interface{}) bool { return msg["type"] == "read_state" })
+		if update["channel"] != "news" || update["last_read_id"] != float64(lastID) || update["unread"] != float64(0) {
+			t.Errorf("Unexpected read_state: %v", update)
+		}
+	}
+
+	// A later session starts from the stored position
+	_, channels = dialActiveChannels(t, hub, wsURL, "alice")
+	if channels["news"]["unread"] != nil || channels["news"]["last_read_id"] != float64(lastID) {
+		t.Errorf("Expected news read after reconnect, got %v", channels["news"])
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// channelEventBuffer is how many recent events each channel keeps for
+// reconnecting clients. It stays well below the client send buffer, which
+// must hold a whole replay.
+const channelEventBuffer = 100
+
+// channelEvent is a broadcast as delivered, with its event_id.
+type channelEvent struct {
+	seq     int
+	payload []byte
+}
+
+// newEpoch names one lifetime of a channel on this node. Event IDs from
+// another node or an earlier lifetime of the channel cannot be resumed.
+func newEpoch() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Error generating channel epoch: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (c *Channel) eventID(seq int) string {
+	return fmt.Sprintf("%s-%d", c.epoch, seq)
+}
+
+// record numbers a broadcast, stamps its event_id and keeps it for replay.
+// The caller holds clientsMu.
+func (c *Channel) record(msg []byte) []byte {
+	c.seq++
+	stamped := withEventID(msg, c.eventID(c.seq))
+	if len(c.events) == channelEventBuffer {
+		c.events = append(c.events[:0], c.events[1:]...)
+	}
+	c.events = append(c.events, channelEvent{seq: c.seq, payload: stamped})
+	return stamped
+}
+
+// withEventID adds an event_id field to a JSON object. Other payloads are
+// returned unchanged.
+func withEventID(msg []byte, eventID string) []byte {
+	if len(msg) < 2 || msg[0] != '{' {
+		return msg
+	}
+	field, _ := json.Marshal(eventID)
+	stamped := make([]byte, 0, len(msg)+len(field)+13)
+	stamped = append(stamped, `{"event_id":`...)
+	stamped = append(stamped, field...)
+	if msg[1] != '}' {
+		stamped = append(stamped, ',')
+	}
+	return append(stamped, msg[1:]...)
+}
+
+// currentEventID returns the ID of the channel's latest event, which a
+// client that has seen everything so far can resume from.
+func (c *Channel) currentEventID() string {
+	c.clientsMu.RLock()
+	defer c.clientsMu.RUnlock()
+	return c.eventID(c.seq)
+}
+
+// eventsAfter returns the buffered events following eventID. ok is false if
+// some of them are no longer buffered or eventID is from another epoch. The
+// caller holds clientsMu.
+func (c *Channel) eventsAfter(eventID string) (events [][]byte, ok bool) {
+	epoch, seqStr, found := strings.Cut(eventID, "-")
+	seq, err := strconv.Atoi(seqStr)
+	if !found || err != nil || epoch != c.epoch || seq > c.seq {
+		return nil, false
+	}
+	if seq < c.seq-len(c.events) {
+		return nil, false
+	}
+	for _, event := range c.events {
+		if event.seq > seq {
+			events = append(events, event.payload)
+		}
+	}
+	return events, true
+}
+
+// parseResumePosition reads a reconnecting client's position in its
+// focused channel from the WebSocket URL:
+// ?channel=...&last_event_id=...&last_message_id=...
+func parseResumePosition(query url.Values) (*ResumePosition, bool) {
+	pos := &ResumePosition{
+		Channel:     query.Get("channel"),
+		LastEventID: query.Get("last_event_id"),
+	}
+	if pos.Channel == "" {
+		return nil, false
+	}
+	if id := query.Get("last_message_id"); id != "" {
+		lastMessageID, err := strconv.Atoi(id)
+		if err != nil || lastMessageID < 0 {
+			return nil, false
+		}
+		pos.LastMessageID = lastMessageID
+	}
+	return pos, true
+}
+
+// parseResumeSubscriptions reads a reconnecting client's positions in the
+// channels it subscribed to from the WebSocket URL, one
+// subscription=<last_event_id>:<last_message_id>:<channel> parameter each.
+// The channel comes last because channel names may contain colons.
+// Malformed positions and positions past maxSubscriptions are skipped.
+func parseResumeSubscriptions(query url.Values) []*ResumePosition {
+	var positions []*ResumePosition
+	for _, value := range query["subscription"] {
+		if len(positions) == maxSubscriptions {
+			break
+		}
+		parts := strings.SplitN(value, ":", 3)
+		if len(parts) != 3 || parts[2] == "" {
+			continue
+		}
+		pos := &ResumePosition{Channel: parts[2], LastEventID: parts[0]}
+		if parts[1] != "" {
+			lastMessageID, err := strconv.Atoi(parts[1])
+			if err != nil || lastMessageID < 0 {
+				continue
+			}
+			pos.LastMessageID = lastMessageID
+		}
+		positions = append(positions, pos)
+	}
+	return positions
+}
+
+// resumeChannel adds a reconnecting client to a channel, focused or as a
+// subscription, and queues what it missed: the buffered events after its
+// last event ID or, if those are gone, the stored messages and replies
+// after its last message ID. Both are queued under the channel lock so no
+// live event overtakes them; replays are dropped as a gap if the client's
+// send buffer fills up.
+func (h *Hub) resumeChannel(client *Client, channel *Channel, pos *ResumePosition, focus bool) (Resumed, int) {
+	resumed := Resumed{Type: "resumed", Channel: channel.name}
+
+	channel.clientsMu.Lock()
+	defer channel.clientsMu.Unlock()
+	channel.clients[client] = true
+	if focus {
+		channel.focused[client] = true
+	}
+	resumed.EventID = channel.eventID(channel.seq)
+
+	missed, ok := channel.eventsAfter(pos.LastEventID)
+	if !ok {
+		resumed.Gap = true
+		if channel.channelType.isStored() {
+			messages, hasMore, err := h.missedMessages(channel.name, pos.LastMessageID)
+			if err != nil {
+				log.Printf("Error loading missed messages in '%s' for %s: %v", channel.name, client.username, err)
+			}
+			for _, msg := range messages {
+				if msgBytes, err := json.Marshal(msg); err == nil {
+					missed = append(missed, msgBytes)
+				}
+			}
+			resumed.HasMore = hasMore
+		}
+	}
+
+	for _, msg := range missed {
+		select {
+		case client.send <- msg:
+			resumed.Replayed++
+		default:
+			resumed.Gap = true
+		}
+	}
+	return resumed, len(channel.clients)
+}
+
+// missedMessages returns the stored messages a client missed after
+// lastMessageID, replies included, or the newest page of history if it had
+// none.
+func (h *Hub) missedMessages(channelName string, lastMessageID int) ([]Message, bool, error) {
+	if lastMessageID == 0 {
+		page, err := h.getHistoryPage(HistoryRequest{Channel: channelName, Limit: maxHistoryPageSize})
+		return page.Messages, page.HasMore, err
+	}
+	return h.store.GetMessagesSince(channelName, lastMessageID, maxHistoryPageSize)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWithEventID(t *testing.T) {
+	tests := map[string]string{
+		`{}`:                 `{"event_id":"e-1"}`,
+		`{"type":"message"}`: `{"event_id":"e-1","type":"message"}`,
+		`plain text`:         `plain text`,
+	}
+	for in, want := range tests {
+		if got := string(withEventID([]byte(in), "e-1")); got != want {
+			t.Errorf("withEventID(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestChannelEventsAfter(t *testing.T) {
+	channel := newChannel("lobby", Ephemeral)
+	for i := 0; i < 5; i++ {
+		channel.record([]byte(fmt.Sprintf(`{"n":%d}`, i+1)))
+	}
+
+	events, ok := channel.eventsAfter(channel.eventID(3))
+	if !ok || len(events) != 2 {
+		t.Fatalf("Expected 2 events after seq 3, got %d (ok=%v)", len(events), ok)
+	}
+	var event map[string]interface{}
+	json.Unmarshal(events[0], &event)
+	if event["event_id"] != channel.eventID(4) || event["n"] != float64(4) {
+		t.Errorf("Expected event 4 stamped with its ID, got %v", event)
+	}
+	if events, ok := channel.eventsAfter(channel.eventID(5)); !ok || len(events) != 0 {
+		t.Errorf("Expected nothing missed at the latest event, got %d (ok=%v)", len(events), ok)
+	}
+
+	for _, eventID := range []string{"", "garbage", "other-3", channel.eventID(9)} {
+		if _, ok := channel.eventsAfter(eventID); ok {
+			t.Errorf("Expected %q not to be resumable", eventID)
+		}
+	}
+
+	// Once the buffer wraps, older positions can no longer be resumed
+	for i := 0; i < channelEventBuffer; i++ {
+		channel.record([]byte(`{}`))
+	}
+	if _, ok := channel.eventsAfter(channel.eventID(4)); ok {
+		t.Error("Expected an overwritten position not to be resumable")
+	}
+	if events, ok := channel.eventsAfter(channel.eventID(5)); !ok || len(events) != channelEventBuffer {
+		t.Errorf("Expected the full buffer after the oldest kept position, got %d (ok=%v)", len(events), ok)
+	}
+}
+
+// dialResume reconnects as username with a resume position and returns the
+// frames received up to and including the resumed frame.
+func dialResume(t *testing.T, hub *Hub, wsURL, username string, params url.Values) []map[string]interface{} {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?"+params.Encode(), authHeader(t, hub, username))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var frames []map[string]interface{}
+	readUntil(t, conn, func(msg map[string]interface{}) bool {
+		frames = append(frames, msg)
+		return msg["type"] == "resumed"
+	})
+	return frames
+}
+
+func TestResumeReplaysMissedEvents(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	sendJSON(t, alice, map[string]interface{}{"type": "create_channel", "name": "lobby"})
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "lobby"})
+	readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "ack" })
+
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "before"})
+	seen := readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["content"] == "before" })
+	lastEventID, _ := seen["event_id"].(string)
+	if lastEventID == "" {
+		t.Fatalf("Expected broadcasts to carry an event_id, got %v", seen)
+	}
+	alice.Close()
+
+	for _, content := range []string{"missed 1", "missed 2"} {
+		sendJSON(t, bob, map[string]interface{}{"type": "message", "content": content})
+	}
+	readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["content"] == "missed 2" })
+
+	frames := dialResume(t, hub, wsURL, "alice", url.Values{"channel": {"lobby"}, "last_event_id": {lastEventID}})
+	var replayed []string
+	for _, frame := range frames {
+		if frame["type"] == "message" {
+			replayed = append(replayed, frame["content"].(string))
+		}
+	}
+	if len(replayed) != 2 || replayed[0] != "missed 1" || replayed[1] != "missed 2" {
+		t.Errorf("Expected the two missed messages in order, got %v", replayed)
+	}
+	resumed := frames[len(frames)-1]
+	if resumed["channel"] != "lobby" || resumed["gap"] != nil || resumed["event_id"] == "" {
+		t.Errorf("Unexpected resumed frame: %v", resumed)
+	}
+}
+
+func TestResumeFallsBackToStoredMessages(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	store.CreateChannel("news", Persistent)
+	var ids []int
+	for i := 0; i < 3; i++ {
+		id, _ := hub.saveMessage(Message{Username: "bob", Content: fmt.Sprintf("story %d", i+1), Type: "message", Channel: "news"})
+		ids = append(ids, id)
+	}
+
+	replyID, _ := hub.saveMessage(Message{Username: "bob", Content: "follow-up", Type: "reply", Channel: "news", ParentID: ids[0]})
+	ids = append(ids, replyID)
+
+	// An event ID from another node or channel lifetime cannot be resumed
+	params := url.Values{"channel": {"news"}, "last_event_id": {"elsewhere-7"}, "last_message_id": {fmt.Sprint(ids[0])}}
+	frames := dialResume(t, hub, wsURL, "alice", params)
+	var replayed []float64
+	for _, frame := range frames {
+		if frame["type"] == "message" || frame["type"] == "reply" {
+			replayed = append(replayed, frame["id"].(float64))
+		}
+	}
+	// Replies are replayed too, even to threads started before the gap
+	if len(replayed) != 3 || int(replayed[0]) != ids[1] || int(replayed[1]) != ids[2] || int(replayed[2]) != replyID {
+		t.Errorf("Expected stored messages and replies after %d, got %v", ids[0], replayed)
+	}
+	if resumed := frames[len(frames)-1]; resumed["gap"] != true || resumed["replayed"] != float64(3) {
+		t.Errorf("Expected a resumed frame reporting the gap, got %v", resumed)
+	}
+
+	// Without access to the channel the client starts in general as usual
+	store.CreateDirectChannel("dm-private", []string{"bob", "carol"})
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?channel=dm-private", authHeader(t, hub, "alice"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	members := readUntil(t, conn, func(msg map[string]interface{}) bool { return msg["type"] == "channel_members" })
+	if members["channel"] != "general" {
+		t.Errorf("Expected to start in general, got %v", members["channel"])
+	}
+}
+
+func TestParseResumeSubscriptions(t *testing.T) {
+	query := url.Values{"subscription": {"ab12-4:17:news", ":0:ops:eu", "bad", "x:-1:team", "::alerts"}}
+	positions := parseResumeSubscriptions(query)
+	want := []ResumePosition{
+		{Channel: "news", LastEventID: "ab12-4", LastMessageID: 17},
+		{Channel: "ops:eu"},
+		{Channel: "alerts"},
+	}
+	if len(positions) != len(want) {
+		t.Fatalf("Expected %d positions, got %d", len(want), len(positions))
+	}
+	for i, pos := range positions {
+		if *pos != want[i] {
+			t.Errorf("Position %d: expected %+v, got %+v", i, want[i], *pos)
+		}
+	}
+}
+
+func TestResumeSubscriptions(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	store.CreateChannel("news", Persistent)
+	var ids []int
+	for i := 0; i < 3; i++ {
+		id, _ := hub.saveMessage(Message{Username: "bob", Content: fmt.Sprintf("story %d", i+1), Type: "message", Channel: "news"})
+		ids = append(ids, id)
+	}
+
+	// Subscriptions are resumed alongside the focused channel, which stays
+	// general here
+	params := url.Values{"subscription": {fmt.Sprintf("elsewhere-3:%d:news", ids[1])}}
+	frames := dialResume(t, hub, wsURL, "alice", params)
+	var replayed []float64
+	for _, frame := range frames {
+		if frame["type"] == "message" && frame["channel"] == "news" {
+			replayed = append(replayed, frame["id"].(float64))
+		}
+	}
+	if len(replayed) != 1 || int(replayed[0]) != ids[2] {
+		t.Errorf("Expected the stored message after %d, got %v", ids[1], replayed)
+	}
+	if resumed := frames[len(frames)-1]; resumed["channel"] != "news" || resumed["gap"] != true {
+		t.Errorf("Expected a resumed frame for the subscription, got %v", resumed)
+	}
+
+	// The client receives the channel again without being present there
+	hub.channelsMu.RLock()
+	news := hub.channels["news"]
+	hub.channelsMu.RUnlock()
+	subscribed := false
+	news.clientsMu.RLock()
+	for client := range news.clients {
+		subscribed = subscribed || client.username == "alice" && !news.focused[client]
+	}
+	news.clientsMu.RUnlock()
+	if !subscribed {
+		t.Error("Expected alice subscribed to news without focusing it")
+	}
+}
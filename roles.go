@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+)
+
+// Roles in persistent channels. A channel's creator is its owner; users
+// without a role are treated as members, except in private channels, which
+// only users with a role may see and join. Server moderators (MODERATORS)
+// act as owners everywhere. Ephemeral channels have no roles: anyone may
+// join and post, and only server moderators manage them.
+const (
+	roleOwner     = "owner"
+	roleModerator = "moderator"
+	roleMember    = "member"
+	roleReadOnly  = "read-only"
+)
+
+// permission is something a role allows in a channel.
+type permission int
+
+const (
+	permJoin   permission = iota // switch to or subscribe to the channel
+	permPost                     // send messages and replies
+	permInvite                   // give users the member or read-only role
+	permManage                   // set the topic, manage webhooks and moderators
+)
+
+var rolePermissions = map[string][]permission{
+	roleOwner:     {permJoin, permPost, permInvite, permManage},
+	roleModerator: {permJoin, permPost, permInvite, permManage},
+	roleMember:    {permJoin, permPost},
+	roleReadOnly:  {permJoin},
+	"":            {permJoin, permPost},
+}
+
+// roleRanks orders roles: users may only change the roles of users ranked
+// below them, to roles ranked below them.
+var roleRanks = map[string]int{
+	roleReadOnly:  0,
+	"":            1,
+	roleMember:    1,
+	roleModerator: 2,
+	roleOwner:     3,
+}
+
+// rankServerModerator ranks server moderators above every channel role.
+const rankServerModerator = 4
+
+var (
+	errCannotPost         = errors.New("you cannot post in this channel")
+	errInvalidRole        = errors.New("role must be owner, moderator, member or read-only")
+	errRolesNeedPersisted = errors.New("roles only apply to persistent channels")
+	errOwnerRole          = errors.New("the owner's role only changes when ownership is granted to someone else")
+)
+
+// channelRole returns username's role in a persistent channel, empty if
+// they have none or the channel has no roles.
+func (h *Hub) channelRole(channelName, username string) (string, error) {
+	channelType, err := h.getChannelType(channelName)
+	if errors.Is(err, errChannelNotFound) || (err == nil && channelType != Persistent) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return h.store.GetChannelRole(channelName, username)
+}
+
+// can reports whether username's role in a channel allows perm. Direct
+// channels only let their members join and post, private channels allow
+// nothing to users without a role, and mutes and bans take away what
+// sanctionError says.
+func (h *Hub) can(username, channelName string, perm permission) bool {
+	if h.sanctionError(username, channelName, perm) != nil {
+		return false
+	}
+	if isDirectChannelName(channelName) {
+		if perm != permJoin && perm != permPost {
+			return false
+		}
+		members, err := h.store.GetChannelMembers(channelName)
+		return err == nil && slices.Contains(members, username)
+	}
+	if h.isModerator(username) {
+		return true
+	}
+	role, err := h.channelRole(channelName, username)
+	if err != nil {
+		log.Printf("Error loading %s's role in channel '%s': %v", username, channelName, err)
+		return false
+	}
+	if role == "" && h.isPrivateChannel(channelName) {
+		return false
+	}
+	return slices.Contains(rolePermissions[role], perm)
+}
+
+// isPrivateChannel reports whether a stored channel is private.
+func (h *Hub) isPrivateChannel(channelName string) bool {
+	private, err := h.store.IsChannelPrivate(channelName)
+	if err != nil && !errors.Is(err, errChannelNotFound) {
+		log.Printf("Error loading privacy of channel '%s': %v", channelName, err)
+	}
+	return private
+}
+
+// isChannelMember reports whether username has a role in a stored channel.
+func (h *Hub) isChannelMember(username, channelName string) bool {
+	role, err := h.store.GetChannelRole(channelName, username)
+	return err == nil && role != ""
+}
+
+// canDeleteChannel reports whether username may delete a channel: only its
+// owner and server moderators may.
+func (h *Hub) canDeleteChannel(username, channelName string) bool {
+	rank, err := h.roleRank(channelName, username)
+	return err == nil && rank >= roleRanks[roleOwner]
+}
+
+// roleRank ranks username in a channel for changing roles.
+func (h *Hub) roleRank(channelName, username string) (int, error) {
+	if h.isModerator(username) {
+		return rankServerModerator, nil
+	}
+	role, err := h.store.GetChannelRole(channelName, username)
+	return roleRanks[role], err
+}
+
+// grantRole gives username a role in a persistent channel. Owners and
+// moderators (permInvite) may grant roles ranked below their own to users
+// ranked below them; the owner, or a server moderator, may also hand
+// ownership over, which makes the previous owner a moderator. Users given
+// their first role in a private channel are told it exists.
+func (h *Hub) grantRole(actor, channelName, username, role string) error {
+	if _, ok := roleRanks[role]; !ok || role == "" {
+		return errInvalidRole
+	}
+	current, err := h.checkRoleChange(actor, channelName, username)
+	if err != nil {
+		return err
+	}
+	actorRank, err := h.roleRank(channelName, actor)
+	if err != nil {
+		return err
+	}
+	if role == roleOwner {
+		if actorRank < roleRanks[roleOwner] {
+			return errNotChannelAdmin
+		}
+		err = h.transferOwnership(actor, channelName, username)
+	} else if actorRank <= roleRanks[role] {
+		return errNotChannelAdmin
+	} else if err = h.store.SetChannelRole(channelName, username, role); err == nil {
+		log.Printf("%s gave %s the %s role in channel '%s'", actor, username, role, channelName)
+		h.announceRole(channelName, username, role, actor)
+	}
+	if err == nil && current == "" && h.isPrivateChannel(channelName) {
+		h.sendToUsers([]string{username}, channelCreatedFrame(channelName, Persistent, true))
+	}
+	return err
+}
+
+// revokeRole takes username's role in a persistent channel away, leaving
+// them an ordinary member, or removing them from a private channel. The
+// owner's role cannot be revoked.
+func (h *Hub) revokeRole(actor, channelName, username string) error {
+	if _, err := h.checkRoleChange(actor, channelName, username); err != nil {
+		return err
+	}
+	if err := h.store.RemoveChannelRole(channelName, username); err != nil {
+		return err
+	}
+	log.Printf("%s revoked %s's role in channel '%s'", actor, username, channelName)
+	h.announceRole(channelName, username, "", actor)
+	if h.isPrivateChannel(channelName) {
+		h.removeMember(channelName, username)
+	}
+	return nil
+}
+
+// removeMember tells username's clients that a private channel they lost
+// their role in is gone for them, then takes them out of it on every node.
+func (h *Hub) removeMember(channelName, username string) {
+	channelDeletedMsg := Message{
+		Username: "System",
+		Content:  channelName,
+		Type:     "channel_deleted",
+		Channel:  channelName,
+	}
+	if msgBytes, err := json.Marshal(channelDeletedMsg); err == nil {
+		h.sendToUsers([]string{username}, msgBytes)
+	}
+	h.removeFromChannel(channelName, username, nil)
+	h.publish(ClusterEvent{Kind: eventKick, Channel: channelName, Users: []string{username}})
+}
+
+// checkRoleChange checks that actor may change username's role in a
+// channel and returns username's current role: the channel must be
+// persistent, actor must be allowed to invite and outrank username, and
+// username must not be the owner.
+func (h *Hub) checkRoleChange(actor, channelName, username string) (string, error) {
+	channelType, err := h.getChannelType(channelName)
+	if err != nil && !errors.Is(err, errChannelNotFound) {
+		return "", err
+	}
+	if err != nil || channelType != Persistent {
+		return "", errRolesNeedPersisted
+	}
+	if err := validateUsername(username); err != nil {
+		return "", newCommandError(errorInvalidArgument, err.Error())
+	}
+	if !h.can(actor, channelName, permInvite) {
+		return "", errNotChannelAdmin
+	}
+	current, err := h.store.GetChannelRole(channelName, username)
+	if err != nil {
+		return "", err
+	}
+	if current == roleOwner {
+		return "", errOwnerRole
+	}
+	actorRank, err := h.roleRank(channelName, actor)
+	if err != nil {
+		return "", err
+	}
+	if actorRank <= roleRanks[current] {
+		return "", errNotChannelAdmin
+	}
+	return current, nil
+}
+
+// transferOwnership makes username the channel's owner and its previous
+// owner a moderator.
+func (h *Hub) transferOwnership(actor, channelName, username string) error {
+	roles, err := h.store.ListChannelRoles(channelName)
+	if err != nil {
+		return err
+	}
+	if err := h.store.SetChannelRole(channelName, username, roleOwner); err != nil {
+		return err
+	}
+	log.Printf("%s made %s the owner of channel '%s'", actor, username, channelName)
+	h.announceRole(channelName, username, roleOwner, actor)
+	for _, r := range roles {
+		if r.Role == roleOwner && r.Username != username {
+			if err := h.store.SetChannelRole(channelName, r.Username, roleModerator); err != nil {
+				return err
+			}
+			h.announceRole(channelName, r.Username, roleModerator, actor)
+		}
+	}
+	return nil
+}
+
+// announceRole tells a channel's members about a role change.
+func (h *Hub) announceRole(channelName, username, role, by string) {
+	update := RoleUpdate{Type: "role_updated", Channel: channelName, Username: username, Role: role, By: by}
+	if msgBytes, err := json.Marshal(update); err == nil {
+		h.broadcastToChannelName(channelName, msgBytes)
+	}
+}
+
+// channelRoles returns the users with a role in a persistent channel.
+// Anyone who may join the channel may see them.
+func (h *Hub) channelRoles(username, channelName string) ([]ChannelRole, error) {
+	channelType, err := h.getChannelType(channelName)
+	if err != nil {
+		return nil, err
+	}
+	if channelType != Persistent {
+		return nil, errRolesNeedPersisted
+	}
+	if !h.can(username, channelName, permJoin) {
+		return nil, errChannelForbidden
+	}
+	return h.store.ListChannelRoles(channelName)
+}
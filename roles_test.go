@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestChannelRoles(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.moderators = map[string]bool{"mod": true}
+	if err := hub.createChannelInDB("team", Persistent, "alice", false); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+	if role, _ := store.GetChannelRole("team", "alice"); role != roleOwner {
+		t.Fatalf("Expected the creator to own the channel, got %q", role)
+	}
+
+	steps := []struct {
+		actor, username, role string // an empty role revokes
+		want                  error
+	}{
+		{"bob", "carol", roleMember, errNotChannelAdmin},
+		{"alice", "bob", roleModerator, nil},
+		{"bob", "carol", roleReadOnly, nil},
+		{"bob", "dave", roleModerator, errNotChannelAdmin},
+		{"bob", "alice", "", errOwnerRole},
+		{"bob", "bob", roleMember, errNotChannelAdmin},
+		{"alice", "dave", "admin", errInvalidRole},
+	}
+	for _, step := range steps {
+		var err error
+		if step.role == "" {
+			err = hub.revokeRole(step.actor, "team", step.username)
+		} else {
+			err = hub.grantRole(step.actor, "team", step.username, step.role)
+		}
+		if !errors.Is(err, step.want) {
+			t.Errorf("%s changing %s's role to %q: expected %v, got %v", step.actor, step.username, step.role, step.want, err)
+		}
+	}
+	if err := hub.grantRole("alice", "team", "not a user!", roleMember); errorCode(err) != errorInvalidArgument {
+		t.Errorf("Expected an invalid username to be rejected, got %v", err)
+	}
+	if err := hub.grantRole("mod", "general", "bob", roleModerator); !errors.Is(err, errRolesNeedPersisted) {
+		t.Errorf("Expected roles in an ephemeral channel to be refused, got %v", err)
+	}
+
+	// Roles decide what users may do
+	permissions := []struct {
+		username string
+		perm     permission
+		want     bool
+	}{
+		{"carol", permJoin, true},
+		{"carol", permPost, false},
+		{"dave", permPost, true},
+		{"dave", permManage, false},
+		{"bob", permManage, true},
+		{"mod", permManage, true},
+	}
+	for _, tt := range permissions {
+		if got := hub.can(tt.username, "team", tt.perm); got != tt.want {
+			t.Errorf("can(%s, %d) = %v, want %v", tt.username, tt.perm, got, tt.want)
+		}
+	}
+	if hub.canDeleteChannel("bob", "team") || !hub.canDeleteChannel("alice", "team") || !hub.canDeleteChannel("mod", "team") {
+		t.Error("Expected only the owner and server moderators to be able to delete the channel")
+	}
+	if !hub.can("dave", "scratch", permPost) || hub.can("dave", "scratch", permManage) {
+		t.Error("Expected anyone to post in an ephemeral channel, and only server moderators to manage it")
+	}
+
+	// Revoking read-only lets carol post again
+	if err := hub.revokeRole("bob", "team", "carol"); err != nil {
+		t.Fatalf("Failed to revoke: %v", err)
+	}
+	if !hub.can("carol", "team", permPost) {
+		t.Error("Expected carol to post after the role was revoked")
+	}
+
+	// Handing ownership over keeps the previous owner as a moderator
+	if err := hub.grantRole("bob", "team", "dave", roleOwner); !errors.Is(err, errNotChannelAdmin) {
+		t.Errorf("Expected a moderator not to hand ownership over, got %v", err)
+	}
+	if err := hub.grantRole("alice", "team", "bob", roleOwner); err != nil {
+		t.Fatalf("Failed to hand ownership over: %v", err)
+	}
+	roles, _ := hub.channelRoles("dave", "team")
+	if len(roles) != 2 || roles[0] != (ChannelRole{"alice", roleModerator}) || roles[1] != (ChannelRole{"bob", roleOwner}) {
+		t.Errorf("Expected bob to own the channel with alice as moderator, got %+v", roles)
+	}
+	if channels, _ := store.ListChannels(); len(channels) != 1 || channels[0].Owner != "bob" {
+		t.Errorf("Expected bob recorded as the owner, got %+v", channels)
+	}
+}
+
+func TestConcurrentChannelCreationHasOneOwner(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := hub.createChannelInDB("race", Persistent, fmt.Sprintf("user%d", i), false); err != nil {
+				t.Errorf("Failed to create channel: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	roles, err := store.ListChannelRoles("race")
+	if err != nil || len(roles) != 1 || roles[0].Role != roleOwner {
+		t.Errorf("Expected exactly one owner, got %+v (%v)", roles, err)
+	}
+}
+
+func TestChannelRoleCommands(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	request := startAPIServer(t, hub)
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	sendJSON(t, alice, map[string]interface{}{"type": "create_channel", "name": "team", "channel_type": "persistent", "request_id": "c1"})
+	readUntil(t, alice, isAck("c1"))
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "team", "request_id": "j1"})
+	members := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "channel_members" })
+	if list := members["members"].([]interface{}); len(list) != 2 || list[0].(map[string]interface{})["role"] != roleOwner {
+		t.Errorf("Expected alice listed as the owner, got %v", members)
+	}
+	readUntil(t, bob, isAck("j1"))
+
+	// Read-only members can read but not post
+	sendJSON(t, alice, map[string]interface{}{"type": "grant_role", "username": "bob", "role": roleReadOnly, "request_id": "g1"})
+	readUntil(t, alice, isAck("g1"))
+	if update := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "role_updated" }); update["username"] != "bob" || update["role"] != roleReadOnly || update["by"] != "alice" {
+		t.Errorf("Expected bob's new role announced, got %v", update)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "hello", "request_id": "m1"})
+	if frame := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "error" }); frame["code"] != errorForbidden || frame["request_id"] != "m1" {
+		t.Errorf("Expected a read-only member's message refused, got %v", frame)
+	}
+	if status, body := request("bob", "POST", "/api/channels/team/messages", map[string]string{"content": "hello"}); status != http.StatusForbidden {
+		t.Errorf("Expected a read-only member's API post refused, got %d %v", status, body)
+	}
+
+	// Only managers set a persistent channel's topic
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "/topic mine now", "request_id": "t1"})
+	if frame := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "error" }); frame["code"] != errorForbidden || frame["request_id"] != "t1" {
+		t.Errorf("Expected bob's topic refused, got %v", frame)
+	}
+
+	// Slash commands grant and revoke too
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/revoke bob", "request_id": "r1"})
+	readUntil(t, alice, isAck("r1"))
+	if update := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "role_updated" }); update["role"] != "" {
+		t.Errorf("Expected bob's role revoked, got %v", update)
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "hello", "request_id": "m2"})
+	readUntil(t, bob, isAck("m2"))
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "/grant bob moderator", "request_id": "g2"})
+	readUntil(t, alice, isAck("g2"))
+
+	// The HTTP API lists and changes roles
+	if status, body := request("carol", "PUT", "/api/channels/team/roles/dave", map[string]string{"role": roleMember}); status != http.StatusForbidden {
+		t.Errorf("Expected carol refused, got %d %v", status, body)
+	}
+	if status, body := request("bob", "PUT", "/api/channels/team/roles/carol", map[string]string{"role": roleReadOnly}); status != http.StatusNoContent {
+		t.Errorf("Expected bob to make carol read-only, got %d %v", status, body)
+	}
+	status, body := request("carol", "GET", "/api/channels/team/roles", nil)
+	roles, _ := body["roles"].([]interface{})
+	if status != http.StatusOK || len(roles) != 3 {
+		t.Fatalf("Expected three roles listed, got %d %v", status, body)
+	}
+	if status, body := request("bob", "DELETE", "/api/channels/team/roles/carol", nil); status != http.StatusNoContent {
+		t.Errorf("Expected carol's role revoked, got %d %v", status, body)
+	}
+	if status, _ := request("bob", "GET", "/api/channels/general/roles", nil); status != http.StatusNotFound {
+		t.Errorf("Expected an ephemeral channel to have no roles, got %d", status)
+	}
+}
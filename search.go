@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Searches return defaultSearchLimit results unless asked for fewer, and at
+// most maxSearchLimit.
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+var errEmptySearch = errors.New("search query is required")
+
+// searchMessages runs a search for username, leaving out private channels
+// they are not a member of unless they are a server moderator.
+func (h *Hub) searchMessages(username string, query SearchQuery) (SearchResults, error) {
+	query.Query = strings.TrimSpace(query.Query)
+	if query.Query == "" {
+		return SearchResults{}, errEmptySearch
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultSearchLimit
+	}
+	if query.Limit > maxSearchLimit {
+		query.Limit = maxSearchLimit
+	}
+	if !h.isModerator(username) {
+		query.Member = username
+	}
+
+	results, err := h.store.SearchMessages(query)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	if results == nil {
+		results = []SearchResult{}
+	}
+	return SearchResults{Type: "search_results", Query: query.Query, Results: results}, nil
+}
+
+// handleSearch serves GET /api/search?q=...&channel=...&username=...&from=...&to=...&limit=...
+// with from and to in RFC 3339 format.
+func handleSearch(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	username, err := hub.auth.authenticateRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	params := r.URL.Query()
+	query := SearchQuery{
+		Query:    params.Get("q"),
+		Channel:  params.Get("channel"),
+		Username: params.Get("username"),
+	}
+
+	if from := params.Get("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "from must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "to must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a number")
+			return
+		}
+	}
+
+	results, err := hub.searchMessages(username, query)
+	if errors.Is(err, errEmptySearch) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Search for '%s' failed: %v", query.Query, err)
+		writeJSONError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
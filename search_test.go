@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedSearchMessages stores a few messages across two persistent channels.
+func seedSearchMessages(t *testing.T, store Store) time.Time {
+	t.Helper()
+	for _, name := range []string{"ops", "dev"} {
+		if err := store.CreateChannel(name, Persistent); err != nil {
+			t.Fatalf("Failed to create channel: %v", err)
+		}
+	}
+
+	base := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	messages := []Message{
+		{Username: "alice", Content: "deploy failed on staging", Channel: "ops"},
+		{Username: "bob", Content: "Deploy succeeded", Channel: "ops"},
+		{Username: "alice", Content: "lunch anyone?", Channel: "ops"},
+		{Username: "carol", Content: "deploy script needs review", Channel: "dev"},
+	}
+	for i, msg := range messages {
+		msg.Timestamp = base.Add(time.Duration(i) * time.Minute)
+		if _, err := store.SaveMessage(msg); err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+	}
+	return base
+}
+
+func TestStoreSearchMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		base := seedSearchMessages(t, store)
+
+		search := func(query SearchQuery) []SearchResult {
+			t.Helper()
+			if query.Limit == 0 {
+				query.Limit = 10
+			}
+			results, err := store.SearchMessages(query)
+			if err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			return results
+		}
+
+		results := search(SearchQuery{Query: "deploy"})
+		if len(results) != 3 {
+			t.Fatalf("Expected 3 results for 'deploy', got %d", len(results))
+		}
+		for _, r := range results {
+			if r.ID == 0 || !strings.Contains(strings.ToLower(r.Snippet), "<mark>deploy</mark>") {
+				t.Errorf("Expected highlighted snippet with ID, got %+v", r)
+			}
+		}
+
+		if results := search(SearchQuery{Query: "deploy", Channel: "dev"}); len(results) != 1 || results[0].Username != "carol" {
+			t.Errorf("Expected channel filter to return carol's message, got %+v", results)
+		}
+		if results := search(SearchQuery{Query: "deploy", Username: "alice"}); len(results) != 1 || results[0].Channel != "ops" {
+			t.Errorf("Expected username filter to return alice's message, got %+v", results)
+		}
+		if results := search(SearchQuery{Query: "deploy", From: base.Add(30 * time.Second), To: base.Add(90 * time.Second)}); len(results) != 1 || results[0].Username != "bob" {
+			t.Errorf("Expected date range to return bob's message, got %+v", results)
+		}
+		if results := search(SearchQuery{Query: "deploy", Limit: 2}); len(results) != 2 {
+			t.Errorf("Expected limit to cap results at 2, got %d", len(results))
+		}
+		if results := search(SearchQuery{Query: "kubernetes"}); len(results) != 0 {
+			t.Errorf("Expected no results, got %+v", results)
+		}
+	})
+}
+
+func TestHandleSearch(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	seedSearchMessages(t, store)
+
+	get := func(query string, authenticated bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/search?"+query, nil)
+		if authenticated {
+			req.Header = authHeader(t, hub, "alice")
+		}
+		rr := httptest.NewRecorder()
+		handleSearch(hub, rr, req)
+		return rr
+	}
+
+	if rr := get("q=deploy", false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", rr.Code)
+	}
+	if rr := get("q=", true); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for empty query, got %d", rr.Code)
+	}
+	if rr := get("q=deploy&from=yesterday", true); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid date, got %d", rr.Code)
+	}
+
+	rr := get("q=deploy&channel=ops", true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var results SearchResults
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatalf("Failed to decode results: %v", err)
+	}
+	if results.Type != "search_results" || results.Query != "deploy" || len(results.Results) != 2 {
+		t.Errorf("Expected 2 results in ops, got %+v", results)
+	}
+}
+
+func TestSearchOverWebSocket(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	seedSearchMessages(t, store)
+
+	client := &Client{hub: hub, send: make(chan []byte, 256), channel: "general", username: "alice"}
+	client.sendSearchResults(SearchQuery{Query: "review", Limit: 1000})
+
+	select {
+	case msg := <-client.send:
+		var results SearchResults
+		if err := json.Unmarshal(msg, &results); err != nil {
+			t.Fatalf("Failed to unmarshal results: %v", err)
+		}
+		if len(results.Results) != 1 || results.Results[0].Channel != "dev" {
+			t.Errorf("Expected one result in dev, got %+v", results)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Client should receive search results")
+	}
+}
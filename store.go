@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Store is the persistence layer used by the Hub for channels and messages.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// CreateChannel records a channel. Creating an existing channel is a no-op.
+	CreateChannel(name string, channelType ChannelType) error
+	// CreateOwnedChannel records a channel together with its owner, if any,
+	// and privacy, atomically, and reports whether this call created it.
+	// Creating an existing channel changes nothing.
+	CreateOwnedChannel(name string, channelType ChannelType, owner string, private bool) (bool, error)
+	// GetChannelType returns errChannelNotFound if the channel is unknown.
+	GetChannelType(name string) (ChannelType, error)
+	// ListChannels returns all stored channels except direct channels,
+	// ordered by name, with their topics, owners, privacy and slow mode.
+	ListChannels() ([]ChannelInfo, error)
+	// SetChannelPrivate makes a channel private or public, or returns
+	// errChannelNotFound if the channel is unknown.
+	SetChannelPrivate(name string, private bool) error
+	// IsChannelPrivate returns errChannelNotFound if the channel is unknown.
+	IsChannelPrivate(name string) (bool, error)
+	// GetChannelTopic returns a channel's topic, empty if it has none, or
+	// errChannelNotFound if the channel is unknown.
+	GetChannelTopic(name string) (string, error)
+	// SetChannelTopic replaces a channel's topic; an empty topic clears it.
+	SetChannelTopic(name, topic string) error
+	// DeleteChannel removes a channel with its messages, read positions,
+	// webhooks, invites and sanctions, or returns errChannelNotFound if the
+	// channel is unknown. Its audit entries are kept.
+	DeleteChannel(name string) error
+	// CreateDirectChannel records a direct channel and its members. Creating
+	// an existing channel is a no-op.
+	CreateDirectChannel(name string, members []string) error
+	// GetChannelMembers returns the members of a channel ordered by
+	// username: the participants of a direct channel, or the users with a
+	// role in other channels. Returns errChannelNotFound if the channel is
+	// unknown.
+	GetChannelMembers(name string) ([]string, error)
+	// SetChannelRole gives username a role in a stored channel, replacing
+	// any role they had. Giving the owner role also records username as the
+	// channel's owner. Returns errChannelNotFound if the channel is unknown.
+	SetChannelRole(name, username, role string) error
+	// RemoveChannelRole takes username's role in a channel away. Removing a
+	// missing role is a no-op.
+	RemoveChannelRole(name, username string) error
+	// GetChannelRole returns username's role in a channel, empty if they
+	// have none, or errChannelNotFound if the channel is unknown.
+	GetChannelRole(name, username string) (string, error)
+	// ListChannelRoles returns the users with a role in a channel ordered by
+	// username, or errChannelNotFound if the channel is unknown.
+	ListChannelRoles(name string) ([]ChannelRole, error)
+	// CreateChannelInvite records an invite link and returns its assigned
+	// ID.
+	CreateChannelInvite(invite ChannelInvite) (int, error)
+	// GetChannelInvite returns the invite whose code has codeHash without
+	// using it, or errInviteNotFound if there is none, it expired by now or
+	// it was used up.
+	GetChannelInvite(codeHash string, now time.Time) (ChannelInvite, error)
+	// UseChannelInvite counts a use of the invite whose code has codeHash
+	// and makes username a member of its channel, atomically, and returns
+	// the invite. It returns errInviteNotFound like GetChannelInvite, or
+	// errAlreadyMember without using the invite if username has a role
+	// there.
+	UseChannelInvite(codeHash, username string, now time.Time) (ChannelInvite, error)
+	// SetChannelSlowMode sets how many seconds users wait between messages
+	// in a channel; zero turns slow mode off. Returns errChannelNotFound if
+	// the channel is unknown.
+	SetChannelSlowMode(name string, seconds int) error
+	// GetChannelSlowMode returns errChannelNotFound if the channel is
+	// unknown.
+	GetChannelSlowMode(name string) (int, error)
+	// SetSanction records a mute or ban, replacing any of the same kind on
+	// the same user and channel, and returns its assigned ID. The channel
+	// need not be stored; an empty channel makes the sanction server-wide.
+	SetSanction(sanction Sanction) (int, error)
+	// RemoveSanction lifts a user's mute or ban in a channel, or returns
+	// errSanctionNotFound if none is in force at now.
+	RemoveSanction(kind, channel, username string, now time.Time) error
+	// ListSanctions returns the sanctions on username in force at now, in
+	// every channel and server-wide.
+	ListSanctions(username string, now time.Time) ([]Sanction, error)
+	// AddAuditEntry records a moderation action and returns its assigned ID.
+	AddAuditEntry(entry AuditEntry) (int, error)
+	// ListAuditLog returns up to limit of the newest audit entries for a
+	// channel, or of all entries when channel is empty, newest first.
+	ListAuditLog(channel string, limit int) ([]AuditEntry, error)
+	// ListDirectChannels returns the direct channels username belongs to,
+	// with their members, ordered by name.
+	ListDirectChannels(username string) ([]ChannelInfo, error)
+	// SaveMessage stores a message and returns its assigned ID. The channel
+	// must already exist. A message whose ClientMsgID its author has used
+	// before is not stored; errDuplicateMessage is returned instead.
+	SaveMessage(msg Message) (int, error)
+	// GetMessageByClientID returns the message username sent with
+	// clientMsgID, or errMessageNotFound.
+	GetMessageByClientID(username, clientMsgID string) (Message, error)
+	// GetChannelHistory returns up to limit of the newest top-level messages
+	// in a channel, oldest first, with their thread summaries and reactions.
+	GetChannelHistory(channelName string, limit int) ([]Message, error)
+	// GetHistoryPage returns up to limit top-level messages of a channel,
+	// with their thread summaries and reactions, using keyset pagination on
+	// message ID, oldest first. Messages older than beforeID (newest first
+	// when paging back) or newer than afterID are selected; a zero cursor is
+	// ignored. The bool reports whether more messages lie beyond the page in
+	// the paging direction.
+	GetHistoryPage(channelName string, beforeID, afterID, limit int) ([]Message, bool, error)
+	// GetMessagesSince returns up to limit messages of a channel newer than
+	// afterID, replies included, oldest first, with their thread summaries
+	// and reactions, and whether more follow.
+	GetMessagesSince(channelName string, afterID, limit int) ([]Message, bool, error)
+	// GetMessage returns errMessageNotFound if no message has the ID.
+	GetMessage(id int) (Message, error)
+	// GetThread returns up to limit replies to a message after afterID (zero
+	// for the first page), oldest first, with their reactions, and whether
+	// more follow.
+	GetThread(parentID, afterID, limit int) ([]Message, bool, error)
+	// EditMessage replaces a message's content, recording the previous
+	// content in its edit history, and returns the updated message. Deleted
+	// messages cannot be edited.
+	EditMessage(id int, content, editor string, editedAt time.Time) (Message, error)
+	// DeleteMessage clears a message's content and marks it deleted, keeping
+	// the old content in its edit history.
+	DeleteMessage(id int, deleter string, deletedAt time.Time) (Message, error)
+	// GetMessageEdits returns a message's edit history, oldest first.
+	GetMessageEdits(id int) ([]MessageEdit, error)
+	// AddReaction records username's reaction to a message and returns the
+	// message's reactions. Adding an existing reaction is a no-op.
+	AddReaction(messageID int, username, emoji string) ([]Reaction, error)
+	// RemoveReaction deletes username's reaction to a message and returns the
+	// message's reactions. Removing a missing reaction is a no-op.
+	RemoveReaction(messageID int, username, emoji string) ([]Reaction, error)
+	// MarkRead records that username has read a channel up to messageID.
+	// The read position only moves forward.
+	MarkRead(username, channelName string, messageID int) error
+	// GetReadState returns username's read state in a stored channel, or
+	// errChannelNotFound if the channel is unknown.
+	GetReadState(username, channelName string) (ReadState, error)
+	// GetReadStates returns username's read state in every persistent
+	// channel and in their direct channels. Unread counts leave out
+	// replies, deleted messages and the user's own messages.
+	GetReadStates(username string) (map[string]ReadState, error)
+	// SearchMessages returns up to query.Limit messages matching the query,
+	// best match first.
+	SearchMessages(query SearchQuery) ([]SearchResult, error)
+
+	// CreateIncomingWebhook records a webhook and returns its assigned ID.
+	CreateIncomingWebhook(hook IncomingWebhook) (int, error)
+	// GetIncomingWebhook returns the webhook whose token has tokenHash, or
+	// errWebhookNotFound.
+	GetIncomingWebhook(tokenHash string) (IncomingWebhook, error)
+	// ListIncomingWebhooks returns a channel's webhooks ordered by ID.
+	ListIncomingWebhooks(channelName string) ([]IncomingWebhook, error)
+	// DeleteIncomingWebhook returns errWebhookNotFound if no webhook has the
+	// ID.
+	DeleteIncomingWebhook(id int) error
+
+	// CreateOutgoingWebhook records a webhook and returns its assigned ID.
+	CreateOutgoingWebhook(hook OutgoingWebhook) (int, error)
+	// ListOutgoingWebhooks returns every outgoing webhook ordered by ID.
+	ListOutgoingWebhooks() ([]OutgoingWebhook, error)
+	// DeleteOutgoingWebhook removes a webhook and its deliveries, or returns
+	// errWebhookNotFound if no webhook has the ID.
+	DeleteOutgoingWebhook(id int) error
+	// EnqueueWebhookDelivery queues a delivery and returns its assigned ID.
+	EnqueueWebhookDelivery(delivery WebhookDelivery) (int, error)
+	// ClaimWebhookDeliveries returns up to limit pending deliveries due by
+	// now, oldest first, and postpones them by lease so that other nodes
+	// skip them while they are attempted.
+	ClaimWebhookDeliveries(now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error)
+	// UpdateWebhookDelivery records the outcome of an attempt: status,
+	// attempts, next attempt, response and delivery time.
+	UpdateWebhookDelivery(delivery WebhookDelivery) error
+	// ListWebhookDeliveries returns a webhook's latest deliveries, newest
+	// first.
+	ListWebhookDeliveries(webhookID, limit int) ([]WebhookDelivery, error)
+
+	// CreateUser returns errUserExists if the username is taken.
+	CreateUser(user User) error
+	// GetUser returns errUserNotFound if the username is unknown.
+	GetUser(username string) (User, error)
+
+	Close() error
+}
+
+var (
+	errChannelNotFound  = errors.New("channel not found")
+	errMessageNotFound  = errors.New("message not found")
+	errDuplicateMessage = errors.New("message already stored")
+	errWebhookNotFound  = errors.New("webhook not found")
+	errInviteNotFound   = errors.New("invite not found, expired or used up")
+	errSanctionNotFound = errors.New("user is not muted or banned there")
+)
+
+// initStore builds the Store selected by STORE_DRIVER: "postgres" (default),
+// "memory" or "file" (uses STORE_PATH).
+func initStore() (Store, error) {
+	driver := getEnv("STORE_DRIVER", "postgres")
+
+	switch driver {
+	case "postgres":
+		db, err := initDatabase()
+		if err != nil {
+			return nil, err
+		}
+		return newPostgresStore(db), nil
+	case "memory":
+		log.Println("Using in-memory store: data will be lost on restart")
+		return newMemoryStore(), nil
+	case "file":
+		path := getEnv("STORE_PATH", "echoroom.jsonl")
+		store, err := newFileStore(path)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Using file store: %s", path)
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown STORE_DRIVER %q", driver)
+	}
+}
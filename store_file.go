@@ -0,0 +1,945 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// journalCompactEvery is how many entries are appended to the journal
+// before it is compacted.
+var journalCompactEvery = 10000
+
+// fileStore is an embedded, file-backed Store. Every change is appended to a
+// JSON-lines journal and applied to an in-memory copy; the journal is
+// replayed on open, so no database server is needed. The journal is
+// compacted into a snapshot of the state on open and every
+// journalCompactEvery entries, so it does not grow without bound.
+type fileStore struct {
+	*memoryStore
+	journalMu sync.Mutex // serialises journal writes
+	file      *os.File
+	path      string
+	entries   int // appended since the last snapshot
+}
+
+type journalEntry struct {
+	Op       string           `json:"op"`
+	Channel  *ChannelInfo     `json:"channel,omitempty"`
+	Message  *Message         `json:"message,omitempty"`
+	User     *User            `json:"user,omitempty"`
+	Edit     *journalEdit     `json:"edit,omitempty"`
+	Reaction *journalReaction `json:"reaction,omitempty"`
+	Read     *journalRead     `json:"read,omitempty"`
+	Webhook  *journalWebhook  `json:"webhook,omitempty"`
+	Role     *journalRole     `json:"role,omitempty"`
+	Invite   *journalInvite   `json:"invite,omitempty"`
+	Sanction *Sanction        `json:"sanction,omitempty"`
+	Audit    *AuditEntry      `json:"audit,omitempty"`
+	Snapshot *journalSnapshot `json:"snapshot,omitempty"`
+
+	OutgoingWebhook *OutgoingWebhook `json:"outgoing_webhook,omitempty"`
+	Delivery        *WebhookDelivery `json:"delivery,omitempty"`
+}
+
+// journalEdit is an edit or deletion of a stored message.
+type journalEdit struct {
+	MessageID int       `json:"message_id"`
+	Content   string    `json:"content,omitempty"`
+	By        string    `json:"by"`
+	At        time.Time `json:"at"`
+}
+
+// journalReaction adds or removes a user's reaction to a message.
+type journalReaction struct {
+	MessageID int    `json:"message_id"`
+	Username  string `json:"username"`
+	Emoji     string `json:"emoji"`
+}
+
+// journalRead moves a user's read position in a channel.
+type journalRead struct {
+	Username  string `json:"username"`
+	Channel   string `json:"channel"`
+	MessageID int    `json:"message_id"`
+}
+
+// journalWebhook creates or, with only an ID, deletes an incoming webhook.
+type journalWebhook struct {
+	ID        int       `json:"id"`
+	Channel   string    `json:"channel,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	TokenHash string    `json:"token_hash,omitempty"`
+}
+
+// journalRole gives a user a role in a channel or, without a role, takes
+// it away.
+type journalRole struct {
+	Channel  string `json:"channel"`
+	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
+}
+
+// journalInvite creates an invite link or, with only an ID and Username,
+// counts a use of it that made Username a member.
+type journalInvite struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses,omitempty"`
+	Uses      int       `json:"uses,omitempty"` // in snapshots only
+	CodeHash  string    `json:"code_hash,omitempty"`
+}
+
+// journalSnapshot is the whole state of the store. A compacted journal
+// starts with one, replacing every entry before it.
+type journalSnapshot struct {
+	Channels  map[string]ChannelType       `json:"channels"`
+	Messages  map[string][]Message         `json:"messages"`
+	Members   map[string][]string          `json:"members"`
+	Users     map[string]User              `json:"users"`
+	Topics    map[string]string            `json:"topics"`
+	Roles     map[string]map[string]string `json:"roles"`
+	Owners    map[string]string            `json:"owners"`
+	Private   map[string]bool              `json:"private"`
+	SlowModes map[string]int               `json:"slow_modes"`
+	Edits     map[int][]MessageEdit        `json:"edits"`
+	Reactions map[int][]reactionEntry      `json:"reactions"`
+	LastRead  map[string]map[string]int    `json:"last_read"`
+	Webhooks  []journalWebhook             `json:"webhooks"`
+	Invites   []journalInvite              `json:"invites"`
+	Sanctions map[int]Sanction             `json:"sanctions"`
+	AuditLog  []AuditEntry                 `json:"audit_log"`
+
+	OutgoingWebhooks map[int]OutgoingWebhook `json:"outgoing_webhooks"`
+	Deliveries       map[int]WebhookDelivery `json:"deliveries"`
+
+	NextID         int `json:"next_id"`
+	NextWebhookID  int `json:"next_webhook_id"`
+	NextInviteID   int `json:"next_invite_id"`
+	NextSanctionID int `json:"next_sanction_id"`
+	NextAuditID    int `json:"next_audit_id"`
+	NextOutgoingID int `json:"next_outgoing_id"`
+	NextDeliveryID int `json:"next_delivery_id"`
+}
+
+const (
+	journalCreateChannel  = "create_channel"
+	journalDeleteChannel  = "delete_channel"
+	journalSetTopic       = "set_topic"
+	journalSetPrivate     = "set_private"
+	journalSetSlowMode    = "set_slow_mode"
+	journalSetRole        = "set_role"
+	journalRemoveRole     = "remove_role"
+	journalCreateDirect   = "create_direct_channel"
+	journalSaveMessage    = "save_message"
+	journalCreateUser     = "create_user"
+	journalEditMessage    = "edit_message"
+	journalDeleteMessage  = "delete_message"
+	journalAddReaction    = "add_reaction"
+	journalRemoveReaction = "remove_reaction"
+	journalMarkRead       = "mark_read"
+	journalCreateWebhook  = "create_webhook"
+	journalDeleteWebhook  = "delete_webhook"
+	journalCreateInvite   = "create_invite"
+	journalUseInvite      = "use_invite"
+	journalSetSanction    = "set_sanction"
+	journalRemoveSanction = "remove_sanction"
+	journalAddAuditEntry  = "add_audit_entry"
+
+	journalCreateOutgoingWebhook = "create_outgoing_webhook"
+	journalDeleteOutgoingWebhook = "delete_outgoing_webhook"
+	journalEnqueueDelivery       = "enqueue_delivery"
+	journalUpdateDelivery        = "update_delivery"
+
+	journalSnapshotOp = "snapshot"
+)
+
+func newFileStore(path string) (*fileStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store file: %v", err)
+	}
+
+	s := &fileStore{memoryStore: newMemoryStore(), file: file, path: path}
+	if err := s.replay(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to replay store file %s: %v", path, err)
+	}
+	if s.entries > 0 {
+		if err := s.compact(); err != nil {
+			s.file.Close()
+			return nil, fmt.Errorf("failed to compact store file %s: %v", path, err)
+		}
+	}
+	return s, nil
+}
+
+// replay applies the journal's entries, counting those after its snapshot.
+// Entries are decoded as a stream, so a snapshot line may be of any length.
+// An undecodable last line is a write torn by a crash and is cut off.
+func (s *fileStore) replay() error {
+	decoder := json.NewDecoder(s.file)
+	var offset int64 // just past the last entry decoded
+	for n := 1; ; n++ {
+		var entry journalEntry
+		err := decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			torn, tailErr := s.discardTornTail(offset)
+			if tailErr != nil {
+				return tailErr
+			}
+			if !torn {
+				return fmt.Errorf("entry %d: %v", n, err)
+			}
+			log.Printf("Discarded torn entry %d at the end of store file %s: %v", n, s.path, err)
+			return nil
+		}
+		offset = decoder.InputOffset()
+		if err := s.apply(entry); err != nil {
+			return fmt.Errorf("entry %d: %v", n, err)
+		}
+		s.entries++
+		if entry.Op == journalSnapshotOp {
+			s.entries = 0
+		}
+	}
+}
+
+// apply mutates the in-memory state. Callers must hold memoryStore.mu or be
+// replaying before the store is shared.
+func (s *fileStore) apply(entry journalEntry) error {
+	switch entry.Op {
+	case journalSnapshotOp:
+		if entry.Snapshot == nil {
+			return fmt.Errorf("%s entry without snapshot", entry.Op)
+		}
+		return s.restore(entry.Snapshot)
+	case journalCreateChannel:
+		if entry.Channel == nil {
+			return fmt.Errorf("%s entry without channel", entry.Op)
+		}
+		return s.createOwnedChannel(*entry.Channel)
+	case journalDeleteChannel:
+		if entry.Channel == nil {
+			return fmt.Errorf("%s entry without channel", entry.Op)
+		}
+		return s.deleteChannel(entry.Channel.Name)
+	case journalSetTopic:
+		if entry.Channel == nil {
+			return fmt.Errorf("%s entry without channel", entry.Op)
+		}
+		return s.setChannelTopic(entry.Channel.Name, entry.Channel.Topic)
+	case journalSetPrivate:
+		if entry.Channel == nil {
+			return fmt.Errorf("%s entry without channel", entry.Op)
+		}
+		return s.setChannelPrivate(entry.Channel.Name, entry.Channel.Private)
+	case journalSetSlowMode:
+		if entry.Channel == nil {
+			return fmt.Errorf("%s entry without channel", entry.Op)
+		}
+		return s.setChannelSlowMode(entry.Channel.Name, entry.Channel.SlowMode)
+	case journalSetRole:
+		if entry.Role == nil {
+			return fmt.Errorf("%s entry without role", entry.Op)
+		}
+		return s.setChannelRole(entry.Role.Channel, entry.Role.Username, entry.Role.Role)
+	case journalRemoveRole:
+		if entry.Role == nil {
+			return fmt.Errorf("%s entry without role", entry.Op)
+		}
+		s.removeChannelRole(entry.Role.Channel, entry.Role.Username)
+	case journalCreateDirect:
+		if entry.Channel == nil {
+			return fmt.Errorf("%s entry without channel", entry.Op)
+		}
+		s.createDirectChannel(entry.Channel.Name, entry.Channel.Members)
+	case journalSaveMessage:
+		if entry.Message == nil {
+			return fmt.Errorf("%s entry without message", entry.Op)
+		}
+		return s.insertMessage(entry.Message)
+	case journalCreateUser:
+		if entry.User == nil {
+			return fmt.Errorf("%s entry without user", entry.Op)
+		}
+		return s.createUser(*entry.User)
+	case journalEditMessage, journalDeleteMessage:
+		if entry.Edit == nil {
+			return fmt.Errorf("%s entry without edit", entry.Op)
+		}
+		edit := entry.Edit
+		_, err := s.editMessage(edit.MessageID, edit.Content, edit.By, edit.At, entry.Op == journalDeleteMessage)
+		return err
+	case journalAddReaction, journalRemoveReaction:
+		if entry.Reaction == nil {
+			return fmt.Errorf("%s entry without reaction", entry.Op)
+		}
+		r := entry.Reaction
+		var err error
+		if entry.Op == journalAddReaction {
+			_, err = s.addReaction(r.MessageID, r.Username, r.Emoji)
+		} else {
+			_, err = s.removeReaction(r.MessageID, r.Username, r.Emoji)
+		}
+		return err
+	case journalMarkRead:
+		if entry.Read == nil {
+			return fmt.Errorf("%s entry without read", entry.Op)
+		}
+		return s.markRead(entry.Read.Username, entry.Read.Channel, entry.Read.MessageID)
+	case journalCreateWebhook, journalDeleteWebhook:
+		if entry.Webhook == nil {
+			return fmt.Errorf("%s entry without webhook", entry.Op)
+		}
+		w := entry.Webhook
+		if entry.Op == journalDeleteWebhook {
+			return s.deleteIncomingWebhook(w.ID)
+		}
+		s.createIncomingWebhook(IncomingWebhook{ID: w.ID, Channel: w.Channel, Name: w.Name, CreatedBy: w.CreatedBy, CreatedAt: w.CreatedAt, TokenHash: w.TokenHash})
+	case journalCreateInvite, journalUseInvite:
+		if entry.Invite == nil {
+			return fmt.Errorf("%s entry without invite", entry.Op)
+		}
+		i := entry.Invite
+		if entry.Op == journalUseInvite {
+			_, err := s.joinWithInvite(i.ID, i.Username)
+			return err
+		}
+		s.createChannelInvite(ChannelInvite{ID: i.ID, Channel: i.Channel, CreatedBy: i.CreatedBy, CreatedAt: i.CreatedAt, ExpiresAt: i.ExpiresAt, MaxUses: i.MaxUses, CodeHash: i.CodeHash})
+	case journalSetSanction, journalRemoveSanction:
+		if entry.Sanction == nil {
+			return fmt.Errorf("%s entry without sanction", entry.Op)
+		}
+		if entry.Op == journalRemoveSanction {
+			s.removeSanction(entry.Sanction.Kind, entry.Sanction.Channel, entry.Sanction.Username)
+		} else {
+			s.setSanction(*entry.Sanction)
+		}
+	case journalAddAuditEntry:
+		if entry.Audit == nil {
+			return fmt.Errorf("%s entry without audit", entry.Op)
+		}
+		s.addAuditEntry(*entry.Audit)
+	case journalCreateOutgoingWebhook, journalDeleteOutgoingWebhook:
+		if entry.OutgoingWebhook == nil {
+			return fmt.Errorf("%s entry without outgoing_webhook", entry.Op)
+		}
+		if entry.Op == journalDeleteOutgoingWebhook {
+			return s.deleteOutgoingWebhook(entry.OutgoingWebhook.ID)
+		}
+		s.createOutgoingWebhook(*entry.OutgoingWebhook)
+	case journalEnqueueDelivery, journalUpdateDelivery:
+		if entry.Delivery == nil {
+			return fmt.Errorf("%s entry without delivery", entry.Op)
+		}
+		if entry.Op == journalUpdateDelivery {
+			return s.updateWebhookDelivery(*entry.Delivery)
+		}
+		return s.enqueueWebhookDelivery(*entry.Delivery)
+	default:
+		return fmt.Errorf("unknown journal op %q", entry.Op)
+	}
+	return nil
+}
+
+// discardTornTail truncates the journal at offset if all that follows it
+// is one incomplete line, and reports whether it did. The newline ending
+// the entry before offset is kept.
+func (s *fileStore) discardTornTail(offset int64) (bool, error) {
+	tail, err := io.ReadAll(io.NewSectionReader(s.file, offset, math.MaxInt64-offset))
+	if err != nil {
+		return false, err
+	}
+	if bytes.ContainsRune(bytes.TrimSpace(tail), '\n') {
+		return false, nil
+	}
+	if offset > 0 && len(tail) > 0 && tail[0] == '\n' {
+		offset++
+	}
+	if err := s.file.Truncate(offset); err != nil {
+		return false, err
+	}
+	return true, s.file.Sync()
+}
+
+// append writes an entry to the journal, first compacting it if it has
+// grown by journalCompactEvery entries. Callers hold memoryStore.mu, so the
+// state is not changed while it is written out.
+func (s *fileStore) append(entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+	if s.entries >= journalCompactEvery {
+		if err := s.compactLocked(); err != nil {
+			return fmt.Errorf("failed to compact store file: %v", err)
+		}
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.entries++
+	return s.file.Sync()
+}
+
+// compact replaces the journal with a snapshot of the current state.
+// Callers hold memoryStore.mu or have not shared the store yet.
+func (s *fileStore) compact() error {
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+	return s.compactLocked()
+}
+
+// compactLocked writes the snapshot to a temporary file and renames it over
+// the journal, so a crash leaves either the old journal or the new one.
+// Callers hold journalMu as well as memoryStore.mu.
+func (s *fileStore) compactLocked() error {
+	data, err := json.Marshal(journalEntry{Op: journalSnapshotOp, Snapshot: s.snapshot()})
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	// The renamed file is the journal now; keep appending through its handle
+	s.file.Close()
+	s.file = tmp
+	s.entries = 0
+	return nil
+}
+
+// snapshot captures the in-memory state. Callers hold memoryStore.mu.
+func (s *fileStore) snapshot() *journalSnapshot {
+	snap := &journalSnapshot{
+		Channels:  s.channels,
+		Messages:  s.messages,
+		Members:   s.members,
+		Users:     s.users,
+		Topics:    s.topics,
+		Roles:     s.roles,
+		Owners:    s.owners,
+		Private:   s.private,
+		SlowModes: s.slowModes,
+		Edits:     s.edits,
+		Reactions: s.reactions,
+		LastRead:  s.lastRead,
+		Sanctions: s.sanctions,
+		AuditLog:  s.auditLog,
+
+		OutgoingWebhooks: s.outgoingWebhooks,
+		Deliveries:       s.deliveries,
+
+		NextID:         s.nextID,
+		NextWebhookID:  s.nextWebhookID,
+		NextInviteID:   s.nextInviteID,
+		NextSanctionID: s.nextSanctionID,
+		NextAuditID:    s.nextAuditID,
+		NextOutgoingID: s.nextOutgoingID,
+		NextDeliveryID: s.nextDeliveryID,
+	}
+	// Token and code hashes are left out of the API types' JSON
+	for _, w := range s.webhooks {
+		snap.Webhooks = append(snap.Webhooks, journalWebhook{ID: w.ID, Channel: w.Channel, Name: w.Name, CreatedBy: w.CreatedBy, CreatedAt: w.CreatedAt, TokenHash: w.TokenHash})
+	}
+	for _, i := range s.invites {
+		snap.Invites = append(snap.Invites, journalInvite{ID: i.ID, Channel: i.Channel, CreatedBy: i.CreatedBy, CreatedAt: i.CreatedAt, ExpiresAt: i.ExpiresAt, MaxUses: i.MaxUses, Uses: i.Uses, CodeHash: i.CodeHash})
+	}
+	return snap
+}
+
+// restore replaces the in-memory state with a snapshot, rebuilding the
+// indexes derived from messages.
+func (s *fileStore) restore(snap *journalSnapshot) error {
+	fresh := newMemoryStore()
+	m := s.memoryStore
+	m.channels = orEmpty(snap.Channels, fresh.channels)
+	m.messages = orEmpty(snap.Messages, fresh.messages)
+	m.members = orEmpty(snap.Members, fresh.members)
+	m.users = orEmpty(snap.Users, fresh.users)
+	m.topics = orEmpty(snap.Topics, fresh.topics)
+	m.roles = orEmpty(snap.Roles, fresh.roles)
+	m.owners = orEmpty(snap.Owners, fresh.owners)
+	m.private = orEmpty(snap.Private, fresh.private)
+	m.slowModes = orEmpty(snap.SlowModes, fresh.slowModes)
+	m.edits = orEmpty(snap.Edits, fresh.edits)
+	m.reactions = orEmpty(snap.Reactions, fresh.reactions)
+	m.lastRead = orEmpty(snap.LastRead, fresh.lastRead)
+	m.sanctions = orEmpty(snap.Sanctions, fresh.sanctions)
+	m.outgoingWebhooks = orEmpty(snap.OutgoingWebhooks, fresh.outgoingWebhooks)
+	m.deliveries = orEmpty(snap.Deliveries, fresh.deliveries)
+	m.auditLog = snap.AuditLog
+	m.webhooks = fresh.webhooks
+	m.invites = fresh.invites
+	m.messageChannel = fresh.messageChannel
+	m.clientMessages = fresh.clientMessages
+	m.nextID = max(fresh.nextID, snap.NextID)
+	m.nextWebhookID = max(fresh.nextWebhookID, snap.NextWebhookID)
+	m.nextInviteID = max(fresh.nextInviteID, snap.NextInviteID)
+	m.nextSanctionID = max(fresh.nextSanctionID, snap.NextSanctionID)
+	m.nextAuditID = max(fresh.nextAuditID, snap.NextAuditID)
+	m.nextOutgoingID = max(fresh.nextOutgoingID, snap.NextOutgoingID)
+	m.nextDeliveryID = max(fresh.nextDeliveryID, snap.NextDeliveryID)
+
+	for _, w := range snap.Webhooks {
+		m.createIncomingWebhook(IncomingWebhook{ID: w.ID, Channel: w.Channel, Name: w.Name, CreatedBy: w.CreatedBy, CreatedAt: w.CreatedAt, TokenHash: w.TokenHash})
+	}
+	for _, i := range snap.Invites {
+		m.createChannelInvite(ChannelInvite{ID: i.ID, Channel: i.Channel, CreatedBy: i.CreatedBy, CreatedAt: i.CreatedAt, ExpiresAt: i.ExpiresAt, MaxUses: i.MaxUses, Uses: i.Uses, CodeHash: i.CodeHash})
+	}
+	for channelName, messages := range m.messages {
+		for _, msg := range messages {
+			m.messageChannel[msg.ID] = channelName
+			if msg.ClientMsgID != "" {
+				m.clientMessages[clientMessageKey{msg.Username, msg.ClientMsgID}] = msg.ID
+			}
+		}
+	}
+	return nil
+}
+
+// orEmpty returns a snapshot's map, or empty if the snapshot had none.
+func orEmpty[K comparable, V any](snapshot, empty map[K]V) map[K]V {
+	if snapshot == nil {
+		return empty
+	}
+	return snapshot
+}
+
+func (s *fileStore) CreateChannel(name string, channelType ChannelType) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, exists := s.channels[name]; exists {
+		return nil
+	}
+	entry := journalEntry{Op: journalCreateChannel, Channel: &ChannelInfo{Name: name, Type: channelType}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+// CreateOwnedChannel journals the channel, its owner and privacy as one
+// entry, so a replay never restores the channel without them.
+func (s *fileStore) CreateOwnedChannel(name string, channelType ChannelType, owner string, private bool) (bool, error) {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, exists := s.channels[name]; exists {
+		return false, nil
+	}
+	entry := journalEntry{Op: journalCreateChannel, Channel: &ChannelInfo{Name: name, Type: channelType, Owner: owner, Private: private}}
+	if err := s.append(entry); err != nil {
+		return false, err
+	}
+	return true, s.apply(entry)
+}
+
+func (s *fileStore) SetChannelTopic(name, topic string) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, ok := s.channels[name]; !ok {
+		return errChannelNotFound
+	}
+	entry := journalEntry{Op: journalSetTopic, Channel: &ChannelInfo{Name: name, Topic: topic}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) SetChannelPrivate(name string, private bool) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, ok := s.channels[name]; !ok {
+		return errChannelNotFound
+	}
+	entry := journalEntry{Op: journalSetPrivate, Channel: &ChannelInfo{Name: name, Private: private}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) SetChannelSlowMode(name string, seconds int) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, ok := s.channels[name]; !ok {
+		return errChannelNotFound
+	}
+	entry := journalEntry{Op: journalSetSlowMode, Channel: &ChannelInfo{Name: name, SlowMode: seconds}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) SetChannelRole(name, username, role string) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, ok := s.channels[name]; !ok {
+		return errChannelNotFound
+	}
+	entry := journalEntry{Op: journalSetRole, Role: &journalRole{Channel: name, Username: username, Role: role}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) RemoveChannelRole(name, username string) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, ok := s.roles[name][username]; !ok {
+		return nil
+	}
+	entry := journalEntry{Op: journalRemoveRole, Role: &journalRole{Channel: name, Username: username}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) DeleteChannel(name string) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, exists := s.channels[name]; !exists {
+		return errChannelNotFound
+	}
+	entry := journalEntry{Op: journalDeleteChannel, Channel: &ChannelInfo{Name: name}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) CreateDirectChannel(name string, members []string) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, exists := s.channels[name]; exists {
+		return nil
+	}
+	entry := journalEntry{Op: journalCreateDirect, Channel: &ChannelInfo{Name: name, Type: Direct, Members: members}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) SaveMessage(msg Message) (int, error) {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, exists := s.channels[msg.Channel]; !exists {
+		return 0, fmt.Errorf("channel '%s': %w", msg.Channel, errChannelNotFound)
+	}
+	if _, exists := s.clientMessages[clientMessageKey{msg.Username, msg.ClientMsgID}]; exists && msg.ClientMsgID != "" {
+		return 0, errDuplicateMessage
+	}
+	msg.ID = s.nextID
+	msg.Type = "message"
+	if err := s.append(journalEntry{Op: journalSaveMessage, Message: &msg}); err != nil {
+		return 0, err
+	}
+	if err := s.insertMessage(&msg); err != nil {
+		return 0, err
+	}
+	return msg.ID, nil
+}
+
+func (s *fileStore) EditMessage(id int, content, editor string, editedAt time.Time) (Message, error) {
+	return s.journalEdit(journalEditMessage, &journalEdit{MessageID: id, Content: content, By: editor, At: editedAt})
+}
+
+func (s *fileStore) DeleteMessage(id int, deleter string, deletedAt time.Time) (Message, error) {
+	return s.journalEdit(journalDeleteMessage, &journalEdit{MessageID: id, By: deleter, At: deletedAt})
+}
+
+func (s *fileStore) journalEdit(op string, edit *journalEdit) (Message, error) {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if msg := s.message(edit.MessageID); msg == nil || msg.DeletedAt != nil {
+		return Message{}, errMessageNotFound
+	}
+	if err := s.append(journalEntry{Op: op, Edit: edit}); err != nil {
+		return Message{}, err
+	}
+	return s.editMessage(edit.MessageID, edit.Content, edit.By, edit.At, op == journalDeleteMessage)
+}
+
+func (s *fileStore) AddReaction(messageID int, username, emoji string) ([]Reaction, error) {
+	return s.journalReaction(journalAddReaction, &journalReaction{MessageID: messageID, Username: username, Emoji: emoji})
+}
+
+func (s *fileStore) RemoveReaction(messageID int, username, emoji string) ([]Reaction, error) {
+	return s.journalReaction(journalRemoveReaction, &journalReaction{MessageID: messageID, Username: username, Emoji: emoji})
+}
+
+// journalReaction records a reaction change, skipping the journal when it
+// would not change anything.
+func (s *fileStore) journalReaction(op string, r *journalReaction) ([]Reaction, error) {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if s.message(r.MessageID) == nil {
+		return nil, errMessageNotFound
+	}
+	if s.hasReaction(r.MessageID, r.Username, r.Emoji) == (op == journalAddReaction) {
+		return s.reactionsFor(r.MessageID), nil
+	}
+	entry := journalEntry{Op: op, Reaction: r}
+	if err := s.append(entry); err != nil {
+		return nil, err
+	}
+	if err := s.apply(entry); err != nil {
+		return nil, err
+	}
+	return s.reactionsFor(r.MessageID), nil
+}
+
+func (s *fileStore) MarkRead(username, channelName string, messageID int) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, exists := s.channels[channelName]; !exists {
+		return fmt.Errorf("channel '%s': %w", channelName, errChannelNotFound)
+	}
+	if messageID <= s.lastRead[username][channelName] {
+		return nil
+	}
+	entry := journalEntry{Op: journalMarkRead, Read: &journalRead{Username: username, Channel: channelName, MessageID: messageID}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) CreateUser(user User) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, exists := s.users[user.Username]; exists {
+		return errUserExists
+	}
+	entry := journalEntry{Op: journalCreateUser, User: &user}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) CreateIncomingWebhook(hook IncomingWebhook) (int, error) {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	entry := journalEntry{Op: journalCreateWebhook, Webhook: &journalWebhook{
+		ID:        s.nextWebhookID,
+		Channel:   hook.Channel,
+		Name:      hook.Name,
+		CreatedBy: hook.CreatedBy,
+		CreatedAt: hook.CreatedAt,
+		TokenHash: hook.TokenHash,
+	}}
+	if err := s.append(entry); err != nil {
+		return 0, err
+	}
+	if err := s.apply(entry); err != nil {
+		return 0, err
+	}
+	return entry.Webhook.ID, nil
+}
+
+func (s *fileStore) DeleteIncomingWebhook(id int) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, ok := s.webhooks[id]; !ok {
+		return errWebhookNotFound
+	}
+	entry := journalEntry{Op: journalDeleteWebhook, Webhook: &journalWebhook{ID: id}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) CreateChannelInvite(invite ChannelInvite) (int, error) {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, ok := s.channels[invite.Channel]; !ok {
+		return 0, errChannelNotFound
+	}
+	entry := journalEntry{Op: journalCreateInvite, Invite: &journalInvite{
+		ID:        s.nextInviteID,
+		Channel:   invite.Channel,
+		CreatedBy: invite.CreatedBy,
+		CreatedAt: invite.CreatedAt,
+		ExpiresAt: invite.ExpiresAt,
+		MaxUses:   invite.MaxUses,
+		CodeHash:  invite.CodeHash,
+	}}
+	if err := s.append(entry); err != nil {
+		return 0, err
+	}
+	if err := s.apply(entry); err != nil {
+		return 0, err
+	}
+	return entry.Invite.ID, nil
+}
+
+func (s *fileStore) UseChannelInvite(codeHash, username string, now time.Time) (ChannelInvite, error) {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	invite, err := s.findChannelInvite(codeHash, now)
+	if err != nil {
+		return ChannelInvite{}, err
+	}
+	if _, ok := s.roles[invite.Channel][username]; ok {
+		return ChannelInvite{}, errAlreadyMember
+	}
+	// One entry, so a replay never counts the use without the membership
+	entry := journalEntry{Op: journalUseInvite, Invite: &journalInvite{ID: invite.ID, Username: username}}
+	if err := s.append(entry); err != nil {
+		return ChannelInvite{}, err
+	}
+	if err := s.apply(entry); err != nil {
+		return ChannelInvite{}, err
+	}
+	return s.invites[invite.ID], nil
+}
+
+func (s *fileStore) SetSanction(sanction Sanction) (int, error) {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	sanction.ID = s.nextSanctionID
+	entry := journalEntry{Op: journalSetSanction, Sanction: &sanction}
+	if err := s.append(entry); err != nil {
+		return 0, err
+	}
+	if err := s.apply(entry); err != nil {
+		return 0, err
+	}
+	return sanction.ID, nil
+}
+
+func (s *fileStore) RemoveSanction(kind, channel, username string, now time.Time) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, ok := s.findSanction(kind, channel, username, now); !ok {
+		return errSanctionNotFound
+	}
+	entry := journalEntry{Op: journalRemoveSanction, Sanction: &Sanction{Kind: kind, Channel: channel, Username: username}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) AddAuditEntry(entry AuditEntry) (int, error) {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	entry.ID = s.nextAuditID
+	journal := journalEntry{Op: journalAddAuditEntry, Audit: &entry}
+	if err := s.append(journal); err != nil {
+		return 0, err
+	}
+	if err := s.apply(journal); err != nil {
+		return 0, err
+	}
+	return entry.ID, nil
+}
+
+func (s *fileStore) CreateOutgoingWebhook(hook OutgoingWebhook) (int, error) {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	hook.ID = s.nextOutgoingID
+	entry := journalEntry{Op: journalCreateOutgoingWebhook, OutgoingWebhook: &hook}
+	if err := s.append(entry); err != nil {
+		return 0, err
+	}
+	if err := s.apply(entry); err != nil {
+		return 0, err
+	}
+	return hook.ID, nil
+}
+
+func (s *fileStore) DeleteOutgoingWebhook(id int) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, ok := s.outgoingWebhooks[id]; !ok {
+		return errWebhookNotFound
+	}
+	entry := journalEntry{Op: journalDeleteOutgoingWebhook, OutgoingWebhook: &OutgoingWebhook{ID: id}}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) EnqueueWebhookDelivery(delivery WebhookDelivery) (int, error) {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, ok := s.outgoingWebhooks[delivery.WebhookID]; !ok {
+		return 0, errWebhookNotFound
+	}
+	delivery.ID = s.nextDeliveryID
+	entry := journalEntry{Op: journalEnqueueDelivery, Delivery: &delivery}
+	if err := s.append(entry); err != nil {
+		return 0, err
+	}
+	if err := s.apply(entry); err != nil {
+		return 0, err
+	}
+	return delivery.ID, nil
+}
+
+func (s *fileStore) UpdateWebhookDelivery(delivery WebhookDelivery) error {
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if _, ok := s.deliveries[delivery.ID]; !ok {
+		return errWebhookNotFound
+	}
+	// The payload is already in the journal
+	delivery.Payload = nil
+	entry := journalEntry{Op: journalUpdateDelivery, Delivery: &delivery}
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+}
+
+func (s *fileStore) Close() error {
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+	return s.file.Close()
+}
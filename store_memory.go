@@ -0,0 +1,1196 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps channels and messages in process memory. It is used for
+// development, tests and as the state behind fileStore.
+type memoryStore struct {
+	mu       sync.RWMutex
+	channels map[string]ChannelType
+	messages map[string][]Message
+	members  map[string][]string
+	users    map[string]User
+	topics   map[string]string
+	nextID   int
+
+	roles     map[string]map[string]string // channel to username to role
+	owners    map[string]string
+	private   map[string]bool
+	slowModes map[string]int
+
+	// messageChannel maps message IDs to their channel; each channel's
+	// messages are kept in ID order.
+	messageChannel map[int]string
+	edits          map[int][]MessageEdit
+	reactions      map[int][]reactionEntry   // in the order they were added
+	lastRead       map[string]map[string]int // username to channel to message ID
+	clientMessages map[clientMessageKey]int  // message IDs by author and client_msg_id
+	webhooks       map[int]IncomingWebhook
+	nextWebhookID  int
+	invites        map[int]ChannelInvite
+	nextInviteID   int
+	sanctions      map[int]Sanction
+	nextSanctionID int
+	auditLog       []AuditEntry // in ID order
+	nextAuditID    int
+
+	outgoingWebhooks map[int]OutgoingWebhook
+	nextOutgoingID   int
+	deliveries       map[int]WebhookDelivery
+	nextDeliveryID   int
+}
+
+// clientMessageKey identifies a message by its author's client_msg_id.
+type clientMessageKey struct {
+	Username    string
+	ClientMsgID string
+}
+
+// reactionEntry is one user's reaction to a message.
+type reactionEntry struct {
+	Username string
+	Emoji    string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		channels: make(map[string]ChannelType),
+		messages: make(map[string][]Message),
+		members:  make(map[string][]string),
+		users:    make(map[string]User),
+		topics:   make(map[string]string),
+		nextID:   1,
+
+		roles:     make(map[string]map[string]string),
+		owners:    make(map[string]string),
+		private:   make(map[string]bool),
+		slowModes: make(map[string]int),
+
+		messageChannel: make(map[int]string),
+		edits:          make(map[int][]MessageEdit),
+		reactions:      make(map[int][]reactionEntry),
+		lastRead:       make(map[string]map[string]int),
+		clientMessages: make(map[clientMessageKey]int),
+		webhooks:       make(map[int]IncomingWebhook),
+		nextWebhookID:  1,
+		invites:        make(map[int]ChannelInvite),
+		nextInviteID:   1,
+		sanctions:      make(map[int]Sanction),
+		nextSanctionID: 1,
+		nextAuditID:    1,
+
+		outgoingWebhooks: make(map[int]OutgoingWebhook),
+		nextOutgoingID:   1,
+		deliveries:       make(map[int]WebhookDelivery),
+		nextDeliveryID:   1,
+	}
+}
+
+func (s *memoryStore) CreateChannel(name string, channelType ChannelType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.createChannel(name, channelType)
+	return nil
+}
+
+func (s *memoryStore) createChannel(name string, channelType ChannelType) {
+	if _, exists := s.channels[name]; !exists {
+		s.channels[name] = channelType
+	}
+}
+
+func (s *memoryStore) CreateOwnedChannel(name string, channelType ChannelType, owner string, private bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.channels[name]; exists {
+		return false, nil
+	}
+	return true, s.createOwnedChannel(ChannelInfo{Name: name, Type: channelType, Owner: owner, Private: private})
+}
+
+// createOwnedChannel records a new channel with its owner and privacy.
+func (s *memoryStore) createOwnedChannel(info ChannelInfo) error {
+	s.createChannel(info.Name, info.Type)
+	if info.Private {
+		if err := s.setChannelPrivate(info.Name, true); err != nil {
+			return err
+		}
+	}
+	if info.Owner != "" {
+		return s.setChannelRole(info.Name, info.Owner, roleOwner)
+	}
+	return nil
+}
+
+func (s *memoryStore) GetChannelType(name string) (ChannelType, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	channelType, ok := s.channels[name]
+	if !ok {
+		return Ephemeral, errChannelNotFound
+	}
+	return channelType, nil
+}
+
+func (s *memoryStore) ListChannels() ([]ChannelInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	channels := make([]ChannelInfo, 0, len(s.channels))
+	for name, channelType := range s.channels {
+		if channelType == Direct {
+			continue
+		}
+		channels = append(channels, ChannelInfo{Name: name, Type: channelType, Topic: s.topics[name], Owner: s.owners[name], Private: s.private[name], SlowMode: s.slowModes[name]})
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	return channels, nil
+}
+
+func (s *memoryStore) SetChannelPrivate(name string, private bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setChannelPrivate(name, private)
+}
+
+func (s *memoryStore) setChannelPrivate(name string, private bool) error {
+	if _, ok := s.channels[name]; !ok {
+		return errChannelNotFound
+	}
+	if private {
+		s.private[name] = true
+	} else {
+		delete(s.private, name)
+	}
+	return nil
+}
+
+func (s *memoryStore) IsChannelPrivate(name string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.channels[name]; !ok {
+		return false, errChannelNotFound
+	}
+	return s.private[name], nil
+}
+
+func (s *memoryStore) GetChannelTopic(name string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.channels[name]; !ok {
+		return "", errChannelNotFound
+	}
+	return s.topics[name], nil
+}
+
+func (s *memoryStore) SetChannelTopic(name, topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setChannelTopic(name, topic)
+}
+
+func (s *memoryStore) setChannelTopic(name, topic string) error {
+	if _, ok := s.channels[name]; !ok {
+		return errChannelNotFound
+	}
+	if topic == "" {
+		delete(s.topics, name)
+	} else {
+		s.topics[name] = topic
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteChannel(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleteChannel(name)
+}
+
+func (s *memoryStore) deleteChannel(name string) error {
+	if _, ok := s.channels[name]; !ok {
+		return errChannelNotFound
+	}
+	for _, msg := range s.messages[name] {
+		delete(s.messageChannel, msg.ID)
+		delete(s.edits, msg.ID)
+		delete(s.reactions, msg.ID)
+		if msg.ClientMsgID != "" {
+			delete(s.clientMessages, clientMessageKey{msg.Username, msg.ClientMsgID})
+		}
+	}
+	for _, channels := range s.lastRead {
+		delete(channels, name)
+	}
+	for id, hook := range s.webhooks {
+		if hook.Channel == name {
+			delete(s.webhooks, id)
+		}
+	}
+	for id, invite := range s.invites {
+		if invite.Channel == name {
+			delete(s.invites, id)
+		}
+	}
+	for id, sanction := range s.sanctions {
+		if sanction.Channel == name {
+			delete(s.sanctions, id)
+		}
+	}
+	delete(s.messages, name)
+	delete(s.members, name)
+	delete(s.topics, name)
+	delete(s.roles, name)
+	delete(s.owners, name)
+	delete(s.private, name)
+	delete(s.slowModes, name)
+	delete(s.channels, name)
+	return nil
+}
+
+func (s *memoryStore) CreateDirectChannel(name string, members []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.createDirectChannel(name, members)
+	return nil
+}
+
+func (s *memoryStore) createDirectChannel(name string, members []string) {
+	if _, exists := s.channels[name]; exists {
+		return
+	}
+	sorted := append([]string(nil), members...)
+	sort.Strings(sorted)
+	s.channels[name] = Direct
+	s.members[name] = sorted
+}
+
+func (s *memoryStore) GetChannelMembers(name string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	channelType, ok := s.channels[name]
+	if !ok {
+		return nil, errChannelNotFound
+	}
+	if channelType == Direct {
+		return append([]string{}, s.members[name]...), nil
+	}
+	members := []string{}
+	for username := range s.roles[name] {
+		members = append(members, username)
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+func (s *memoryStore) SetChannelRole(name, username, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setChannelRole(name, username, role)
+}
+
+func (s *memoryStore) setChannelRole(name, username, role string) error {
+	if _, ok := s.channels[name]; !ok {
+		return errChannelNotFound
+	}
+	if s.roles[name] == nil {
+		s.roles[name] = make(map[string]string)
+	}
+	s.roles[name][username] = role
+	if role == roleOwner {
+		s.owners[name] = username
+	} else if s.owners[name] == username {
+		delete(s.owners, name)
+	}
+	return nil
+}
+
+func (s *memoryStore) RemoveChannelRole(name, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeChannelRole(name, username)
+	return nil
+}
+
+func (s *memoryStore) removeChannelRole(name, username string) {
+	delete(s.roles[name], username)
+	if s.owners[name] == username {
+		delete(s.owners, name)
+	}
+}
+
+func (s *memoryStore) GetChannelRole(name, username string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.channels[name]; !ok {
+		return "", errChannelNotFound
+	}
+	return s.roles[name][username], nil
+}
+
+func (s *memoryStore) ListChannelRoles(name string) ([]ChannelRole, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.channels[name]; !ok {
+		return nil, errChannelNotFound
+	}
+	roles := []ChannelRole{}
+	for username, role := range s.roles[name] {
+		roles = append(roles, ChannelRole{Username: username, Role: role})
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Username < roles[j].Username })
+	return roles, nil
+}
+
+func (s *memoryStore) CreateChannelInvite(invite ChannelInvite) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.channels[invite.Channel]; !ok {
+		return 0, errChannelNotFound
+	}
+	invite.ID = s.nextInviteID
+	s.createChannelInvite(invite)
+	return invite.ID, nil
+}
+
+func (s *memoryStore) createChannelInvite(invite ChannelInvite) {
+	invite.Code = ""
+	s.invites[invite.ID] = invite
+	if invite.ID >= s.nextInviteID {
+		s.nextInviteID = invite.ID + 1
+	}
+}
+
+func (s *memoryStore) GetChannelInvite(codeHash string, now time.Time) (ChannelInvite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.findChannelInvite(codeHash, now)
+}
+
+func (s *memoryStore) UseChannelInvite(codeHash, username string, now time.Time) (ChannelInvite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, err := s.findChannelInvite(codeHash, now)
+	if err != nil {
+		return ChannelInvite{}, err
+	}
+	if _, ok := s.roles[invite.Channel][username]; ok {
+		return ChannelInvite{}, errAlreadyMember
+	}
+	return s.joinWithInvite(invite.ID, username)
+}
+
+// findChannelInvite returns the invite whose code has codeHash if it can
+// still be used at now.
+func (s *memoryStore) findChannelInvite(codeHash string, now time.Time) (ChannelInvite, error) {
+	for _, invite := range s.invites {
+		if invite.CodeHash != codeHash {
+			continue
+		}
+		if !now.Before(invite.ExpiresAt) || (invite.MaxUses > 0 && invite.Uses >= invite.MaxUses) {
+			break
+		}
+		return invite, nil
+	}
+	return ChannelInvite{}, errInviteNotFound
+}
+
+// joinWithInvite counts a use of an invite and makes username a member of
+// its channel. An empty username only counts the use.
+func (s *memoryStore) joinWithInvite(id int, username string) (ChannelInvite, error) {
+	invite, ok := s.invites[id]
+	if !ok {
+		return ChannelInvite{}, errInviteNotFound
+	}
+	if username != "" {
+		if err := s.setChannelRole(invite.Channel, username, roleMember); err != nil {
+			return ChannelInvite{}, err
+		}
+	}
+	invite.Uses++
+	s.invites[id] = invite
+	return invite, nil
+}
+
+func (s *memoryStore) SetChannelSlowMode(name string, seconds int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setChannelSlowMode(name, seconds)
+}
+
+func (s *memoryStore) setChannelSlowMode(name string, seconds int) error {
+	if _, ok := s.channels[name]; !ok {
+		return errChannelNotFound
+	}
+	if seconds == 0 {
+		delete(s.slowModes, name)
+	} else {
+		s.slowModes[name] = seconds
+	}
+	return nil
+}
+
+func (s *memoryStore) GetChannelSlowMode(name string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.channels[name]; !ok {
+		return 0, errChannelNotFound
+	}
+	return s.slowModes[name], nil
+}
+
+func (s *memoryStore) SetSanction(sanction Sanction) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sanction.ID = s.nextSanctionID
+	s.setSanction(sanction)
+	return sanction.ID, nil
+}
+
+func (s *memoryStore) setSanction(sanction Sanction) {
+	s.removeSanction(sanction.Kind, sanction.Channel, sanction.Username)
+	s.sanctions[sanction.ID] = sanction
+	if sanction.ID >= s.nextSanctionID {
+		s.nextSanctionID = sanction.ID + 1
+	}
+}
+
+func (s *memoryStore) RemoveSanction(kind, channel, username string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.findSanction(kind, channel, username, now); !ok {
+		return errSanctionNotFound
+	}
+	s.removeSanction(kind, channel, username)
+	return nil
+}
+
+// findSanction returns a user's sanction of a kind in a channel if it is in
+// force at now.
+func (s *memoryStore) findSanction(kind, channel, username string, now time.Time) (Sanction, bool) {
+	for _, sanction := range s.sanctions {
+		if sanction.Kind == kind && sanction.Channel == channel && sanction.Username == username && now.Before(sanction.ExpiresAt) {
+			return sanction, true
+		}
+	}
+	return Sanction{}, false
+}
+
+func (s *memoryStore) removeSanction(kind, channel, username string) {
+	for id, sanction := range s.sanctions {
+		if sanction.Kind == kind && sanction.Channel == channel && sanction.Username == username {
+			delete(s.sanctions, id)
+		}
+	}
+}
+
+func (s *memoryStore) ListSanctions(username string, now time.Time) ([]Sanction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sanctions := []Sanction{}
+	for _, sanction := range s.sanctions {
+		if sanction.Username == username && now.Before(sanction.ExpiresAt) {
+			sanctions = append(sanctions, sanction)
+		}
+	}
+	sort.Slice(sanctions, func(i, j int) bool { return sanctions[i].ID < sanctions[j].ID })
+	return sanctions, nil
+}
+
+func (s *memoryStore) AddAuditEntry(entry AuditEntry) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry.ID = s.nextAuditID
+	s.addAuditEntry(entry)
+	return entry.ID, nil
+}
+
+func (s *memoryStore) addAuditEntry(entry AuditEntry) {
+	s.auditLog = append(s.auditLog, entry)
+	if entry.ID >= s.nextAuditID {
+		s.nextAuditID = entry.ID + 1
+	}
+}
+
+func (s *memoryStore) ListAuditLog(channel string, limit int) ([]AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := []AuditEntry{}
+	for i := len(s.auditLog) - 1; i >= 0 && len(entries) < limit; i-- {
+		if channel == "" || s.auditLog[i].Channel == channel {
+			entries = append(entries, s.auditLog[i])
+		}
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) ListDirectChannels(username string) ([]ChannelInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	channels := []ChannelInfo{}
+	for name, members := range s.members {
+		for _, member := range members {
+			if member == username {
+				channels = append(channels, ChannelInfo{Name: name, Type: Direct, Members: append([]string(nil), members...)})
+				break
+			}
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	return channels, nil
+}
+
+func (s *memoryStore) SaveMessage(msg Message) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg.ID = 0
+	if err := s.insertMessage(&msg); err != nil {
+		return 0, err
+	}
+	return msg.ID, nil
+}
+
+// insertMessage stores msg, assigning the next ID unless msg.ID is already
+// set (as it is when fileStore replays its journal).
+func (s *memoryStore) insertMessage(msg *Message) error {
+	if _, exists := s.channels[msg.Channel]; !exists {
+		return fmt.Errorf("channel '%s': %w", msg.Channel, errChannelNotFound)
+	}
+	key := clientMessageKey{msg.Username, msg.ClientMsgID}
+	if _, exists := s.clientMessages[key]; exists && msg.ClientMsgID != "" {
+		return errDuplicateMessage
+	}
+	if msg.ID == 0 {
+		msg.ID = s.nextID
+	}
+	if msg.ID >= s.nextID {
+		s.nextID = msg.ID + 1
+	}
+	msg.Type = "message"
+	if msg.ParentID != 0 {
+		msg.Type = "reply"
+	}
+	s.messages[msg.Channel] = append(s.messages[msg.Channel], *msg)
+	s.messageChannel[msg.ID] = msg.Channel
+	if msg.ClientMsgID != "" {
+		s.clientMessages[key] = msg.ID
+	}
+	return nil
+}
+
+// message returns the stored message with the ID, or nil.
+func (s *memoryStore) message(id int) *Message {
+	channelName, ok := s.messageChannel[id]
+	if !ok {
+		return nil
+	}
+	messages := s.messages[channelName]
+	i := sort.Search(len(messages), func(i int) bool { return messages[i].ID >= id })
+	if i == len(messages) || messages[i].ID != id {
+		return nil
+	}
+	return &messages[i]
+}
+
+func (s *memoryStore) GetMessage(id int) (Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msg := s.message(id)
+	if msg == nil {
+		return Message{}, errMessageNotFound
+	}
+	return s.withReactions(s.withThreadSummaries(msg.Channel, []Message{*msg}))[0], nil
+}
+
+func (s *memoryStore) GetMessageByClientID(username, clientMsgID string) (Message, error) {
+	s.mu.RLock()
+	id, ok := s.clientMessages[clientMessageKey{username, clientMsgID}]
+	s.mu.RUnlock()
+	if !ok || clientMsgID == "" {
+		return Message{}, errMessageNotFound
+	}
+	return s.GetMessage(id)
+}
+
+func (s *memoryStore) GetThread(parentID, afterID, limit int) ([]Message, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	parent := s.message(parentID)
+	if parent == nil {
+		return nil, false, errMessageNotFound
+	}
+
+	replies := []Message{}
+	for _, msg := range s.messages[parent.Channel] {
+		if msg.ParentID == parentID && msg.ID > afterID {
+			replies = append(replies, msg)
+		}
+	}
+	hasMore := len(replies) > limit
+	if hasMore {
+		replies = replies[:limit]
+	}
+	return s.withReactions(replies), hasMore, nil
+}
+
+// withThreadSummaries fills in reply counts and last reply times for the
+// given messages of a channel. Deleted replies are not counted.
+func (s *memoryStore) withThreadSummaries(channelName string, messages []Message) []Message {
+	counts := make(map[int]int)
+	last := make(map[int]time.Time)
+	for _, msg := range s.messages[channelName] {
+		if msg.ParentID == 0 || msg.DeletedAt != nil {
+			continue
+		}
+		counts[msg.ParentID]++
+		if msg.Timestamp.After(last[msg.ParentID]) {
+			last[msg.ParentID] = msg.Timestamp
+		}
+	}
+	for i := range messages {
+		if count := counts[messages[i].ID]; count > 0 {
+			lastReplyAt := last[messages[i].ID]
+			messages[i].ReplyCount = count
+			messages[i].LastReplyAt = &lastReplyAt
+		}
+	}
+	return messages
+}
+
+func (s *memoryStore) EditMessage(id int, content, editor string, editedAt time.Time) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.editMessage(id, content, editor, editedAt, false)
+}
+
+func (s *memoryStore) DeleteMessage(id int, deleter string, deletedAt time.Time) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.editMessage(id, "", deleter, deletedAt, true)
+}
+
+// editMessage replaces a message's content, or deletes it, recording the
+// previous content.
+func (s *memoryStore) editMessage(id int, content, editor string, at time.Time, deleted bool) (Message, error) {
+	msg := s.message(id)
+	if msg == nil || msg.DeletedAt != nil {
+		return Message{}, errMessageNotFound
+	}
+	s.edits[id] = append(s.edits[id], MessageEdit{
+		MessageID:       id,
+		PreviousContent: msg.Content,
+		EditedBy:        editor,
+		EditedAt:        at,
+	})
+	msg.Content = content
+	if deleted {
+		msg.DeletedAt = &at
+	} else {
+		msg.EditedAt = &at
+	}
+	return *msg, nil
+}
+
+func (s *memoryStore) GetMessageEdits(id int) ([]MessageEdit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.message(id) == nil {
+		return nil, errMessageNotFound
+	}
+	return append([]MessageEdit{}, s.edits[id]...), nil
+}
+
+func (s *memoryStore) GetChannelHistory(channelName string, limit int) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var messages []Message
+	for _, msg := range s.messages[channelName] {
+		if msg.ParentID == 0 {
+			messages = append(messages, msg)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	})
+	if limit >= 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return s.withReactions(s.withThreadSummaries(channelName, messages)), nil
+}
+
+func (s *memoryStore) GetHistoryPage(channelName string, beforeID, afterID, limit int) ([]Message, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var messages []Message
+	for _, msg := range s.messages[channelName] {
+		if msg.ParentID == 0 && (beforeID == 0 || msg.ID < beforeID) && (afterID == 0 || msg.ID > afterID) {
+			messages = append(messages, msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		// Paging forwards keeps the oldest matches, otherwise the newest
+		if afterID != 0 && beforeID == 0 {
+			messages = messages[:limit]
+		} else {
+			messages = messages[len(messages)-limit:]
+		}
+	}
+	return s.withReactions(s.withThreadSummaries(channelName, messages)), hasMore, nil
+}
+
+func (s *memoryStore) GetMessagesSince(channelName string, afterID, limit int) ([]Message, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var messages []Message
+	for _, msg := range s.messages[channelName] {
+		if msg.ID > afterID {
+			messages = append(messages, msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	return s.withReactions(s.withThreadSummaries(channelName, messages)), hasMore, nil
+}
+
+func (s *memoryStore) AddReaction(messageID int, username, emoji string) ([]Reaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addReaction(messageID, username, emoji)
+}
+
+func (s *memoryStore) addReaction(messageID int, username, emoji string) ([]Reaction, error) {
+	if s.message(messageID) == nil {
+		return nil, errMessageNotFound
+	}
+	if !s.hasReaction(messageID, username, emoji) {
+		s.reactions[messageID] = append(s.reactions[messageID], reactionEntry{Username: username, Emoji: emoji})
+	}
+	return s.reactionsFor(messageID), nil
+}
+
+func (s *memoryStore) RemoveReaction(messageID int, username, emoji string) ([]Reaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.removeReaction(messageID, username, emoji)
+}
+
+func (s *memoryStore) removeReaction(messageID int, username, emoji string) ([]Reaction, error) {
+	if s.message(messageID) == nil {
+		return nil, errMessageNotFound
+	}
+	entries := s.reactions[messageID]
+	for i, entry := range entries {
+		if entry.Username == username && entry.Emoji == emoji {
+			s.reactions[messageID] = append(entries[:i:i], entries[i+1:]...)
+			break
+		}
+	}
+	return s.reactionsFor(messageID), nil
+}
+
+func (s *memoryStore) hasReaction(messageID int, username, emoji string) bool {
+	for _, entry := range s.reactions[messageID] {
+		if entry.Username == username && entry.Emoji == emoji {
+			return true
+		}
+	}
+	return false
+}
+
+// reactionsFor aggregates a message's reactions by emoji, in the order each
+// emoji was first used.
+func (s *memoryStore) reactionsFor(messageID int) []Reaction {
+	reactions := []Reaction{}
+	index := make(map[string]int)
+	for _, entry := range s.reactions[messageID] {
+		i, ok := index[entry.Emoji]
+		if !ok {
+			i = len(reactions)
+			index[entry.Emoji] = i
+			reactions = append(reactions, Reaction{Emoji: entry.Emoji})
+		}
+		reactions[i].Count++
+		reactions[i].Users = append(reactions[i].Users, entry.Username)
+	}
+	return reactions
+}
+
+// withReactions fills in the reactions of the given messages.
+func (s *memoryStore) withReactions(messages []Message) []Message {
+	for i := range messages {
+		if reactions := s.reactionsFor(messages[i].ID); len(reactions) > 0 {
+			messages[i].Reactions = reactions
+		}
+	}
+	return messages
+}
+
+func (s *memoryStore) MarkRead(username, channelName string, messageID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.markRead(username, channelName, messageID)
+}
+
+func (s *memoryStore) markRead(username, channelName string, messageID int) error {
+	if _, ok := s.channels[channelName]; !ok {
+		return fmt.Errorf("channel '%s': %w", channelName, errChannelNotFound)
+	}
+	reads, ok := s.lastRead[username]
+	if !ok {
+		reads = make(map[string]int)
+		s.lastRead[username] = reads
+	}
+	if messageID > reads[channelName] {
+		reads[channelName] = messageID
+	}
+	return nil
+}
+
+func (s *memoryStore) GetReadState(username, channelName string) (ReadState, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.channels[channelName]; !ok {
+		return ReadState{}, errChannelNotFound
+	}
+	return s.readState(username, channelName), nil
+}
+
+func (s *memoryStore) GetReadStates(username string) (map[string]ReadState, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	states := make(map[string]ReadState)
+	for name, channelType := range s.channels {
+		switch channelType {
+		case Persistent:
+		case Direct:
+			if !slices.Contains(s.members[name], username) {
+				continue
+			}
+		default:
+			continue
+		}
+
+		states[name] = s.readState(username, name)
+	}
+	return states, nil
+}
+
+// readState counts the messages in a channel that username has not read.
+func (s *memoryStore) readState(username, channelName string) ReadState {
+	state := ReadState{LastReadID: s.lastRead[username][channelName]}
+	for _, msg := range s.messages[channelName] {
+		if msg.ID > state.LastReadID && msg.ParentID == 0 && msg.DeletedAt == nil && msg.Username != username {
+			state.Unread++
+		}
+	}
+	return state
+}
+
+// SearchMessages matches messages containing every query term,
+// case-insensitively, ranked by how often the terms occur. It is a simple
+// stand-in for PostgreSQL full-text search: there is no stemming.
+func (s *memoryStore) SearchMessages(query SearchQuery) ([]SearchResult, error) {
+	terms := strings.Fields(strings.ToLower(query.Query))
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	highlight := regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []SearchResult{}
+	for channelName, messages := range s.messages {
+		// Direct conversations are never searchable
+		if s.channels[channelName] != Persistent {
+			continue
+		}
+		if query.Member != "" && s.private[channelName] && s.roles[channelName][query.Member] == "" {
+			continue
+		}
+		if query.Channel != "" && channelName != query.Channel {
+			continue
+		}
+		for _, msg := range messages {
+			if msg.DeletedAt != nil {
+				continue
+			}
+			if query.Username != "" && msg.Username != query.Username {
+				continue
+			}
+			if !query.From.IsZero() && msg.Timestamp.Before(query.From) {
+				continue
+			}
+			if !query.To.IsZero() && msg.Timestamp.After(query.To) {
+				continue
+			}
+
+			content := strings.ToLower(msg.Content)
+			hits := 0
+			for _, term := range terms {
+				n := strings.Count(content, term)
+				if n == 0 {
+					hits = 0
+					break
+				}
+				hits += n
+			}
+			if hits == 0 {
+				continue
+			}
+
+			results = append(results, SearchResult{
+				ID:        msg.ID,
+				Channel:   msg.Channel,
+				Username:  msg.Username,
+				Content:   msg.Content,
+				Timestamp: msg.Timestamp,
+				Snippet:   highlight.ReplaceAllString(msg.Content, "<mark>$0</mark>"),
+				Rank:      float64(hits),
+			})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].ID > results[j].ID
+	})
+	if query.Limit >= 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+	return results, nil
+}
+
+func (s *memoryStore) CreateIncomingWebhook(hook IncomingWebhook) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hook.ID = s.nextWebhookID
+	s.createIncomingWebhook(hook)
+	return hook.ID, nil
+}
+
+func (s *memoryStore) createIncomingWebhook(hook IncomingWebhook) {
+	hook.Token = ""
+	s.webhooks[hook.ID] = hook
+	if hook.ID >= s.nextWebhookID {
+		s.nextWebhookID = hook.ID + 1
+	}
+}
+
+func (s *memoryStore) GetIncomingWebhook(tokenHash string) (IncomingWebhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, hook := range s.webhooks {
+		if hook.TokenHash == tokenHash {
+			return hook, nil
+		}
+	}
+	return IncomingWebhook{}, errWebhookNotFound
+}
+
+func (s *memoryStore) ListIncomingWebhooks(channelName string) ([]IncomingWebhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hooks := []IncomingWebhook{}
+	for _, hook := range s.webhooks {
+		if hook.Channel == channelName {
+			hooks = append(hooks, hook)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks, nil
+}
+
+func (s *memoryStore) DeleteIncomingWebhook(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleteIncomingWebhook(id)
+}
+
+func (s *memoryStore) deleteIncomingWebhook(id int) error {
+	if _, ok := s.webhooks[id]; !ok {
+		return errWebhookNotFound
+	}
+	delete(s.webhooks, id)
+	return nil
+}
+
+func (s *memoryStore) CreateOutgoingWebhook(hook OutgoingWebhook) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hook.ID = s.nextOutgoingID
+	s.createOutgoingWebhook(hook)
+	return hook.ID, nil
+}
+
+func (s *memoryStore) createOutgoingWebhook(hook OutgoingWebhook) {
+	s.outgoingWebhooks[hook.ID] = hook
+	if hook.ID >= s.nextOutgoingID {
+		s.nextOutgoingID = hook.ID + 1
+	}
+}
+
+func (s *memoryStore) ListOutgoingWebhooks() ([]OutgoingWebhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hooks := []OutgoingWebhook{}
+	for _, hook := range s.outgoingWebhooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks, nil
+}
+
+func (s *memoryStore) DeleteOutgoingWebhook(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleteOutgoingWebhook(id)
+}
+
+func (s *memoryStore) deleteOutgoingWebhook(id int) error {
+	if _, ok := s.outgoingWebhooks[id]; !ok {
+		return errWebhookNotFound
+	}
+	for deliveryID, delivery := range s.deliveries {
+		if delivery.WebhookID == id {
+			delete(s.deliveries, deliveryID)
+		}
+	}
+	delete(s.outgoingWebhooks, id)
+	return nil
+}
+
+func (s *memoryStore) EnqueueWebhookDelivery(delivery WebhookDelivery) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delivery.ID = s.nextDeliveryID
+	if err := s.enqueueWebhookDelivery(delivery); err != nil {
+		return 0, err
+	}
+	return delivery.ID, nil
+}
+
+func (s *memoryStore) enqueueWebhookDelivery(delivery WebhookDelivery) error {
+	if _, ok := s.outgoingWebhooks[delivery.WebhookID]; !ok {
+		return errWebhookNotFound
+	}
+	s.deliveries[delivery.ID] = delivery
+	if delivery.ID >= s.nextDeliveryID {
+		s.nextDeliveryID = delivery.ID + 1
+	}
+	return nil
+}
+
+func (s *memoryStore) ClaimWebhookDeliveries(now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := []WebhookDelivery{}
+	for _, delivery := range s.deliveries {
+		if delivery.Status == deliveryPending && !delivery.NextAttemptAt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttemptAt.Equal(due[j].NextAttemptAt) {
+			return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for _, delivery := range due {
+		delivery.NextAttemptAt = now.Add(lease)
+		s.deliveries[delivery.ID] = delivery
+	}
+	return due, nil
+}
+
+func (s *memoryStore) UpdateWebhookDelivery(delivery WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateWebhookDelivery(delivery)
+}
+
+func (s *memoryStore) updateWebhookDelivery(delivery WebhookDelivery) error {
+	stored, ok := s.deliveries[delivery.ID]
+	if !ok {
+		return errWebhookNotFound
+	}
+	stored.Status = delivery.Status
+	stored.Attempts = delivery.Attempts
+	stored.NextAttemptAt = delivery.NextAttemptAt
+	stored.ResponseStatus = delivery.ResponseStatus
+	stored.Error = delivery.Error
+	stored.DeliveredAt = delivery.DeliveredAt
+	s.deliveries[delivery.ID] = stored
+	return nil
+}
+
+func (s *memoryStore) ListWebhookDeliveries(webhookID, limit int) ([]WebhookDelivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range s.deliveries {
+		if delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID > deliveries[j].ID })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (s *memoryStore) CreateUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createUser(user)
+}
+
+func (s *memoryStore) createUser(user User) error {
+	if _, exists := s.users[user.Username]; exists {
+		return errUserExists
+	}
+	s.users[user.Username] = user
+	return nil
+}
+
+func (s *memoryStore) GetUser(username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[username]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
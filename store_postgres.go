@@ -0,0 +1,1223 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type postgresStore struct {
+	db *sql.DB
+}
+
+func newPostgresStore(db *sql.DB) *postgresStore {
+	return &postgresStore{db: db}
+}
+
+func (s *postgresStore) CreateChannel(name string, channelType ChannelType) error {
+	_, err := s.db.Exec("INSERT INTO channels (name, type) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING", name, string(channelType))
+	return err
+}
+
+// CreateOwnedChannel inserts the channel and its owner's role in one
+// transaction, so of concurrent creators only the one whose insert wins
+// becomes the owner.
+func (s *postgresStore) CreateOwnedChannel(name string, channelType ChannelType, owner string, private bool) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO channels (name, type, owner, private) VALUES ($1, $2, NULLIF($3, ''), $4)
+		ON CONFLICT (name) DO NOTHING
+	`, name, string(channelType), owner, private)
+	if err != nil {
+		return false, err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return false, err
+	}
+	if owner != "" {
+		if _, err := tx.Exec(`
+			INSERT INTO channel_members (channel_name, username, role) VALUES ($1, $2, $3)
+			ON CONFLICT (channel_name, username) DO UPDATE SET role = EXCLUDED.role
+		`, name, owner, roleOwner); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+func (s *postgresStore) GetChannelType(name string) (ChannelType, error) {
+	var channelType string
+	err := s.db.QueryRow("SELECT type FROM channels WHERE name = $1", name).Scan(&channelType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Ephemeral, errChannelNotFound
+	}
+	if err != nil {
+		return Ephemeral, err
+	}
+	return ChannelType(channelType), nil
+}
+
+func (s *postgresStore) ListChannels() ([]ChannelInfo, error) {
+	rows, err := s.db.Query("SELECT name, type, topic, COALESCE(owner, ''), private, slow_mode FROM channels WHERE type <> 'direct' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []ChannelInfo
+	for rows.Next() {
+		var name, channelType, topic, owner string
+		var private bool
+		var slowMode int
+		if err := rows.Scan(&name, &channelType, &topic, &owner, &private, &slowMode); err != nil {
+			continue
+		}
+		channels = append(channels, ChannelInfo{Name: name, Type: ChannelType(channelType), Topic: topic, Owner: owner, Private: private, SlowMode: slowMode})
+	}
+	return channels, rows.Err()
+}
+
+func (s *postgresStore) SetChannelPrivate(name string, private bool) error {
+	result, err := s.db.Exec("UPDATE channels SET private = $2 WHERE name = $1", name, private)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errChannelNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) IsChannelPrivate(name string) (bool, error) {
+	var private bool
+	err := s.db.QueryRow("SELECT private FROM channels WHERE name = $1", name).Scan(&private)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, errChannelNotFound
+	}
+	return private, err
+}
+
+func (s *postgresStore) GetChannelTopic(name string) (string, error) {
+	var topic string
+	err := s.db.QueryRow("SELECT topic FROM channels WHERE name = $1", name).Scan(&topic)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errChannelNotFound
+	}
+	return topic, err
+}
+
+func (s *postgresStore) SetChannelTopic(name, topic string) error {
+	result, err := s.db.Exec("UPDATE channels SET topic = $2 WHERE name = $1", name, topic)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errChannelNotFound
+	}
+	return nil
+}
+
+// DeleteChannel deletes the channel's messages and webhooks first, as they
+// do not cascade; the messages' edits, reactions and replies do, as do the
+// channel's members, read positions and invites.
+func (s *postgresStore) DeleteChannel(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM messages WHERE channel_name = $1", name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM incoming_webhooks WHERE channel_name = $1", name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM sanctions WHERE channel_name = $1", name); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM channels WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errChannelNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) CreateDirectChannel(name string, members []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO channels (name, type) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING", name, string(Direct))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return nil // already exists
+	}
+	for _, member := range members {
+		if _, err := tx.Exec("INSERT INTO channel_members (channel_name, username) VALUES ($1, $2)", name, member); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) GetChannelMembers(name string) ([]string, error) {
+	if _, err := s.GetChannelType(name); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query("SELECT username FROM channel_members WHERE channel_name = $1 ORDER BY username", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		members = append(members, username)
+	}
+	return members, rows.Err()
+}
+
+// SetChannelRole keeps channels.owner in step with the owner role.
+func (s *postgresStore) SetChannelRole(name, username, role string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE channels
+		SET owner = CASE WHEN $3 = 'owner' THEN $2 WHEN owner = $2 THEN NULL ELSE owner END
+		WHERE name = $1
+	`, name, username, role)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errChannelNotFound
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO channel_members (channel_name, username, role) VALUES ($1, $2, $3)
+		ON CONFLICT (channel_name, username) DO UPDATE SET role = EXCLUDED.role
+	`, name, username, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) RemoveChannelRole(name, username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM channel_members WHERE channel_name = $1 AND username = $2", name, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE channels SET owner = NULL WHERE name = $1 AND owner = $2", name, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) GetChannelRole(name, username string) (string, error) {
+	var role sql.NullString
+	err := s.db.QueryRow(`
+		SELECT m.role
+		FROM channels c
+		LEFT JOIN channel_members m ON m.channel_name = c.name AND m.username = $2
+		WHERE c.name = $1
+	`, name, username).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errChannelNotFound
+	}
+	return role.String, err
+}
+
+func (s *postgresStore) ListChannelRoles(name string) ([]ChannelRole, error) {
+	if _, err := s.GetChannelType(name); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query("SELECT username, role FROM channel_members WHERE channel_name = $1 ORDER BY username", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []ChannelRole{}
+	for rows.Next() {
+		var role ChannelRole
+		if err := rows.Scan(&role.Username, &role.Role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (s *postgresStore) CreateChannelInvite(invite ChannelInvite) (int, error) {
+	if _, err := s.GetChannelType(invite.Channel); err != nil {
+		return 0, err
+	}
+	var id int
+	err := s.db.QueryRow(`
+		INSERT INTO channel_invites (code_hash, channel_name, created_by, created_at, expires_at, max_uses)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, invite.CodeHash, invite.Channel, invite.CreatedBy, invite.CreatedAt, invite.ExpiresAt, invite.MaxUses).Scan(&id)
+	return id, err
+}
+
+func (s *postgresStore) GetChannelInvite(codeHash string, now time.Time) (ChannelInvite, error) {
+	var invite ChannelInvite
+	err := s.db.QueryRow(`
+		SELECT id, channel_name, created_by, created_at, expires_at, max_uses, uses, code_hash
+		FROM channel_invites
+		WHERE code_hash = $1 AND expires_at > $2 AND (max_uses = 0 OR uses < max_uses)
+	`, codeHash, now.UTC()).Scan(&invite.ID, &invite.Channel, &invite.CreatedBy, &invite.CreatedAt, &invite.ExpiresAt, &invite.MaxUses, &invite.Uses, &invite.CodeHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ChannelInvite{}, errInviteNotFound
+	}
+	return invite, err
+}
+
+// UseChannelInvite checks and counts the use in one statement, which locks
+// the invite, so an invite cannot be used more than MaxUses times by
+// concurrent joins. The use is rolled back if username is already a member.
+func (s *postgresStore) UseChannelInvite(codeHash, username string, now time.Time) (ChannelInvite, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ChannelInvite{}, err
+	}
+	defer tx.Rollback()
+
+	var invite ChannelInvite
+	err = tx.QueryRow(`
+		UPDATE channel_invites SET uses = uses + 1
+		WHERE code_hash = $1 AND expires_at > $2 AND (max_uses = 0 OR uses < max_uses)
+		RETURNING id, channel_name, created_by, created_at, expires_at, max_uses, uses, code_hash
+	`, codeHash, now.UTC()).Scan(&invite.ID, &invite.Channel, &invite.CreatedBy, &invite.CreatedAt, &invite.ExpiresAt, &invite.MaxUses, &invite.Uses, &invite.CodeHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ChannelInvite{}, errInviteNotFound
+	}
+	if err != nil {
+		return ChannelInvite{}, err
+	}
+	result, err := tx.Exec(`
+		INSERT INTO channel_members (channel_name, username, role) VALUES ($1, $2, $3)
+		ON CONFLICT (channel_name, username) DO NOTHING
+	`, invite.Channel, username, roleMember)
+	if err != nil {
+		return ChannelInvite{}, err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return ChannelInvite{}, errAlreadyMember
+	}
+	return invite, tx.Commit()
+}
+
+func (s *postgresStore) SetChannelSlowMode(name string, seconds int) error {
+	result, err := s.db.Exec("UPDATE channels SET slow_mode = $2 WHERE name = $1", name, seconds)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errChannelNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) GetChannelSlowMode(name string) (int, error) {
+	var seconds int
+	err := s.db.QueryRow("SELECT slow_mode FROM channels WHERE name = $1", name).Scan(&seconds)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errChannelNotFound
+	}
+	return seconds, err
+}
+
+func (s *postgresStore) SetSanction(sanction Sanction) (int, error) {
+	var id int
+	err := s.db.QueryRow(`
+		INSERT INTO sanctions (kind, channel_name, username, reason, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (kind, channel_name, username) DO UPDATE
+		SET reason = EXCLUDED.reason, created_by = EXCLUDED.created_by,
+		    created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+		RETURNING id
+	`, sanction.Kind, sanction.Channel, sanction.Username, sanction.Reason, sanction.CreatedBy, sanction.CreatedAt.UTC(), sanction.ExpiresAt.UTC()).Scan(&id)
+	return id, err
+}
+
+func (s *postgresStore) RemoveSanction(kind, channel, username string, now time.Time) error {
+	result, err := s.db.Exec(`
+		DELETE FROM sanctions
+		WHERE kind = $1 AND channel_name = $2 AND username = $3 AND expires_at > $4
+	`, kind, channel, username, now.UTC())
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errSanctionNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) ListSanctions(username string, now time.Time) ([]Sanction, error) {
+	rows, err := s.db.Query(`
+		SELECT id, kind, channel_name, username, reason, created_by, created_at, expires_at
+		FROM sanctions
+		WHERE username = $1 AND expires_at > $2
+		ORDER BY id
+	`, username, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sanctions := []Sanction{}
+	for rows.Next() {
+		var sanction Sanction
+		if err := rows.Scan(&sanction.ID, &sanction.Kind, &sanction.Channel, &sanction.Username, &sanction.Reason, &sanction.CreatedBy, &sanction.CreatedAt, &sanction.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sanctions = append(sanctions, sanction)
+	}
+	return sanctions, rows.Err()
+}
+
+func (s *postgresStore) AddAuditEntry(entry AuditEntry) (int, error) {
+	var id int
+	err := s.db.QueryRow(`
+		INSERT INTO audit_log (action, channel_name, actor, target, reason, details, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, entry.Action, entry.Channel, entry.Actor, entry.Target, entry.Reason, entry.Details, entry.CreatedAt.UTC()).Scan(&id)
+	return id, err
+}
+
+func (s *postgresStore) ListAuditLog(channel string, limit int) ([]AuditEntry, error) {
+	rows, err := s.db.Query(`
+		SELECT id, action, channel_name, actor, target, reason, details, created_at
+		FROM audit_log
+		WHERE $1 = '' OR channel_name = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, channel, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		if err := rows.Scan(&entry.ID, &entry.Action, &entry.Channel, &entry.Actor, &entry.Target, &entry.Reason, &entry.Details, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *postgresStore) ListDirectChannels(username string) ([]ChannelInfo, error) {
+	rows, err := s.db.Query(`
+		SELECT c.name, m.username
+		FROM channels c
+		JOIN channel_members m ON m.channel_name = c.name
+		WHERE c.type = 'direct'
+		  AND c.name IN (SELECT channel_name FROM channel_members WHERE username = $1)
+		ORDER BY c.name, m.username
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []ChannelInfo{}
+	for rows.Next() {
+		var name, member string
+		if err := rows.Scan(&name, &member); err != nil {
+			return nil, err
+		}
+		if len(channels) == 0 || channels[len(channels)-1].Name != name {
+			channels = append(channels, ChannelInfo{Name: name, Type: Direct})
+		}
+		last := &channels[len(channels)-1]
+		last.Members = append(last.Members, member)
+	}
+	return channels, rows.Err()
+}
+
+// messageColumns are the columns read by scanMessage, in order.
+const messageColumns = "id, channel_name, username, content, timestamp, edited_at, deleted_at, parent_id, client_msg_id, display_name, attachments"
+
+func scanMessage(row interface{ Scan(...interface{}) error }) (Message, error) {
+	var msg Message
+	var editedAt, deletedAt sql.NullTime
+	var parentID sql.NullInt64
+	var clientMsgID, displayName sql.NullString
+	var attachments []byte
+	if err := row.Scan(&msg.ID, &msg.Channel, &msg.Username, &msg.Content, &msg.Timestamp, &editedAt, &deletedAt, &parentID, &clientMsgID, &displayName, &attachments); err != nil {
+		return Message{}, err
+	}
+	msg.ClientMsgID = clientMsgID.String
+	msg.DisplayName = displayName.String
+	if attachments != nil {
+		if err := json.Unmarshal(attachments, &msg.Attachments); err != nil {
+			return Message{}, fmt.Errorf("message %d attachments: %v", msg.ID, err)
+		}
+	}
+	if editedAt.Valid {
+		msg.EditedAt = &editedAt.Time
+	}
+	if deletedAt.Valid {
+		msg.DeletedAt = &deletedAt.Time
+	}
+	msg.Type = "message"
+	if parentID.Valid {
+		msg.ParentID = int(parentID.Int64)
+		msg.Type = "reply"
+	}
+	return msg, nil
+}
+
+// attachThreadSummaries fills in reply counts and last reply times for
+// top-level messages. Deleted replies are not counted.
+func (s *postgresStore) attachThreadSummaries(messages []Message) error {
+	index := make(map[int]int)
+	var ids []int64
+	for i, msg := range messages {
+		if msg.ParentID == 0 {
+			index[msg.ID] = i
+			ids = append(ids, int64(msg.ID))
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := s.db.Query(`
+		SELECT parent_id, COUNT(*), MAX(timestamp)
+		FROM messages
+		WHERE parent_id = ANY($1) AND deleted_at IS NULL
+		GROUP BY parent_id
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var parentID, count int
+		var lastReplyAt time.Time
+		if err := rows.Scan(&parentID, &count, &lastReplyAt); err != nil {
+			return err
+		}
+		msg := &messages[index[parentID]]
+		msg.ReplyCount = count
+		msg.LastReplyAt = &lastReplyAt
+	}
+	return rows.Err()
+}
+
+// attachReactions fills in the aggregated reactions of messages, each emoji
+// in the order it was first used.
+func (s *postgresStore) attachReactions(messages []Message) error {
+	index := make(map[int]int, len(messages))
+	ids := make([]int64, 0, len(messages))
+	for i, msg := range messages {
+		index[msg.ID] = i
+		ids = append(ids, int64(msg.ID))
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := s.db.Query(`
+		SELECT message_id, emoji, COUNT(*), array_agg(username ORDER BY id)
+		FROM message_reactions
+		WHERE message_id = ANY($1)
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(id)
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int
+		var reaction Reaction
+		if err := rows.Scan(&messageID, &reaction.Emoji, &reaction.Count, pq.Array(&reaction.Users)); err != nil {
+			return err
+		}
+		msg := &messages[index[messageID]]
+		msg.Reactions = append(msg.Reactions, reaction)
+	}
+	return rows.Err()
+}
+
+func (s *postgresStore) SaveMessage(msg Message) (int, error) {
+	var attachments []byte
+	if len(msg.Attachments) > 0 {
+		var err error
+		if attachments, err = json.Marshal(msg.Attachments); err != nil {
+			return 0, err
+		}
+	}
+	var id int
+	err := s.db.QueryRow(`
+		INSERT INTO messages (channel_name, username, content, timestamp, parent_id, client_msg_id, display_name, attachments)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), NULLIF($6, ''), NULLIF($7, ''), $8)
+		ON CONFLICT ON CONSTRAINT messages_username_client_msg_id_key DO NOTHING
+		RETURNING id
+	`, msg.Channel, msg.Username, msg.Content, msg.Timestamp, msg.ParentID, msg.ClientMsgID, msg.DisplayName, attachments).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errDuplicateMessage
+	}
+	return id, err
+}
+
+func (s *postgresStore) GetMessageByClientID(username, clientMsgID string) (Message, error) {
+	var id int
+	err := s.db.QueryRow("SELECT id FROM messages WHERE username = $1 AND client_msg_id = $2", username, clientMsgID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, errMessageNotFound
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	return s.GetMessage(id)
+}
+
+func (s *postgresStore) GetChannelHistory(channelName string, limit int) ([]Message, error) {
+	rows, err := s.db.Query(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE channel_name = $1 AND parent_id IS NULL
+		ORDER BY timestamp DESC
+		LIMIT $2
+	`, channelName, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append([]Message{msg}, messages...) // Reverse order
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.attachThreadSummaries(messages); err != nil {
+		return nil, err
+	}
+	return messages, s.attachReactions(messages)
+}
+
+func (s *postgresStore) GetHistoryPage(channelName string, beforeID, afterID, limit int) ([]Message, bool, error) {
+	// Paging forwards walks up from afterID, otherwise down from beforeID
+	// (or the newest message). One extra row tells whether there is more.
+	order := "DESC"
+	if afterID != 0 && beforeID == 0 {
+		order = "ASC"
+	}
+	rows, err := s.db.Query(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE channel_name = $1
+		  AND parent_id IS NULL
+		  AND ($2 = 0 OR id < $2)
+		  AND ($3 = 0 OR id > $3)
+		ORDER BY id `+order+`
+		LIMIT $4
+	`, channelName, beforeID, afterID, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	if order == "DESC" {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	if err := s.attachThreadSummaries(messages); err != nil {
+		return nil, false, err
+	}
+	return messages, hasMore, s.attachReactions(messages)
+}
+
+func (s *postgresStore) GetMessagesSince(channelName string, afterID, limit int) ([]Message, bool, error) {
+	rows, err := s.db.Query(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE channel_name = $1 AND id > $2
+		ORDER BY id ASC
+		LIMIT $3
+	`, channelName, afterID, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	if err := s.attachThreadSummaries(messages); err != nil {
+		return nil, false, err
+	}
+	return messages, hasMore, s.attachReactions(messages)
+}
+
+func (s *postgresStore) GetMessage(id int) (Message, error) {
+	msg, err := scanMessage(s.db.QueryRow("SELECT "+messageColumns+" FROM messages WHERE id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, errMessageNotFound
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	messages := []Message{msg}
+	if err := s.attachThreadSummaries(messages); err != nil {
+		return Message{}, err
+	}
+	if err := s.attachReactions(messages); err != nil {
+		return Message{}, err
+	}
+	return messages[0], nil
+}
+
+// checkMessageExists returns errMessageNotFound if no message has the ID.
+func (s *postgresStore) checkMessageExists(id int) error {
+	var exists bool
+	if err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM messages WHERE id = $1)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errMessageNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) GetThread(parentID, afterID, limit int) ([]Message, bool, error) {
+	if err := s.checkMessageExists(parentID); err != nil {
+		return nil, false, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE parent_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3
+	`, parentID, afterID, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	replies := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		replies = append(replies, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(replies) > limit
+	if hasMore {
+		replies = replies[:limit]
+	}
+	return replies, hasMore, s.attachReactions(replies)
+}
+
+func (s *postgresStore) EditMessage(id int, content, editor string, editedAt time.Time) (Message, error) {
+	return s.editMessage(id, `
+		UPDATE messages SET content = $2, edited_at = $3 WHERE id = $1
+		RETURNING `+messageColumns, content, editor, editedAt)
+}
+
+func (s *postgresStore) DeleteMessage(id int, deleter string, deletedAt time.Time) (Message, error) {
+	return s.editMessage(id, `
+		UPDATE messages SET content = $2, deleted_at = $3 WHERE id = $1
+		RETURNING `+messageColumns, "", deleter, deletedAt)
+}
+
+// editMessage records a message's current content in message_edits and
+// applies update, which takes the ID, new content and timestamp.
+func (s *postgresStore) editMessage(id int, update, content, editor string, at time.Time) (Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.QueryRow("SELECT content FROM messages WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&previous)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, errMessageNotFound
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO message_edits (message_id, previous_content, edited_by, edited_at)
+		VALUES ($1, $2, $3, $4)
+	`, id, previous, editor, at); err != nil {
+		return Message{}, err
+	}
+
+	msg, err := scanMessage(tx.QueryRow(update, id, content, at))
+	if err != nil {
+		return Message{}, err
+	}
+	return msg, tx.Commit()
+}
+
+func (s *postgresStore) GetMessageEdits(id int) ([]MessageEdit, error) {
+	if _, err := s.GetMessage(id); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`
+		SELECT message_id, previous_content, edited_by, edited_at
+		FROM message_edits
+		WHERE message_id = $1
+		ORDER BY id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var edit MessageEdit
+		if err := rows.Scan(&edit.MessageID, &edit.PreviousContent, &edit.EditedBy, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
+}
+
+func (s *postgresStore) AddReaction(messageID int, username, emoji string) ([]Reaction, error) {
+	return s.changeReaction(messageID, `
+		INSERT INTO message_reactions (message_id, username, emoji)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (message_id, username, emoji) DO NOTHING
+	`, username, emoji)
+}
+
+func (s *postgresStore) RemoveReaction(messageID int, username, emoji string) ([]Reaction, error) {
+	return s.changeReaction(messageID, `
+		DELETE FROM message_reactions
+		WHERE message_id = $1 AND username = $2 AND emoji = $3
+	`, username, emoji)
+}
+
+// changeReaction applies change, which takes the message ID, username and
+// emoji, and returns the message's reactions.
+func (s *postgresStore) changeReaction(messageID int, change, username, emoji string) ([]Reaction, error) {
+	if err := s.checkMessageExists(messageID); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.Exec(change, messageID, username, emoji); err != nil {
+		return nil, err
+	}
+	messages := []Message{{ID: messageID}}
+	if err := s.attachReactions(messages); err != nil {
+		return nil, err
+	}
+	if messages[0].Reactions == nil {
+		return []Reaction{}, nil
+	}
+	return messages[0].Reactions, nil
+}
+
+func (s *postgresStore) MarkRead(username, channelName string, messageID int) error {
+	if _, err := s.GetChannelType(channelName); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO channel_reads (username, channel_name, last_read_id, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username, channel_name) DO UPDATE
+		SET last_read_id = GREATEST(channel_reads.last_read_id, EXCLUDED.last_read_id),
+		    updated_at = EXCLUDED.updated_at
+	`, username, channelName, messageID, time.Now().UTC())
+	return err
+}
+
+func (s *postgresStore) GetReadState(username, channelName string) (ReadState, error) {
+	var state ReadState
+	err := s.db.QueryRow(`
+		SELECT COALESCE(r.last_read_id, 0),
+		       (SELECT COUNT(*)
+		        FROM messages m
+		        WHERE m.channel_name = c.name
+		          AND m.id > COALESCE(r.last_read_id, 0)
+		          AND m.parent_id IS NULL
+		          AND m.deleted_at IS NULL
+		          AND m.username <> $1)
+		FROM channels c
+		LEFT JOIN channel_reads r ON r.channel_name = c.name AND r.username = $1
+		WHERE c.name = $2
+	`, username, channelName).Scan(&state.LastReadID, &state.Unread)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReadState{}, errChannelNotFound
+	}
+	return state, err
+}
+
+func (s *postgresStore) GetReadStates(username string) (map[string]ReadState, error) {
+	rows, err := s.db.Query(`
+		SELECT c.name, COALESCE(r.last_read_id, 0),
+		       (SELECT COUNT(*)
+		        FROM messages m
+		        WHERE m.channel_name = c.name
+		          AND m.id > COALESCE(r.last_read_id, 0)
+		          AND m.parent_id IS NULL
+		          AND m.deleted_at IS NULL
+		          AND m.username <> $1)
+		FROM channels c
+		LEFT JOIN channel_reads r ON r.channel_name = c.name AND r.username = $1
+		WHERE c.type = 'persistent'
+		   OR (c.type = 'direct' AND c.name IN (SELECT channel_name FROM channel_members WHERE username = $1))
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]ReadState)
+	for rows.Next() {
+		var name string
+		var state ReadState
+		if err := rows.Scan(&name, &state.LastReadID, &state.Unread); err != nil {
+			return nil, err
+		}
+		states[name] = state
+	}
+	return states, rows.Err()
+}
+
+func (s *postgresStore) SearchMessages(query SearchQuery) ([]SearchResult, error) {
+	var from, to interface{}
+	if !query.From.IsZero() {
+		from = query.From.UTC()
+	}
+	if !query.To.IsZero() {
+		to = query.To.UTC()
+	}
+
+	rows, err := s.db.Query(`
+		SELECT m.id, m.channel_name, m.username, m.content, m.timestamp,
+		       ts_headline('english', m.content, q, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5'),
+		       ts_rank(m.content_tsv, q) AS rank
+		FROM messages m
+		JOIN channels c ON c.name = m.channel_name,
+		     websearch_to_tsquery('english', $1) q
+		WHERE c.type = 'persistent'
+		  AND ($7 = '' OR NOT c.private OR EXISTS (
+		      SELECT 1 FROM channel_members cm WHERE cm.channel_name = c.name AND cm.username = $7))
+		  AND m.deleted_at IS NULL
+		  AND m.content_tsv @@ q
+		  AND ($2 = '' OR m.channel_name = $2)
+		  AND ($3 = '' OR m.username = $3)
+		  AND ($4::timestamp IS NULL OR m.timestamp >= $4::timestamp)
+		  AND ($5::timestamp IS NULL OR m.timestamp <= $5::timestamp)
+		ORDER BY rank DESC, m.id DESC
+		LIMIT $6
+	`, query.Query, query.Channel, query.Username, from, to, query.Limit, query.Member)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(&r.ID, &r.Channel, &r.Username, &r.Content, &r.Timestamp, &r.Snippet, &r.Rank); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+func (s *postgresStore) CreateIncomingWebhook(hook IncomingWebhook) (int, error) {
+	var id int
+	err := s.db.QueryRow(`
+		INSERT INTO incoming_webhooks (token_hash, channel_name, name, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, hook.TokenHash, hook.Channel, hook.Name, hook.CreatedBy, hook.CreatedAt).Scan(&id)
+	return id, err
+}
+
+// webhookColumns are the columns read by scanWebhook, in order.
+const webhookColumns = "id, channel_name, name, created_by, created_at, token_hash"
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (IncomingWebhook, error) {
+	var hook IncomingWebhook
+	err := row.Scan(&hook.ID, &hook.Channel, &hook.Name, &hook.CreatedBy, &hook.CreatedAt, &hook.TokenHash)
+	return hook, err
+}
+
+func (s *postgresStore) GetIncomingWebhook(tokenHash string) (IncomingWebhook, error) {
+	hook, err := scanWebhook(s.db.QueryRow("SELECT "+webhookColumns+" FROM incoming_webhooks WHERE token_hash = $1", tokenHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return IncomingWebhook{}, errWebhookNotFound
+	}
+	return hook, err
+}
+
+func (s *postgresStore) ListIncomingWebhooks(channelName string) ([]IncomingWebhook, error) {
+	rows, err := s.db.Query("SELECT "+webhookColumns+" FROM incoming_webhooks WHERE channel_name = $1 ORDER BY id", channelName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []IncomingWebhook{}
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *postgresStore) DeleteIncomingWebhook(id int) error {
+	result, err := s.db.Exec("DELETE FROM incoming_webhooks WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errWebhookNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) CreateOutgoingWebhook(hook OutgoingWebhook) (int, error) {
+	var id int
+	err := s.db.QueryRow(`
+		INSERT INTO outgoing_webhooks (url, events, channel_name, secret, created_by, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)
+		RETURNING id
+	`, hook.URL, pq.Array(hook.Events), hook.Channel, hook.Secret, hook.CreatedBy, hook.CreatedAt).Scan(&id)
+	return id, err
+}
+
+func (s *postgresStore) ListOutgoingWebhooks() ([]OutgoingWebhook, error) {
+	rows, err := s.db.Query(`
+		SELECT id, url, events, COALESCE(channel_name, ''), secret, created_by, created_at
+		FROM outgoing_webhooks ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []OutgoingWebhook{}
+	for rows.Next() {
+		var hook OutgoingWebhook
+		if err := rows.Scan(&hook.ID, &hook.URL, pq.Array(&hook.Events), &hook.Channel, &hook.Secret, &hook.CreatedBy, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// DeleteOutgoingWebhook relies on ON DELETE CASCADE to drop the deliveries.
+func (s *postgresStore) DeleteOutgoingWebhook(id int) error {
+	result, err := s.db.Exec("DELETE FROM outgoing_webhooks WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errWebhookNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) EnqueueWebhookDelivery(delivery WebhookDelivery) (int, error) {
+	var id int
+	err := s.db.QueryRow(`
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, status, attempts, next_attempt_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, delivery.WebhookID, delivery.Event, string(delivery.Payload), delivery.Status, delivery.Attempts, delivery.NextAttemptAt, delivery.CreatedAt).Scan(&id)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+		return 0, errWebhookNotFound
+	}
+	return id, err
+}
+
+// deliveryColumns are the columns read by scanDelivery, in order.
+const deliveryColumns = `id, webhook_id, event, payload, status, attempts, next_attempt_at,
+	COALESCE(response_status, 0), COALESCE(error, ''), created_at, delivered_at`
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var payload string
+	err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts,
+		&delivery.NextAttemptAt, &delivery.ResponseStatus, &delivery.Error, &delivery.CreatedAt, &delivery.DeliveredAt)
+	delivery.Payload = json.RawMessage(payload)
+	return delivery, err
+}
+
+func scanDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	defer rows.Close()
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// ClaimWebhookDeliveries skips rows another node is claiming, so each
+// delivery is attempted by one node at a time.
+func (s *postgresStore) ClaimWebhookDeliveries(now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(`
+		UPDATE webhook_deliveries SET next_attempt_at = $2
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $3 AND next_attempt_at <= $1
+			ORDER BY next_attempt_at, id
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+deliveryColumns, now, now.Add(lease), deliveryPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+func (s *postgresStore) UpdateWebhookDelivery(delivery WebhookDelivery) error {
+	result, err := s.db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, next_attempt_at = $4, response_status = NULLIF($5, 0),
+			error = NULLIF($6, ''), delivered_at = $7
+		WHERE id = $1
+	`, delivery.ID, delivery.Status, delivery.Attempts, delivery.NextAttemptAt, delivery.ResponseStatus, delivery.Error, delivery.DeliveredAt)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errWebhookNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) ListWebhookDeliveries(webhookID, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(
+		"SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY id DESC LIMIT $2",
+		webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+func (s *postgresStore) CreateUser(user User) error {
+	result, err := s.db.Exec(`
+		INSERT INTO users (username, password_hash, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (username) DO NOTHING
+	`, user.Username, user.PasswordHash, user.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errUserExists
+	}
+	return nil
+}
+
+func (s *postgresStore) GetUser(username string) (User, error) {
+	var user User
+	err := s.db.QueryRow("SELECT username, password_hash, created_at FROM users WHERE username = $1", username).
+		Scan(&user.Username, &user.PasswordHash, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errUserNotFound
+	}
+	return user, err
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
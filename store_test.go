@@ -0,0 +1,1210 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// forEachStore runs fn against every Store implementation available in the
+// test environment. PostgreSQL is included only when reachable.
+func forEachStore(t *testing.T, fn func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, newMemoryStore())
+	})
+
+	t.Run("file", func(t *testing.T) {
+		store, err := newFileStore(filepath.Join(t.TempDir(), "store.jsonl"))
+		if err != nil {
+			t.Fatalf("Failed to open file store: %v", err)
+		}
+		defer store.Close()
+		fn(t, store)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		db := setupTestDB(t)
+		if db == nil {
+			return
+		}
+		store := newPostgresStore(db)
+		defer store.Close()
+		fn(t, store)
+	})
+}
+
+func TestStoreChannels(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		if err := store.CreateChannel("beta", Persistent); err != nil {
+			t.Fatalf("Failed to create channel: %v", err)
+		}
+		if err := store.CreateChannel("alpha", Persistent); err != nil {
+			t.Fatalf("Failed to create channel: %v", err)
+		}
+		// Creating an existing channel is a no-op
+		if err := store.CreateChannel("alpha", Persistent); err != nil {
+			t.Fatalf("Creating an existing channel should not fail: %v", err)
+		}
+
+		channelType, err := store.GetChannelType("alpha")
+		if err != nil {
+			t.Fatalf("Failed to get channel type: %v", err)
+		}
+		if channelType != Persistent {
+			t.Errorf("Expected Persistent, got %s", channelType)
+		}
+
+		if _, err := store.GetChannelType("missing"); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound for unknown channel, got %v", err)
+		}
+
+		channels, err := store.ListChannels()
+		if err != nil {
+			t.Fatalf("Failed to list channels: %v", err)
+		}
+		if len(channels) != 2 || channels[0].Name != "alpha" || channels[1].Name != "beta" {
+			t.Errorf("Expected channels [alpha beta], got %v", channels)
+		}
+	})
+}
+
+func TestStoreDeleteChannel(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		if err := store.DeleteChannel("missing"); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound deleting a missing channel, got %v", err)
+		}
+
+		store.CreateChannel("doomed", Persistent)
+		store.CreateChannel("kept", Persistent)
+		id, err := store.SaveMessage(Message{Username: "alice", Content: "bye", Channel: "doomed", Timestamp: time.Now().UTC(), ClientMsgID: "c-1"})
+		if err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+		store.SaveMessage(Message{Username: "bob", Content: "reply", Channel: "doomed", ParentID: id, Timestamp: time.Now().UTC()})
+		store.AddReaction(id, "bob", "👍")
+		store.MarkRead("bob", "doomed", id)
+		keptID, _ := store.SaveMessage(Message{Username: "alice", Content: "stay", Channel: "kept", Timestamp: time.Now().UTC()})
+
+		if err := store.DeleteChannel("doomed"); err != nil {
+			t.Fatalf("Failed to delete channel: %v", err)
+		}
+		if _, err := store.GetChannelType("doomed"); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected the channel to be gone, got %v", err)
+		}
+		if _, err := store.GetMessage(id); !errors.Is(err, errMessageNotFound) {
+			t.Errorf("Expected the channel's messages to be gone, got %v", err)
+		}
+		if states, _ := store.GetReadStates("bob"); states["doomed"] != (ReadState{}) {
+			t.Errorf("Expected no read state left in the channel, got %+v", states)
+		}
+		if _, err := store.GetMessage(keptID); err != nil {
+			t.Errorf("Expected other channels' messages to stay, got %v", err)
+		}
+
+		// The name and client message IDs can be used again
+		store.CreateChannel("doomed", Persistent)
+		if _, err := store.SaveMessage(Message{Username: "alice", Content: "back", Channel: "doomed", Timestamp: time.Now().UTC(), ClientMsgID: "c-1"}); err != nil {
+			t.Errorf("Expected a fresh channel to accept the message, got %v", err)
+		}
+	})
+}
+
+func TestStoreChannelTopics(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.CreateChannel("team", Persistent)
+		if topic, err := store.GetChannelTopic("team"); err != nil || topic != "" {
+			t.Errorf("Expected a new channel to have no topic, got %q (%v)", topic, err)
+		}
+		if err := store.SetChannelTopic("team", "Release on Friday"); err != nil {
+			t.Fatalf("Failed to set topic: %v", err)
+		}
+		if topic, _ := store.GetChannelTopic("team"); topic != "Release on Friday" {
+			t.Errorf("Expected the topic stored, got %q", topic)
+		}
+		if channels, _ := store.ListChannels(); len(channels) != 1 || channels[0].Topic != "Release on Friday" {
+			t.Errorf("Expected the topic listed with the channel, got %+v", channels)
+		}
+		if err := store.SetChannelTopic("missing", "x"); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound for an unknown channel, got %v", err)
+		}
+		if _, err := store.GetChannelTopic("missing"); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound reading an unknown channel, got %v", err)
+		}
+
+		// A recreated channel starts without its old topic
+		store.DeleteChannel("team")
+		store.CreateChannel("team", Persistent)
+		if topic, _ := store.GetChannelTopic("team"); topic != "" {
+			t.Errorf("Expected the deleted channel's topic gone, got %q", topic)
+		}
+	})
+}
+
+func TestStoreCreateOwnedChannel(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		created, err := store.CreateOwnedChannel("team", Persistent, "alice", true)
+		if err != nil || !created {
+			t.Fatalf("Expected the channel created, got %v (%v)", created, err)
+		}
+		if created, err := store.CreateOwnedChannel("team", Persistent, "bob", false); err != nil || created {
+			t.Errorf("Expected an existing channel left alone, got %v (%v)", created, err)
+		}
+		if roles, _ := store.ListChannelRoles("team"); len(roles) != 1 || roles[0] != (ChannelRole{"alice", roleOwner}) {
+			t.Errorf("Expected alice the only owner, got %+v", roles)
+		}
+		if private, _ := store.IsChannelPrivate("team"); !private {
+			t.Error("Expected the channel private")
+		}
+		if created, err := store.CreateOwnedChannel("open", Persistent, "", false); err != nil || !created {
+			t.Errorf("Expected a channel without an owner created, got %v (%v)", created, err)
+		}
+		if roles, _ := store.ListChannelRoles("open"); len(roles) != 0 {
+			t.Errorf("Expected no roles in an unowned channel, got %+v", roles)
+		}
+	})
+}
+
+func TestStoreChannelRoles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.CreateChannel("team", Persistent)
+		if err := store.SetChannelRole("team", "alice", roleOwner); err != nil {
+			t.Fatalf("Failed to set role: %v", err)
+		}
+		store.SetChannelRole("team", "bob", roleReadOnly)
+		store.SetChannelRole("team", "bob", roleModerator)
+		if role, err := store.GetChannelRole("team", "bob"); err != nil || role != roleModerator {
+			t.Errorf("Expected bob's role replaced, got %q (%v)", role, err)
+		}
+		if role, err := store.GetChannelRole("team", "carol"); err != nil || role != "" {
+			t.Errorf("Expected no role for carol, got %q (%v)", role, err)
+		}
+		if roles, _ := store.ListChannelRoles("team"); len(roles) != 2 || roles[0] != (ChannelRole{"alice", roleOwner}) || roles[1] != (ChannelRole{"bob", roleModerator}) {
+			t.Errorf("Expected both roles listed, got %+v", roles)
+		}
+		if members, _ := store.GetChannelMembers("team"); len(members) != 2 || members[0] != "alice" {
+			t.Errorf("Expected the role holders as members, got %v", members)
+		}
+		if channels, _ := store.ListChannels(); len(channels) != 1 || channels[0].Owner != "alice" {
+			t.Errorf("Expected alice listed as the owner, got %+v", channels)
+		}
+		if err := store.SetChannelRole("missing", "alice", roleOwner); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound for an unknown channel, got %v", err)
+		}
+		if _, err := store.GetChannelRole("missing", "alice"); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound reading an unknown channel, got %v", err)
+		}
+
+		// Losing the owner role clears the owner
+		if err := store.RemoveChannelRole("team", "alice"); err != nil {
+			t.Fatalf("Failed to remove role: %v", err)
+		}
+		if err := store.RemoveChannelRole("team", "alice"); err != nil {
+			t.Errorf("Expected removing a missing role to be a no-op, got %v", err)
+		}
+		if channels, _ := store.ListChannels(); channels[0].Owner != "" {
+			t.Errorf("Expected no owner, got %+v", channels)
+		}
+		store.DeleteChannel("team")
+		store.CreateChannel("team", Persistent)
+		if roles, _ := store.ListChannelRoles("team"); len(roles) != 0 {
+			t.Errorf("Expected the deleted channel's roles gone, got %+v", roles)
+		}
+	})
+}
+
+func TestStorePrivateChannels(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.CreateChannel("team", Persistent)
+		store.CreateChannel("lobby", Persistent)
+		if err := store.SetChannelPrivate("team", true); err != nil {
+			t.Fatalf("Failed to make channel private: %v", err)
+		}
+		if private, err := store.IsChannelPrivate("team"); err != nil || !private {
+			t.Errorf("Expected team private, got %v (%v)", private, err)
+		}
+		if channels, _ := store.ListChannels(); len(channels) != 2 || channels[0].Private || !channels[1].Private {
+			t.Errorf("Expected only team listed as private, got %+v", channels)
+		}
+		if _, err := store.IsChannelPrivate("missing"); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound for an unknown channel, got %v", err)
+		}
+
+		// Private channels are only searched for their members
+		store.SetChannelRole("team", "alice", roleMember)
+		store.SaveMessage(Message{Username: "alice", Content: "secret plans", Channel: "team", Timestamp: time.Now().UTC()})
+		if results, _ := store.SearchMessages(SearchQuery{Query: "plans", Limit: 10, Member: "bob"}); len(results) != 0 {
+			t.Errorf("Expected no results for a non-member, got %+v", results)
+		}
+		if results, _ := store.SearchMessages(SearchQuery{Query: "plans", Limit: 10, Member: "alice"}); len(results) != 1 {
+			t.Errorf("Expected the message found for a member, got %+v", results)
+		}
+	})
+}
+
+func TestStoreChannelInvites(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.CreateChannel("team", Persistent)
+		now := time.Now().UTC().Truncate(time.Second)
+		invite := ChannelInvite{Channel: "team", CreatedBy: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour), MaxUses: 2, CodeHash: hashWebhookToken("code")}
+		id, err := store.CreateChannelInvite(invite)
+		if err != nil {
+			t.Fatalf("Failed to create invite: %v", err)
+		}
+		if got, err := store.GetChannelInvite(hashWebhookToken("code"), now); err != nil || got.ID != id || got.Uses != 0 {
+			t.Errorf("Expected the unused invite, got %+v (%v)", got, err)
+		}
+		used, err := store.UseChannelInvite(hashWebhookToken("code"), "bob", now)
+		if err != nil || used.ID != id || used.Channel != "team" || used.CreatedBy != "alice" || used.Uses != 1 {
+			t.Errorf("Expected the invite's first use, got %+v (%v)", used, err)
+		}
+		if role, _ := store.GetChannelRole("team", "bob"); role != roleMember {
+			t.Errorf("Expected the invite to make bob a member, got %q", role)
+		}
+		// Members already in the channel do not use the invite up
+		if _, err := store.UseChannelInvite(hashWebhookToken("code"), "bob", now); !errors.Is(err, errAlreadyMember) {
+			t.Errorf("Expected errAlreadyMember for a member, got %v", err)
+		}
+		store.UseChannelInvite(hashWebhookToken("code"), "carol", now)
+		if _, err := store.UseChannelInvite(hashWebhookToken("code"), "dave", now); !errors.Is(err, errInviteNotFound) {
+			t.Errorf("Expected a used up invite refused, got %v", err)
+		}
+		if _, err := store.GetChannelInvite(hashWebhookToken("code"), now); !errors.Is(err, errInviteNotFound) {
+			t.Errorf("Expected a used up invite not found, got %v", err)
+		}
+		if role, _ := store.GetChannelRole("team", "dave"); role != "" {
+			t.Errorf("Expected a refused invite to give no role, got %q", role)
+		}
+		if _, err := store.UseChannelInvite(hashWebhookToken("other"), "dave", now); !errors.Is(err, errInviteNotFound) {
+			t.Errorf("Expected an unknown code refused, got %v", err)
+		}
+
+		invite.CodeHash, invite.MaxUses = hashWebhookToken("open"), 0
+		store.CreateChannelInvite(invite)
+		if _, err := store.UseChannelInvite(hashWebhookToken("open"), "dave", now.Add(time.Hour)); !errors.Is(err, errInviteNotFound) {
+			t.Errorf("Expected an expired invite refused, got %v", err)
+		}
+		if _, err := store.CreateChannelInvite(ChannelInvite{Channel: "missing", CreatedAt: now, ExpiresAt: now, CodeHash: hashWebhookToken("x")}); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound for an unknown channel, got %v", err)
+		}
+
+		// Deleting the channel deletes its invites
+		store.DeleteChannel("team")
+		store.CreateChannel("team", Persistent)
+		if _, err := store.GetChannelInvite(hashWebhookToken("open"), now); !errors.Is(err, errInviteNotFound) {
+			t.Errorf("Expected the deleted channel's invites gone, got %v", err)
+		}
+	})
+}
+
+func TestStoreSanctions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.CreateChannel("team", Persistent)
+		now := time.Now().UTC().Truncate(time.Second)
+		mute := Sanction{Kind: sanctionMute, Channel: "team", Username: "bob", Reason: "spam", CreatedBy: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+		if _, err := store.SetSanction(mute); err != nil {
+			t.Fatalf("Failed to mute: %v", err)
+		}
+		// Sanctions may name ephemeral channels, or none for server-wide ones
+		store.SetSanction(Sanction{Kind: sanctionBan, Channel: "", Username: "bob", CreatedBy: "mod", CreatedAt: now, ExpiresAt: now.Add(time.Minute)})
+		store.SetSanction(Sanction{Kind: sanctionBan, Channel: "lounge", Username: "carol", CreatedBy: "mod", CreatedAt: now, ExpiresAt: now.Add(time.Minute)})
+
+		sanctions, err := store.ListSanctions("bob", now)
+		if err != nil || len(sanctions) != 2 || sanctions[0].Kind != sanctionMute || sanctions[0].Reason != "spam" || sanctions[1].Channel != "" {
+			t.Errorf("Expected bob's mute and server ban, got %+v (%v)", sanctions, err)
+		}
+		if sanctions, _ := store.ListSanctions("bob", now.Add(30*time.Minute)); len(sanctions) != 1 || sanctions[0].Kind != sanctionMute {
+			t.Errorf("Expected the ban to expire before the mute, got %+v", sanctions)
+		}
+
+		// Muting again replaces the mute
+		mute.ExpiresAt, mute.Reason = now.Add(time.Minute), "calmer now"
+		store.SetSanction(mute)
+		if sanctions, _ := store.ListSanctions("bob", now.Add(30*time.Minute)); len(sanctions) != 0 {
+			t.Errorf("Expected the shorter mute to replace the first, got %+v", sanctions)
+		}
+
+		if err := store.RemoveSanction(sanctionMute, "team", "bob", now); err != nil {
+			t.Errorf("Failed to unmute: %v", err)
+		}
+		if err := store.RemoveSanction(sanctionMute, "team", "bob", now); !errors.Is(err, errSanctionNotFound) {
+			t.Errorf("Expected errSanctionNotFound unmuting again, got %v", err)
+		}
+		if err := store.RemoveSanction(sanctionBan, "", "bob", now.Add(time.Hour)); !errors.Is(err, errSanctionNotFound) {
+			t.Errorf("Expected errSanctionNotFound lifting an expired ban, got %v", err)
+		}
+
+		// Deleting a channel lifts its sanctions
+		store.SetSanction(mute)
+		store.DeleteChannel("team")
+		if sanctions, _ := store.ListSanctions("bob", now); len(sanctions) != 1 || sanctions[0].Channel != "" {
+			t.Errorf("Expected only the server ban left, got %+v", sanctions)
+		}
+	})
+}
+
+func TestStoreSlowModeAndAuditLog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.CreateChannel("team", Persistent)
+		if err := store.SetChannelSlowMode("team", 30); err != nil {
+			t.Fatalf("Failed to set slow mode: %v", err)
+		}
+		if seconds, err := store.GetChannelSlowMode("team"); err != nil || seconds != 30 {
+			t.Errorf("Expected 30 seconds of slow mode, got %d (%v)", seconds, err)
+		}
+		if channels, _ := store.ListChannels(); len(channels) != 1 || channels[0].SlowMode != 30 {
+			t.Errorf("Expected the slow mode listed, got %+v", channels)
+		}
+		if err := store.SetChannelSlowMode("missing", 30); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound, got %v", err)
+		}
+		if _, err := store.GetChannelSlowMode("missing"); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound, got %v", err)
+		}
+
+		now := time.Now().UTC().Truncate(time.Second)
+		for _, entry := range []AuditEntry{
+			{Action: actionMute, Channel: "team", Actor: "alice", Target: "bob", Reason: "spam", Details: "10m0s", CreatedAt: now},
+			{Action: actionBan, Actor: "mod", Target: "carol", Details: "24h0m0s", CreatedAt: now},
+			{Action: actionSlowMode, Channel: "team", Actor: "alice", Details: "30s", CreatedAt: now},
+		} {
+			if _, err := store.AddAuditEntry(entry); err != nil {
+				t.Fatalf("Failed to add audit entry: %v", err)
+			}
+		}
+		entries, err := store.ListAuditLog("team", 10)
+		if err != nil || len(entries) != 2 || entries[0].Action != actionSlowMode || entries[1].Target != "bob" || entries[1].Reason != "spam" {
+			t.Errorf("Expected the channel's entries newest first, got %+v (%v)", entries, err)
+		}
+		if entries, _ := store.ListAuditLog("", 2); len(entries) != 2 || entries[1].Action != actionBan {
+			t.Errorf("Expected the two newest entries, got %+v", entries)
+		}
+
+		// Deleting a channel keeps its audit log
+		store.DeleteChannel("team")
+		if entries, _ := store.ListAuditLog("team", 10); len(entries) != 2 {
+			t.Errorf("Expected the audit log kept, got %+v", entries)
+		}
+	})
+}
+
+func TestStoreIncomingWebhooks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.CreateChannel("alerts", Persistent)
+		hook := IncomingWebhook{Channel: "alerts", Name: "ci-bot", CreatedBy: "mod", CreatedAt: time.Now().UTC(), TokenHash: hashWebhookToken("secret")}
+		id, err := store.CreateIncomingWebhook(hook)
+		if err != nil {
+			t.Fatalf("Failed to create webhook: %v", err)
+		}
+		got, err := store.GetIncomingWebhook(hashWebhookToken("secret"))
+		if err != nil || got.ID != id || got.Channel != "alerts" || got.Name != "ci-bot" {
+			t.Errorf("Expected the webhook by its token hash, got %+v (%v)", got, err)
+		}
+		if _, err := store.GetIncomingWebhook(hashWebhookToken("other")); !errors.Is(err, errWebhookNotFound) {
+			t.Errorf("Expected errWebhookNotFound for another token, got %v", err)
+		}
+		if hooks, _ := store.ListIncomingWebhooks("alerts"); len(hooks) != 1 || hooks[0].ID != id {
+			t.Errorf("Expected the channel's webhook listed, got %+v", hooks)
+		}
+
+		// Webhook messages keep their display name and attachments
+		msgID, err := store.SaveMessage(Message{Username: webhookUsernamePrefix + "ci-bot", DisplayName: "Build Bot", Content: "passed", Channel: "alerts", Timestamp: time.Now().UTC(),
+			Attachments: []Attachment{{Title: "Logs", TitleLink: "https://ci.example.com/1"}}})
+		if err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+		if msg, err := store.GetMessage(msgID); err != nil || msg.DisplayName != "Build Bot" || len(msg.Attachments) != 1 || msg.Attachments[0].Title != "Logs" {
+			t.Errorf("Expected display name and attachments stored, got %+v (%v)", msg, err)
+		}
+
+		if err := store.DeleteIncomingWebhook(id); err != nil {
+			t.Fatalf("Failed to delete webhook: %v", err)
+		}
+		if err := store.DeleteIncomingWebhook(id); !errors.Is(err, errWebhookNotFound) {
+			t.Errorf("Expected errWebhookNotFound deleting twice, got %v", err)
+		}
+
+		// Deleting a channel revokes its webhooks
+		store.CreateIncomingWebhook(IncomingWebhook{Channel: "alerts", Name: "pager", CreatedBy: "mod", CreatedAt: time.Now().UTC(), TokenHash: hashWebhookToken("pager")})
+		store.DeleteChannel("alerts")
+		if _, err := store.GetIncomingWebhook(hashWebhookToken("pager")); !errors.Is(err, errWebhookNotFound) {
+			t.Errorf("Expected the deleted channel's webhook to be gone, got %v", err)
+		}
+	})
+}
+
+func TestStoreWebhookDeliveries(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		hookID, err := store.CreateOutgoingWebhook(OutgoingWebhook{URL: "https://example.com/hook", Events: []string{eventMessageCreated}, Channel: "ops", Secret: "s3cret", CreatedBy: "mod", CreatedAt: now})
+		if err != nil {
+			t.Fatalf("Failed to create webhook: %v", err)
+		}
+		if hooks, _ := store.ListOutgoingWebhooks(); len(hooks) != 1 || hooks[0].Secret != "s3cret" || hooks[0].Channel != "ops" || len(hooks[0].Events) != 1 {
+			t.Errorf("Expected the webhook with its secret, got %+v", hooks)
+		}
+
+		enqueue := func(at time.Time) int {
+			id, err := store.EnqueueWebhookDelivery(WebhookDelivery{WebhookID: hookID, Event: eventMessageCreated, Payload: []byte(`{"event":"message.created"}`), Status: deliveryPending, NextAttemptAt: at, CreatedAt: now})
+			if err != nil {
+				t.Fatalf("Failed to enqueue delivery: %v", err)
+			}
+			return id
+		}
+		first := enqueue(now)
+		enqueue(now.Add(time.Hour))
+		if _, err := store.EnqueueWebhookDelivery(WebhookDelivery{WebhookID: hookID + 100, Status: deliveryPending, Payload: []byte(`{}`)}); !errors.Is(err, errWebhookNotFound) {
+			t.Errorf("Expected errWebhookNotFound for an unknown webhook, got %v", err)
+		}
+
+		claimed, err := store.ClaimWebhookDeliveries(now, time.Minute, 10)
+		if err != nil || len(claimed) != 1 || claimed[0].ID != first || string(claimed[0].Payload) != `{"event":"message.created"}` {
+			t.Fatalf("Expected only the due delivery claimed, got %+v (%v)", claimed, err)
+		}
+		if again, _ := store.ClaimWebhookDeliveries(now, time.Minute, 10); len(again) != 0 {
+			t.Errorf("Expected a claimed delivery to be skipped until its lease ends, got %+v", again)
+		}
+
+		delivered := claimed[0]
+		delivered.Status, delivered.Attempts, delivered.ResponseStatus, delivered.DeliveredAt = deliveryDelivered, 1, 200, &now
+		if err := store.UpdateWebhookDelivery(delivered); err != nil {
+			t.Fatalf("Failed to update delivery: %v", err)
+		}
+		log, err := store.ListWebhookDeliveries(hookID, 10)
+		if err != nil || len(log) != 2 || log[1].ID != first {
+			t.Fatalf("Expected both deliveries newest first, got %+v (%v)", log, err)
+		}
+		if got := log[1]; got.Status != deliveryDelivered || got.Attempts != 1 || got.ResponseStatus != 200 || got.DeliveredAt == nil {
+			t.Errorf("Expected the attempt recorded, got %+v", got)
+		}
+		if later, _ := store.ClaimWebhookDeliveries(now.Add(2*time.Hour), time.Minute, 10); len(later) != 1 || later[0].ID == first {
+			t.Errorf("Expected only the pending delivery once due, got %+v", later)
+		}
+
+		if err := store.DeleteOutgoingWebhook(hookID); err != nil {
+			t.Fatalf("Failed to delete webhook: %v", err)
+		}
+		if err := store.DeleteOutgoingWebhook(hookID); !errors.Is(err, errWebhookNotFound) {
+			t.Errorf("Expected errWebhookNotFound deleting twice, got %v", err)
+		}
+		if log, _ := store.ListWebhookDeliveries(hookID, 10); len(log) != 0 {
+			t.Errorf("Expected the webhook's deliveries deleted with it, got %+v", log)
+		}
+	})
+}
+
+func TestStoreMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		if _, err := store.SaveMessage(Message{Username: "user", Content: "lost", Channel: "missing"}); err == nil {
+			t.Error("Expected error when saving to non-existent channel")
+		}
+
+		if err := store.CreateChannel("history", Persistent); err != nil {
+			t.Fatalf("Failed to create channel: %v", err)
+		}
+
+		base := time.Now().UTC().Truncate(time.Millisecond)
+		var lastID int
+		for i, content := range []string{"one", "two", "three"} {
+			id, err := store.SaveMessage(Message{
+				Username:  "user",
+				Content:   content,
+				Type:      "message",
+				Channel:   "history",
+				Timestamp: base.Add(time.Duration(i) * time.Second),
+			})
+			if err != nil {
+				t.Fatalf("Failed to save message: %v", err)
+			}
+			if id <= lastID {
+				t.Errorf("Expected increasing message IDs, got %d after %d", id, lastID)
+			}
+			lastID = id
+		}
+
+		history, err := store.GetChannelHistory("history", 2)
+		if err != nil {
+			t.Fatalf("Failed to get history: %v", err)
+		}
+		if len(history) != 2 {
+			t.Fatalf("Expected 2 messages, got %d", len(history))
+		}
+		if history[0].Content != "two" || history[1].Content != "three" {
+			t.Errorf("Expected newest messages oldest first, got %q, %q", history[0].Content, history[1].Content)
+		}
+		if history[1].ID != lastID || history[1].Channel != "history" || history[1].Type != "message" {
+			t.Errorf("Unexpected history message: %+v", history[1])
+		}
+	})
+}
+
+func TestFileStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+
+	store, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open file store: %v", err)
+	}
+	if err := store.CreateChannel("durable", Persistent); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+	id, err := store.SaveMessage(Message{Username: "user", Content: "kept", Channel: "durable", Timestamp: time.Now().UTC(), ClientMsgID: "c-1"})
+	if err != nil {
+		t.Fatalf("Failed to save message: %v", err)
+	}
+	if err := store.CreateDirectChannel("dm-durable", []string{"alice", "bob"}); err != nil {
+		t.Fatalf("Failed to create direct channel: %v", err)
+	}
+	editedID, _ := store.SaveMessage(Message{Username: "user", Content: "typo", Channel: "durable", Timestamp: time.Now().UTC()})
+	if _, err := store.EditMessage(editedID, "fixed", "user", time.Now().UTC()); err != nil {
+		t.Fatalf("Failed to edit message: %v", err)
+	}
+	store.AddReaction(id, "alice", "👍")
+	store.AddReaction(id, "bob", "👍")
+	store.RemoveReaction(id, "alice", "👍")
+	store.MarkRead("alice", "durable", editedID)
+	store.SetChannelTopic("durable", "Kept topic")
+	store.SetChannelRole("durable", "alice", roleOwner)
+	store.SetChannelRole("durable", "bob", roleReadOnly)
+	store.RemoveChannelRole("durable", "bob")
+	store.SetChannelPrivate("durable", true)
+	store.SetChannelSlowMode("durable", 15)
+	now := time.Now().UTC()
+	store.SetSanction(Sanction{Kind: sanctionMute, Channel: "durable", Username: "bob", CreatedBy: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	store.SetSanction(Sanction{Kind: sanctionBan, Channel: "durable", Username: "carol", CreatedBy: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	store.RemoveSanction(sanctionBan, "durable", "carol", now)
+	store.AddAuditEntry(AuditEntry{Action: actionMute, Channel: "durable", Actor: "alice", Target: "bob", CreatedAt: now})
+	store.CreateChannelInvite(ChannelInvite{Channel: "durable", CreatedBy: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour), MaxUses: 1, CodeHash: hashWebhookToken("once")})
+	store.UseChannelInvite(hashWebhookToken("once"), "dave", now)
+	store.CreateChannelInvite(ChannelInvite{Channel: "durable", CreatedBy: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour), CodeHash: hashWebhookToken("open")})
+	store.CreateOwnedChannel("owned", Persistent, "erin", true)
+	store.CreateChannel("dropped", Persistent)
+	store.SaveMessage(Message{Username: "user", Content: "gone", Channel: "dropped", Timestamp: time.Now().UTC()})
+	store.DeleteChannel("dropped")
+	hookID, _ := store.CreateIncomingWebhook(IncomingWebhook{Channel: "durable", Name: "ci-bot", CreatedBy: "mod", CreatedAt: time.Now().UTC(), TokenHash: hashWebhookToken("kept")})
+	revokedID, _ := store.CreateIncomingWebhook(IncomingWebhook{Channel: "durable", Name: "old", CreatedBy: "mod", CreatedAt: time.Now().UTC(), TokenHash: hashWebhookToken("revoked")})
+	store.DeleteIncomingWebhook(revokedID)
+	outgoingID, _ := store.CreateOutgoingWebhook(OutgoingWebhook{URL: "https://example.com/hook", Events: []string{eventChannelCreated}, Secret: "s3cret", CreatedBy: "mod", CreatedAt: time.Now().UTC()})
+	deliveryID, _ := store.EnqueueWebhookDelivery(WebhookDelivery{WebhookID: outgoingID, Event: eventChannelCreated, Payload: []byte(`{"event":"channel.created"}`), Status: deliveryPending, NextAttemptAt: time.Now().UTC()})
+	store.UpdateWebhookDelivery(WebhookDelivery{ID: deliveryID, Status: deliveryFailed, Attempts: 3, Error: "unexpected status 500"})
+	store.Close()
+
+	// Opening compacts the journal into a snapshot; the second open restores it
+	for i := 0; i < 2; i++ {
+		reopened, err := newFileStore(path)
+		if err != nil {
+			t.Fatalf("Failed to reopen file store: %v", err)
+		}
+		reopened.Close()
+	}
+	if lines := journalLines(t, path); lines != 1 {
+		t.Errorf("Expected the journal compacted to one snapshot, got %d lines", lines)
+	}
+	reopened, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen file store: %v", err)
+	}
+	defer reopened.Close()
+
+	if channelType, err := reopened.GetChannelType("durable"); err != nil || channelType != Persistent {
+		t.Errorf("Expected durable persistent channel after replay, got %s, %v", channelType, err)
+	}
+	if roles, _ := reopened.ListChannelRoles("durable"); len(roles) != 2 || roles[0] != (ChannelRole{"alice", roleOwner}) || roles[1] != (ChannelRole{"dave", roleMember}) {
+		t.Errorf("Expected alice's role and dave's from the invite after replay, got %+v", roles)
+	}
+	if private, _ := reopened.IsChannelPrivate("durable"); !private {
+		t.Error("Expected durable to stay private after replay")
+	}
+	if roles, _ := reopened.ListChannelRoles("owned"); len(roles) != 1 || roles[0] != (ChannelRole{"erin", roleOwner}) {
+		t.Errorf("Expected erin to own the created channel after replay, got %+v", roles)
+	}
+	if private, _ := reopened.IsChannelPrivate("owned"); !private {
+		t.Error("Expected owned to be created private after replay")
+	}
+	if _, err := reopened.UseChannelInvite(hashWebhookToken("once"), "erin", now); !errors.Is(err, errInviteNotFound) {
+		t.Errorf("Expected the used invite to stay used after replay, got %v", err)
+	}
+	if invite, err := reopened.UseChannelInvite(hashWebhookToken("open"), "erin", now); err != nil || invite.Uses != 1 {
+		t.Errorf("Expected the open invite after replay, got %+v (%v)", invite, err)
+	}
+	if seconds, _ := reopened.GetChannelSlowMode("durable"); seconds != 15 {
+		t.Errorf("Expected the slow mode after replay, got %d", seconds)
+	}
+	if sanctions, _ := reopened.ListSanctions("bob", now); len(sanctions) != 1 || sanctions[0].Kind != sanctionMute {
+		t.Errorf("Expected bob's mute after replay, got %+v", sanctions)
+	}
+	if sanctions, _ := reopened.ListSanctions("carol", now); len(sanctions) != 0 {
+		t.Errorf("Expected carol's ban to stay lifted after replay, got %+v", sanctions)
+	}
+	if entries, _ := reopened.ListAuditLog("durable", 10); len(entries) != 1 || entries[0].Target != "bob" {
+		t.Errorf("Expected the audit log after replay, got %+v", entries)
+	}
+	if topic, err := reopened.GetChannelTopic("durable"); err != nil || topic != "Kept topic" {
+		t.Errorf("Expected the topic after replay, got %q (%v)", topic, err)
+	}
+	if hook, err := reopened.GetIncomingWebhook(hashWebhookToken("kept")); err != nil || hook.ID != hookID {
+		t.Errorf("Expected webhook %d after replay, got %+v (%v)", hookID, hook, err)
+	}
+	if deliveries, _ := reopened.ListWebhookDeliveries(outgoingID, 10); len(deliveries) != 1 || deliveries[0].Status != deliveryFailed ||
+		deliveries[0].Attempts != 3 || string(deliveries[0].Payload) != `{"event":"channel.created"}` {
+		t.Errorf("Expected the failed delivery and its payload after replay, got %+v", deliveries)
+	}
+	if _, err := reopened.GetIncomingWebhook(hashWebhookToken("revoked")); !errors.Is(err, errWebhookNotFound) {
+		t.Errorf("Expected the revoked webhook to stay revoked after replay, got %v", err)
+	}
+	if _, err := reopened.GetChannelType("dropped"); !errors.Is(err, errChannelNotFound) {
+		t.Errorf("Expected the deleted channel to stay deleted after replay, got %v", err)
+	}
+	if members, err := reopened.GetChannelMembers("dm-durable"); err != nil || len(members) != 2 {
+		t.Errorf("Expected direct channel members after replay, got %v, %v", members, err)
+	}
+
+	history, err := reopened.GetChannelHistory("durable", 10)
+	if err != nil {
+		t.Fatalf("Failed to get history: %v", err)
+	}
+	if len(history) != 2 || history[0].ID != id || history[0].Content != "kept" {
+		t.Errorf("Expected replayed message %d, got %+v", id, history)
+	}
+	if edited, err := reopened.GetMessage(editedID); err != nil || edited.Content != "fixed" || edited.EditedAt == nil {
+		t.Errorf("Expected replayed edit, got %+v (%v)", edited, err)
+	}
+	if states, _ := reopened.GetReadStates("alice"); states["durable"].LastReadID != editedID {
+		t.Errorf("Expected replayed read position %d, got %+v", editedID, states["durable"])
+	}
+	if reactions := history[0].Reactions; len(reactions) != 1 || reactions[0].Count != 1 || reactions[0].Users[0] != "bob" {
+		t.Errorf("Expected replayed reactions, got %+v", reactions)
+	}
+	if _, err := reopened.SaveMessage(Message{Username: "user", Content: "kept", Channel: "durable", ClientMsgID: "c-1"}); !errors.Is(err, errDuplicateMessage) {
+		t.Errorf("Expected client message IDs to survive replay, got %v", err)
+	}
+
+	// New IDs continue after the replayed ones
+	nextID, err := reopened.SaveMessage(Message{Username: "user", Content: "next", Channel: "durable"})
+	if err != nil {
+		t.Fatalf("Failed to save message: %v", err)
+	}
+	if nextID <= editedID {
+		t.Errorf("Expected ID after %d, got %d", editedID, nextID)
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	defer func(every int) { journalCompactEvery = every }(journalCompactEvery)
+	journalCompactEvery = 4
+
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	store, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open file store: %v", err)
+	}
+	if err := store.CreateChannel("busy", Persistent); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+	var lastID int
+	for i := 0; i < 10; i++ {
+		lastID, err = store.SaveMessage(Message{Username: "user", Content: fmt.Sprintf("message %d", i), Channel: "busy", Timestamp: time.Now().UTC()})
+		if err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+	}
+	if _, err := store.EditMessage(lastID, "edited", "user", time.Now().UTC()); err != nil {
+		t.Fatalf("Failed to edit message: %v", err)
+	}
+
+	// 12 entries: compacted before the 5th and 9th, leaving a snapshot and 4
+	if lines := journalLines(t, path); lines != 5 {
+		t.Errorf("Expected a snapshot and 4 entries in the journal, got %d lines", lines)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary file left behind, got %v", err)
+	}
+	store.Close()
+
+	reopened, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen file store: %v", err)
+	}
+	defer reopened.Close()
+
+	history, err := reopened.GetChannelHistory("busy", 20)
+	if err != nil {
+		t.Fatalf("Failed to get history: %v", err)
+	}
+	if len(history) != 10 || history[0].Content != "message 0" || history[9].Content != "edited" {
+		t.Errorf("Expected every message after compaction, got %+v", history)
+	}
+	if edits, _ := reopened.GetMessageEdits(lastID); len(edits) != 1 || edits[0].PreviousContent != "message 9" {
+		t.Errorf("Expected the edit history after compaction, got %+v", edits)
+	}
+	if nextID, _ := reopened.SaveMessage(Message{Username: "user", Content: "next", Channel: "busy"}); nextID <= lastID {
+		t.Errorf("Expected ID after %d, got %d", lastID, nextID)
+	}
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	store, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open file store: %v", err)
+	}
+	store.CreateChannel("durable", Persistent)
+	keptID, _ := store.SaveMessage(Message{Username: "user", Content: "kept", Channel: "durable", Timestamp: time.Now().UTC()})
+	store.Close()
+	// Reopening compacts the journal, so the next open only has the torn
+	// line to deal with
+	if store, err = newFileStore(path); err != nil {
+		t.Fatalf("Failed to reopen file store: %v", err)
+	}
+	store.Close()
+
+	// A crash in the middle of a write leaves half a line at the end
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	file.WriteString(`{"op":"save_message","message":{"id":2,"content":"lo`)
+	file.Close()
+
+	reopened, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("Expected the torn write to be discarded, got %v", err)
+	}
+	if lines := journalLines(t, path); lines != 1 {
+		t.Errorf("Expected the journal cut back to its snapshot line, got %d lines", lines)
+	}
+	if history, _ := reopened.GetChannelHistory("durable", 10); len(history) != 1 || history[0].ID != keptID {
+		t.Errorf("Expected only the complete message, got %+v", history)
+	}
+	nextID, err := reopened.SaveMessage(Message{Username: "user", Content: "next", Channel: "durable", Timestamp: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("Failed to save message: %v", err)
+	}
+	reopened.Close()
+
+	reopened, err = newFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen file store: %v", err)
+	}
+	if history, _ := reopened.GetChannelHistory("durable", 10); len(history) != 2 || history[1].ID != nextID {
+		t.Errorf("Expected messages written after the torn one, got %+v", history)
+	}
+	reopened.Close()
+
+	// Corruption before the last line is not a torn write
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, append([]byte("{not json\n"), data...), 0o644)
+	if _, err := newFileStore(path); err == nil {
+		t.Error("Expected a corrupt entry before the end to fail")
+	}
+}
+
+// journalLines counts the entries in a file store's journal.
+func journalLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read journal: %v", err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestStoreHistoryPage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		if err := store.CreateChannel("paged", Persistent); err != nil {
+			t.Fatalf("Failed to create channel: %v", err)
+		}
+
+		// Timestamps run backwards to show paging follows IDs, not time
+		base := time.Now().UTC().Truncate(time.Second)
+		var ids []int
+		for i := 0; i < 5; i++ {
+			id, err := store.SaveMessage(Message{
+				Username:  "user",
+				Content:   string(rune('a' + i)),
+				Channel:   "paged",
+				Timestamp: base.Add(-time.Duration(i) * time.Second),
+			})
+			if err != nil {
+				t.Fatalf("Failed to save message: %v", err)
+			}
+			ids = append(ids, id)
+		}
+
+		contents := func(messages []Message) string {
+			s := ""
+			for _, msg := range messages {
+				s += msg.Content
+			}
+			return s
+		}
+
+		page, hasMore, err := store.GetHistoryPage("paged", 0, 0, 2)
+		if err != nil {
+			t.Fatalf("Failed to get history page: %v", err)
+		}
+		if contents(page) != "de" || !hasMore {
+			t.Errorf("Expected newest page \"de\" with more, got %q (has_more=%v)", contents(page), hasMore)
+		}
+
+		page, hasMore, _ = store.GetHistoryPage("paged", page[0].ID, 0, 2)
+		if contents(page) != "bc" || !hasMore {
+			t.Errorf("Expected page \"bc\" with more, got %q (has_more=%v)", contents(page), hasMore)
+		}
+
+		page, hasMore, _ = store.GetHistoryPage("paged", page[0].ID, 0, 2)
+		if contents(page) != "a" || hasMore {
+			t.Errorf("Expected last page \"a\" without more, got %q (has_more=%v)", contents(page), hasMore)
+		}
+
+		page, hasMore, _ = store.GetHistoryPage("paged", 0, ids[0], 3)
+		if contents(page) != "bcd" || !hasMore {
+			t.Errorf("Expected forward page \"bcd\" with more, got %q (has_more=%v)", contents(page), hasMore)
+		}
+
+		page, hasMore, _ = store.GetHistoryPage("paged", ids[4], ids[1], 10)
+		if contents(page) != "cd" || hasMore {
+			t.Errorf("Expected bounded page \"cd\", got %q (has_more=%v)", contents(page), hasMore)
+		}
+
+		page, hasMore, _ = store.GetHistoryPage("missing", 0, 0, 10)
+		if len(page) != 0 || hasMore {
+			t.Errorf("Expected empty page for unknown channel, got %v", page)
+		}
+	})
+}
+
+func TestStoreDirectChannels(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		if err := store.CreateChannel("lobby", Persistent); err != nil {
+			t.Fatalf("Failed to create channel: %v", err)
+		}
+		if err := store.CreateDirectChannel("dm-test", []string{"bob", "alice"}); err != nil {
+			t.Fatalf("Failed to create direct channel: %v", err)
+		}
+		// Creating an existing channel is a no-op
+		if err := store.CreateDirectChannel("dm-test", []string{"mallory", "alice"}); err != nil {
+			t.Fatalf("Creating an existing direct channel should not fail: %v", err)
+		}
+
+		if channelType, err := store.GetChannelType("dm-test"); err != nil || channelType != Direct {
+			t.Errorf("Expected direct channel type, got %s (%v)", channelType, err)
+		}
+
+		members, err := store.GetChannelMembers("dm-test")
+		if err != nil {
+			t.Fatalf("Failed to get members: %v", err)
+		}
+		if len(members) != 2 || members[0] != "alice" || members[1] != "bob" {
+			t.Errorf("Expected members [alice bob], got %v", members)
+		}
+		if _, err := store.GetChannelMembers("missing"); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound for unknown channel, got %v", err)
+		}
+
+		channels, _ := store.ListChannels()
+		if len(channels) != 1 || channels[0].Name != "lobby" {
+			t.Errorf("Expected direct channels to be left out of ListChannels, got %v", channels)
+		}
+
+		direct, err := store.ListDirectChannels("bob")
+		if err != nil {
+			t.Fatalf("Failed to list direct channels: %v", err)
+		}
+		if len(direct) != 1 || direct[0].Name != "dm-test" || len(direct[0].Members) != 2 {
+			t.Errorf("Expected bob's direct channel with members, got %v", direct)
+		}
+		if direct, _ := store.ListDirectChannels("mallory"); len(direct) != 0 {
+			t.Errorf("Expected no direct channels for a non-member, got %v", direct)
+		}
+
+		if _, err := store.SaveMessage(Message{Username: "alice", Content: "psst", Channel: "dm-test", Timestamp: time.Now().UTC()}); err != nil {
+			t.Errorf("Failed to save direct message: %v", err)
+		}
+		if results, _ := store.SearchMessages(SearchQuery{Query: "psst", Limit: 10}); len(results) != 0 {
+			t.Errorf("Expected direct messages to be excluded from search, got %v", results)
+		}
+	})
+}
+
+func TestStoreMessageEdits(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		if err := store.CreateChannel("edits", Persistent); err != nil {
+			t.Fatalf("Failed to create channel: %v", err)
+		}
+		id, err := store.SaveMessage(Message{Username: "alice", Content: "helo", Channel: "edits", Timestamp: time.Now().UTC()})
+		if err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+
+		editedAt := time.Now().UTC().Truncate(time.Millisecond)
+		edited, err := store.EditMessage(id, "hello", "alice", editedAt)
+		if err != nil {
+			t.Fatalf("Failed to edit message: %v", err)
+		}
+		if edited.Content != "hello" || edited.EditedAt == nil || edited.Channel != "edits" || edited.Username != "alice" {
+			t.Errorf("Unexpected edited message: %+v", edited)
+		}
+
+		msg, err := store.GetMessage(id)
+		if err != nil || msg.Content != "hello" || msg.EditedAt == nil {
+			t.Errorf("Expected stored message to reflect edit, got %+v (%v)", msg, err)
+		}
+		if results, _ := store.SearchMessages(SearchQuery{Query: "hello", Limit: 10}); len(results) != 1 {
+			t.Errorf("Expected search to match edited content, got %v", results)
+		}
+
+		deleted, err := store.DeleteMessage(id, "mod", time.Now().UTC())
+		if err != nil {
+			t.Fatalf("Failed to delete message: %v", err)
+		}
+		if deleted.Content != "" || deleted.DeletedAt == nil {
+			t.Errorf("Expected deleted message without content, got %+v", deleted)
+		}
+
+		// Deleted messages keep their place in history
+		page, _, _ := store.GetHistoryPage("edits", 0, 0, 10)
+		if len(page) != 1 || page[0].ID != id || page[0].DeletedAt == nil || page[0].Content != "" {
+			t.Errorf("Expected deleted message in history, got %+v", page)
+		}
+		if results, _ := store.SearchMessages(SearchQuery{Query: "hello", Limit: 10}); len(results) != 0 {
+			t.Errorf("Expected deleted message to be excluded from search, got %v", results)
+		}
+
+		if _, err := store.EditMessage(id, "again", "alice", time.Now().UTC()); !errors.Is(err, errMessageNotFound) {
+			t.Errorf("Expected errMessageNotFound editing a deleted message, got %v", err)
+		}
+		if _, err := store.GetMessage(id + 1000); !errors.Is(err, errMessageNotFound) {
+			t.Errorf("Expected errMessageNotFound for unknown message, got %v", err)
+		}
+
+		edits, err := store.GetMessageEdits(id)
+		if err != nil {
+			t.Fatalf("Failed to get edits: %v", err)
+		}
+		if len(edits) != 2 || edits[0].PreviousContent != "helo" || edits[1].PreviousContent != "hello" || edits[1].EditedBy != "mod" {
+			t.Errorf("Unexpected edit history: %+v", edits)
+		}
+	})
+}
+
+func TestStoreThreads(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		if err := store.CreateChannel("threads", Persistent); err != nil {
+			t.Fatalf("Failed to create channel: %v", err)
+		}
+		base := time.Now().UTC().Truncate(time.Second)
+		parentID, err := store.SaveMessage(Message{Username: "alice", Content: "question", Channel: "threads", Timestamp: base})
+		if err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+
+		var replyIDs []int
+		for i := 1; i <= 3; i++ {
+			id, err := store.SaveMessage(Message{Username: "bob", Content: "answer", Channel: "threads", Timestamp: base.Add(time.Duration(i) * time.Second), ParentID: parentID})
+			if err != nil {
+				t.Fatalf("Failed to save reply: %v", err)
+			}
+			replyIDs = append(replyIDs, id)
+		}
+		if _, err := store.DeleteMessage(replyIDs[2], "bob", time.Now().UTC()); err != nil {
+			t.Fatalf("Failed to delete reply: %v", err)
+		}
+
+		// Replies stay out of channel history; the parent carries a summary
+		history, _ := store.GetChannelHistory("threads", 10)
+		if len(history) != 1 || history[0].ID != parentID {
+			t.Fatalf("Expected only the parent in history, got %+v", history)
+		}
+		if history[0].ReplyCount != 2 || history[0].LastReplyAt == nil || !history[0].LastReplyAt.Equal(base.Add(2*time.Second)) {
+			t.Errorf("Expected summary of 2 live replies, got count %d, last %v", history[0].ReplyCount, history[0].LastReplyAt)
+		}
+		page, _, _ := store.GetHistoryPage("threads", 0, 0, 10)
+		if len(page) != 1 || page[0].ReplyCount != 2 {
+			t.Errorf("Expected history page with parent summary, got %+v", page)
+		}
+		if parent, _ := store.GetMessage(parentID); parent.ReplyCount != 2 {
+			t.Errorf("Expected GetMessage to include the summary, got %+v", parent)
+		}
+
+		replies, hasMore, err := store.GetThread(parentID, 0, 2)
+		if err != nil {
+			t.Fatalf("Failed to get thread: %v", err)
+		}
+		if len(replies) != 2 || !hasMore || replies[0].ID != replyIDs[0] || replies[0].Type != "reply" || replies[0].ParentID != parentID {
+			t.Errorf("Unexpected first thread page: %+v (has_more=%v)", replies, hasMore)
+		}
+		replies, hasMore, _ = store.GetThread(parentID, replies[1].ID, 2)
+		if len(replies) != 1 || hasMore || replies[0].DeletedAt == nil {
+			t.Errorf("Expected the deleted reply on the last page, got %+v (has_more=%v)", replies, hasMore)
+		}
+
+		if _, _, err := store.GetThread(parentID+1000, 0, 10); !errors.Is(err, errMessageNotFound) {
+			t.Errorf("Expected errMessageNotFound for unknown parent, got %v", err)
+		}
+
+		// Catching up after an ID includes replies, in ID order
+		since, hasMore, err := store.GetMessagesSince("threads", parentID, 2)
+		if err != nil || len(since) != 2 || !hasMore || since[0].ID != replyIDs[0] || since[0].Type != "reply" || since[1].ID != replyIDs[1] {
+			t.Errorf("Unexpected messages since the parent: %+v (has_more=%v, %v)", since, hasMore, err)
+		}
+		if since, hasMore, _ := store.GetMessagesSince("threads", 0, 10); len(since) != 4 || hasMore || since[0].ReplyCount != 2 {
+			t.Errorf("Expected the parent with its summary and every reply, got %+v (has_more=%v)", since, hasMore)
+		}
+	})
+}
+
+func TestStoreReactions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		if err := store.CreateChannel("reactions", Persistent); err != nil {
+			t.Fatalf("Failed to create channel: %v", err)
+		}
+		id, err := store.SaveMessage(Message{Username: "alice", Content: "ship it?", Channel: "reactions", Timestamp: time.Now().UTC()})
+		if err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+
+		store.AddReaction(id, "bob", "👍")
+		store.AddReaction(id, "carol", "🎉")
+		store.AddReaction(id, "carol", "👍")
+		// Reacting twice with the same emoji counts once
+		reactions, err := store.AddReaction(id, "bob", "👍")
+		if err != nil {
+			t.Fatalf("Failed to add reaction: %v", err)
+		}
+		if len(reactions) != 2 || reactions[0].Emoji != "👍" || reactions[0].Count != 2 || reactions[1].Emoji != "🎉" || reactions[1].Count != 1 {
+			t.Fatalf("Unexpected reactions: %+v", reactions)
+		}
+		if users := reactions[0].Users; users[0] != "bob" || users[1] != "carol" {
+			t.Errorf("Expected users in reaction order, got %v", users)
+		}
+
+		reactions, err = store.RemoveReaction(id, "carol", "🎉")
+		if err != nil {
+			t.Fatalf("Failed to remove reaction: %v", err)
+		}
+		if len(reactions) != 1 || reactions[0].Emoji != "👍" {
+			t.Errorf("Expected only 👍 after removal, got %+v", reactions)
+		}
+		if _, err := store.RemoveReaction(id, "carol", "🎉"); err != nil {
+			t.Errorf("Expected removing a missing reaction to be a no-op, got %v", err)
+		}
+
+		history, _ := store.GetChannelHistory("reactions", 10)
+		if len(history) != 1 || len(history[0].Reactions) != 1 || history[0].Reactions[0].Count != 2 {
+			t.Errorf("Expected reactions in history, got %+v", history)
+		}
+		page, _, _ := store.GetHistoryPage("reactions", 0, 0, 10)
+		if len(page) != 1 || len(page[0].Reactions) != 1 {
+			t.Errorf("Expected reactions in history page, got %+v", page)
+		}
+
+		if _, err := store.AddReaction(id+1000, "bob", "👍"); !errors.Is(err, errMessageNotFound) {
+			t.Errorf("Expected errMessageNotFound for unknown message, got %v", err)
+		}
+	})
+}
+
+func TestStoreReadStates(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.CreateChannel("news", Persistent)
+		store.CreateChannel("lobby", Ephemeral)
+		store.CreateDirectChannel("dm-alice-bob", []string{"alice", "bob"})
+		store.CreateDirectChannel("dm-bob-carol", []string{"bob", "carol"})
+
+		now := time.Now().UTC()
+		save := func(username, content string, parentID int) int {
+			id, err := store.SaveMessage(Message{Username: username, Content: content, Channel: "news", Timestamp: now, ParentID: parentID})
+			if err != nil {
+				t.Fatalf("Failed to save message: %v", err)
+			}
+			return id
+		}
+		first := save("alice", "mine", 0)
+		second := save("bob", "one", 0)
+		save("bob", "two", 0)
+		save("bob", "a reply", second)
+		deleted := save("bob", "oops", 0)
+		if _, err := store.DeleteMessage(deleted, "bob", now); err != nil {
+			t.Fatalf("Failed to delete message: %v", err)
+		}
+
+		states, err := store.GetReadStates("alice")
+		if err != nil {
+			t.Fatalf("Failed to get read states: %v", err)
+		}
+		if len(states) != 2 {
+			t.Errorf("Expected news and alice's direct channel, got %+v", states)
+		}
+		if _, ok := states["dm-alice-bob"]; !ok {
+			t.Errorf("Expected alice's direct channel, got %+v", states)
+		}
+		// Own messages, replies and deleted messages are not unread
+		if state := states["news"]; state.LastReadID != 0 || state.Unread != 2 {
+			t.Errorf("Expected 2 unread in news, got %+v", state)
+		}
+
+		if err := store.MarkRead("alice", "news", second); err != nil {
+			t.Fatalf("Failed to mark read: %v", err)
+		}
+		// The read position never moves back
+		store.MarkRead("alice", "news", first)
+		states, _ = store.GetReadStates("alice")
+		if state := states["news"]; state.LastReadID != second || state.Unread != 1 {
+			t.Errorf("Expected 1 unread after marking read, got %+v", state)
+		}
+		if state, err := store.GetReadState("alice", "news"); err != nil || state != states["news"] {
+			t.Errorf("Expected the channel's read state %+v, got %+v (%v)", states["news"], state, err)
+		}
+		if states, _ := store.GetReadStates("bob"); states["news"].Unread != 1 {
+			t.Errorf("Expected read state to be per user, got %+v", states["news"])
+		}
+
+		if err := store.MarkRead("alice", "missing", 1); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound, got %v", err)
+		}
+		if _, err := store.GetReadState("alice", "missing"); !errors.Is(err, errChannelNotFound) {
+			t.Errorf("Expected errChannelNotFound, got %v", err)
+		}
+	})
+}
+
+func TestStoreClientMessageIDs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.CreateChannel("retries", Persistent)
+		msg := Message{Username: "alice", Content: "once", Channel: "retries", Timestamp: time.Now().UTC(), ClientMsgID: "c-1"}
+
+		id, err := store.SaveMessage(msg)
+		if err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+		if _, err := store.SaveMessage(msg); !errors.Is(err, errDuplicateMessage) {
+			t.Errorf("Expected errDuplicateMessage for a resend, got %v", err)
+		}
+		if original, err := store.GetMessageByClientID("alice", "c-1"); err != nil || original.ID != id || original.ClientMsgID != "c-1" {
+			t.Errorf("Expected message %d by client ID, got %+v (%v)", id, original, err)
+		}
+
+		// Client IDs are scoped to their author, and messages without one
+		// are never deduplicated
+		msg.Username = "bob"
+		if _, err := store.SaveMessage(msg); err != nil {
+			t.Errorf("Expected bob's message with the same client ID to be saved, got %v", err)
+		}
+		msg.ClientMsgID = ""
+		for i := 0; i < 2; i++ {
+			if _, err := store.SaveMessage(msg); err != nil {
+				t.Errorf("Expected messages without a client ID to be saved, got %v", err)
+			}
+		}
+		if _, err := store.GetMessageByClientID("alice", "missing"); !errors.Is(err, errMessageNotFound) {
+			t.Errorf("Expected errMessageNotFound, got %v", err)
+		}
+		if history, _ := store.GetChannelHistory("retries", 10); len(history) != 4 {
+			t.Errorf("Expected 4 stored messages, got %d", len(history))
+		}
+	})
+}
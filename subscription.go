@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// maxSubscriptions caps how many channels one connection receives besides
+// its focused channel.
+const maxSubscriptions = 50
+
+var (
+	errNotSubscribed        = errors.New("not subscribed to this channel")
+	errTooManySubscriptions = fmt.Errorf("cannot subscribe to more than %d channels", maxSubscriptions)
+)
+
+// focusedChannel returns the channel the client is viewing.
+func (c *Client) focusedChannel() string {
+	if c.channel == "" {
+		return "general"
+	}
+	return c.channel
+}
+
+// isSubscribed reports whether the client receives a channel's messages.
+func (c *Client) isSubscribed(channelName string) bool {
+	return channelName == c.focusedChannel() || c.subscriptions[channelName]
+}
+
+// subscribe starts delivering a channel's messages to the client without
+// focusing it, so the client does not show up as present there.
+func (c *Client) subscribe(channelName string) error {
+	return c.subscribeFrom(channelName, nil)
+}
+
+// subscribeFrom subscribes the client to a channel. With a resume position
+// it is sent what it missed there since, followed by a resumed frame,
+// instead of the latest history.
+func (c *Client) subscribeFrom(channelName string, pos *ResumePosition) error {
+	if channelName == "" {
+		return newCommandError(errorInvalidArgument, "channel is required")
+	}
+	if c.wasRemoved(channelName) {
+		// Kicked from its focused channel, a client joins it again instead
+		if channelName == c.focusedChannel() {
+			return errRemovedFromChannel
+		}
+		delete(c.subscriptions, channelName)
+	}
+	if c.subscriptions[channelName] {
+		return nil
+	}
+	if err := c.hub.sanctionError(c.username, channelName, permJoin); err != nil {
+		return err
+	}
+	if !c.hub.canAccessChannel(c.username, channelName) {
+		log.Printf("Client %s may not subscribe to channel '%s'", c.username, channelName)
+		return errChannelForbidden
+	}
+	if len(c.subscriptions) >= maxSubscriptions {
+		return errTooManySubscriptions
+	}
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string]bool)
+	}
+	c.subscriptions[channelName] = true
+	if channelName == c.focusedChannel() {
+		// Already received; switching away will now keep it
+		return nil
+	}
+
+	channelCreated := false
+	c.hub.channelsMu.Lock()
+	if _, ok := c.hub.channels[channelName]; !ok {
+		// Get channel type from database, default to ephemeral if not found
+		channelType, err := c.hub.getChannelType(channelName)
+		if err != nil {
+			channelType = Ephemeral
+		}
+
+		c.hub.channels[channelName] = newChannel(channelName, channelType)
+		go c.hub.channels[channelName].run(c.hub.shutdown)
+		channelCreated = true
+	}
+	channel := c.hub.channels[channelName]
+	c.hub.channelsMu.Unlock()
+
+	var resumed Resumed
+	var clientCount int
+	if pos != nil {
+		resumed, clientCount = c.hub.resumeChannel(c, channel, pos, false)
+	} else {
+		channel.clientsMu.Lock()
+		channel.clients[c] = true
+		clientCount = len(channel.clients)
+		channel.clientsMu.Unlock()
+	}
+	c.rejoined(channelName)
+	c.hub.publishPresence(channelName, clientCount)
+	log.Printf("Client %s subscribed to channel '%s'", c.username, channelName)
+
+	if channelCreated && c.hub.remoteMemberCount(channelName) == 0 && channel.channelType != Direct {
+		c.hub.announceChannelCreated(channelName, channel.channelType)
+	}
+
+	// Catch the client up on the channel it now receives
+	if pos != nil {
+		c.sendFrame(resumed)
+	} else if channel.channelType.isStored() {
+		if err := c.sendHistoryPage(HistoryRequest{Channel: channelName}); err != nil {
+			log.Printf("Error sending history for subscription to '%s': %v", channelName, err)
+		}
+	}
+	c.sendChannelMembers(channelName)
+	c.sendChannelTopic(channelName)
+	return nil
+}
+
+// unsubscribe stops delivering a channel the client subscribed to. The
+// focused channel is still received until the client switches away.
+func (c *Client) unsubscribe(channelName string) error {
+	if !c.subscriptions[channelName] {
+		return errNotSubscribed
+	}
+	delete(c.subscriptions, channelName)
+	if channelName != c.focusedChannel() {
+		c.hub.leaveSubscription(c, channelName)
+		log.Printf("Client %s unsubscribed from channel '%s'", c.username, channelName)
+	}
+	return nil
+}
+
+// unfocus marks the client as no longer viewing a channel it still
+// receives.
+func (c *Client) unfocus(channel *Channel) {
+	channel.clientsMu.Lock()
+	delete(channel.focused, c)
+	clientCount := len(channel.clients)
+	channel.clientsMu.Unlock()
+	c.hub.publishPresence(channel.name, clientCount)
+	if !channel.hasUser(c.username) {
+		c.hub.announcePresence(channel.name, c.username, presenceLeave)
+	}
+}
+
+// leaveSubscription removes a client from a channel it received without
+// focusing it.
+func (h *Hub) leaveSubscription(client *Client, channelName string) {
+	h.channelsMu.RLock()
+	channel, ok := h.channels[channelName]
+	h.channelsMu.RUnlock()
+	if !ok {
+		return
+	}
+
+	channel.clientsMu.Lock()
+	delete(channel.clients, client)
+	clientCount := len(channel.clients)
+	channel.clientsMu.Unlock()
+	h.publishPresence(channelName, clientCount)
+
+	if clientCount == 0 && channelName != "general" {
+		h.closeChannel(channel, client)
+	}
+}
+
+// closeChannel drops a channel whose last local client has left. Ephemeral
+// channels are announced as deleted to everyone but except, unless they
+// still have members on other nodes; persistent ones stay in the store.
+func (h *Hub) closeChannel(channel *Channel, except *Client) {
+	h.channelsMu.Lock()
+	delete(h.channels, channel.name)
+	h.channelsMu.Unlock()
+
+	if channel.channelType != Ephemeral {
+		log.Printf("Persistent channel '%s' removed from memory (no clients, but preserved in database)", channel.name)
+		return
+	}
+	log.Printf("Ephemeral channel '%s' removed (no clients)", channel.name)
+
+	channelDeletedMsg := Message{
+		Username: "System",
+		Content:  channel.name,
+		Type:     "channel_deleted",
+		Channel:  channel.name,
+	}
+
+	if h.remoteMemberCount(channel.name) > 0 {
+		return
+	}
+	if msgBytes, err := json.Marshal(channelDeletedMsg); err == nil {
+		h.deliverToAll(msgBytes, except)
+		h.publish(ClusterEvent{Kind: eventHubBroadcast, Payload: msgBytes})
+	}
+	h.emitWebhookEvent(eventChannelDeleted, channel.name, ChannelInfo{Name: channel.name, Type: Ephemeral})
+}
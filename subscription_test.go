@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func isAck(requestID string) func(map[string]interface{}) bool {
+	return func(msg map[string]interface{}) bool {
+		return (msg["type"] == "ack" || msg["type"] == "error") && msg["request_id"] == requestID
+	}
+}
+
+func TestSubscribeToSeveralChannels(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	sendJSON(t, alice, map[string]interface{}{"type": "subscribe", "channel": "side", "request_id": "s1"})
+	if ack := readUntil(t, alice, isAck("s1")); ack["type"] != "ack" {
+		t.Fatalf("Expected subscribe to be acknowledged, got %v", ack)
+	}
+
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "side"})
+	members := readUntil(t, bob, func(msg map[string]interface{}) bool {
+		return msg["type"] == "channel_members" && msg["channel"] == "side"
+	})
+	// Subscribers receive the channel but are not present in it
+	if list, _ := members["members"].([]interface{}); len(list) != 1 {
+		t.Errorf("Expected only bob in side's members, got %v", members["members"])
+	}
+
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "from side"})
+	msg := readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	if msg["channel"] != "side" || msg["content"] != "from side" {
+		t.Errorf("Expected bob's message tagged with side, got %v", msg)
+	}
+
+	// Alice posts to the subscribed channel without switching to it
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "hi bob", "channel": "side", "request_id": "m1"})
+	if ack := readUntil(t, alice, isAck("m1")); ack["type"] != "ack" {
+		t.Fatalf("Expected message to a subscribed channel to be acknowledged, got %v", ack)
+	}
+	msg = readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" && msg["username"] == "alice" })
+	if msg["channel"] != "side" {
+		t.Errorf("Expected alice's message in side, got %v", msg)
+	}
+
+	sendJSON(t, alice, map[string]interface{}{"type": "message", "content": "nope", "channel": "elsewhere", "request_id": "m2"})
+	if reply := readUntil(t, alice, isAck("m2")); reply["code"] != errorInvalidArgument {
+		t.Errorf("Expected invalid_argument for an unsubscribed channel, got %v", reply)
+	}
+
+	sendJSON(t, alice, map[string]interface{}{"type": "unsubscribe", "channel": "side", "request_id": "u1"})
+	if ack := readUntil(t, alice, isAck("u1")); ack["type"] != "ack" {
+		t.Fatalf("Expected unsubscribe to be acknowledged, got %v", ack)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "unsubscribe", "channel": "side", "request_id": "u2"})
+	if reply := readUntil(t, alice, isAck("u2")); reply["code"] != errorInvalidArgument {
+		t.Errorf("Expected invalid_argument when not subscribed, got %v", reply)
+	}
+
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "anyone?"})
+	expectNone(t, alice, 200*time.Millisecond, func(msg map[string]interface{}) bool {
+		return msg["type"] == "message" && msg["channel"] == "side"
+	})
+}
+
+func TestSubscriptionsSurviveSwitching(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+
+	// Subscribing to the focused channel keeps it after switching away
+	sendJSON(t, alice, map[string]interface{}{"type": "subscribe", "channel": "general", "request_id": "s1"})
+	readUntil(t, alice, isAck("s1"))
+	sendJSON(t, alice, map[string]interface{}{"type": "join_channel", "channel": "focus", "request_id": "j1"})
+	readUntil(t, alice, isAck("j1"))
+
+	hub.channelsMu.RLock()
+	general := hub.channels["general"]
+	hub.channelsMu.RUnlock()
+	waitFor(t, "alice to leave general's presence", func() bool { return !general.hasUser("alice") })
+
+	sendJSON(t, bob, map[string]interface{}{"type": "message", "content": "still there?"})
+	msg := readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	if msg["channel"] != "general" {
+		t.Errorf("Expected general's message after switching away, got %v", msg)
+	}
+
+	// A hub-wide broadcast reaches a client in several channels once
+	hub.broadcastToAll([]byte(`{"type":"announcement"}`))
+	readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "announcement" })
+	expectNone(t, alice, 200*time.Millisecond, func(msg map[string]interface{}) bool { return msg["type"] == "announcement" })
+}
+
+func TestDisconnectLeavesSubscriptions(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	sendJSON(t, alice, map[string]interface{}{"type": "subscribe", "channel": "scratch", "request_id": "s1"})
+	readUntil(t, alice, isAck("s1"))
+	readUntil(t, bob, func(msg map[string]interface{}) bool {
+		return msg["type"] == "channel_created" && msg["name"] == "scratch"
+	})
+
+	alice.Close()
+	readUntil(t, bob, func(msg map[string]interface{}) bool {
+		return msg["type"] == "channel_deleted" && msg["channel"] == "scratch"
+	})
+	hub.channelsMu.RLock()
+	_, ok := hub.channels["scratch"]
+	hub.channelsMu.RUnlock()
+	if ok {
+		t.Error("Expected the subscribed ephemeral channel to be removed on disconnect")
+	}
+	waitFor(t, "alice to go offline", func() bool { return hub.presenceOf("alice").Status == "offline" })
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+var errReplyToDeleted = errors.New("cannot reply to a deleted message")
+
+// postReply stores a reply to parentID from username and broadcasts it to
+// the parent's channel. Replies to replies join the parent's thread, so
+// threads are one level deep.
+func (h *Hub) postReply(username string, parentID int, content string) (Message, error) {
+	if strings.TrimSpace(content) == "" {
+		return Message{}, errEmptyMessage
+	}
+	parent, err := h.store.GetMessage(parentID)
+	if err != nil {
+		return Message{}, err
+	}
+	if !h.canAccessChannel(username, parent.Channel) {
+		return Message{}, errMessageNotFound
+	}
+	if parent.ParentID != 0 {
+		if parent, err = h.store.GetMessage(parent.ParentID); err != nil {
+			return Message{}, err
+		}
+	}
+	if parent.DeletedAt != nil {
+		return Message{}, errReplyToDeleted
+	}
+	if err := h.checkPost(Message{Username: username, Channel: parent.Channel}); err != nil {
+		return Message{}, err
+	}
+
+	reply := Message{
+		Username:  username,
+		Content:   content,
+		Type:      "reply",
+		Channel:   parent.Channel,
+		Timestamp: time.Now().UTC(),
+		ParentID:  parent.ID,
+	}
+	if reply.ID, err = h.saveMessage(reply); err != nil {
+		return Message{}, err
+	}
+
+	if msgBytes, err := json.Marshal(reply); err == nil {
+		h.broadcastToChannelName(reply.Channel, msgBytes)
+	}
+	return reply, nil
+}
+
+// getThread returns a message and a page of its replies, paged like history.
+func (h *Hub) getThread(username string, req ThreadRequest) (Thread, error) {
+	parent, err := h.store.GetMessage(req.ParentID)
+	if err != nil {
+		return Thread{}, err
+	}
+	if !h.canAccessChannel(username, parent.Channel) {
+		return Thread{}, errMessageNotFound
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultHistoryPageSize
+	}
+	if limit > maxHistoryPageSize {
+		limit = maxHistoryPageSize
+	}
+
+	replies, hasMore, err := h.store.GetThread(parent.ID, req.AfterID, limit)
+	if err != nil {
+		return Thread{}, err
+	}
+	if replies == nil {
+		replies = []Message{}
+	}
+	return Thread{Type: "thread", Parent: parent, Messages: replies, HasMore: hasMore}, nil
+}
+
+func (c *Client) sendThread(req ThreadRequest) error {
+	thread, err := c.hub.getThread(c.username, req)
+	if err != nil {
+		log.Printf("Error loading thread %d for %s: %v", req.ParentID, c.username, err)
+		return err
+	}
+
+	if msgBytes, err := json.Marshal(thread); err == nil {
+		select {
+		case c.send <- msgBytes:
+		default:
+			log.Printf("Dropping thread for %s: send buffer full", c.username)
+		}
+	}
+	return nil
+}
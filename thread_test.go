@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPostReply(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+
+	if err := store.CreateChannel("help", Persistent); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+	parentID, _ := hub.saveMessage(Message{Username: "alice", Content: "how?", Type: "message", Channel: "help", Timestamp: time.Now().UTC()})
+
+	reply, err := hub.postReply("bob", parentID, "like this")
+	if err != nil {
+		t.Fatalf("Failed to reply: %v", err)
+	}
+	if reply.ID == 0 || reply.ParentID != parentID || reply.Channel != "help" || reply.Type != "reply" {
+		t.Errorf("Unexpected reply: %+v", reply)
+	}
+
+	// Replying to a reply continues the same thread
+	nested, err := hub.postReply("alice", reply.ID, "thanks")
+	if err != nil || nested.ParentID != parentID {
+		t.Errorf("Expected nested reply to join thread %d, got %+v (%v)", parentID, nested, err)
+	}
+
+	if _, err := hub.postReply("bob", parentID, " "); !errors.Is(err, errEmptyMessage) {
+		t.Errorf("Expected errEmptyMessage, got %v", err)
+	}
+	if _, err := hub.postReply("bob", parentID+1000, "hello?"); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("Expected errMessageNotFound, got %v", err)
+	}
+	if err := hub.deleteMessage("alice", parentID); err != nil {
+		t.Fatalf("Failed to delete parent: %v", err)
+	}
+	if _, err := hub.postReply("bob", parentID, "too late"); !errors.Is(err, errReplyToDeleted) {
+		t.Errorf("Expected errReplyToDeleted, got %v", err)
+	}
+}
+
+func TestThreadOverWebSocket(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	if err := store.CreateChannel("help", Persistent); err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	sendJSON(t, alice, Message{Type: "join_channel", Channel: "help"})
+	readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "channel_switch" })
+
+	sendJSON(t, alice, Message{Type: "message", Content: "anyone?"})
+	parent := readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	parentID := int(parent["id"].(float64))
+
+	sendJSON(t, alice, Message{Type: "reply", ParentID: parentID, Content: "me"})
+	reply := readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "reply" })
+	if int(reply["parent_id"].(float64)) != parentID || reply["username"] != "alice" {
+		t.Errorf("Unexpected reply frame: %v", reply)
+	}
+
+	sendJSON(t, alice, ThreadRequest{Type: "thread_request", ParentID: parentID})
+	thread := readUntil(t, alice, func(msg map[string]interface{}) bool { return msg["type"] == "thread" })
+	if messages := thread["messages"].([]interface{}); len(messages) != 1 || thread["has_more"] != false {
+		t.Errorf("Expected one reply in thread, got %v", thread)
+	}
+	if summary := thread["parent"].(map[string]interface{}); summary["reply_count"] != float64(1) {
+		t.Errorf("Expected parent summary with one reply, got %v", summary)
+	}
+}
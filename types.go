@@ -1,7 +1,7 @@
 package main
 
 import (
-	"database/sql"
+	"encoding/json"
 	"net/http"
 	"sync"
 	"time"
@@ -21,8 +21,58 @@ type Hub struct {
 	register   chan *Client
 	unregister chan *Client
 	broadcast  chan []byte
-	db         *sql.DB
+	store      Store
+	auth       *authenticator
+	moderators map[string]bool // server-wide moderators from MODERATORS
 	shutdown   chan bool
+
+	// User presence by username, covering local connections and statuses
+	// reported by other nodes.
+	presenceMu sync.Mutex
+	presence   map[string]*userPresence
+
+	// Flood protection; userBuckets are keyed by username and family, or
+	// by incoming webhook.
+	rateLimits  rateLimits
+	rateMu      sync.Mutex
+	userBuckets map[string]*tokenBucket
+
+	// When users last posted in channels in slow mode.
+	slowModeMu sync.Mutex
+	lastPosts  map[slowModeKey]time.Time
+
+	// Cluster state, set up by useBroker. remoteMembers maps channel name to
+	// node ID to that node's member count, and remoteUsers to its usernames.
+	nodeID        string
+	broker        Broker
+	remoteMu      sync.RWMutex
+	remoteMembers map[string]map[string]int
+	remoteUsers   map[string]map[string][]string
+	remoteSeen    map[string]time.Time
+	clusterDone   chan struct{}
+	clusterOnce   sync.Once
+
+	// Outgoing webhook delivery. Queuing a delivery pokes webhookWake so
+	// the dispatcher started by startWebhookDelivery sends it right away.
+	webhookRetry  webhookRetryPolicy
+	webhookClient *http.Client
+	webhookWake   chan struct{}
+	webhookDone   chan struct{}
+	webhookOnce   sync.Once
+
+	// Outgoing webhooks as last loaded, so events do not query the store
+	// for them. Creating or deleting one, here or on another node, bumps
+	// webhooksGen, which drops the cached list.
+	webhooksMu       sync.Mutex
+	webhooksCache    []OutgoingWebhook
+	webhooksLoadedAt time.Time
+	webhooksGen      int
+
+	// Slash commands by name, including those of bots, and the bots by
+	// username.
+	commandsMu sync.RWMutex
+	commands   map[string]Command
+	bots       map[string]*Bot
 }
 
 type ChannelType string
@@ -30,38 +80,572 @@ type ChannelType string
 const (
 	Ephemeral  ChannelType = "ephemeral"
 	Persistent ChannelType = "persistent"
+	// Direct channels are stored conversations with a fixed member list.
+	Direct ChannelType = "direct"
 )
 
+// isStored reports whether messages in channels of this type are saved.
+func (t ChannelType) isStored() bool {
+	return t == Persistent || t == Direct
+}
+
 type Channel struct {
 	name        string
 	channelType ChannelType
-	clients     map[*Client]bool
+	clients     map[*Client]bool // every client receiving the channel
+	focused     map[*Client]bool // clients whose focused channel this is
 	clientsMu   sync.RWMutex
 	broadcast   chan []byte
 	shutdown    chan bool
+
+	// Recent broadcasts for reconnecting clients, guarded by clientsMu.
+	// Events are numbered by seq within the channel's epoch.
+	epoch  string
+	seq    int
+	events []channelEvent
+
+	// The topic and slow mode interval of an ephemeral channel, guarded by
+	// clientsMu. Stored channels keep theirs in the store.
+	topic    string
+	slowMode time.Duration
 }
 
 type Client struct {
 	hub       *Hub
 	conn      *websocket.Conn
 	send      chan []byte
-	channel   string
+	closeOnce sync.Once
+	channel   string // the focused channel, where presence and typing apply
 	username  string
 	hasJoined bool
+
+	// subscriptions are the channels joined with subscribe, which the
+	// client receives besides its focused channel. Only readPump changes
+	// them; the hub reads them once readPump has finished.
+	subscriptions map[string]bool
+
+	// Channels moderators kicked the client from, until it joins them
+	// again. Moderators' goroutines set them, so they are guarded.
+	removedMu sync.Mutex
+	removed   map[string]bool
+
+	// Typing indicator state. typingChannel is where the client is shown
+	// typing, if anywhere; typingSeq invalidates superseded expiry timers.
+	typingMu      sync.Mutex
+	typingChannel string
+	typingTimer   *time.Timer
+	typingSeq     int
+	lastTypingAt  time.Time
+
+	buckets *connectionBuckets // rate limits, made on first use
+	resume  *ResumePosition    // set when reconnecting, until registered
+
+	// Subscriptions of a reconnecting client, resumed once reading starts
+	resumeSubscriptions []*ResumePosition
 }
 
 type Message struct {
-	ID        int       `json:"id,omitempty"`
-	Username  string    `json:"username"`
-	Content   string    `json:"content"`
-	Type      string    `json:"type"`
+	ID        int        `json:"id,omitempty"`
+	Username  string     `json:"username"`
+	Content   string     `json:"content"`
+	Type      string     `json:"type"`
+	Channel   string     `json:"channel"`
+	Timestamp time.Time  `json:"timestamp,omitempty"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // deleted messages keep their place with empty content
+
+	// ParentID is set on replies. Top-level messages loaded from the store
+	// carry a summary of their thread.
+	ParentID    int        `json:"parent_id,omitempty"`
+	ReplyCount  int        `json:"reply_count,omitempty"`
+	LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+	Reactions   []Reaction `json:"reactions,omitempty"`
+
+	// ClientMsgID is chosen by the sending client so that a message resent
+	// after a reconnect is stored only once per user.
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+
+	// DisplayName and Attachments are only set on messages posted through
+	// incoming webhooks, whose Username names the webhook.
+	DisplayName string       `json:"display_name,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Attachment is a block of rich content posted by an integration.
+type Attachment struct {
+	Title     string `json:"title,omitempty"`
+	TitleLink string `json:"title_link,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Color     string `json:"color,omitempty"`
+	ImageURL  string `json:"image_url,omitempty"`
+}
+
+// IncomingWebhook lets an integration post into a channel. Only a hash of
+// its token is stored; Token is set once, in the reply to its creation.
+type IncomingWebhook struct {
+	ID        int       `json:"id"`
 	Channel   string    `json:"channel"`
-	Timestamp time.Time `json:"timestamp,omitempty"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	Token     string    `json:"token,omitempty"`
+	TokenHash string    `json:"-"`
+}
+
+// WebhookPayload is the body posted to an incoming webhook. Username
+// overrides the display name, which defaults to the webhook's name.
+type WebhookPayload struct {
+	Text        string       `json:"text"`
+	Username    string       `json:"username,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// OutgoingWebhook posts server events to an external URL. Events lists the
+// event names it receives; Channel, if set, limits it to one channel's
+// events. Secret signs every payload and is only sent in the reply to its
+// creation.
+type OutgoingWebhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Channel   string    `json:"channel,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	Secret    string    `json:"secret,omitempty"`
+}
+
+// WebhookEvent is the body posted to an outgoing webhook.
+type WebhookEvent struct {
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Channel   string      `json:"channel,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookDelivery is one event queued for an outgoing webhook, and the log
+// of its attempts. Pending deliveries are retried at NextAttemptAt until
+// they are delivered or fail for good.
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	WebhookID      int             `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// Presence is a user's status as seen by others. LastSeen is when the user
+// last connected, disconnected or changed status.
+type Presence struct {
+	Username string     `json:"username"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	Nick     string     `json:"nick,omitempty"`
+	Bot      bool       `json:"bot,omitempty"`
+	Role     string     `json:"role,omitempty"` // in channel_members of persistent channels
+}
+
+// PresenceUpdate announces that a user joined or left a channel, or changed
+// status while in it.
+type PresenceUpdate struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+	Action  string `json:"action"`
+	Presence
+}
+
+// commandEnvelope holds the fields common to every client command.
+// RequestID is chosen by the client and echoed in the command's ack or
+// error frame.
+type commandEnvelope struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Ack confirms that a command succeeded. Acks for messages carry the
+// stored ID, the server timestamp and the message's client_msg_id;
+// Duplicate reports a resent message that had already been stored.
+type Ack struct {
+	Type        string     `json:"type"`
+	RequestID   string     `json:"request_id,omitempty"`
+	Command     string     `json:"command"`
+	ID          int        `json:"id,omitempty"`
+	Timestamp   *time.Time `json:"timestamp,omitempty"`
+	ClientMsgID string     `json:"client_msg_id,omitempty"`
+	Duplicate   bool       `json:"duplicate,omitempty"`
+}
+
+// ErrorFrame tells a client why a command was rejected.
+type ErrorFrame struct {
+	Type         string `json:"type"`
+	RequestID    string `json:"request_id,omitempty"`
+	Command      string `json:"command,omitempty"`
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	RetryAfterMS int64  `json:"retry_after_ms,omitempty"`
+}
+
+// TypingEvent tells a channel's other members whether a user is typing.
+type TypingEvent struct {
+	Type     string `json:"type"`
+	Channel  string `json:"channel"`
+	Username string `json:"username"`
+	Typing   bool   `json:"typing"`
+}
+
+// ChannelMembers lists the users in a channel with their presence.
+type ChannelMembers struct {
+	Type    string     `json:"type"`
+	Channel string     `json:"channel"`
+	Members []Presence `json:"members"`
+	EventID string     `json:"event_id,omitempty"` // the channel's latest event
+}
+
+// ChannelTopic tells members a channel's topic. Username is who set it,
+// absent when a client is told the topic on joining.
+type ChannelTopic struct {
+	Type     string `json:"type"`
+	Channel  string `json:"channel"`
+	Topic    string `json:"topic"`
+	Username string `json:"username,omitempty"`
+}
+
+// ChannelMemberCount answers the HTTP API's member query: Count users are
+// present in the channel, over Connections WebSocket connections.
+type ChannelMemberCount struct {
+	Channel     string     `json:"channel"`
+	Count       int        `json:"count"`
+	Connections int        `json:"connections"`
+	Members     []Presence `json:"members"`
+}
+
+// ResumePosition is where a reconnecting client left off in a channel: the
+// last event it received and the newest stored message it has.
+type ResumePosition struct {
+	Channel       string
+	LastEventID   string
+	LastMessageID int
+}
+
+// Resumed follows the events replayed to a reconnecting client. Gap means
+// some missed events could not be replayed; HasMore means more stored
+// messages follow the replayed ones.
+type Resumed struct {
+	Type     string `json:"type"`
+	Channel  string `json:"channel"`
+	EventID  string `json:"event_id"`
+	Replayed int    `json:"replayed"`
+	Gap      bool   `json:"gap,omitempty"`
+	HasMore  bool   `json:"has_more,omitempty"`
+}
+
+// StatusRequest sets the sender's status to online or away.
+type StatusRequest struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// Reaction aggregates the users who reacted to a message with one emoji.
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+// ReactionRequest adds or removes the sender's reaction to a message.
+type ReactionRequest struct {
+	Type      string `json:"type"`
+	MessageID int    `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionUpdate announces the current reactions on a message.
+type ReactionUpdate struct {
+	Type      string     `json:"type"`
+	MessageID int        `json:"message_id"`
+	Channel   string     `json:"channel"`
+	Reactions []Reaction `json:"reactions"`
 }
 
+// MessageEdit records the content a message had before an edit or deletion.
+type MessageEdit struct {
+	MessageID       int       `json:"message_id"`
+	PreviousContent string    `json:"previous_content"`
+	EditedBy        string    `json:"edited_by"`
+	EditedAt        time.Time `json:"edited_at"`
+}
+
+// EditMessageRequest replaces the content of a stored message.
+type EditMessageRequest struct {
+	Type    string `json:"type"`
+	ID      int    `json:"id"`
+	Content string `json:"content"`
+}
+
+// DeleteMessageRequest deletes a stored message.
+type DeleteMessageRequest struct {
+	Type string `json:"type"`
+	ID   int    `json:"id"`
+}
+
+type ChannelInfo struct {
+	Name     string      `json:"name"`
+	Type     ChannelType `json:"type"`
+	Topic    string      `json:"topic,omitempty"`
+	Owner    string      `json:"owner,omitempty"`     // persistent channels only
+	Private  bool        `json:"private,omitempty"`   // persistent channels only
+	SlowMode int         `json:"slow_mode,omitempty"` // seconds between a user's messages
+	Members  []string    `json:"members,omitempty"`   // direct channels only
+
+	// The recipient's read position, for stored channels in active_channels
+	LastReadID int `json:"last_read_id,omitempty"`
+	Unread     int `json:"unread,omitempty"`
+}
+
+// ChannelRole is a user's role in a persistent channel.
+type ChannelRole struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// RoleRequest grants a role (grant_role) or takes one away (revoke_role)
+// in a channel, the focused one if Channel is empty.
+type RoleRequest struct {
+	Channel  string `json:"channel"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// RoleUpdate tells a channel that By changed a user's role. Role is empty
+// when it was revoked.
+type RoleUpdate struct {
+	Type     string `json:"type"`
+	Channel  string `json:"channel"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	By       string `json:"by"`
+}
+
+// ReadState is a user's read position in a stored channel: the last message
+// they have read and how many top-level messages from others follow it.
+type ReadState struct {
+	LastReadID int `json:"last_read_id"`
+	Unread     int `json:"unread"`
+}
+
+// MarkReadRequest marks a channel read up to MessageID, or up to its newest
+// message when MessageID is zero. Channel defaults to the current channel.
+type MarkReadRequest struct {
+	Type      string `json:"type"`
+	Channel   string `json:"channel,omitempty"`
+	MessageID int    `json:"message_id,omitempty"`
+}
+
+// ReadStateUpdate tells a user's connections their new read position in a
+// channel.
+type ReadStateUpdate struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+	ReadState
+}
+
+// ChannelCreateRequest creates a channel. Private channels must be
+// persistent; only their members see and join them.
 type ChannelCreateRequest struct {
 	Name        string      `json:"name"`
 	ChannelType ChannelType `json:"channel_type"`
+	Private     bool        `json:"private,omitempty"`
+}
+
+// InviteRequest invites a user into a channel, the focused one if Channel
+// is empty. Without a Username it creates an invite link instead, valid
+// for ExpiresIn seconds and MaxUses joins (zero for the defaults).
+type InviteRequest struct {
+	Channel   string `json:"channel"`
+	Username  string `json:"username,omitempty"`
+	ExpiresIn int    `json:"expires_in,omitempty"`
+	MaxUses   int    `json:"max_uses,omitempty"`
+}
+
+// InviteCreated gives the client that asked for it a new invite link.
+type InviteCreated struct {
+	Type string `json:"type"`
+	ChannelInvite
+}
+
+// JoinInviteRequest joins the channel of an invite link.
+type JoinInviteRequest struct {
+	Type string `json:"type"`
+	Code string `json:"code"`
+}
+
+// ChannelInvite is an invite link: whoever holds its code may join the
+// channel as a member until it expires or has been used MaxUses times.
+// Only the code's hash is stored; Code is set when the invite is created.
+type ChannelInvite struct {
+	ID        int       `json:"id"`
+	Channel   string    `json:"channel"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses,omitempty"`
+	Uses      int       `json:"uses"`
+	Code      string    `json:"code,omitempty"`
+	CodeHash  string    `json:"-"`
+}
+
+// ModerationRequest kicks, mutes, bans, unmutes or unbans a user in a
+// channel, the focused one if Channel is empty, or everywhere if Server is
+// set. Duration is how many seconds a mute or ban lasts.
+type ModerationRequest struct {
+	Type     string `json:"type"`
+	Channel  string `json:"channel"`
+	Username string `json:"username"`
+	Duration int    `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Server   bool   `json:"server,omitempty"`
+}
+
+// SlowModeRequest sets how many seconds users must wait between messages
+// in a channel, the focused one if Channel is empty; zero turns slow mode
+// off.
+type SlowModeRequest struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+	Seconds int    `json:"seconds"`
+}
+
+// ModerationNotice tells a channel's members, or the user concerned for
+// server-wide actions, that By moderated a user or set slow mode. Until is
+// when a mute or ban ends; Seconds is the new slow mode interval, absent
+// when it was turned off.
+type ModerationNotice struct {
+	Type     string     `json:"type"`
+	Action   string     `json:"action"`
+	Channel  string     `json:"channel,omitempty"`
+	Username string     `json:"username,omitempty"`
+	By       string     `json:"by"`
+	Reason   string     `json:"reason,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+	Seconds  int        `json:"seconds,omitempty"`
+}
+
+// Sanction mutes or bans a user in a channel, or everywhere when Channel is
+// empty, until ExpiresAt.
+type Sanction struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Channel   string    `json:"channel,omitempty"`
+	Username  string    `json:"username"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AuditEntry records a moderation action: who did what to whom, in which
+// channel (empty for server-wide actions), and why. Details holds a mute
+// or ban's duration or a slow mode interval.
+type AuditEntry struct {
+	ID        int       `json:"id"`
+	Action    string    `json:"action"`
+	Channel   string    `json:"channel,omitempty"`
+	Actor     string    `json:"actor"`
+	Target    string    `json:"target,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Details   string    `json:"details,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DirectMessageRequest opens a direct conversation between the sender and
+// the named users.
+type DirectMessageRequest struct {
+	Type      string   `json:"type"`
+	Usernames []string `json:"usernames"`
+}
+
+// SubscriptionRequest subscribes to or unsubscribes from a channel besides
+// the focused one.
+type SubscriptionRequest struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+}
+
+// HistoryRequest asks for a page of a channel's history. BeforeID pages
+// backwards from a message, AfterID pages forwards; with neither set the
+// newest messages are returned.
+type HistoryRequest struct {
+	Type     string `json:"type"`
+	Channel  string `json:"channel"`
+	BeforeID int    `json:"before_id,omitempty"`
+	AfterID  int    `json:"after_id,omitempty"`
+	Limit    int    `json:"limit,omitempty"`
+}
+
+// HistoryPage answers a HistoryRequest. Messages are oldest first and
+// HasMore reports whether further messages exist in the requested direction.
+type HistoryPage struct {
+	Type     string    `json:"type"`
+	Channel  string    `json:"channel"`
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"has_more"`
+}
+
+// ThreadRequest asks for the replies to a message, oldest first, optionally
+// after a reply ID.
+type ThreadRequest struct {
+	Type     string `json:"type"`
+	ParentID int    `json:"parent_id"`
+	AfterID  int    `json:"after_id,omitempty"`
+	Limit    int    `json:"limit,omitempty"`
+}
+
+// Thread answers a ThreadRequest with the parent message and a page of its
+// replies.
+type Thread struct {
+	Type     string    `json:"type"`
+	Parent   Message   `json:"parent"`
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"has_more"`
+}
+
+// SearchQuery selects messages in persistent channels matching Query, with
+// optional channel, username and timestamp filters. Zero values are ignored.
+type SearchQuery struct {
+	Query    string    `json:"query"`
+	Channel  string    `json:"channel,omitempty"`
+	Username string    `json:"username,omitempty"`
+	From     time.Time `json:"from,omitempty"`
+	To       time.Time `json:"to,omitempty"`
+	Limit    int       `json:"limit,omitempty"`
+
+	// Member limits private channels to those the user has a role in;
+	// when empty, every private channel is searched.
+	Member string `json:"-"`
+}
+
+// SearchResult is a matching message. Snippet is an excerpt of the content
+// with matched terms wrapped in <mark></mark>; ID can be used as a history
+// cursor to show the message in context.
+type SearchResult struct {
+	ID        int       `json:"id"`
+	Channel   string    `json:"channel"`
+	Username  string    `json:"username"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+	Snippet   string    `json:"snippet"`
+	Rank      float64   `json:"rank"`
+}
+
+type SearchResults struct {
+	Type    string         `json:"type"`
+	Query   string         `json:"query"`
+	Results []SearchResult `json:"results"`
 }
 
 type DatabaseConfig struct {
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// A typing indicator expires after typingTimeout without a new typing_start,
+// so clients should repeat typing_start while the user keeps typing. A
+// client's typing_start is relayed at most once per typingThrottle.
+var (
+	typingTimeout  = 6 * time.Second
+	typingThrottle = 2 * time.Second
+)
+
+// startTyping handles typing_start: it shows the client typing in its
+// current channel, or extends the indicator if it is already shown.
+func (c *Client) startTyping() {
+	channelName := c.channel
+	if channelName == "" {
+		channelName = "general"
+	}
+
+	c.typingMu.Lock()
+	defer c.typingMu.Unlock()
+
+	if c.typingChannel == channelName {
+		c.armTypingTimer()
+		return
+	}
+	// Ignore starts that would toggle the indicator faster than the throttle
+	if time.Since(c.lastTypingAt) < typingThrottle {
+		return
+	}
+	if c.typingChannel != "" {
+		c.relayTyping(c.typingChannel, false)
+	}
+
+	c.typingChannel = channelName
+	c.lastTypingAt = time.Now()
+	c.armTypingTimer()
+	c.relayTyping(channelName, true)
+}
+
+// stopTyping handles typing_stop and clears the indicator when the client
+// sends a message, changes channel or disconnects.
+func (c *Client) stopTyping() {
+	c.typingMu.Lock()
+	defer c.typingMu.Unlock()
+	c.clearTyping()
+}
+
+// armTypingTimer (re)starts the expiry timer. Callers hold typingMu.
+func (c *Client) armTypingTimer() {
+	if c.typingTimer != nil {
+		c.typingTimer.Stop()
+	}
+	c.typingSeq++
+	seq := c.typingSeq
+	c.typingTimer = time.AfterFunc(typingTimeout, func() {
+		c.typingMu.Lock()
+		defer c.typingMu.Unlock()
+		if c.typingSeq == seq {
+			c.clearTyping()
+		}
+	})
+}
+
+// clearTyping relays a stop if the client is shown typing. Callers hold
+// typingMu.
+func (c *Client) clearTyping() {
+	if c.typingChannel == "" {
+		return
+	}
+	if c.typingTimer != nil {
+		c.typingTimer.Stop()
+	}
+	c.typingSeq++
+	c.relayTyping(c.typingChannel, false)
+	c.typingChannel = ""
+}
+
+// relayTyping tells the channel's other members whether the client is
+// typing. The sender's own connections are left out.
+func (c *Client) relayTyping(channelName string, typing bool) {
+	if c.username == "" {
+		return
+	}
+	event := TypingEvent{
+		Type:     "typing",
+		Channel:  channelName,
+		Username: c.username,
+		Typing:   typing,
+	}
+	if msgBytes, err := json.Marshal(event); err == nil {
+		c.hub.relayToChannel(channelName, msgBytes, c.username)
+	}
+}
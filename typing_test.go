@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypingRelay(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+
+	isTyping := func(msg map[string]interface{}) bool { return msg["type"] == "typing" }
+
+	sendJSON(t, alice, map[string]string{"type": "typing_start"})
+	event := readUntil(t, bob, isTyping)
+	if event["username"] != "alice" || event["typing"] != true || event["channel"] != "general" {
+		t.Errorf("Unexpected typing event: %v", event)
+	}
+
+	sendJSON(t, alice, map[string]string{"type": "typing_stop"})
+	event = readUntil(t, bob, isTyping)
+	if event["username"] != "alice" || event["typing"] != false {
+		t.Errorf("Expected alice to stop typing, got %v", event)
+	}
+
+	// The sender never sees its own typing events
+	expectNone(t, alice, 100*time.Millisecond, isTyping)
+}
+
+func TestTypingThrottleAndExpiry(t *testing.T) {
+	defer func(timeout, throttle time.Duration) {
+		typingTimeout, typingThrottle = timeout, throttle
+	}(typingTimeout, typingThrottle)
+	typingTimeout = 150 * time.Millisecond
+	typingThrottle = time.Second
+
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+
+	isTyping := func(msg map[string]interface{}) bool { return msg["type"] == "typing" }
+
+	// Rapid start/stop toggling relays one start and one stop per throttle window
+	for i := 0; i < 5; i++ {
+		sendJSON(t, alice, map[string]string{"type": "typing_start"})
+		sendJSON(t, alice, map[string]string{"type": "typing_stop"})
+	}
+	if event := readUntil(t, bob, isTyping); event["typing"] != true {
+		t.Fatalf("Expected typing start first, got %v", event)
+	}
+	if event := readUntil(t, bob, isTyping); event["typing"] != false {
+		t.Fatalf("Expected typing stop second, got %v", event)
+	}
+	expectNone(t, bob, 200*time.Millisecond, isTyping)
+
+	// Without a stop, the indicator expires on its own. Bob's connection
+	// is unusable after the read timeout above, so Carol watches.
+	carol := dialTestClient(t, hub, wsURL, "carol")
+	time.Sleep(typingThrottle)
+	sendJSON(t, alice, map[string]string{"type": "typing_start"})
+	if event := readUntil(t, carol, isTyping); event["typing"] != true {
+		t.Fatalf("Expected typing start, got %v", event)
+	}
+	start := time.Now()
+	if event := readUntil(t, carol, isTyping); event["typing"] != false {
+		t.Fatalf("Expected typing to expire, got %v", event)
+	}
+	if elapsed := time.Since(start); elapsed < typingTimeout/2 {
+		t.Errorf("Typing expired too early after %v", elapsed)
+	}
+}
+
+func TestTypingStopsOnMessage(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+
+	alice := dialTestClient(t, hub, wsURL, "alice")
+	bob := dialTestClient(t, hub, wsURL, "bob")
+
+	sendJSON(t, alice, map[string]string{"type": "typing_start"})
+	readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "typing" })
+
+	sendJSON(t, alice, Message{Type: "message", Content: "done"})
+	event := readUntil(t, bob, func(msg map[string]interface{}) bool {
+		return msg["type"] == "typing" || msg["type"] == "message"
+	})
+	if event["type"] != "typing" || event["typing"] != false {
+		t.Errorf("Expected typing to stop before the message, got %v", event)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Incoming webhooks post as "webhook:<name>"; the colon cannot appear in a
+// registered username, so they cannot be mistaken for a user.
+const webhookUsernamePrefix = "webhook:"
+
+// Limits on what an incoming webhook may post.
+const (
+	maxAttachments         = 10
+	maxWebhookDisplayName  = 100
+	maxAttachmentTextBytes = 4000
+)
+
+var (
+	errInvalidWebhookName = errors.New("webhook name must be 3-32 letters, digits, '.', '_' or '-'")
+	errInvalidAttachment  = errors.New("attachments need text, a title or an image, and http(s) links")
+	errTooManyAttachments = fmt.Errorf("a message has at most %d attachments", maxAttachments)
+	errWebhookNameTaken   = errors.New("username is another user's name")
+)
+
+// randomToken returns 24 random bytes, hex encoded.
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newWebhookToken returns a random token and the hash it is stored under.
+func newWebhookToken() (token, hash string, err error) {
+	if token, err = randomToken(); err != nil {
+		return "", "", err
+	}
+	return token, hashWebhookToken(token), nil
+}
+
+func hashWebhookToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// canManageChannel reports whether username may manage a channel's
+// integrations: its owner and moderators, and server moderators.
+func (h *Hub) canManageChannel(username, channelName string) bool {
+	return h.can(username, channelName, permManage)
+}
+
+// createIncomingWebhook adds a webhook posting into a persistent channel, or
+// an ephemeral one while it is active. The returned webhook carries its
+// token, which is not stored and cannot be shown again.
+func (h *Hub) createIncomingWebhook(username, channelName, name string) (IncomingWebhook, error) {
+	if !h.canManageChannel(username, channelName) {
+		return IncomingWebhook{}, errNotChannelAdmin
+	}
+	if !usernamePattern.MatchString(name) {
+		return IncomingWebhook{}, errInvalidWebhookName
+	}
+	channelType, err := h.getChannelType(channelName)
+	if errors.Is(err, errChannelNotFound) && h.localMemberCount(channelName)+h.remoteMemberCount(channelName) > 0 {
+		channelType, err = Ephemeral, nil
+	}
+	if err != nil {
+		return IncomingWebhook{}, err
+	}
+	if channelType == Direct {
+		return IncomingWebhook{}, newCommandError(errorInvalidArgument, "direct channels cannot have webhooks")
+	}
+
+	token, hash, err := newWebhookToken()
+	if err != nil {
+		return IncomingWebhook{}, err
+	}
+	hook := IncomingWebhook{
+		Channel:   channelName,
+		Name:      name,
+		CreatedBy: username,
+		CreatedAt: time.Now().UTC(),
+		TokenHash: hash,
+	}
+	if hook.ID, err = h.store.CreateIncomingWebhook(hook); err != nil {
+		return IncomingWebhook{}, err
+	}
+	log.Printf("Incoming webhook '%s' for channel '%s' created by %s", name, channelName, username)
+	hook.Token = token
+	return hook, nil
+}
+
+// listIncomingWebhooks returns a channel's webhooks, without their tokens.
+func (h *Hub) listIncomingWebhooks(username, channelName string) ([]IncomingWebhook, error) {
+	if !h.canManageChannel(username, channelName) {
+		return nil, errNotChannelAdmin
+	}
+	return h.store.ListIncomingWebhooks(channelName)
+}
+
+// deleteIncomingWebhook revokes one of a channel's webhooks.
+func (h *Hub) deleteIncomingWebhook(username, channelName string, id int) error {
+	if !h.canManageChannel(username, channelName) {
+		return errNotChannelAdmin
+	}
+	hooks, err := h.store.ListIncomingWebhooks(channelName)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if hook.ID == id {
+			log.Printf("Incoming webhook '%s' for channel '%s' deleted by %s", hook.Name, channelName, username)
+			return h.store.DeleteIncomingWebhook(id)
+		}
+	}
+	return errWebhookNotFound
+}
+
+// incomingWebhook returns the webhook a token belongs to.
+func (h *Hub) incomingWebhook(token string) (IncomingWebhook, error) {
+	if token == "" {
+		return IncomingWebhook{}, errWebhookNotFound
+	}
+	return h.store.GetIncomingWebhook(hashWebhookToken(token))
+}
+
+// validateWebhookPayload checks what an integration posts. Links must be
+// http or https so clients can render them safely.
+func validateWebhookPayload(payload WebhookPayload) error {
+	if strings.TrimSpace(payload.Text) == "" {
+		return errEmptyMessage
+	}
+	if len(payload.Username) > maxWebhookDisplayName {
+		return newCommandError(errorInvalidArgument, fmt.Sprintf("username must be at most %d bytes", maxWebhookDisplayName))
+	}
+	if len(payload.Attachments) > maxAttachments {
+		return errTooManyAttachments
+	}
+	for _, a := range payload.Attachments {
+		if a.Text == "" && a.Title == "" && a.ImageURL == "" {
+			return errInvalidAttachment
+		}
+		if len(a.Text) > maxAttachmentTextBytes {
+			return newCommandError(errorInvalidArgument, fmt.Sprintf("attachment text must be at most %d bytes", maxAttachmentTextBytes))
+		}
+		for _, link := range []string{a.TitleLink, a.ImageURL} {
+			if link == "" {
+				continue
+			}
+			if u, err := url.Parse(link); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return errInvalidAttachment
+			}
+		}
+	}
+	return nil
+}
+
+// postWebhookMessage posts an integration's payload into its webhook's
+// channel, like a user's message.
+func (h *Hub) postWebhookMessage(hook IncomingWebhook, payload WebhookPayload) (Message, error) {
+	if err := validateWebhookPayload(payload); err != nil {
+		return Message{}, err
+	}
+	displayName := strings.TrimSpace(payload.Username)
+	if displayName == "" {
+		displayName = hook.Name
+	} else if err := h.checkNameFree(displayName); errors.Is(err, errNickTaken) {
+		// Clients show the display name, so it must not pass for a user's
+		return Message{}, errWebhookNameTaken
+	} else if err != nil {
+		return Message{}, err
+	}
+	posted, _, err := h.postMessage(Message{
+		Username:    webhookUsernamePrefix + hook.Name,
+		DisplayName: displayName,
+		Content:     payload.Text,
+		Channel:     hook.Channel,
+		Attachments: payload.Attachments,
+	})
+	return posted, err
+}
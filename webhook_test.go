@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateWebhookPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload WebhookPayload
+		valid   bool
+	}{
+		{"text", WebhookPayload{Text: "build passed"}, true},
+		{"attachment", WebhookPayload{Text: "deploy", Attachments: []Attachment{{Title: "v1.2", TitleLink: "https://ci.example.com/1"}}}, true},
+		{"empty", WebhookPayload{Text: "  "}, false},
+		{"empty attachment", WebhookPayload{Text: "x", Attachments: []Attachment{{Color: "#f00"}}}, false},
+		{"script link", WebhookPayload{Text: "x", Attachments: []Attachment{{Title: "t", TitleLink: "javascript:alert(1)"}}}, false},
+		{"too many", WebhookPayload{Text: "x", Attachments: make([]Attachment, maxAttachments+1)}, false},
+		{"long name", WebhookPayload{Text: "x", Username: strings.Repeat("n", maxWebhookDisplayName+1)}, false},
+	}
+	for _, tt := range tests {
+		if err := validateWebhookPayload(tt.payload); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid=%v, got %v", tt.name, tt.valid, err)
+		}
+	}
+}
+
+func TestIncomingWebhooks(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+	hub := newHub(store)
+	hub.moderators = map[string]bool{"mod": true}
+	hub.rateLimits.webhook = rateLimit{burst: 2, per: time.Minute}
+	go hub.run()
+	defer hub.stop()
+	wsURL := startTestServer(t, hub)
+	request := startAPIServer(t, hub)
+
+	store.CreateChannel("alerts", Persistent)
+	if status, body := request("alice", "POST", "/api/channels/alerts/webhooks", map[string]string{"name": "ci-bot"}); status != http.StatusForbidden {
+		t.Errorf("Expected a non-moderator to be refused, got %d %v", status, body)
+	}
+	if status, body := request("mod", "POST", "/api/channels/alerts/webhooks", map[string]string{"name": "no spaces"}); status != http.StatusBadRequest {
+		t.Errorf("Expected an invalid name to be rejected, got %d %v", status, body)
+	}
+	if status, body := request("mod", "POST", "/api/channels/nowhere/webhooks", map[string]string{"name": "ci-bot"}); status != http.StatusNotFound {
+		t.Errorf("Expected a webhook for a missing channel to be rejected, got %d %v", status, body)
+	}
+	status, hook := request("mod", "POST", "/api/channels/alerts/webhooks", map[string]string{"name": "ci-bot"})
+	token, _ := hook["token"].(string)
+	if status != http.StatusCreated || token == "" {
+		t.Fatalf("Expected the webhook with its token, got %d %v", status, hook)
+	}
+	status, listed := request("mod", "GET", "/api/channels/alerts/webhooks", nil)
+	hooks, _ := listed["webhooks"].([]interface{})
+	if status != http.StatusOK || len(hooks) != 1 || hooks[0].(map[string]interface{})["token"] != nil {
+		t.Errorf("Expected the webhook listed without its token, got %d %v", status, listed)
+	}
+
+	bob := dialTestClient(t, hub, wsURL, "bob")
+	sendJSON(t, bob, map[string]interface{}{"type": "join_channel", "channel": "alerts", "request_id": "j1"})
+	readUntil(t, bob, isAck("j1"))
+
+	status, posted := request("", "POST", "/hooks/"+token, json.RawMessage(`{"text": "build #12 passed", "username": "Build Bot", "attachments": [{"title": "Logs", "title_link": "https://ci.example.com/12"}]}`))
+	if status != http.StatusCreated || posted["username"] != webhookUsernamePrefix+"ci-bot" || posted["id"] == nil {
+		t.Fatalf("Expected the message to be posted as the webhook, got %d %v", status, posted)
+	}
+	live := readUntil(t, bob, func(msg map[string]interface{}) bool { return msg["type"] == "message" })
+	if live["display_name"] != "Build Bot" || live["channel"] != "alerts" || live["attachments"] == nil {
+		t.Errorf("Expected the webhook's message live in alerts, got %v", live)
+	}
+	if stored, err := store.GetMessage(int(posted["id"].(float64))); err != nil || len(stored.Attachments) != 1 || stored.DisplayName != "Build Bot" {
+		t.Errorf("Expected the message stored with its attachments, got %+v (%v)", stored, err)
+	}
+
+	if status, body := request("", "POST", "/hooks/"+token, json.RawMessage(`{"text": ""}`)); status != http.StatusBadRequest {
+		t.Errorf("Expected an empty payload to be rejected, got %d %v", status, body)
+	}
+	if status, body := request("", "POST", "/hooks/"+token, json.RawMessage(`{"text": "third"}`)); status != http.StatusTooManyRequests || body["code"] != errorRateLimited {
+		t.Errorf("Expected the token's rate limit to apply, got %d %v", status, body)
+	}
+	if status, _ := request("", "POST", "/hooks/not-a-token", json.RawMessage(`{"text": "hi"}`)); status != http.StatusNotFound {
+		t.Errorf("Expected an unknown token to be not found, got %d", status)
+	}
+
+	// Webhooks cannot post under the server's or a user's name
+	store.CreateUser(User{Username: "alice", PasswordHash: "x", CreatedAt: time.Now().UTC()})
+	registered, _ := hub.incomingWebhook(token)
+	for _, name := range []string{"System", "alice", " system "} {
+		if _, err := hub.postWebhookMessage(registered, WebhookPayload{Text: "hi", Username: name}); !errors.Is(err, errWebhookNameTaken) {
+			t.Errorf("Expected the display name %q refused, got %v", name, err)
+		}
+	}
+
+	id := int(hook["id"].(float64))
+	if status, _ := request("mod", "DELETE", "/api/channels/alerts/webhooks/"+strconv.Itoa(id), nil); status != http.StatusNoContent {
+		t.Fatalf("Expected the webhook to be deleted, got %d", status)
+	}
+	if _, err := hub.incomingWebhook(token); err != errWebhookNotFound {
+		t.Errorf("Expected a deleted webhook's token to stop working, got %v", err)
+	}
+}
@@ -6,6 +6,17 @@ import (
 )
 
 func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	// Authenticate before upgrading so the username comes from a verified token
+	username, err := hub.auth.authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := hub.serverBanError(username); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
@@ -13,11 +24,19 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &Client{
-		hub:     hub,
-		conn:    conn,
-		send:    make(chan []byte, 256),
-		channel: "general",
+		hub:      hub,
+		conn:     conn,
+		send:     make(chan []byte, 256),
+		channel:  "general",
+		username: username,
+	}
+
+	// A reconnecting client picks up where it left off
+	if pos, ok := parseResumePosition(r.URL.Query()); ok && hub.canAccessChannel(username, pos.Channel) {
+		client.channel = pos.Channel
+		client.resume = pos
 	}
+	client.resumeSubscriptions = parseResumeSubscriptions(r.URL.Query())
 
 	client.hub.register <- client
 
@@ -30,6 +49,94 @@ func setupRoutes(hub *Hub) {
 		handleWebSocket(hub, w, r)
 	})
 
+	// Account endpoints
+	http.HandleFunc("/api/register", func(w http.ResponseWriter, r *http.Request) {
+		handleRegister(hub, w, r)
+	})
+	http.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
+		handleLogin(hub, w, r)
+	})
+
+	http.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		handleSearch(hub, w, r)
+	})
+
+	// Channel and message endpoints for integrations
+	http.HandleFunc("GET /api/channels", func(w http.ResponseWriter, r *http.Request) {
+		handleListChannels(hub, w, r)
+	})
+	http.HandleFunc("POST /api/channels", func(w http.ResponseWriter, r *http.Request) {
+		handleCreateChannel(hub, w, r)
+	})
+	http.HandleFunc("DELETE /api/channels/{name}", func(w http.ResponseWriter, r *http.Request) {
+		handleDeleteChannel(hub, w, r)
+	})
+	http.HandleFunc("GET /api/channels/{name}/messages", func(w http.ResponseWriter, r *http.Request) {
+		handleChannelHistory(hub, w, r)
+	})
+	http.HandleFunc("POST /api/channels/{name}/messages", func(w http.ResponseWriter, r *http.Request) {
+		handlePostMessage(hub, w, r)
+	})
+	http.HandleFunc("GET /api/channels/{name}/members", func(w http.ResponseWriter, r *http.Request) {
+		handleChannelMembers(hub, w, r)
+	})
+	http.HandleFunc("GET /api/channels/{name}/roles", func(w http.ResponseWriter, r *http.Request) {
+		handleChannelRoles(hub, w, r)
+	})
+	http.HandleFunc("PUT /api/channels/{name}/roles/{username}", func(w http.ResponseWriter, r *http.Request) {
+		handleGrantRole(hub, w, r)
+	})
+	http.HandleFunc("DELETE /api/channels/{name}/roles/{username}", func(w http.ResponseWriter, r *http.Request) {
+		handleRevokeRole(hub, w, r)
+	})
+	http.HandleFunc("POST /api/channels/{name}/invites", func(w http.ResponseWriter, r *http.Request) {
+		handleCreateInvite(hub, w, r)
+	})
+	http.HandleFunc("POST /api/invites/{code}", func(w http.ResponseWriter, r *http.Request) {
+		handleJoinInvite(hub, w, r)
+	})
+	http.HandleFunc("POST /api/channels/{name}/moderation", func(w http.ResponseWriter, r *http.Request) {
+		handleModeration(hub, w, r)
+	})
+	http.HandleFunc("POST /api/moderation", func(w http.ResponseWriter, r *http.Request) {
+		handleModeration(hub, w, r)
+	})
+	http.HandleFunc("PUT /api/channels/{name}/slow-mode", func(w http.ResponseWriter, r *http.Request) {
+		handleSetSlowMode(hub, w, r)
+	})
+	http.HandleFunc("GET /api/channels/{name}/audit", func(w http.ResponseWriter, r *http.Request) {
+		handleAuditLog(hub, w, r)
+	})
+	http.HandleFunc("GET /api/audit", func(w http.ResponseWriter, r *http.Request) {
+		handleAuditLog(hub, w, r)
+	})
+	http.HandleFunc("GET /api/channels/{name}/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		handleListWebhooks(hub, w, r)
+	})
+	http.HandleFunc("POST /api/channels/{name}/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		handleCreateWebhook(hub, w, r)
+	})
+	http.HandleFunc("DELETE /api/channels/{name}/webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleDeleteWebhook(hub, w, r)
+	})
+	http.HandleFunc("GET /api/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		handleListOutgoingWebhooks(hub, w, r)
+	})
+	http.HandleFunc("POST /api/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		handleCreateOutgoingWebhook(hub, w, r)
+	})
+	http.HandleFunc("DELETE /api/webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleDeleteOutgoingWebhook(hub, w, r)
+	})
+	http.HandleFunc("GET /api/webhooks/{id}/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		handleWebhookDeliveries(hub, w, r)
+	})
+
+	// Incoming webhooks authenticate with the token in their URL
+	http.HandleFunc("POST /hooks/{token}", func(w http.ResponseWriter, r *http.Request) {
+		handleIncomingWebhook(hub, w, r)
+	})
+
 	// Health check endpoint
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -10,23 +11,99 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-func TestWebSocketUpgrade(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		// Create a minimal hub for testing without database
-		hub := &Hub{
-			channels:   make(map[string]*Channel),
-			register:   make(chan *Client, 1),
-			unregister: make(chan *Client, 1),
-			broadcast:  make(chan []byte, 1),
-			db:         nil,
+// authHeader returns upgrade headers carrying a valid session token.
+func authHeader(t *testing.T, hub *Hub, username string) http.Header {
+	t.Helper()
+	token, _, err := hub.auth.issueToken(username)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	return http.Header{"Authorization": []string{"Bearer " + token}}
+}
+
+// startTestServer serves hub's WebSocket endpoint for the duration of the
+// test and returns its URL.
+func startTestServer(t *testing.T, hub *Hub) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(hub, w, r)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// dialTestClient connects as username and waits until registration completes.
+func dialTestClient(t *testing.T, hub *Hub, wsURL, username string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, authHeader(t, hub, username))
+	if err != nil {
+		t.Fatalf("Failed to connect %s: %v", username, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// active_channels is sent once registration has completed
+	readUntil(t, conn, func(msg map[string]interface{}) bool { return msg["type"] == "active_channels" })
+	return conn
+}
+
+// readUntil reads frames until match returns true, failing after a timeout.
+func readUntil(t *testing.T, conn *websocket.Conn, match func(map[string]interface{}) bool) map[string]interface{} {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn.SetReadDeadline(deadline)
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Expected message not received: %v", err)
 		}
-		testWebSocketUpgrade(t, hub)
-		return
+		var msg map[string]interface{}
+		if json.Unmarshal(data, &msg) == nil && match(msg) {
+			return msg
+		}
+	}
+}
+
+// expectNone fails if a frame matching match arrives within wait.
+func expectNone(t *testing.T, conn *websocket.Conn, wait time.Duration, match func(map[string]interface{}) bool) {
+	t.Helper()
+	deadline := time.Now().Add(wait)
+	for {
+		conn.SetReadDeadline(deadline)
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg map[string]interface{}
+		if json.Unmarshal(data, &msg) == nil && match(msg) {
+			t.Fatalf("Unexpected message: %s", data)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	defer db.Close()
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func sendJSON(t *testing.T, conn *websocket.Conn, v interface{}) {
+	t.Helper()
+	data, _ := json.Marshal(v)
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+}
 
-	hub := newHub(db)
+func TestWebSocketUpgrade(t *testing.T) {
+	store := setupTestStore(t)
+	defer store.Close()
+
+	hub := newHub(store)
 	testWebSocketUpgrade(t, hub)
 }
 
@@ -40,7 +117,7 @@ func testWebSocketUpgrade(t *testing.T, hub *Hub) {
 	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
 
 	// Test WebSocket connection
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, authHeader(t, hub, "testuser"))
 	if err != nil {
 		t.Fatalf("Failed to connect to WebSocket: %v", err)
 	}
@@ -53,22 +130,10 @@ func testWebSocketUpgrade(t *testing.T, hub *Hub) {
 }
 
 func TestSetupRoutes(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		// Create a minimal hub for testing without database
-		hub := &Hub{
-			channels:   make(map[string]*Channel),
-			register:   make(chan *Client, 1),
-			unregister: make(chan *Client, 1),
-			broadcast:  make(chan []byte, 1),
-			db:         nil,
-		}
-		testSetupRoutes(t, hub)
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 	testSetupRoutes(t, hub)
 }
 
@@ -142,14 +207,10 @@ func TestWebSocketUpgraderConfig(t *testing.T) {
 }
 
 func TestHandleWebSocketClientRegistration(t *testing.T) {
-	db := setupTestDB(t)
-	if db == nil {
-		t.Skip("Skipping WebSocket client registration test without database")
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 
 	// Start hub in background
 	go hub.run()
@@ -164,7 +225,7 @@ func TestHandleWebSocketClientRegistration(t *testing.T) {
 	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
 
 	// Connect WebSocket client
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, authHeader(t, hub, "testuser"))
 	if err != nil {
 		t.Fatalf("Failed to connect to WebSocket: %v", err)
 	}
@@ -194,22 +255,10 @@ func TestHandleWebSocketClientRegistration(t *testing.T) {
 
 func TestWebSocketErrorHandling(t *testing.T) {
 	// Test handling invalid WebSocket upgrade requests
-	db := setupTestDB(t)
-	if db == nil {
-		// Use minimal hub for test
-		hub := &Hub{
-			channels:   make(map[string]*Channel),
-			register:   make(chan *Client, 1),
-			unregister: make(chan *Client, 1),
-			broadcast:  make(chan []byte, 1),
-			db:         nil,
-		}
-		testWebSocketErrorHandling(t, hub)
-		return
-	}
-	defer db.Close()
+	store := setupTestStore(t)
+	defer store.Close()
 
-	hub := newHub(db)
+	hub := newHub(store)
 	testWebSocketErrorHandling(t, hub)
 }
 